@@ -0,0 +1,460 @@
+// Package bench runs db_bench-style workloads against a database and
+// reports throughput and latency, so projects embedding the engine can
+// track its performance from their own tests and CI.
+//
+//	store, _ := db.Open(dir, db.DefaultOptions())
+//	defer store.Close()
+//	result, err := bench.Run(store, bench.ReadRandom(100000))
+//	if err != nil { ... }
+//	fmt.Println(result)
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"mini-leveldb/db"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyDistribution chooses which keys a workload's operations touch.
+type KeyDistribution int
+
+const (
+	// Sequential walks the key space in order, wrapping around at the end.
+	// With several workers each walks its own share of it.
+	Sequential KeyDistribution = iota
+	// Uniform picks every key with equal probability.
+	Uniform
+	// Zipfian picks a few keys far more often than the rest, as hot-key
+	// traffic does. Workload.ZipfS sets how skewed it is.
+	Zipfian
+	// ScrambledZipfian is YCSB's zipfian request distribution: Zipfian
+	// with constant 0.99, with the popular keys hashed across the key
+	// space. Keys inserted during the run are not chosen.
+	ScrambledZipfian
+	// Latest is YCSB's latest request distribution, Zipfian over the keys
+	// from the most recently inserted back.
+	Latest
+)
+
+func (d KeyDistribution) String() string {
+	switch d {
+	case Sequential:
+		return "sequential"
+	case Uniform:
+		return "uniform"
+	case Zipfian:
+		return "zipfian"
+	case ScrambledZipfian:
+		return "scrambled-zipfian"
+	case Latest:
+		return "latest"
+	}
+	return fmt.Sprintf("KeyDistribution(%d)", int(d))
+}
+
+// Sizes is a range of value sizes in bytes. Each write picks a size
+// uniformly between Min and Max, inclusive; Max below Min means Min.
+type Sizes struct {
+	Min, Max int
+}
+
+// Workload describes a benchmark run.
+type Workload struct {
+	// Name labels the result.
+	Name string
+	// Operations is the number of operations to run.
+	Operations int
+	// Keys is the size of the key space. Zero means Operations.
+	Keys int
+	// KeyPrefix is prepended to every key, so several workloads can share
+	// a database without touching each other's keys.
+	KeyPrefix string
+	// Distribution chooses the keys operations touch.
+	Distribution KeyDistribution
+	// ZipfS is the exponent of the Zipfian distribution, above 1. Zero
+	// means 1.1.
+	ZipfS float64
+	// ValueSize is the size of written values. The zero value writes 100
+	// byte values.
+	ValueSize Sizes
+	// ReadFraction is the fraction of operations that are reads, from 0
+	// for a write-only workload to 1 for a read-only one.
+	ReadFraction float64
+	// ScanFraction is the fraction of operations that iterate over up to
+	// MaxScanLength keys from a chosen key.
+	ScanFraction float64
+	// InsertFraction is the fraction of operations that write keys past
+	// the end of the key space, growing it.
+	InsertFraction float64
+	// ReadModifyWriteFraction is the fraction of operations that read a
+	// key and write it back. The operations not counted by any fraction
+	// update existing keys.
+	ReadModifyWriteFraction float64
+	// MaxScanLength caps the keys a scan reads; each scan picks a length
+	// uniformly up to it. Zero means 100.
+	MaxScanLength int
+	// Preload writes every key in the key space before the timed run, so
+	// reads find them.
+	Preload bool
+	// Concurrency is the number of goroutines issuing operations. Zero
+	// means one.
+	Concurrency int
+	// Seed seeds the key and value generators, so a run is repeatable.
+	Seed int64
+}
+
+// FillSeq writes n keys in order, as db_bench's fillseq does.
+func FillSeq(n int) Workload {
+	return Workload{Name: "fillseq", Operations: n, Distribution: Sequential}
+}
+
+// FillRandom writes n keys in random order.
+func FillRandom(n int) Workload {
+	return Workload{Name: "fillrandom", Operations: n, Distribution: Uniform}
+}
+
+// ReadRandom preloads n keys and then reads them in random order.
+func ReadRandom(n int) Workload {
+	return Workload{Name: "readrandom", Operations: n, Distribution: Uniform, ReadFraction: 1, Preload: true}
+}
+
+// ReadWhileWriting preloads n keys and then runs a mix of nine reads to
+// every write, from four goroutines, over a Zipfian key distribution.
+func ReadWhileWriting(n int) Workload {
+	return Workload{Name: "readwhilewriting", Operations: n, Distribution: Zipfian, ReadFraction: 0.9, Preload: true, Concurrency: 4}
+}
+
+// Latency summarizes the latencies of one kind of operation.
+type Latency struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Result is what a workload measured. The preload is not counted.
+type Result struct {
+	Workload string
+	// Operations is the number of operations run.
+	Operations int
+	// NotFound counts reads of keys that did not exist.
+	NotFound int
+	// BytesWritten is the total size of the keys and values written.
+	BytesWritten int64
+	Duration     time.Duration
+	Reads        Latency
+	// Writes covers updates and inserts.
+	Writes           Latency
+	Scans            Latency
+	ReadModifyWrites Latency
+}
+
+// OpsPerSec returns the operations run per second.
+func (r *Result) OpsPerSec() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Operations) / r.Duration.Seconds()
+}
+
+// MBPerSec returns the megabytes written per second.
+func (r *Result) MBPerSec() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.BytesWritten) / (1 << 20) / r.Duration.Seconds()
+}
+
+// String formats the result as a db_bench report line, followed by a line
+// of latencies for each kind of operation run.
+func (r *Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-18s : %10.3f micros/op; %10.0f ops/sec", r.Workload,
+		float64(r.Duration.Microseconds())/float64(max(r.Operations, 1)), r.OpsPerSec())
+	if r.BytesWritten > 0 {
+		fmt.Fprintf(&b, "; %7.1f MB/s", r.MBPerSec())
+	}
+	if r.Reads.Count > 0 {
+		fmt.Fprintf(&b, " (%d of %d found)", r.Reads.Count-r.NotFound, r.Reads.Count)
+	}
+	for _, l := range []struct {
+		name string
+		Latency
+	}{{"reads", r.Reads}, {"writes", r.Writes}, {"scans", r.Scans}, {"rmw", r.ReadModifyWrites}} {
+		if l.Count > 0 {
+			fmt.Fprintf(&b, "\n  %-6s p50 %v  p95 %v  p99 %v  max %v", l.name, l.P50, l.P95, l.P99, l.Max)
+		}
+	}
+	return b.String()
+}
+
+// Run runs w against store and returns what it measured. It stops at the
+// first failed operation; a read of a missing key is counted, not failed.
+func Run(store *db.DB, w Workload) (*Result, error) {
+	if w.Operations <= 0 {
+		return nil, fmt.Errorf("workload %s has no operations", w.Name)
+	}
+	sum := 0.0
+	for _, f := range []float64{w.ReadFraction, w.ScanFraction, w.InsertFraction, w.ReadModifyWriteFraction} {
+		if f < 0 {
+			return nil, fmt.Errorf("workload %s has a negative operation fraction", w.Name)
+		}
+		sum += f
+	}
+	if sum > 1+1e-9 {
+		return nil, fmt.Errorf("workload %s has operation fractions adding up to %v, over 1", w.Name, sum)
+	}
+	keys := w.Keys
+	if keys <= 0 {
+		keys = w.Operations
+	}
+	sizes := w.ValueSize
+	if sizes == (Sizes{}) {
+		sizes = Sizes{Min: 100, Max: 100}
+	}
+	if sizes.Max < sizes.Min {
+		sizes.Max = sizes.Min
+	}
+	values := newValueSource(w.Seed, sizes.Max)
+
+	if w.Preload {
+		rng := rand.New(rand.NewSource(w.Seed))
+		for i := 0; i < keys; i++ {
+			if err := store.Put(formatKey(w.KeyPrefix, i), values.next(rng, sizes)); err != nil {
+				return nil, fmt.Errorf("failed to preload workload %s: %w", w.Name, err)
+			}
+		}
+	}
+
+	workers := max(w.Concurrency, 1)
+	runs := make([]workerResult, workers)
+	var inserted atomic.Int64
+	inserted.Store(int64(keys))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range runs {
+		ops := w.Operations / workers
+		if i < w.Operations%workers {
+			ops++
+		}
+		wg.Add(1)
+		go func(run *workerResult, i, ops int) {
+			defer wg.Done()
+			run.run(store, &w, keys, &inserted, sizes, values, i, workers, ops)
+		}(&runs[i], i, ops)
+	}
+	wg.Wait()
+	result := &Result{Workload: w.Name, Duration: time.Since(start)}
+
+	var reads, writes, scans, rmws []time.Duration
+	var errs []error
+	for _, run := range runs {
+		result.NotFound += run.notFound
+		result.BytesWritten += run.bytesWritten
+		reads = append(reads, run.reads...)
+		writes = append(writes, run.writes...)
+		scans = append(scans, run.scans...)
+		rmws = append(rmws, run.rmws...)
+		errs = append(errs, run.err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("failed to run workload %s: %w", w.Name, err)
+	}
+	result.Operations = len(reads) + len(writes) + len(scans) + len(rmws)
+	result.Reads = summarize(reads)
+	result.Writes = summarize(writes)
+	result.Scans = summarize(scans)
+	result.ReadModifyWrites = summarize(rmws)
+	return result, nil
+}
+
+// workerResult is what one goroutine of a run measured.
+type workerResult struct {
+	reads        []time.Duration
+	writes       []time.Duration
+	scans        []time.Duration
+	rmws         []time.Duration
+	notFound     int
+	bytesWritten int64
+	err          error
+}
+
+// run issues ops operations as worker i of n. inserted counts the keys in
+// the key space, including those inserted so far.
+func (r *workerResult) run(store *db.DB, w *Workload, keys int, inserted *atomic.Int64, sizes Sizes, values *valueSource, i, n, ops int) {
+	rng := rand.New(rand.NewSource(w.Seed + int64(i) + 1))
+	var zipf *rand.Zipf
+	var latest *zipfian
+	var scrambled *scrambledZipfian
+	switch w.Distribution {
+	case Zipfian:
+		s := w.ZipfS
+		if s <= 1 {
+			s = 1.1
+		}
+		zipf = rand.NewZipf(rng, s, 1, uint64(keys-1))
+	case ScrambledZipfian:
+		scrambled = newScrambledZipfian(uint64(keys))
+	case Latest:
+		latest = newZipfian(uint64(keys), ycsbZipfianConstant)
+	}
+	// Sequential workers start evenly spaced through the key space.
+	next := i * (keys / n)
+	choose := func() int {
+		switch w.Distribution {
+		case Sequential:
+			next++
+			return (next - 1) % keys
+		case Zipfian:
+			return int(zipf.Uint64())
+		case ScrambledZipfian:
+			return int(scrambled.next(rng))
+		case Latest:
+			count := inserted.Load()
+			latest.grow(uint64(count))
+			return int(count - 1 - int64(latest.next(rng)))
+		}
+		return rng.Intn(keys)
+	}
+	scanLength := w.MaxScanLength
+	if scanLength <= 0 {
+		scanLength = 100
+	}
+
+	for op := 0; op < ops; op++ {
+		p := rng.Float64()
+		var err error
+		switch {
+		case p < w.ReadFraction:
+			err = r.read(store, formatKey(w.KeyPrefix, choose()))
+		case p < w.ReadFraction+w.ScanFraction:
+			err = r.scan(store, formatKey(w.KeyPrefix, choose()), 1+rng.Intn(scanLength))
+		case p < w.ReadFraction+w.ScanFraction+w.InsertFraction:
+			key := formatKey(w.KeyPrefix, int(inserted.Add(1)-1))
+			err = r.write(store, key, values.next(rng, sizes))
+		case p < w.ReadFraction+w.ScanFraction+w.InsertFraction+w.ReadModifyWriteFraction:
+			err = r.readModifyWrite(store, formatKey(w.KeyPrefix, choose()), values.next(rng, sizes))
+		default:
+			err = r.write(store, formatKey(w.KeyPrefix, choose()), values.next(rng, sizes))
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+// read times a Get of key. A missing key is counted, not failed.
+func (r *workerResult) read(store *db.DB, key string) error {
+	start := time.Now()
+	_, err := store.Get(key)
+	r.reads = append(r.reads, time.Since(start))
+	if errors.Is(err, db.ErrNotFound) {
+		r.notFound++
+		return nil
+	}
+	return err
+}
+
+// write times a Put of key.
+func (r *workerResult) write(store *db.DB, key, value string) error {
+	start := time.Now()
+	err := store.Put(key, value)
+	r.writes = append(r.writes, time.Since(start))
+	if err == nil {
+		r.bytesWritten += int64(len(key) + len(value))
+	}
+	return err
+}
+
+// scan times reading up to n keys from key on.
+func (r *workerResult) scan(store *db.DB, key string, n int) error {
+	start := time.Now()
+	it := store.NewIterator()
+	for it.Seek(key); it.Valid() && n > 0; it.Next() {
+		n--
+	}
+	err := it.Err()
+	it.Close()
+	r.scans = append(r.scans, time.Since(start))
+	return err
+}
+
+// readModifyWrite times a Get of key followed by a Put of value, as YCSB
+// does, without making the two atomic.
+func (r *workerResult) readModifyWrite(store *db.DB, key, value string) error {
+	start := time.Now()
+	if _, err := store.Get(key); err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	err := store.Put(key, value)
+	r.rmws = append(r.rmws, time.Since(start))
+	if err == nil {
+		r.bytesWritten += int64(len(key) + len(value))
+	}
+	return err
+}
+
+// formatKey returns key number i, zero-padded so keys sort numerically.
+func formatKey(prefix string, i int) string {
+	return fmt.Sprintf("%s%016d", prefix, i)
+}
+
+// valueSource hands out values cut from one block of random data, as
+// db_bench does, so generating them costs next to nothing next to the
+// write. The block is half random and half repeated bytes, so values
+// compress to about half their size.
+type valueSource struct {
+	data string
+}
+
+func newValueSource(seed int64, size int) *valueSource {
+	rng := rand.New(rand.NewSource(seed))
+	n := max(size, 1) * 4
+	data := make([]byte, n)
+	for i := 0; i < n; i += 2 {
+		data[i] = byte(' ' + rng.Intn(95))
+		if i+1 < n {
+			data[i+1] = ' '
+		}
+	}
+	return &valueSource{data: string(data)}
+}
+
+// next returns a value of a size drawn from sizes.
+func (v *valueSource) next(rng *rand.Rand, sizes Sizes) string {
+	size := sizes.Min + rng.Intn(sizes.Max-sizes.Min+1)
+	off := rng.Intn(len(v.data) - size + 1)
+	return v.data[off : off+size]
+}
+
+// summarize computes the latency summary of samples, which it sorts.
+func summarize(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	at := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+	return Latency{
+		Count: len(samples),
+		Mean:  total / time.Duration(len(samples)),
+		P50:   at(0.50),
+		P95:   at(0.95),
+		P99:   at(0.99),
+		Max:   samples[len(samples)-1],
+	}
+}
@@ -0,0 +1,86 @@
+package bench_test
+
+import (
+	"mini-leveldb/bench"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunWorkloads(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("bench", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	fill, err := bench.Run(store, bench.FillSeq(1000))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, fill.Operations)
+	assert.Equal(t, 1000, fill.Writes.Count)
+	assert.Zero(t, fill.Reads.Count)
+	assert.Equal(t, int64(1000*(16+100)), fill.BytesWritten)
+	assert.Positive(t, fill.OpsPerSec())
+
+	read := bench.ReadRandom(500)
+	read.KeyPrefix = "r/"
+	result, err := bench.Run(store, read)
+	require.NoError(t, err)
+	assert.Equal(t, 500, result.Reads.Count)
+	assert.Zero(t, result.NotFound, "every key is preloaded")
+	assert.LessOrEqual(t, result.Reads.P50, result.Reads.P99)
+	assert.LessOrEqual(t, result.Reads.P99, result.Reads.Max)
+
+	mixed := bench.Workload{
+		Name:         "mixed",
+		Operations:   1000,
+		Keys:         2000,
+		KeyPrefix:    "m/",
+		Distribution: bench.Zipfian,
+		ValueSize:    bench.Sizes{Min: 10, Max: 1000},
+		ReadFraction: 0.5,
+		Concurrency:  4,
+		Seed:         7,
+	}
+	result, err = bench.Run(store, mixed)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, result.Reads.Count+result.Writes.Count)
+	assert.Positive(t, result.Reads.Count)
+	assert.Positive(t, result.Writes.Count)
+	assert.Positive(t, result.NotFound, "nothing was preloaded")
+	assert.Contains(t, result.String(), "mixed")
+
+	_, err = bench.Run(store, bench.Workload{Name: "empty"})
+	assert.Error(t, err)
+}
+
+func TestYCSBWorkloads(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("ycsb", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, letter := range []string{"a", "b", "c", "d", "e", "F"} {
+		w, err := bench.YCSB(letter, 200, 400)
+		require.NoError(t, err)
+		result, err := bench.Run(store, w)
+		require.NoError(t, err, letter)
+		assert.Equal(t, 400, result.Operations, letter)
+		assert.Zero(t, result.NotFound, "%s reads only loaded or inserted keys", letter)
+		switch letter {
+		case "c":
+			assert.Equal(t, 400, result.Reads.Count)
+		case "e":
+			assert.Positive(t, result.Scans.Count)
+			assert.Zero(t, result.Reads.Count)
+		case "F":
+			assert.Positive(t, result.ReadModifyWrites.Count)
+		}
+	}
+
+	_, err = bench.YCSB("g", 10, 10)
+	assert.Error(t, err)
+}
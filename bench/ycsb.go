@@ -0,0 +1,151 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// YCSB returns the preset of YCSB core workload a through f, in either
+// case, over records preloaded records of 1000 bytes, the size of YCSB's
+// ten 100-byte fields, running operations operations:
+//
+//	a: 50% reads, 50% updates
+//	b: 95% reads, 5% updates
+//	c: 100% reads
+//	d: 95% reads, 5% inserts, reading the latest records most
+//	e: 95% scans of up to 100 keys, 5% inserts
+//	f: 50% reads, 50% read-modify-writes
+//
+// Keys are chosen as YCSB chooses them, by a scrambled Zipfian
+// distribution with constant 0.99, except in d.
+func YCSB(workload string, records, operations int) (Workload, error) {
+	w := Workload{
+		Name:         "ycsb-" + strings.ToLower(workload),
+		Operations:   operations,
+		Keys:         records,
+		KeyPrefix:    "user",
+		Distribution: ScrambledZipfian,
+		ValueSize:    Sizes{Min: 1000, Max: 1000},
+		Preload:      true,
+	}
+	switch strings.ToLower(workload) {
+	case "a":
+		w.ReadFraction = 0.5
+	case "b":
+		w.ReadFraction = 0.95
+	case "c":
+		w.ReadFraction = 1
+	case "d":
+		w.ReadFraction, w.InsertFraction = 0.95, 0.05
+		w.Distribution = Latest
+	case "e":
+		w.ScanFraction, w.InsertFraction = 0.95, 0.05
+	case "f":
+		w.ReadFraction, w.ReadModifyWriteFraction = 0.5, 0.5
+	default:
+		return Workload{}, fmt.Errorf("unknown YCSB workload %q", workload)
+	}
+	return w, nil
+}
+
+// ycsbZipfianConstant is YCSB's default skew. Unlike math/rand's Zipf, its
+// generator takes constants below 1.
+const ycsbZipfianConstant = 0.99
+
+// zipfian is YCSB's Zipfian generator, after Gray et al., "Quickly
+// Generating Billion-Record Synthetic Databases". It returns values in
+// [0, items), with 0 the most likely. items may grow between draws.
+type zipfian struct {
+	theta, alpha, zeta2 float64
+	items               uint64
+	zetan               float64
+	eta                 float64
+}
+
+func newZipfian(items uint64, theta float64) *zipfian {
+	z := &zipfian{theta: theta, alpha: 1 / (1 - theta), zeta2: zeta(0, 2, theta, 0)}
+	z.grow(items)
+	return z
+}
+
+// newZipfianWithZeta is newZipfian with zeta(items) already known, for
+// item counts too large to sum.
+func newZipfianWithZeta(items uint64, theta, zetan float64) *zipfian {
+	z := &zipfian{theta: theta, alpha: 1 / (1 - theta), zeta2: zeta(0, 2, theta, 0), items: items, zetan: zetan}
+	z.eta = (1 - math.Pow(2/float64(items), 1-theta)) / (1 - z.zeta2/zetan)
+	return z
+}
+
+// grow extends the generator to items values, summing zeta only over the
+// new ones.
+func (z *zipfian) grow(items uint64) {
+	if items <= z.items {
+		return
+	}
+	z.zetan = zeta(z.items, items, z.theta, z.zetan)
+	z.items = items
+	z.eta = (1 - math.Pow(2/float64(items), 1-z.theta)) / (1 - z.zeta2/z.zetan)
+}
+
+func (z *zipfian) next(rng *rand.Rand) uint64 {
+	u := rng.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	return uint64(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+}
+
+// zeta returns sum, the zeta of the first from values, extended to n.
+func zeta(from, n uint64, theta, sum float64) float64 {
+	for i := from; i < n; i++ {
+		sum += 1 / math.Pow(float64(i+1), theta)
+	}
+	return sum
+}
+
+// scrambledZipfian is YCSB's scrambled Zipfian generator: Zipfian draws over
+// a fixed ten billion items, hashed onto the key space so the popular keys
+// are spread through it rather than bunched at its start.
+type scrambledZipfian struct {
+	z     *zipfian
+	items uint64
+}
+
+// Ten billion items and their zeta for constant 0.99, as YCSB fixes them.
+const (
+	scrambledZipfianItems = 10_000_000_000
+	scrambledZipfianZetan = 26.46902820178302
+)
+
+func newScrambledZipfian(items uint64) *scrambledZipfian {
+	return &scrambledZipfian{
+		z:     newZipfianWithZeta(scrambledZipfianItems, ycsbZipfianConstant, scrambledZipfianZetan),
+		items: items,
+	}
+}
+
+func (s *scrambledZipfian) next(rng *rand.Rand) uint64 {
+	return fnvHash64(s.z.next(rng)) % s.items
+}
+
+// fnvHash64 is the FNV-1a hash of the bytes of v, low byte first, as YCSB
+// hashes.
+func fnvHash64(v uint64) uint64 {
+	h := uint64(0xcbf29ce484222325)
+	for i := 0; i < 8; i++ {
+		h ^= v & 0xff
+		h *= 1099511628211
+		v >>= 8
+	}
+	// YCSB takes the absolute value of the hash as a signed long.
+	if int64(h) < 0 {
+		h = uint64(-int64(h))
+	}
+	return h
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var backupDest string
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Upload a backup to the bucket in the backup section of --config",
+	Long: `Upload a backup to the bucket in the backup section of --config, then prune
+the backups its retention settings no longer keep. The list and download
+subcommands read the bucket without opening the database.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := config.backupOptions()
+		if err != nil {
+			return err
+		}
+		scheduler, err := getDB().StartBackups(opts)
+		if err != nil {
+			return err
+		}
+		defer scheduler.Close()
+		info, err := scheduler.BackupNow()
+		if err != nil {
+			return fmt.Errorf("failed to back up: %w", err)
+		}
+		fmt.Printf("Uploaded backup %s at sequence %d: %d files, %d bytes uploaded\n", info.ID, info.Sequence, len(info.Files), info.Uploaded)
+		return nil
+	},
+}
+
+// configOnly reads --config without opening the database.
+func configOnly(cmd *cobra.Command, args []string) error {
+	if configFile == "" {
+		return nil
+	}
+	return loadConfig(cmd, configFile)
+}
+
+var backupListCmd = &cobra.Command{
+	Use:               "list",
+	Short:             "List the backups in the bucket",
+	PersistentPreRunE: configOnly,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := config.backupOptions()
+		if err != nil {
+			return err
+		}
+		backups, err := db.ListBackups(opts.Store, opts.Prefix)
+		if err != nil {
+			return err
+		}
+		for _, b := range backups {
+			var size int64
+			for _, f := range b.Files {
+				size += f.Size
+			}
+			fmt.Printf("%s\t%s\tseq=%d\tfiles=%d\tbytes=%d\n", b.ID, b.Time.Local().Format(time.RFC3339), b.Sequence, len(b.Files), size)
+		}
+		return nil
+	},
+}
+
+var backupDownloadCmd = &cobra.Command{
+	Use:               "download [id]",
+	Short:             "Download a backup into a new directory that can be opened as a database",
+	Args:              cobra.ExactArgs(1),
+	PersistentPreRunE: configOnly,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := config.backupOptions()
+		if err != nil {
+			return err
+		}
+		if err := db.DownloadBackup(opts.Store, opts.Prefix, args[0], backupDest, nil); err != nil {
+			return fmt.Errorf("failed to download backup %s: %w", args[0], err)
+		}
+		fmt.Printf("Backup %s downloaded to %s\n", args[0], backupDest)
+		return nil
+	},
+}
+
+func init() {
+	backupDownloadCmd.Flags().StringVar(&backupDest, "dest", "", "Directory to download the backup into (must not exist or be empty)")
+	_ = backupDownloadCmd.MarkFlagRequired("dest")
+	backupCmd.AddCommand(backupListCmd, backupDownloadCmd)
+	rootCmd.AddCommand(backupCmd)
+}
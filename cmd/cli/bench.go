@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/bench"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchWorkloads string
+	benchNum       int
+	benchRecords   int
+)
+
+var benchWorkloadsByName = map[string]func(int) bench.Workload{
+	"fillseq":          bench.FillSeq,
+	"fillrandom":       bench.FillRandom,
+	"readrandom":       bench.ReadRandom,
+	"readwhilewriting": bench.ReadWhileWriting,
+}
+
+// benchWorkload returns the workload called name, which is one of
+// benchWorkloadsByName or ycsba through ycsbf.
+func benchWorkload(name string) (bench.Workload, error) {
+	if workload, ok := benchWorkloadsByName[name]; ok {
+		return workload(benchNum), nil
+	}
+	if letter, ok := strings.CutPrefix(name, "ycsb"); ok {
+		records := benchRecords
+		if records <= 0 {
+			records = benchNum
+		}
+		return bench.YCSB(letter, records, benchNum)
+	}
+	return bench.Workload{}, fmt.Errorf("unknown workload %q", name)
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Run db_bench-style workloads against the database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range strings.Split(benchWorkloads, ",") {
+			workload, err := benchWorkload(strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			result, err := bench.Run(getDB(), workload)
+			if err != nil {
+				return err
+			}
+			cmd.Println(result)
+		}
+		return nil
+	},
+}
+
+func init() {
+	benchCmd.Flags().StringVar(&benchWorkloads, "workloads", "fillseq,readrandom", "Comma-separated workloads: fillseq, fillrandom, readrandom, readwhilewriting, or the YCSB core workloads ycsba through ycsbf")
+	benchCmd.Flags().IntVar(&benchNum, "num", 100000, "Number of operations per workload")
+	benchCmd.Flags().IntVar(&benchRecords, "records", 0, "Number of records YCSB workloads load first (default --num)")
+	rootCmd.AddCommand(benchCmd)
+}
@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkpointDest         string
+	checkpointArchivedWALs bool
+)
+
+var checkpointCmd = &cobra.Command{
+	Use:   "checkpoint",
+	Short: "Write a consistent copy of the database that can be opened on its own",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := &db.CheckpointOptions{IncludeArchivedWALs: checkpointArchivedWALs}
+		if err := getDB().CheckpointWithOptions(checkpointDest, opts); err != nil {
+			return fmt.Errorf("failed to checkpoint to %s: %w", checkpointDest, err)
+		}
+		fmt.Printf("Checkpoint written to %s\n", checkpointDest)
+		return nil
+	},
+}
+
+func init() {
+	checkpointCmd.Flags().StringVar(&checkpointDest, "dest", "", "Directory to write the checkpoint to (must not exist or be empty)")
+	checkpointCmd.Flags().BoolVar(&checkpointArchivedWALs, "include-archived-wals", false, "Also copy the WAL archive, for point-in-time restore from the checkpoint")
+	_ = checkpointCmd.MarkFlagRequired("dest")
+	rootCmd.AddCommand(checkpointCmd)
+}
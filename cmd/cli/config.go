@@ -0,0 +1,275 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"mini-leveldb/db"
+	"mini-leveldb/server"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the contents of a --config file, in YAML, or in TOML when
+// the file name ends in .toml. Settings left out keep their defaults, and
+// flags given on the command line override the file.
+type fileConfig struct {
+	DataDir         string `yaml:"data_dir" toml:"data_dir"`
+	Compression     string `yaml:"compression" toml:"compression"`
+	CreateIfMissing *bool  `yaml:"create_if_missing" toml:"create_if_missing"`
+	TraceFile       string `yaml:"trace_file" toml:"trace_file"`
+
+	// CompressionDictSize trains a zstd dictionary of this many bytes for
+	// each compaction output; it needs compression: zstd.
+	CompressionDictSize int `yaml:"compression_dict_size" toml:"compression_dict_size"`
+
+	// RecordChecksums stores and verifies a checksum of every record.
+	RecordChecksums bool `yaml:"record_checksums" toml:"record_checksums"`
+
+	// WALSyncInterval of zero syncs the WAL on every write.
+	WALSyncInterval time.Duration `yaml:"wal_sync_interval" toml:"wal_sync_interval"`
+
+	// WALCheckpointInterval sets how precisely a restore finds a point in
+	// time; zero means one second.
+	WALCheckpointInterval time.Duration `yaml:"wal_checkpoint_interval" toml:"wal_checkpoint_interval"`
+	// WALPerColumnFamily logs each column family's writes in WALs of its
+	// own, which dropping the family disposes of.
+	WALPerColumnFamily bool `yaml:"wal_per_column_family" toml:"wal_per_column_family"`
+
+	WriteBufferSize       int  `yaml:"write_buffer_size" toml:"write_buffer_size"`
+	MaxImmutableMemTables int  `yaml:"max_immutable_memtables" toml:"max_immutable_memtables"`
+	MaxOpenFiles          int  `yaml:"max_open_files" toml:"max_open_files"`
+	PinL0IndexAndFilter   bool `yaml:"pin_l0_index_and_filter" toml:"pin_l0_index_and_filter"`
+	PinL1IndexAndFilter   bool `yaml:"pin_l1_index_and_filter" toml:"pin_l1_index_and_filter"`
+	BloomBitsPerKey       int  `yaml:"bloom_bits_per_key" toml:"bloom_bits_per_key"`
+
+	NumLevels            int     `yaml:"num_levels" toml:"num_levels"`
+	LevelMaxFiles        []int   `yaml:"level_max_files" toml:"level_max_files"`
+	LevelTargetSizes     []int64 `yaml:"level_target_sizes" toml:"level_target_sizes"`
+	LevelSizeMultiplier  int     `yaml:"level_size_multiplier" toml:"level_size_multiplier"`
+	TargetFileSizeBase   int64   `yaml:"target_file_size_base" toml:"target_file_size_base"`
+	MaxSubcompactions    int     `yaml:"max_subcompactions" toml:"max_subcompactions"`
+	RateLimitBytesPerSec int64   `yaml:"rate_limit_bytes_per_sec" toml:"rate_limit_bytes_per_sec"`
+
+	// The listeners serve opens, and how it secures and logs them.
+	MemcachedAddr string `yaml:"memcached_addr" toml:"memcached_addr"`
+	TLSCert       string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey        string `yaml:"tls_key" toml:"tls_key"`
+	TLSClientCA   string `yaml:"tls_client_ca" toml:"tls_client_ca"`
+	MetricsAddr   string `yaml:"metrics_addr" toml:"metrics_addr"`
+	AccessLog     string `yaml:"access_log" toml:"access_log"`
+	ShipWALDir    string `yaml:"ship_wal_dir" toml:"ship_wal_dir"`
+
+	// Multi-tenant serving, as serve's --tenants flags set it.
+	Tenants                 bool  `yaml:"tenants" toml:"tenants"`
+	TenantMaxDiskBytes      int64 `yaml:"tenant_max_disk_bytes" toml:"tenant_max_disk_bytes"`
+	TenantMaxRequestsPerSec int64 `yaml:"tenant_max_requests_per_sec" toml:"tenant_max_requests_per_sec"`
+
+	// AuthTokens, if any, are the tokens serve's clients must authenticate
+	// with.
+	AuthTokens []tokenConfig `yaml:"auth_tokens" toml:"auth_tokens"`
+
+	// ObjectStore, if set, keeps SSTables in an S3 or GCS bucket.
+	ObjectStore *objectStoreConfig `yaml:"object_store" toml:"object_store"`
+
+	// Backup, if set, is where backups are uploaded to: by the backup
+	// command, and every Interval while serving.
+	Backup *backupConfig `yaml:"backup" toml:"backup"`
+}
+
+// objectStoreConfig names the bucket SSTables are kept in. Credentials
+// come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// rather than the file.
+type objectStoreConfig struct {
+	Endpoint   string `yaml:"endpoint" toml:"endpoint"`
+	Region     string `yaml:"region" toml:"region"`
+	Bucket     string `yaml:"bucket" toml:"bucket"`
+	Prefix     string `yaml:"prefix" toml:"prefix"`
+	CacheBytes int64  `yaml:"cache_bytes" toml:"cache_bytes"`
+}
+
+// backupConfig names the bucket backups go to and how they are taken and
+// kept, as db.BackupOptions describes.
+type backupConfig struct {
+	Endpoint            string        `yaml:"endpoint" toml:"endpoint"`
+	Region              string        `yaml:"region" toml:"region"`
+	Bucket              string        `yaml:"bucket" toml:"bucket"`
+	Prefix              string        `yaml:"prefix" toml:"prefix"`
+	Interval            time.Duration `yaml:"interval" toml:"interval"`
+	Incremental         bool          `yaml:"incremental" toml:"incremental"`
+	IncludeArchivedWALs bool          `yaml:"include_archived_wals" toml:"include_archived_wals"`
+	Retain              int           `yaml:"retain" toml:"retain"`
+	MaxAge              time.Duration `yaml:"max_age" toml:"max_age"`
+}
+
+// newS3Store returns the bucket at endpoint, signing requests with the
+// credentials in the environment.
+func newS3Store(endpoint, region, bucket string) (*db.S3ObjectStore, error) {
+	return db.NewS3ObjectStore(db.S3Options{
+		Endpoint:        endpoint,
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	})
+}
+
+// backupOptions returns the backup settings of the config file.
+func (c *fileConfig) backupOptions() (db.BackupOptions, error) {
+	if c.Backup == nil {
+		return db.BackupOptions{}, fmt.Errorf("no backup bucket configured: add a backup section to --config")
+	}
+	store, err := newS3Store(c.Backup.Endpoint, c.Backup.Region, c.Backup.Bucket)
+	if err != nil {
+		return db.BackupOptions{}, err
+	}
+	return db.BackupOptions{
+		Store:               store,
+		Prefix:              c.Backup.Prefix,
+		Interval:            c.Backup.Interval,
+		Incremental:         c.Backup.Incremental,
+		IncludeArchivedWALs: c.Backup.IncludeArchivedWALs,
+		Retain:              c.Backup.Retain,
+		MaxAge:              c.Backup.MaxAge,
+	}, nil
+}
+
+// fileSystem returns the filesystem keeping SSTables in the configured
+// bucket, or nil without one.
+func (c *fileConfig) fileSystem() (db.FileSystem, error) {
+	if c.ObjectStore == nil {
+		return nil, nil
+	}
+	store, err := newS3Store(c.ObjectStore.Endpoint, c.ObjectStore.Region, c.ObjectStore.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewObjectFileSystem(nil, store, &db.ObjectFileSystemOptions{
+		Prefix:     c.ObjectStore.Prefix,
+		CacheBytes: c.ObjectStore.CacheBytes,
+	}), nil
+}
+
+// tokenConfig is a token clients may authenticate with. Without an acl
+// field it grants every key; an empty acl list grants none.
+type tokenConfig struct {
+	Token string      `yaml:"token" toml:"token"`
+	ACL   []aclConfig `yaml:"acl" toml:"acl"`
+}
+
+// aclConfig grants the keys starting with Prefix: Access is r, w, rw, or
+// empty to grant nothing.
+type aclConfig struct {
+	Prefix string `yaml:"prefix" toml:"prefix"`
+	Access string `yaml:"access" toml:"access"`
+}
+
+// authenticator returns the tokens in the config file, together with
+// extra tokens that grant every key, or nil if there are none.
+func (c *fileConfig) authenticator(extra []string) (server.Authenticator, error) {
+	if len(c.AuthTokens) == 0 && len(extra) == 0 {
+		return nil, nil
+	}
+	tokens := make(server.StaticTokens)
+	for _, t := range c.AuthTokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("auth token cannot be empty")
+		}
+		// A nil ACL grants every key, so only a missing acl field may
+		// leave it nil.
+		var acl server.ACL
+		if t.ACL != nil {
+			acl = make(server.ACL, 0, len(t.ACL))
+		}
+		for _, rule := range t.ACL {
+			if rule.Access != "" && rule.Access != "r" && rule.Access != "w" && rule.Access != "rw" {
+				return nil, fmt.Errorf("unknown access %q for prefix %q: must be r, w, rw, or empty", rule.Access, rule.Prefix)
+			}
+			acl = append(acl, server.ACLRule{
+				Prefix: rule.Prefix,
+				Read:   strings.Contains(rule.Access, "r"),
+				Write:  strings.Contains(rule.Access, "w"),
+			})
+		}
+		tokens[t.Token] = acl
+	}
+	for _, token := range extra {
+		tokens[token] = nil
+	}
+	return tokens, nil
+}
+
+// config holds the file read by loadConfig, or the zero fileConfig without
+// --config.
+var config fileConfig
+
+// loadConfig reads path into config and copies its settings into the
+// persistent flags' variables, except for flags set on the command line.
+func loadConfig(cmd *cobra.Command, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if filepath.Ext(path) == ".toml" {
+		md, err := toml.Decode(string(data), &config)
+		if err != nil {
+			return fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("failed to parse config %s: unknown setting %s", path, undecoded[0])
+		}
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&config); err != nil {
+			return fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+
+	flags := cmd.Flags()
+	if config.DataDir != "" && !flags.Changed("data-dir") {
+		dataDir = config.DataDir
+	}
+	if config.Compression != "" && !flags.Changed("compression") {
+		compression = config.Compression
+	}
+	if config.CreateIfMissing != nil && !flags.Changed("create-if-missing") {
+		createDB = *config.CreateIfMissing
+	}
+	if config.TraceFile != "" && !flags.Changed("trace-file") {
+		traceFile = config.TraceFile
+	}
+	return nil
+}
+
+// apply sets the options the config file holds on opts.
+func (c *fileConfig) apply(opts *db.Options) {
+	opts.WALSyncInterval = c.WALSyncInterval
+	opts.WALCheckpointInterval = c.WALCheckpointInterval
+	opts.WALPerColumnFamily = c.WALPerColumnFamily
+	opts.CompressionDictSize = c.CompressionDictSize
+	opts.RecordChecksums = c.RecordChecksums
+	if c.WriteBufferSize != 0 {
+		opts.WriteBufferSize = c.WriteBufferSize
+	}
+	if c.MaxImmutableMemTables != 0 {
+		opts.MaxImmutableMemTables = c.MaxImmutableMemTables
+	}
+	opts.MaxOpenFiles = c.MaxOpenFiles
+	opts.PinL0IndexAndFilter = c.PinL0IndexAndFilter
+	opts.PinL1IndexAndFilter = c.PinL1IndexAndFilter
+	opts.BloomBitsPerKey = c.BloomBitsPerKey
+	opts.NumLevels = c.NumLevels
+	opts.LevelMaxFiles = c.LevelMaxFiles
+	opts.LevelTargetSizes = c.LevelTargetSizes
+	opts.LevelSizeMultiplier = c.LevelSizeMultiplier
+	opts.TargetFileSizeBase = c.TargetFileSizeBase
+	opts.MaxSubcompactions = c.MaxSubcompactions
+	opts.RateLimitBytesPerSec = c.RateLimitBytesPerSec
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestEmptyACLDeniesEveryKey(t *testing.T) {
+	const yamlConfig = `
+auth_tokens:
+  - token: admin
+  - token: locked
+    acl: []
+  - token: reader
+    acl:
+      - prefix: "pub/"
+        access: r
+`
+	const tomlConfig = `
+[[auth_tokens]]
+token = "admin"
+
+[[auth_tokens]]
+token = "locked"
+acl = []
+
+[[auth_tokens]]
+token = "reader"
+acl = [{ prefix = "pub/", access = "r" }]
+`
+	var fromYAML, fromTOML fileConfig
+	require.NoError(t, yaml.Unmarshal([]byte(yamlConfig), &fromYAML))
+	_, err := toml.Decode(tomlConfig, &fromTOML)
+	require.NoError(t, err)
+
+	for name, c := range map[string]*fileConfig{"yaml": &fromYAML, "toml": &fromTOML} {
+		auth, err := c.authenticator(nil)
+		require.NoError(t, err, name)
+		allows := func(token, key string, write bool) bool {
+			acl, ok := auth.Authenticate("", token)
+			require.True(t, ok, "%s: %s", name, token)
+			return acl.Allows(key, write)
+		}
+		assert.True(t, allows("admin", "any", true), name)
+		assert.False(t, allows("locked", "any", false), name)
+		assert.False(t, allows("locked", "pub/x", true), name)
+		assert.True(t, allows("reader", "pub/x", false), name)
+		assert.False(t, allows("reader", "pub/x", true), name)
+		assert.False(t, allows("reader", "other", false), name)
+	}
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	countPrefix string
+	countStart  string
+	countEnd    string
+	countApprox bool
+)
+
+var countCmd = &cobra.Command{
+	Use:   "count",
+	Short: "Count the keys in a range, by scanning or, with --approx, by estimate",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		start, end := countStart, countEnd
+		if countPrefix != "" {
+			if start != "" || end != "" {
+				return fmt.Errorf("--prefix cannot be combined with --start or --end")
+			}
+			start, end = countPrefix, prefixEnd(countPrefix)
+		}
+		if end != "" && end <= start {
+			return fmt.Errorf("--end %q must sort after --start %q", end, start)
+		}
+
+		if countApprox {
+			fmt.Println(getDB().EstimateNumKeysInRange(start, end))
+			return nil
+		}
+		it := getDB().NewIterator()
+		defer it.Close()
+		var n uint64
+		for it.Seek(start); it.Valid() && (end == "" || it.Key() < end); it.Next() {
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("failed to count keys: %w", err)
+		}
+		fmt.Println(n)
+		return nil
+	},
+}
+
+// prefixEnd returns the first key after every key starting with prefix, or
+// "" if there is none.
+func prefixEnd(prefix string) string {
+	trimmed := strings.TrimRight(prefix, "\xff")
+	if trimmed == "" {
+		return ""
+	}
+	return trimmed[:len(trimmed)-1] + string([]byte{trimmed[len(trimmed)-1] + 1})
+}
+
+func init() {
+	countCmd.Flags().StringVar(&countPrefix, "prefix", "", "Count only keys starting with this prefix")
+	countCmd.Flags().StringVar(&countStart, "start", "", "First key of the range (inclusive)")
+	countCmd.Flags().StringVar(&countEnd, "end", "", "End of the range (exclusive); empty means no upper bound")
+	countCmd.Flags().BoolVar(&countApprox, "approx", false, "Estimate from table properties instead of scanning")
+	rootCmd.AddCommand(countCmd)
+}
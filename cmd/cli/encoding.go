@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// ioEncoding is how get, put and scan read keys and values from the command
+// line and write them out: raw, base64 or hex. The encodings carry
+// newlines, NULs and other bytes a shell or terminal would mangle.
+var ioEncoding string
+
+const encodingUsage = "Encoding of keys and values on the command line and in output: raw, base64, or hex"
+
+// decodeArg returns the bytes s stands for in ioEncoding.
+func decodeArg(s string) (string, error) {
+	switch ioEncoding {
+	case "raw":
+		return s, nil
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 %q: %w", s, err)
+		}
+		return string(b), nil
+	case "hex":
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid hex %q: %w", s, err)
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("unknown encoding %q: must be raw, base64, or hex", ioEncoding)
+}
+
+// encodeOutput returns s in ioEncoding.
+func encodeOutput(s string) string {
+	switch ioEncoding {
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	case "hex":
+		return hex.EncodeToString([]byte(s))
+	}
+	return s
+}
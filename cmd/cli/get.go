@@ -1,13 +1,27 @@
 package cli
 
-import "github.com/spf13/cobra"
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var getOutput string
 
 var getCmd = &cobra.Command{
 	Use:   "get [key]",
 	Short: "Get the value for a key from the database",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		key := args[0]
+		key, err := decodeArg(args[0])
+		if err != nil {
+			return err
+		}
+		if getOutput != "" {
+			return getToFile(key, getOutput)
+		}
 		value, err := getDB().Get(key)
 		if err != nil {
 			return err
@@ -15,11 +29,35 @@ var getCmd = &cobra.Command{
 		if value == "" {
 			return cmd.Help()
 		}
-		cmd.Println(value)
+		fmt.Fprintln(cmd.OutOrStdout(), encodeOutput(value))
 		return nil
 	},
 }
 
+// getToFile streams the value of key into path, byte for byte, replacing
+// whatever path held.
+func getToFile(key, path string) error {
+	rc, err := getDB().GetReader(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write value of %s to %s: %w", key, path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write value of %s to %s: %w", key, path, err)
+	}
+	return nil
+}
+
 func init() {
+	getCmd.Flags().StringVar(&ioEncoding, "encoding", "raw", encodingUsage)
+	getCmd.Flags().StringVarP(&getOutput, "output", "o", "", "Write the value to this file instead of printing it")
 	rootCmd.AddCommand(getCmd)
 }
@@ -0,0 +1,304 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	loadFormat    string
+	loadBatchSize int
+	loadSorted    bool
+	loadTableSize int64
+	loadQuiet     bool
+)
+
+var loadCmd = &cobra.Command{
+	Use:   "load [file]",
+	Short: "Bulk load key-value records from a TSV or NDJSON file, or - for stdin",
+	Long: `Bulk load key-value records from a file, or from standard input when the file
+is -. With --format tsv each line is a key, a tab and a value; with --format
+ndjson each line is an object such as {"key": "k", "value": "v"}. Keys and
+values are decoded with --encoding, so base64 or hex can carry tabs and
+newlines.
+
+Records are written in WriteBatches of --batch-size. With --sorted, for input
+whose keys are in strictly increasing order, they are written straight into
+SSTables that are then ingested, skipping the WAL and memtable.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if loadFormat != "tsv" && loadFormat != "ndjson" {
+			return fmt.Errorf("unknown format %q: must be tsv or ndjson", loadFormat)
+		}
+		if loadBatchSize <= 0 {
+			return fmt.Errorf("--batch-size must be positive")
+		}
+
+		in, size := io.Reader(cmd.InOrStdin()), int64(0)
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %w", args[0], err)
+			}
+			defer f.Close()
+			if info, err := f.Stat(); err == nil {
+				size = info.Size()
+			}
+			in = f
+		}
+		p := &loadProgress{out: cmd.ErrOrStderr(), total: size, quiet: loadQuiet, start: time.Now()}
+		records := &recordReader{r: bufio.NewReaderSize(&countingReader{r: in, n: &p.read}, 1<<20), format: loadFormat}
+
+		var n int64
+		var err error
+		if loadSorted {
+			n, err = loadSortedTables(records, p)
+		} else {
+			n, err = loadBatches(records, p)
+		}
+		p.finish(n)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Loaded %d records\n", n)
+		return nil
+	},
+}
+
+// loadBatches writes records through WriteBatches of loadBatchSize.
+func loadBatches(records *recordReader, p *loadProgress) (int64, error) {
+	store := getDB()
+	batch := &db.WriteBatch{}
+	var n int64
+	for {
+		key, value, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		batch.Put(key, value)
+		if batch.Len() == loadBatchSize {
+			if err := store.Write(batch); err != nil {
+				return n, fmt.Errorf("failed to write batch at line %d: %w", records.line, err)
+			}
+			n += int64(batch.Len())
+			batch.Reset()
+			p.update(n)
+		}
+	}
+	if batch.Len() > 0 {
+		if err := store.Write(batch); err != nil {
+			return n, fmt.Errorf("failed to write batch at line %d: %w", records.line, err)
+		}
+		n += int64(batch.Len())
+	}
+	return n, nil
+}
+
+// loadSortedTables writes records, whose keys must be strictly increasing,
+// into SSTables of about loadTableSize bytes in a scratch directory under the
+// data directory, so they can be linked rather than copied, and ingests them
+// once the input is consumed. The tables are written with the database's
+// options, so they match the ones it writes itself.
+func loadSortedTables(records *recordReader, p *loadProgress) (int64, error) {
+	scratch, err := os.MkdirTemp(dataDir, "load-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	fs := dbOpts.FileSystem
+	if fs == nil {
+		fs = db.OSFileSystem()
+	}
+
+	var (
+		paths   []string
+		w       *db.SSTableWriter
+		written int64
+		n       int64
+		prev    string
+	)
+	defer func() {
+		if w != nil {
+			w.Abandon()
+		}
+		for _, path := range paths {
+			fs.Remove(path)
+		}
+		os.RemoveAll(scratch)
+	}()
+	for {
+		key, value, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if n > 0 && key <= prev {
+			return n, fmt.Errorf("line %d: key %q is not greater than the key before it; --sorted needs strictly increasing keys", records.line, key)
+		}
+		if w == nil {
+			path := filepath.Join(scratch, fmt.Sprintf("%06d.sst", len(paths)))
+			w = db.NewSSTableWriter(path, dbOpts)
+			paths = append(paths, path)
+		}
+		if err := w.Add(key, value); err != nil {
+			return n, err
+		}
+		prev = key
+		n++
+		written += int64(len(key) + len(value))
+		if written >= loadTableSize {
+			if err := w.Finish(); err != nil {
+				return n, err
+			}
+			w, written = nil, 0
+		}
+		if n%int64(loadBatchSize) == 0 {
+			p.update(n)
+		}
+	}
+	if w != nil {
+		if err := w.Finish(); err != nil {
+			return n, err
+		}
+		w = nil
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	if err := getDB().IngestSSTables(paths); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// recordReader splits its input into key-value records in format, decoding
+// keys and values with ioEncoding.
+type recordReader struct {
+	r      *bufio.Reader
+	format string
+	line   int
+}
+
+// next returns the next record, skipping blank lines, or io.EOF.
+func (rr *recordReader) next() (string, string, error) {
+	for {
+		text, err := rr.r.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return "", "", io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return "", "", fmt.Errorf("failed to read input: %w", err)
+		}
+		rr.line++
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if text == "" {
+			continue
+		}
+		key, value, err := rr.parse(text)
+		if err != nil {
+			return "", "", fmt.Errorf("line %d: %w", rr.line, err)
+		}
+		if key, err = decodeArg(key); err != nil {
+			return "", "", fmt.Errorf("line %d: %w", rr.line, err)
+		}
+		if value, err = decodeArg(value); err != nil {
+			return "", "", fmt.Errorf("line %d: %w", rr.line, err)
+		}
+		return key, value, nil
+	}
+}
+
+func (rr *recordReader) parse(text string) (string, string, error) {
+	if rr.format == "tsv" {
+		key, value, ok := strings.Cut(text, "\t")
+		if !ok {
+			return "", "", fmt.Errorf("no tab between key and value")
+		}
+		return key, value, nil
+	}
+	var rec struct {
+		Key   *string `json:"key"`
+		Value *string `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(text), &rec); err != nil {
+		return "", "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if rec.Key == nil || rec.Value == nil {
+		return "", "", fmt.Errorf(`record needs both "key" and "value"`)
+	}
+	return *rec.Key, *rec.Value, nil
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// loadProgress redraws one status line on out at most a few times a second.
+type loadProgress struct {
+	out   io.Writer
+	total int64
+	read  int64
+	quiet bool
+	start time.Time
+	last  time.Time
+}
+
+func (p *loadProgress) update(records int64) {
+	if p.quiet || time.Since(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	p.draw(records)
+}
+
+func (p *loadProgress) draw(records int64) {
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(p.read) / (1 << 20) / max(elapsed, 1e-9)
+	if p.total > 0 {
+		const width = 30
+		done := int(width * min(p.read, p.total) / p.total)
+		fmt.Fprintf(p.out, "\r[%s%s] %3d%% %d records %.1f MB/s", strings.Repeat("=", done), strings.Repeat(" ", width-done),
+			100*min(p.read, p.total)/p.total, records, rate)
+		return
+	}
+	fmt.Fprintf(p.out, "\r%d records %.1f MB/s", records, rate)
+}
+
+func (p *loadProgress) finish(records int64) {
+	if p.quiet {
+		return
+	}
+	p.draw(records)
+	fmt.Fprintln(p.out)
+}
+
+func init() {
+	loadCmd.Flags().StringVar(&loadFormat, "format", "tsv", "Input format: tsv or ndjson")
+	loadCmd.Flags().StringVar(&ioEncoding, "encoding", "raw", encodingUsage)
+	loadCmd.Flags().IntVar(&loadBatchSize, "batch-size", 10000, "Records per WriteBatch")
+	loadCmd.Flags().BoolVar(&loadSorted, "sorted", false, "Input keys are strictly increasing: write SSTables directly and ingest them")
+	loadCmd.Flags().Int64Var(&loadTableSize, "table-size", 64<<20, "With --sorted, bytes of keys and values per SSTable")
+	loadCmd.Flags().BoolVarP(&loadQuiet, "quiet", "q", false, "Do not show progress")
+	rootCmd.AddCommand(loadCmd)
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mini-leveldb/server"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// startMetrics serves the counters stats returns on addr at /metrics, in
+// the Prometheus text format. It is secured like the memcached listener:
+// over TLS with a non-nil tlsConfig, and with a non-nil auth only to
+// requests carrying a token auth accepts, as "Authorization: Bearer
+// <token>".
+func startMetrics(addr string, tlsConfig *tls.Config, auth server.Authenticator, stats func() map[string]server.CommandStats) (*http.Server, net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, valid := auth.Authenticate("", token); !ok || !valid {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, stats())
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, ln.Addr(), nil
+}
+
+func writeMetrics(w io.Writer, stats map[string]server.CommandStats) {
+	commands := make([]string, 0, len(stats))
+	for name := range stats {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+
+	counter := func(name, help string, value func(server.CommandStats) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, c := range commands {
+			fmt.Fprintf(w, "%s{command=%q} %s\n", name, c, value(stats[c]))
+		}
+	}
+	counter("minildb_requests_total", "Requests answered, by command.",
+		func(s server.CommandStats) string { return strconv.FormatInt(s.Requests, 10) })
+	counter("minildb_request_errors_total", "Requests answered with an error, by command.",
+		func(s server.CommandStats) string { return strconv.FormatInt(s.Errors, 10) })
+	counter("minildb_request_bytes_total", "Bytes received in requests, by command.",
+		func(s server.CommandStats) string { return strconv.FormatInt(s.BytesIn, 10) })
+	counter("minildb_response_bytes_total", "Bytes sent in responses, by command.",
+		func(s server.CommandStats) string { return strconv.FormatInt(s.BytesOut, 10) })
+
+	const hist = "minildb_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to answer requests, by command.\n# TYPE %s histogram\n", hist, hist)
+	for _, c := range commands {
+		s := stats[c]
+		var cumulative int64
+		for i, bound := range server.LatencyBuckets {
+			cumulative += s.LatencyBuckets[i]
+			fmt.Fprintf(w, "%s_bucket{command=%q,le=\"%g\"} %d\n", hist, c, bound.Seconds(), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{command=%q,le=\"+Inf\"} %d\n", hist, c, s.Requests)
+		fmt.Fprintf(w, "%s_sum{command=%q} %g\n", hist, c, s.Latency.Seconds())
+		fmt.Fprintf(w, "%s_count{command=%q} %d\n", hist, c, s.Requests)
+	}
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"io"
+	"mini-leveldb/server"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRequireToken(t *testing.T) {
+	stats := func() map[string]server.CommandStats {
+		buckets := make([]int64, len(server.LatencyBuckets)+1)
+		return map[string]server.CommandStats{"get": {Requests: 3, LatencyBuckets: buckets}}
+	}
+	srv, addr, err := startMetrics("127.0.0.1:0", nil, server.StaticTokens{"s3cret": nil}, stats)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	scrape := func(auth string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr.String()+"/metrics", nil)
+		require.NoError(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		status, body := scrape(auth)
+		assert.Equal(t, http.StatusUnauthorized, status, auth)
+		assert.NotContains(t, body, "minildb_requests_total", auth)
+	}
+	status, body := scrape("Bearer s3cret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `minildb_requests_total{command="get"} 3`)
+}
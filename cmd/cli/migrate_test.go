@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"bytes"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateDirCommand(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "source")
+	dest := filepath.Join(root, "dest")
+	store, err := db.Open(source, db.DefaultOptions())
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Put("b", "2"))
+	require.NoError(t, store.Close())
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs([]string{"migrate-dir", "--from", source, "--to", dest, "--data-dir", filepath.Join(root, "unused")})
+	t.Cleanup(func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	})
+	require.NoError(t, rootCmd.Execute())
+	assert.Contains(t, out.String(), "Migrated 2 keys")
+	assert.Contains(t, out.String(), "v2 tables")
+
+	_, err = os.Stat(filepath.Join(root, "unused"))
+	assert.True(t, os.IsNotExist(err), "migrate-dir created --data-dir")
+	migrated, err := db.Open(dest, db.DefaultOptions())
+	require.NoError(t, err)
+	defer migrated.Close()
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		got, err := migrated.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
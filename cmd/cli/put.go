@@ -2,24 +2,65 @@ package cli
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	putStdin bool
+	putFile  string
+)
+
 var putCmd = &cobra.Command{
 	Use:   "put [key] [value]",
 	Short: "Put a key-value pair into the database",
+	Long: `Put a key-value pair into the database. With --stdin or --file the value is
+read, byte for byte, from standard input or a file instead of the command line.`,
 	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) != 2 {
+		want := 2
+		if putStdin || putFile != "" {
+			want = 1
+		}
+		if len(args) != want {
 			return cmd.Help()
 		}
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		key := args[0]
-		value := strings.Join(args[1:], " ")
-		if err := getDB().Put(key, value); err != nil {
+		if putStdin && putFile != "" {
+			return fmt.Errorf("--stdin cannot be combined with --file")
+		}
+		key, err := decodeArg(args[0])
+		if err != nil {
+			return err
+		}
+
+		var r io.Reader
+		switch {
+		case putStdin:
+			r = cmd.InOrStdin()
+		case putFile != "":
+			f, err := os.Open(putFile)
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %w", putFile, err)
+			}
+			defer f.Close()
+			r = f
+		default:
+			value, err := decodeArg(strings.Join(args[1:], " "))
+			if err != nil {
+				return err
+			}
+			if err := getDB().Put(key, value); err != nil {
+				return fmt.Errorf("failed to put key %s: %w", key, err)
+			}
+			fmt.Println("OK")
+			return nil
+		}
+		if err := getDB().PutReader(key, r); err != nil {
 			return fmt.Errorf("failed to put key %s: %w", key, err)
 		}
 		fmt.Println("OK")
@@ -28,5 +69,8 @@ var putCmd = &cobra.Command{
 }
 
 func init() {
+	putCmd.Flags().StringVar(&ioEncoding, "encoding", "raw", encodingUsage)
+	putCmd.Flags().BoolVar(&putStdin, "stdin", false, "Read the value from standard input")
+	putCmd.Flags().StringVar(&putFile, "file", "", "Read the value from this file")
 	rootCmd.AddCommand(putCmd)
 }
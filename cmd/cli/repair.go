@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+
+	"github.com/spf13/cobra"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Salvage readable records and rebuild a damaged database",
+	// Repair works on the raw files and must run while the database is closed.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		report, err := db.Repair(dataDir)
+		if err != nil {
+			return fmt.Errorf("failed to repair %s: %w", dataDir, err)
+		}
+		cmd.Printf("Scanned %d SSTables (%d damaged), salvaged %d table records and %d WAL records\n",
+			report.TablesScanned, report.TablesCorrupted, report.TableRecords, report.WALRecords)
+		cmd.Printf("Rebuilt database with %d keys\n", report.KeysWritten)
+		for _, path := range report.MovedAside {
+			cmd.Printf("Moved aside: %s\n", path)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayTrace  string
+	replayTo     string
+	replayTiming bool
+	replaySpeed  float64
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Re-execute a recorded operation trace against a fresh database",
+	// The fresh database is opened by the command itself, so skip opening
+	// --data-dir.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if entries, err := os.ReadDir(replayTo); err == nil && len(entries) > 0 {
+			return fmt.Errorf("replay directory %s is not empty", replayTo)
+		}
+		trace, err := db.OpenTrace(nil, replayTrace)
+		if err != nil {
+			return err
+		}
+		defer trace.Close()
+
+		codec, err := db.ParseCompressionType(compression)
+		if err != nil {
+			return err
+		}
+		opts := db.DefaultOptions()
+		opts.Compression = codec
+		store, err := db.Open(replayTo, opts)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		report, err := store.ReplayTrace(trace, &db.TraceReplayOptions{PreserveTiming: replayTiming, Speed: replaySpeed})
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay %s: %w", replayTrace, err)
+		}
+		cmd.Printf("Replayed %d operations in %v (%.0f ops/sec), %d failed\n", report.Operations, report.Duration,
+			float64(report.Operations)/report.Duration.Seconds(), report.Errors)
+		return nil
+	},
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayTrace, "trace", "", "Trace file recorded with --trace-file or Options.TraceFile")
+	replayCmd.Flags().StringVar(&replayTo, "to", "", "Directory of the fresh database to replay into (must be empty)")
+	replayCmd.Flags().BoolVar(&replayTiming, "preserve-timing", false, "Wait between operations as long as when they were traced")
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "Speed-up applied to the traced timing with --preserve-timing")
+	_ = replayCmd.MarkFlagRequired("trace")
+	_ = replayCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(replayCmd)
+}
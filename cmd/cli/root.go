@@ -9,8 +9,14 @@ import (
 )
 
 var (
-	dataDir string
-	dbh     *db.DB
+	dataDir     string
+	compression string
+	traceFile   string
+	createDB    bool
+	breakLock   bool
+	configFile  string
+	dbh         *db.DB
+	dbOpts      *db.Options
 )
 
 var rootCmd = &cobra.Command{
@@ -20,15 +26,11 @@ var rootCmd = &cobra.Command{
 		if dbh != nil {
 			return nil
 		}
-		if err := os.MkdirAll(dataDir, 0755); err != nil {
-			return fmt.Errorf("failed to create data directory: %w", err)
-		}
-		newDB, err := db.NewDB(dataDir)
+		opts, err := dbOptions(cmd)
 		if err != nil {
-			return fmt.Errorf("failed to open database: %w", err)
+			return err
 		}
-		dbh = newDB
-		return nil
+		return openDB(opts)
 	},
 	PersistentPostRun: func(cmd *cobra.Command, args []string) {
 		if dbh != nil {
@@ -38,7 +40,57 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML or .toml file of settings; flags given on the command line override it")
 	rootCmd.PersistentFlags().StringVarP(&dataDir, "data-dir", "d", "./data", "Directory to store database files")
+	rootCmd.PersistentFlags().StringVar(&compression, "compression", "none", "Compression for new SSTables: none, snappy, or zstd")
+	rootCmd.PersistentFlags().BoolVar(&createDB, "create-if-missing", true, "Create the database if the data directory holds none")
+	rootCmd.PersistentFlags().BoolVar(&breakLock, "break-stale-lock", false, "Take over a LOCK left by a process that is no longer running")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace-file", "", "Record every operation to this trace file, for minildb replay")
+}
+
+// dbOptions reads --config and returns the options it and the persistent
+// flags give, creating the data directory if --create-if-missing is set.
+func dbOptions(cmd *cobra.Command) (*db.Options, error) {
+	if configFile != "" {
+		if err := loadConfig(cmd, configFile); err != nil {
+			return nil, err
+		}
+	}
+	if createDB {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+	codec, err := db.ParseCompressionType(compression)
+	if err != nil {
+		return nil, err
+	}
+	opts := db.DefaultOptions()
+	config.apply(opts)
+	fs, err := config.fileSystem()
+	if err != nil {
+		return nil, err
+	}
+	if fs != nil {
+		opts.FileSystem = fs
+		opts.ReadMode = db.ReadModePread
+	}
+	opts.Compression = codec
+	opts.TraceFile = traceFile
+	opts.CreateIfMissing = createDB
+	opts.BreakStaleLock = breakLock
+	return opts, nil
+}
+
+// openDB opens the database in the data directory for getDB, keeping opts
+// for commands that write its tables themselves.
+func openDB(opts *db.Options) error {
+	newDB, err := db.Open(dataDir, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	dbh, dbOpts = newDB, opts
+	return nil
 }
 
 func Execute() {
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanPrefix string
+	scanStart  string
+	scanEnd    string
+	scanLimit  int
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Print the keys and values in a range, one tab-separated pair per line",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var start, end string
+		var err error
+		if start, err = decodeArg(scanStart); err != nil {
+			return err
+		}
+		if end, err = decodeArg(scanEnd); err != nil {
+			return err
+		}
+		if scanPrefix != "" {
+			if start != "" || end != "" {
+				return fmt.Errorf("--prefix cannot be combined with --start or --end")
+			}
+			prefix, err := decodeArg(scanPrefix)
+			if err != nil {
+				return err
+			}
+			start, end = prefix, prefixEnd(prefix)
+		}
+
+		it := getDB().NewIterator()
+		defer it.Close()
+		out := cmd.OutOrStdout()
+		n := 0
+		for it.Seek(start); it.Valid() && (end == "" || it.Key() < end); it.Next() {
+			if scanLimit > 0 && n == scanLimit {
+				break
+			}
+			fmt.Fprintf(out, "%s\t%s\n", encodeOutput(it.Key()), encodeOutput(it.Value()))
+			n++
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("failed to scan: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	scanCmd.Flags().StringVar(&scanPrefix, "prefix", "", "Scan only keys starting with this prefix")
+	scanCmd.Flags().StringVar(&scanStart, "start", "", "First key of the range (inclusive)")
+	scanCmd.Flags().StringVar(&scanEnd, "end", "", "End of the range (exclusive); empty means no upper bound")
+	scanCmd.Flags().IntVar(&scanLimit, "limit", 0, "Print at most this many pairs; zero means no limit")
+	scanCmd.Flags().StringVar(&ioEncoding, "encoding", "raw", encodingUsage)
+	rootCmd.AddCommand(scanCmd)
+}
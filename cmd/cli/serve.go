@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mini-leveldb/db"
+	"mini-leveldb/server"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveMemcachedAddr    string
+	serveMemcachedMaxSize int
+	serveTLSCert          string
+	serveTLSKey           string
+	serveTLSClientCA      string
+	serveAuthTokens       []string
+	serveMetricsAddr      string
+	serveAccessLog        string
+	serveTenants          bool
+	serveTenantMaxDisk    int64
+	serveTenantMaxRate    int64
+	serveShipWAL          string
+
+	// serveTenantOptions opens each tenant's database with --tenants.
+	serveTenantOptions *db.Options
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the database to network clients until interrupted",
+	Long: `Serve the database to network clients until interrupted. With --tenants, the
+data directory instead holds a database per tenant, in a subdirectory named
+after it, and clients name the tenant before a colon in each key, as in
+acme:user/1.`,
+	// With --tenants the data directory is not a database itself, so it is
+	// opened here only without it.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := dbOptions(cmd)
+		if err != nil {
+			return err
+		}
+		flags := cmd.Flags()
+		if config.Tenants && !flags.Changed("tenants") {
+			serveTenants = true
+		}
+		if !serveTenants {
+			return openDB(opts)
+		}
+		if opts.TraceFile != "" {
+			return fmt.Errorf("--trace-file cannot be used with --tenants")
+		}
+		serveTenantOptions = opts
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if config.TenantMaxDiskBytes != 0 && !flags.Changed("tenant-max-disk-bytes") {
+			serveTenantMaxDisk = config.TenantMaxDiskBytes
+		}
+		if config.TenantMaxRequestsPerSec != 0 && !flags.Changed("tenant-max-requests-per-sec") {
+			serveTenantMaxRate = config.TenantMaxRequestsPerSec
+		}
+		if config.MemcachedAddr != "" && !flags.Changed("memcached") {
+			serveMemcachedAddr = config.MemcachedAddr
+		}
+		if config.TLSCert != "" && !flags.Changed("tls-cert") {
+			serveTLSCert = config.TLSCert
+		}
+		if config.TLSKey != "" && !flags.Changed("tls-key") {
+			serveTLSKey = config.TLSKey
+		}
+		if config.TLSClientCA != "" && !flags.Changed("tls-client-ca") {
+			serveTLSClientCA = config.TLSClientCA
+		}
+		if config.MetricsAddr != "" && !flags.Changed("metrics") {
+			serveMetricsAddr = config.MetricsAddr
+		}
+		if config.AccessLog != "" && !flags.Changed("access-log") {
+			serveAccessLog = config.AccessLog
+		}
+		if config.ShipWALDir != "" && !flags.Changed("ship-wal") {
+			serveShipWAL = config.ShipWALDir
+		}
+		if serveMemcachedAddr == "" {
+			return fmt.Errorf("no listener configured: set --memcached")
+		}
+		if serveShipWAL != "" && serveTenants {
+			return fmt.Errorf("--ship-wal cannot be used with --tenants")
+		}
+		tlsConfig, err := serverTLSConfig(serveTLSCert, serveTLSKey, serveTLSClientCA)
+		if err != nil {
+			return err
+		}
+
+		auth, err := config.authenticator(serveAuthTokens)
+		if err != nil {
+			return err
+		}
+
+		var accessLog io.Writer
+		switch serveAccessLog {
+		case "":
+		case "-":
+			accessLog = os.Stdout
+		default:
+			f, err := os.OpenFile(serveAccessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open access log: %w", err)
+			}
+			defer f.Close()
+			accessLog = f
+		}
+
+		memcachedOpts := &server.MemcachedOptions{
+			MaxValueSize:  serveMemcachedMaxSize,
+			Authenticator: auth,
+			AccessLog:     accessLog,
+			TLSConfig:     tlsConfig,
+		}
+		var memcached *server.MemcachedServer
+		if serveTenants {
+			tenants, err := server.OpenTenants(dataDir, &server.TenantOptions{
+				Options:           serveTenantOptions,
+				MaxDiskBytes:      serveTenantMaxDisk,
+				MaxRequestsPerSec: serveTenantMaxRate,
+			})
+			if err != nil {
+				return err
+			}
+			defer tenants.Close()
+			memcached, err = tenants.StartMemcached(serveMemcachedAddr, memcachedOpts)
+			if err != nil {
+				return err
+			}
+		} else {
+			if serveShipWAL != "" {
+				sink, err := db.NewFileWALSink(serveShipWAL, nil)
+				if err != nil {
+					return err
+				}
+				defer sink.Close()
+				shipper, err := getDB().StartWALShipping(sink, nil)
+				if err != nil {
+					return err
+				}
+				defer shipper.Close()
+				log.Printf("Shipping writes after sequence %d to %s", shipper.StartSequence(), serveShipWAL)
+			}
+			if config.Backup != nil && config.Backup.Interval > 0 {
+				opts, err := config.backupOptions()
+				if err != nil {
+					return err
+				}
+				scheduler, err := getDB().StartBackups(opts)
+				if err != nil {
+					return err
+				}
+				defer scheduler.Close()
+				log.Printf("Backing up to bucket %s every %s", config.Backup.Bucket, opts.Interval)
+			}
+			memcached, err = server.StartMemcached(getDB(), serveMemcachedAddr, memcachedOpts)
+			if err != nil {
+				return err
+			}
+		}
+		if serveMetricsAddr != "" {
+			metrics, addr, err := startMetrics(serveMetricsAddr, tlsConfig, auth, memcached.Stats)
+			if err != nil {
+				memcached.Close()
+				return err
+			}
+			defer metrics.Close()
+			scheme := "http"
+			if tlsConfig != nil {
+				scheme = "https"
+			}
+			log.Printf("Serving metrics on %s://%s/metrics", scheme, addr)
+		}
+		if tlsConfig != nil {
+			log.Printf("Serving memcached protocol over TLS on %s", memcached.Addr())
+		} else {
+			log.Printf("Serving memcached protocol on %s", memcached.Addr())
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Printf("Shutting down")
+		return memcached.Close()
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveMemcachedAddr, "memcached", "", "Address to serve the memcached text protocol on, such as :11211")
+	serveCmd.Flags().IntVar(&serveMemcachedMaxSize, "memcached-max-value-size", 0, "Largest value memcached clients may store, in bytes; 0 means 1 MiB")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "PEM certificate to serve TLS with; reloaded on SIGHUP")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "PEM private key of --tls-cert; reloaded on SIGHUP")
+	serveCmd.Flags().StringVar(&serveTLSClientCA, "tls-client-ca", "", "PEM CA certificates that client certificates must be signed by (mutual TLS)")
+	serveCmd.Flags().StringArrayVar(&serveAuthTokens, "auth-token", nil, "Token clients must authenticate with, granting every key; repeatable, and added to auth_tokens from --config")
+	serveCmd.Flags().StringVar(&serveMetricsAddr, "metrics", "", "Address to serve Prometheus metrics on at /metrics, such as :9100; over TLS and behind the auth tokens when they are set")
+	serveCmd.Flags().StringVar(&serveAccessLog, "access-log", "", "File to append a JSON line per request to, or - for standard output")
+	serveCmd.Flags().BoolVar(&serveTenants, "tenants", false, "Serve a database per tenant from subdirectories of --data-dir, named by a tenant: prefix on each key")
+	serveCmd.Flags().Int64Var(&serveTenantMaxDisk, "tenant-max-disk-bytes", 0, "With --tenants, refuse writes to a tenant whose files take up this many bytes; 0 means no limit")
+	serveCmd.Flags().StringVar(&serveShipWAL, "ship-wal", "", "Directory, such as one on a file share, to ship every committed write to for disaster recovery")
+	serveCmd.Flags().Int64Var(&serveTenantMaxRate, "tenant-max-requests-per-sec", 0, "With --tenants, delay each tenant's requests beyond this rate; 0 means no limit")
+	rootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show lifetime totals and per-level flush and compaction statistics for this session",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lifetime := getDB().LifetimeStats()
+		cmd.Println("Lifetime totals")
+		cmd.Printf("  Writes:       %d\n", lifetime.Writes)
+		cmd.Printf("  Flushes:      %d (%.2f MB)\n", lifetime.Flushes, float64(lifetime.BytesFlushed)/(1<<20))
+		cmd.Printf("  Compactions:  %d (%.2f MB written)\n", lifetime.Compactions, float64(lifetime.BytesCompacted)/(1<<20))
+
+		stats := getDB().CompactionStats()
+		cmd.Println("Level  Compactions  Files in  Files out    Read (MB)   Written (MB)  Time (s)")
+		row := func(name string, l db.LevelCompactionStats) {
+			cmd.Printf("%-6s %11d %9d %10d %12.2f %14.2f %9.2f\n",
+				name, l.Compactions, l.FilesRead, l.FilesWritten,
+				float64(l.BytesRead)/(1<<20), float64(l.BytesWritten)/(1<<20), l.Duration.Seconds())
+		}
+		row("Flush", stats.Flushes)
+		for _, l := range stats.Levels {
+			row(fmt.Sprintf("L%d", l.Level), l)
+		}
+		cmd.Printf("Write amplification: %.2f\n", stats.WriteAmplification())
+
+		cmd.Println("Level  Files    Size (MB)")
+		for _, l := range getDB().Levels() {
+			cmd.Printf("L%-5d %5d %12.2f\n", l.Level, len(l.Files), float64(l.Size)/(1<<20))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// walArchiveDirName is the subdirectory of the database directory that
+// Options.ArchiveWALs moves flushed WALs into.
+const walArchiveDirName = "archive"
+
+// walArchiveDir returns the WAL archive of the database in dir.
+func walArchiveDir(dir string) string {
+	return filepath.Join(dir, walArchiveDirName)
+}
+
+// archivedWALs returns the WALs in the archive of the database in dir, in
+// the order they were written.
+func archivedWALs(fs FileSystem, dir string) ([]string, error) {
+	return walFiles(fs, walArchiveDir(dir))
+}
+
+// retireWALs disposes of WALs the database no longer needs: with
+// Options.ArchiveWALs they are moved into the archive, which is then
+// trimmed to its retention limits, and otherwise they are deleted.
+func (db *DB) retireWALs(paths []string) {
+	if !db.opts.ArchiveWALs {
+		db.removeWALs(paths)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+	archive := walArchiveDir(db.dir)
+	if err := db.fs.MkdirAll(archive, 0755); err != nil {
+		log.Printf("Warning: failed to create WAL archive: %v", err)
+		db.removeWALs(paths)
+		return
+	}
+	for _, path := range paths {
+		dst := filepath.Join(archive, filepath.Base(path))
+		if err := db.fs.Rename(path, dst); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to archive WAL %s: %v", path, err)
+		}
+	}
+	// The archive's entry must be durable before the database's goes, or a
+	// crash could lose the WAL from both.
+	if err := db.fs.SyncDir(archive); err != nil {
+		log.Printf("Warning: failed to sync WAL archive: %v", err)
+	}
+	db.syncRemovals(paths)
+	db.trimWALArchive(time.Now())
+}
+
+// trimWALArchive removes archived WALs, oldest first, that are older than
+// Options.WALArchiveTTL or that take the archive over
+// Options.WALArchiveSizeLimit.
+func (db *DB) trimWALArchive(now time.Time) {
+	ttl, limit := db.opts.WALArchiveTTL, db.opts.WALArchiveSizeLimit
+	if ttl <= 0 && limit <= 0 {
+		return
+	}
+	paths, err := archivedWALs(db.fs, db.dir)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	type archived struct {
+		path    string
+		size    int64
+		expired bool
+	}
+	var wals []archived
+	var total int64
+	for _, path := range paths {
+		info, err := db.fs.Stat(path)
+		if err != nil {
+			continue
+		}
+		wals = append(wals, archived{path, info.Size(), ttl > 0 && now.Sub(info.ModTime()) > ttl})
+		total += info.Size()
+	}
+
+	var removed []string
+	for _, w := range wals {
+		if !w.expired && (limit <= 0 || total <= limit) {
+			continue
+		}
+		if err := db.fs.Remove(w.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove archived WAL %s: %v", w.path, err)
+			continue
+		}
+		total -= w.size
+		removed = append(removed, w.path)
+	}
+	if len(removed) > 0 {
+		if err := db.fs.SyncDir(walArchiveDir(db.dir)); err != nil {
+			log.Printf("Warning: failed to sync WAL archive: %v", err)
+		}
+	}
+}
+
+// ArchivedWALs returns the paths of the WALs in the archive, in the order
+// they were written. Each holds the writes of a memtable that has been
+// flushed, as its WAL recorded them.
+func (db *DB) ArchivedWALs() ([]string, error) {
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to list archived WALs: %w", ErrClosed)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return archivedWALs(db.fs, db.dir)
+}
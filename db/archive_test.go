@@ -0,0 +1,56 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushedWALsAreArchived(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		want  int
+	}{
+		{"unbounded", 0, 3},
+		{"size limit", 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "archive", strings.ReplaceAll(tc.name, " ", "-"))
+			_ = os.RemoveAll(dir)
+			opts := db.DefaultOptions()
+			opts.ArchiveWALs = true
+			opts.WALArchiveSizeLimit = tc.limit
+			store, err := db.Open(dir, opts)
+			require.NoError(t, err)
+			defer store.Close()
+
+			for _, key := range []string{"a", "b", "c"} {
+				require.NoError(t, store.Put(key, "value-"+key))
+				require.NoError(t, store.Flush())
+			}
+
+			archived, err := store.ArchivedWALs()
+			require.NoError(t, err)
+			assert.Len(t, archived, tc.want)
+			live, err := filepath.Glob(filepath.Join(dir, "*.walb"))
+			require.NoError(t, err)
+			assert.Len(t, live, 1, "only the active WAL stays in the database directory")
+
+			if tc.want > 0 {
+				data, err := os.ReadFile(archived[0])
+				require.NoError(t, err)
+				assert.Contains(t, string(data), "value-a", "the oldest archived WAL holds the first write")
+			}
+		})
+	}
+}
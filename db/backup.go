@@ -0,0 +1,516 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackupInterval = time.Hour
+
+	// backupStagingDirName is the subdirectory of the database directory
+	// a backup is checkpointed into before it is uploaded.
+	backupStagingDirName = "backup-staging"
+	backupManifestName   = "BACKUP.json"
+	backupIDLayout       = "20060102T150405.000000000Z"
+
+	// unreferencedTablesName is the object, under the prefix, in which
+	// PruneBackups records when it first found each shared table that no
+	// backup refers to. A table is deleted once it has gone unreferenced
+	// for backupTableGracePeriod, so that a backup in progress, which
+	// may have found a table already uploaded and be about to refer to
+	// it, has that long to upload its manifest.
+	unreferencedTablesName = "UNREFERENCED.json"
+	backupTableGracePeriod = 24 * time.Hour
+)
+
+// BackupOptions configures the backups StartBackups takes.
+type BackupOptions struct {
+	// Store and Prefix are where backups are uploaded: each under
+	// Prefix + "backups/<id>/", and with Incremental the SSTables they
+	// share under Prefix + "tables/". A prefix must belong to one
+	// database, as pruning removes what no backup there refers to.
+	Store  ObjectStore
+	Prefix string
+
+	// Interval is the time between backups. Zero means an hour.
+	Interval time.Duration
+
+	// Incremental uploads each SSTable once, for every backup to refer to,
+	// rather than with each backup. SSTables never change once written, so
+	// a backup then uploads only the tables written since the last one.
+	// Shared tables are named by their content's SHA-256 as well as their
+	// file name, as file numbers are reused after a restore.
+	Incremental bool
+
+	// IncludeArchivedWALs adds the archived WALs to each backup, as
+	// CheckpointOptions.IncludeArchivedWALs does.
+	IncludeArchivedWALs bool
+
+	// Retain keeps only the newest Retain backups, and MaxAge removes
+	// backups taken longer ago than that. Zero leaves either unbounded.
+	// The newest backup is always kept.
+	Retain int
+	MaxAge time.Duration
+}
+
+// BackupFile is a file of a backup and the object it is stored as.
+type BackupFile struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// BackupInfo describes an uploaded backup. It is stored with the backup, as
+// its BACKUP.json, which is uploaded last so only complete backups are
+// listed.
+type BackupInfo struct {
+	ID          string       `json:"id"`
+	Time        time.Time    `json:"time"`
+	Sequence    uint64       `json:"sequence"`
+	Incremental bool         `json:"incremental"`
+	Files       []BackupFile `json:"files"`
+	// Uploaded is the bytes this backup uploaded, less than the total size
+	// of its files when it shares tables with earlier backups.
+	Uploaded int64 `json:"uploaded"`
+}
+
+// BackupScheduler takes a backup of a database every Interval, uploads it
+// and prunes old backups.
+type BackupScheduler struct {
+	db     *DB
+	opts   BackupOptions
+	stopCh chan struct{}
+	done   chan struct{}
+	now    func() time.Time
+
+	mu     sync.Mutex // serializes backups
+	closed bool
+}
+
+// StartBackups starts taking backups every opts.Interval, the first one
+// interval from now.
+func (db *DB) StartBackups(opts BackupOptions) (*BackupScheduler, error) {
+	if opts.Store == nil {
+		return nil, fmt.Errorf("failed to start backups: no object store")
+	}
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to start backups: %w", ErrClosed)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultBackupInterval
+	}
+	s := &BackupScheduler{
+		db:     db,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+		now:    time.Now,
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *BackupScheduler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			info, err := s.BackupNow()
+			if err != nil {
+				log.Printf("Warning: backup failed: %v", err)
+				continue
+			}
+			log.Printf("Uploaded backup %s at sequence %d (%d files, %d bytes uploaded)", info.ID, info.Sequence, len(info.Files), info.Uploaded)
+		}
+	}
+}
+
+// Close stops taking backups, waiting for one in progress.
+func (s *BackupScheduler) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stopCh)
+	<-s.done
+	return nil
+}
+
+// BackupNow takes a backup and uploads it, then prunes the backups the
+// retention policy no longer keeps.
+func (s *BackupScheduler) BackupNow() (*BackupInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("failed to back up: scheduler closed")
+	}
+	info, err := s.db.uploadBackup(s.now(), &s.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := PruneBackups(s.opts.Store, s.opts.Prefix, s.opts.Retain, s.opts.MaxAge, s.now()); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// uploadBackup checkpoints the database into the staging directory and
+// uploads the checkpoint.
+func (db *DB) uploadBackup(now time.Time, opts *BackupOptions) (*BackupInfo, error) {
+	staging := filepath.Join(db.dir, backupStagingDirName)
+	if err := removeAll(db.fs, staging); err != nil {
+		return nil, fmt.Errorf("failed to clear backup staging directory: %w", err)
+	}
+	defer func() {
+		if err := removeAll(db.fs, staging); err != nil {
+			log.Printf("Warning: failed to remove backup staging directory: %v", err)
+		}
+	}()
+	seq, err := db.checkpoint(staging, &CheckpointOptions{IncludeArchivedWALs: opts.IncludeArchivedWALs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkpoint backup: %w", err)
+	}
+	names, err := walkFiles(db.fs, staging, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup files: %w", err)
+	}
+
+	info := &BackupInfo{
+		ID:          now.UTC().Format(backupIDLayout),
+		Time:        now.UTC(),
+		Sequence:    seq,
+		Incremental: opts.Incremental,
+	}
+	dir := opts.Prefix + "backups/" + info.ID + "/"
+	for _, name := range names {
+		key := dir + name
+		localPath := filepath.Join(staging, filepath.FromSlash(name))
+		shared := opts.Incremental && strings.HasSuffix(name, ".sst") && !strings.Contains(name, "/")
+		if shared {
+			sum, err := fileChecksum(db.fs, localPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to checksum backup file %s: %w", name, err)
+			}
+			key = opts.Prefix + "tables/" + strings.TrimSuffix(name, ".sst") + "-" + sum + ".sst"
+		}
+		stat, err := db.fs.Stat(localPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat backup file %s: %w", name, err)
+		}
+		info.Files = append(info.Files, BackupFile{Name: name, Key: key, Size: stat.Size()})
+		if shared {
+			if size, err := opts.Store.Size(key); err == nil && size == stat.Size() {
+				continue
+			}
+		}
+		if err := uploadFile(db.fs, localPath, opts.Store, key); err != nil {
+			return nil, fmt.Errorf("failed to upload backup file %s: %w", name, err)
+		}
+		info.Uploaded += stat.Size()
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Store.Put(dir+backupManifestName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("failed to upload backup manifest: %w", err)
+	}
+	return info, nil
+}
+
+// walkFiles returns the slash-separated paths, relative to root, of the
+// files under dir.
+func walkFiles(fs FileSystem, root, dir string) ([]string, error) {
+	entries, err := fs.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range entries {
+		rel := path.Join(dir, name)
+		stat, err := fs.Stat(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			files = append(files, rel)
+			continue
+		}
+		sub, err := walkFiles(fs, root, rel)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// removeAll removes dir and everything in it, if it exists.
+func removeAll(fs FileSystem, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range entries {
+		p := filepath.Join(dir, name)
+		stat, err := fs.Stat(p)
+		if err != nil {
+			return err
+		}
+		if stat.IsDir() {
+			err = removeAll(fs, p)
+		} else {
+			err = fs.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fs.Remove(dir)
+}
+
+// fileChecksum returns the hex SHA-256 of the file called name.
+func fileChecksum(fs FileSystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func uploadFile(fs FileSystem, name string, store ObjectStore, key string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Put(key, f, stat.Size())
+}
+
+// ListBackups returns the complete backups under prefix in store, oldest
+// first.
+func ListBackups(store ObjectStore, prefix string) ([]*BackupInfo, error) {
+	keys, err := store.List(prefix + "backups/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	var backups []*BackupInfo
+	for _, key := range keys {
+		if path.Base(key) != backupManifestName {
+			continue
+		}
+		size, err := store.Size(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup manifest %s: %w", key, err)
+		}
+		data := make([]byte, size)
+		if n, err := store.ReadAt(key, data, 0); err != nil && !(err == io.EOF && n == len(data)) {
+			return nil, fmt.Errorf("failed to read backup manifest %s: %w", key, err)
+		}
+		var info BackupInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("failed to decode backup manifest %s: %w", key, err)
+		}
+		backups = append(backups, &info)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID < backups[j].ID })
+	return backups, nil
+}
+
+// PruneBackups removes the backups under prefix beyond the newest retain,
+// and those taken longer than maxAge before now; zero leaves either
+// unbounded, and the newest backup is always kept. It then removes the
+// shared SSTables no remaining backup has referred to for a day: a backup
+// being taken meanwhile, possibly by another process, may reuse a table
+// before its manifest refers to it.
+func PruneBackups(store ObjectStore, prefix string, retain int, maxAge time.Duration, now time.Time) error {
+	backups, err := ListBackups(store, prefix)
+	if err != nil {
+		return err
+	}
+	var kept []*BackupInfo
+	for i, b := range backups {
+		newest := i == len(backups)-1
+		tooMany := retain > 0 && len(backups)-i > retain
+		tooOld := maxAge > 0 && now.Sub(b.Time) > maxAge
+		if newest || !tooMany && !tooOld {
+			kept = append(kept, b)
+			continue
+		}
+		if err := deleteBackup(store, prefix, b.ID); err != nil {
+			return err
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, b := range kept {
+		for _, f := range b.Files {
+			referenced[f.Key] = true
+		}
+	}
+	tables, err := store.List(prefix + "tables/")
+	if err != nil {
+		return fmt.Errorf("failed to list backed up tables: %w", err)
+	}
+	seen, err := readUnreferencedTables(store, prefix)
+	if err != nil {
+		return err
+	}
+	unreferenced := make(map[string]time.Time)
+	for _, key := range tables {
+		if referenced[key] {
+			continue
+		}
+		since, ok := seen[key]
+		if !ok {
+			since = now.UTC()
+		}
+		if now.Sub(since) < backupTableGracePeriod {
+			unreferenced[key] = since
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete backed up table %s: %w", key, err)
+		}
+	}
+	data, err := json.MarshalIndent(unreferenced, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.Put(prefix+unreferencedTablesName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to record unreferenced tables: %w", err)
+	}
+	return nil
+}
+
+// readUnreferencedTables returns when the last PruneBackups under prefix
+// first found each table it kept unreferenced.
+func readUnreferencedTables(store ObjectStore, prefix string) (map[string]time.Time, error) {
+	key := prefix + unreferencedTablesName
+	size, err := store.Size(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unreferenced tables: %w", err)
+	}
+	data := make([]byte, size)
+	if n, err := store.ReadAt(key, data, 0); err != nil && !(err == io.EOF && n == len(data)) {
+		return nil, fmt.Errorf("failed to read unreferenced tables: %w", err)
+	}
+	var seen map[string]time.Time
+	if err := json.Unmarshal(data, &seen); err != nil {
+		return nil, fmt.Errorf("failed to decode unreferenced tables: %w", err)
+	}
+	return seen, nil
+}
+
+// deleteBackup removes a backup's manifest, so it is no longer listed, and
+// then the rest of its own objects.
+func deleteBackup(store ObjectStore, prefix, id string) error {
+	dir := prefix + "backups/" + id + "/"
+	if err := store.Delete(dir + backupManifestName); err != nil {
+		return fmt.Errorf("failed to delete backup %s: %w", id, err)
+	}
+	keys, err := store.List(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list backup %s: %w", id, err)
+	}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete backup %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// DownloadBackup writes the backup id under prefix in store into dir, which
+// must not exist or must be empty, ready to be opened with Open. A nil fs
+// means the OS filesystem.
+func DownloadBackup(store ObjectStore, prefix, id, dir string, fs FileSystem) error {
+	fs = fsOrDefault(fs)
+	backups, err := ListBackups(store, prefix)
+	if err != nil {
+		return err
+	}
+	var info *BackupInfo
+	for _, b := range backups {
+		if b.ID == id {
+			info = b
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("backup %s: %w", id, ErrNotFound)
+	}
+	if entries, err := fs.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("restore directory %s is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to inspect restore directory: %w", err)
+	}
+	for _, f := range info.Files {
+		dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create restore directory: %w", err)
+		}
+		if err := downloadFile(store, f, fs, dst); err != nil {
+			return fmt.Errorf("failed to download backup file %s: %w", f.Name, err)
+		}
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync restore directory: %w", err)
+	}
+	return nil
+}
+
+func downloadFile(store ObjectStore, f BackupFile, fs FileSystem, dst string) error {
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	src := io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+		return store.ReadAt(f.Key, p, off)
+	}), 0, f.Size)
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
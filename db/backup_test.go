@@ -0,0 +1,159 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrementalBackupsUploadPruneAndRestore(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.DisableAutoCompaction = true
+	store, err := db.Open("backed-up", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	objects := db.NewMemObjectStore()
+	scheduler, err := store.StartBackups(db.BackupOptions{
+		Store:       objects,
+		Prefix:      "prod/",
+		Interval:    time.Hour,
+		Incremental: true,
+		Retain:      2,
+	})
+	require.NoError(t, err)
+	defer scheduler.Close()
+
+	backup := func(round int) *db.BackupInfo {
+		for i := 0; i < 50; i++ {
+			require.NoError(t, store.Put(fmt.Sprintf("round%d-key%02d", round, i), strings.Repeat("x", 100)))
+		}
+		require.NoError(t, store.Flush())
+		info, err := scheduler.BackupNow()
+		require.NoError(t, err)
+		return info
+	}
+
+	first := backup(1)
+	second := backup(2)
+	assert.Equal(t, store.LastSequence(), second.Sequence)
+	// The second backup shares the first's table and uploads only its own.
+	var tableBytes int64
+	for _, f := range second.Files {
+		if strings.HasSuffix(f.Name, ".sst") {
+			assert.True(t, strings.HasPrefix(f.Key, "prod/tables/"))
+			tableBytes += f.Size
+		}
+	}
+	assert.Less(t, second.Uploaded, tableBytes)
+
+	third := backup(3)
+	backups, err := db.ListBackups(objects, "prod/")
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, second.ID, backups[0].ID)
+	assert.Equal(t, third.ID, backups[1].ID)
+	keys, err := objects.List("prod/backups/" + first.ID + "/")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// Pruning by age keeps the newest backup. Tables no backup refers to,
+	// such as one a backup in progress elsewhere has uploaded, are dropped
+	// once they have gone unreferenced for a day.
+	inFlight := "prod/tables/000099-0123.sst"
+	require.NoError(t, objects.Put(inFlight, strings.NewReader("table"), 5))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, db.PruneBackups(objects, "prod/", 0, time.Minute, later))
+	backups, err = db.ListBackups(objects, "prod/")
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	var want []string
+	for _, f := range third.Files {
+		if strings.HasPrefix(f.Key, "prod/tables/") {
+			want = append(want, f.Key)
+		}
+	}
+	tables, err := objects.List("prod/tables/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, append([]string{inFlight}, want...), tables)
+	require.NoError(t, db.PruneBackups(objects, "prod/", 0, time.Minute, later.Add(24*time.Hour)))
+	tables, err = objects.List("prod/tables/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, tables)
+
+	restoreFS := db.NewMemFileSystem()
+	require.NoError(t, db.DownloadBackup(objects, "prod/", third.ID, "restored", restoreFS))
+	ropts := db.DefaultOptions()
+	ropts.FileSystem = restoreFS
+	restored, err := db.Open("restored", ropts)
+	require.NoError(t, err)
+	defer restored.Close()
+	assert.Equal(t, third.Sequence, restored.LastSequence())
+	for round := 1; round <= 3; round++ {
+		got, err := restored.Get(fmt.Sprintf("round%d-key07", round))
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("x", 100), got)
+	}
+}
+
+func TestIncrementalBackupsDoNotShareReusedTableNames(t *testing.T) {
+	objects := db.NewMemObjectStore()
+	backup := func(dir, value string) *db.BackupInfo {
+		opts := db.DefaultOptions()
+		opts.FileSystem = db.NewMemFileSystem()
+		store, err := db.Open(dir, opts)
+		require.NoError(t, err)
+		defer store.Close()
+		for i := 0; i < 50; i++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%02d", i), strings.Repeat(value, 100)))
+		}
+		require.NoError(t, store.Flush())
+		scheduler, err := store.StartBackups(db.BackupOptions{Store: objects, Prefix: "prod/", Incremental: true})
+		require.NoError(t, err)
+		defer scheduler.Close()
+		info, err := scheduler.BackupNow()
+		require.NoError(t, err)
+		return info
+	}
+
+	// The database is restored and written again: its new table takes a
+	// file number, and size, that a backed up table already has.
+	first := backup("original", "a")
+	second := backup("restored", "b")
+	tables := func(info *db.BackupInfo) map[string]db.BackupFile {
+		files := make(map[string]db.BackupFile)
+		for _, f := range info.Files {
+			if strings.HasSuffix(f.Name, ".sst") {
+				files[f.Name] = f
+			}
+		}
+		return files
+	}
+	reused := 0
+	for name, f := range tables(second) {
+		if prev, ok := tables(first)[name]; ok {
+			reused++
+			assert.Equal(t, prev.Size, f.Size)
+			assert.NotEqual(t, prev.Key, f.Key)
+		}
+	}
+	require.NotZero(t, reused)
+
+	restoreFS := db.NewMemFileSystem()
+	require.NoError(t, db.DownloadBackup(objects, "prod/", second.ID, "copy", restoreFS))
+	ropts := db.DefaultOptions()
+	ropts.FileSystem = restoreFS
+	restored, err := db.Open("copy", ropts)
+	require.NoError(t, err)
+	defer restored.Close()
+	got, err := restored.Get("key07")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 100), got)
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keys starting with internalKeyPrefix are reserved for the engine. Column
+// family keys live under cfKeyPrefix as "\x00cf\x00<family>\x00<key>", so
+// every family shares the WAL, memtable, and SSTables of the default one.
+const (
+	internalKeyPrefix = "\x00"
+	cfKeyPrefix       = internalKeyPrefix + "cf\x00"
+
+	// batchRecordKey marks an untyped WAL record whose value is an encoded
+	// batch that must be applied all-or-nothing on replay. Batches are now
+	// typed walBatch records; these are still replayed.
+	batchRecordKey = internalKeyPrefix + "batch"
+)
+
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
+func validateUserKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+	if isInternalKey(key) {
+		return fmt.Errorf("keys starting with 0x00 are reserved")
+	}
+	return nil
+}
+
+// ColumnFamily is a named keyspace inside a DB. Keys in different families
+// never collide, and a WriteBatch may update several families atomically.
+type ColumnFamily struct {
+	db     *DB
+	name   string
+	prefix string
+}
+
+// ColumnFamily returns a handle for the family called name. Families need no
+// creation step; an unused family is simply empty.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, fmt.Errorf("column family name cannot be empty")
+	}
+	if strings.Contains(name, "\x00") {
+		return nil, fmt.Errorf("column family name cannot contain 0x00")
+	}
+	return &ColumnFamily{db: db, name: name, prefix: cfKeyPrefix + name + "\x00"}, nil
+}
+
+// Name returns the family's name.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+func (cf *ColumnFamily) Get(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("failed to get key %s: key cannot be empty", key)
+	}
+	if cf.db.closed.Load() {
+		return "", fmt.Errorf("failed to get key %s from column family %s: %w", key, cf.name, ErrClosed)
+	}
+	cf.db.trace(TraceRecord{Op: TraceGet, Key: cf.prefix + key})
+	value, err := cf.db.getJoined(cf.prefix + key)
+	if errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("failed to get key %s from column family %s: %w", key, cf.name, ErrNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get key %s from column family %s: %w", key, cf.name, err)
+	}
+	return value, nil
+}
+
+func (cf *ColumnFamily) Put(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("failed to put key %s: key cannot be empty", key)
+	}
+	cf.db.trace(TraceRecord{Op: TracePut, Key: cf.prefix + key, Size: int64(len(value))})
+	return cf.db.writeValues([][2]string{{cf.prefix + key, value}}, nil, false)
+}
+
+// WriteBatch collects writes, possibly across column families, that DB.Write
+// commits atomically: after a crash either all of them or none are replayed.
+type WriteBatch struct {
+	kvs     [][2]string
+	deletes map[int]bool // indices of kvs holding tombstones
+	err     error
+}
+
+// Put adds a write to the default keyspace.
+func (b *WriteBatch) Put(key, value string) {
+	if err := validateUserKey(key); err != nil {
+		b.setErr(fmt.Errorf("failed to add key %s to batch: %w", key, err))
+		return
+	}
+	b.kvs = append(b.kvs, [2]string{key, value})
+}
+
+// PutCF adds a write to column family cf.
+func (b *WriteBatch) PutCF(cf *ColumnFamily, key, value string) {
+	if key == "" {
+		b.setErr(fmt.Errorf("failed to add key to batch for column family %s: key cannot be empty", cf.name))
+		return
+	}
+	b.kvs = append(b.kvs, [2]string{cf.prefix + key, value})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.kvs)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.kvs = nil
+	b.deletes = nil
+	b.err = nil
+}
+
+func (b *WriteBatch) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Write commits every write in b as a single WAL record.
+func (db *DB) Write(b *WriteBatch) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.kvs) == 0 {
+		return nil
+	}
+	db.traceBatch(b.kvs, b.deletes)
+	return db.writeValues(b.kvs, b.deletes, true)
+}
+
+func encodeBatch(kvs [][2]string) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(kvs)))
+	for _, kv := range kvs {
+		_ = writeString(&buf, kv[0])
+		_ = writeString(&buf, kv[1])
+	}
+	return buf.Bytes()
+}
+
+func decodeBatch(data []byte) ([][2]string, error) {
+	r := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("failed to read batch count: %w", err)
+	}
+	if int64(count) > int64(len(data)) {
+		return nil, fmt.Errorf("batch count %d exceeds record size", count)
+	}
+
+	kvs := make([][2]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch key %d: %w", i, err)
+		}
+		value, err := readString(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch value %d: %w", i, err)
+		}
+		kvs = append(kvs, [2]string{key, value})
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("batch record has %d trailing bytes", r.Len())
+	}
+	return kvs, nil
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// blockRestartInterval is the number of entries between two restart points.
+const blockRestartInterval = 16
+
+// A block stores sorted key-value entries with shared key prefixes elided:
+//
+//	entry:   [shared uvarint][unshared uvarint][value len uvarint][key suffix][value]
+//	trailer: [restart offset u32]...[restart count u32]
+//
+// shared is the length of the prefix the key has in common with the previous
+// key. Every blockRestartInterval entries a restart point stores its key in
+// full, so lookups binary-search the restart points and then scan forward.
+type blockBuilder struct {
+	buf      bytes.Buffer
+	restarts []uint32
+	counter  int
+	lastKey  string
+	scratch  [binary.MaxVarintLen64]byte
+}
+
+func (b *blockBuilder) add(key string, value []byte) {
+	if b.counter == blockRestartInterval {
+		b.counter = 0
+	}
+	shared := 0
+	if b.counter == 0 {
+		b.restarts = append(b.restarts, uint32(b.buf.Len()))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+
+	b.putUvarint(uint64(shared))
+	b.putUvarint(uint64(len(key) - shared))
+	b.putUvarint(uint64(len(value)))
+	b.buf.WriteString(key[shared:])
+	b.buf.Write(value)
+
+	b.lastKey = key
+	b.counter++
+}
+
+func (b *blockBuilder) putUvarint(v uint64) {
+	n := binary.PutUvarint(b.scratch[:], v)
+	b.buf.Write(b.scratch[:n])
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.buf.Len() == 0
+}
+
+// estimatedSize is the size finish would return.
+func (b *blockBuilder) estimatedSize() int {
+	return b.buf.Len() + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart trailer and returns the block contents. The
+// builder is reset and the returned slice stays valid.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		_ = binary.Write(&b.buf, binary.LittleEndian, r)
+	}
+	_ = binary.Write(&b.buf, binary.LittleEndian, uint32(len(b.restarts)))
+
+	out := append([]byte(nil), b.buf.Bytes()...)
+	b.buf.Reset()
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+	return out
+}
+
+// block reads the contents produced by blockBuilder.finish.
+type block struct {
+	data     []byte // entries only
+	restarts []byte // restart offsets, 4 bytes each
+}
+
+func newBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("block too short")
+	}
+	n := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	if n <= 0 || n > (len(data)-4)/4 {
+		return nil, fmt.Errorf("invalid block restart count %d", n)
+	}
+	restartStart := len(data) - 4 - 4*n
+	b := &block{data: data[:restartStart], restarts: data[restartStart : len(data)-4]}
+	for i := 0; i < n; i++ {
+		if int(b.restart(i)) >= len(b.data) {
+			return nil, fmt.Errorf("block restart point beyond entries")
+		}
+	}
+	return b, nil
+}
+
+func (b *block) numRestarts() int {
+	return len(b.restarts) / 4
+}
+
+func (b *block) restart(i int) uint32 {
+	return binary.LittleEndian.Uint32(b.restarts[4*i:])
+}
+
+// entryAt decodes the entry at off, whose predecessor has key prevKey.
+func (b *block) entryAt(off int, prevKey string) (key string, value []byte, next int, err error) {
+	var hdr [3]uint64
+	pos := off
+	for i := range hdr {
+		v, n := binary.Uvarint(b.data[pos:])
+		if n <= 0 {
+			return "", nil, 0, fmt.Errorf("bad block entry header at %d", off)
+		}
+		hdr[i] = v
+		pos += n
+	}
+	shared, unshared, valueLen := hdr[0], hdr[1], hdr[2]
+	if shared > uint64(len(prevKey)) || unshared+valueLen > uint64(len(b.data)-pos) {
+		return "", nil, 0, fmt.Errorf("bad block entry lengths at %d", off)
+	}
+
+	keyEnd := pos + int(unshared)
+	key = prevKey[:shared] + string(b.data[pos:keyEnd])
+	value = b.data[keyEnd : keyEnd+int(valueLen)]
+	return key, value, keyEnd + int(valueLen), nil
+}
+
+// seek returns the first entry with a key >= target. found is false when
+// every key in the block is smaller.
+func (b *block) seek(target string) (key string, value []byte, found bool, err error) {
+	// Find the last restart point whose key is < target.
+	var keyErr error
+	r := sort.Search(b.numRestarts(), func(i int) bool {
+		k, _, _, err := b.entryAt(int(b.restart(i)), "")
+		if err != nil {
+			keyErr = err
+			return true
+		}
+		return k >= target
+	})
+	if keyErr != nil {
+		return "", nil, false, keyErr
+	}
+	if r > 0 {
+		r--
+	}
+
+	off, prev := int(b.restart(r)), ""
+	for off < len(b.data) {
+		key, value, off, err = b.entryAt(off, prev)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if key >= target {
+			return key, value, true, nil
+		}
+		prev = key
+	}
+	return "", nil, false, nil
+}
+
+// forEach calls fn for every entry in order.
+func (b *block) forEach(fn func(key string, value []byte) error) error {
+	off, prev := 0, ""
+	for off < len(b.data) {
+		key, value, next, err := b.entryAt(off, prev)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+		off, prev = next, key
+	}
+	return nil
+}
+
+func encodeBlockHandle(h blockHandle) []byte {
+	buf := make([]byte, blockHandleSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(h.offset))
+	binary.LittleEndian.PutUint32(buf[8:12], h.length)
+	return buf
+}
+
+func decodeBlockHandle(data []byte) (blockHandle, error) {
+	if len(data) != blockHandleSize {
+		return blockHandle{}, fmt.Errorf("invalid block handle length %d", len(data))
+	}
+	return blockHandle{
+		offset: int64(binary.LittleEndian.Uint64(data[0:8])),
+		length: binary.LittleEndian.Uint32(data[8:12]),
+	}, nil
+}
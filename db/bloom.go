@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"hash/fnv"
 	"math"
 )
@@ -9,9 +10,40 @@ type BloomFilter struct {
 	bitset []byte
 	m      uint
 	k      uint
+	scheme uint32 // how keys are hashed; see bloomHashFNV1a
 }
 
+// Tables record the filter's format version and hash scheme with it, so a
+// new layout or hash function can be introduced while filters written with
+// the old ones are still recognised. bloomFilterVersion is the layout: a
+// bitset of m bits, with k probes per key. bloomHashFNV1a derives probe i
+// of a key from the 64-bit FNV-1a hash of byte i followed by the key.
+const (
+	bloomFilterVersion = uint32(1)
+	bloomHashFNV1a     = uint32(1)
+)
+
+// knownBloomHash reports whether this version can probe filters hashed with
+// scheme.
+func knownBloomHash(scheme uint32) bool {
+	return scheme == bloomHashFNV1a
+}
+
+// maxBloomHashes bounds the hash count a decoded filter may claim; real
+// filters use a handful.
+const maxBloomHashes = 128
+
+// Bounds on the filter settings in Options, which keep the hash count of
+// the filters they produce well below maxBloomHashes.
+const (
+	minBloomFPRate     = 1e-6
+	maxBloomBitsPerKey = 64
+)
+
 func NewBloomFilter(n uint, fpRate float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
 	m := optimalM(n, fpRate)
 	k := optimalK(n, m)
 
@@ -19,9 +51,41 @@ func NewBloomFilter(n uint, fpRate float64) *BloomFilter {
 		bitset: make([]byte, (m+7)/8),
 		m:      m,
 		k:      k,
+		scheme: bloomHashFNV1a,
 	}
 }
 
+// newTableFilter returns an empty filter for n keys given bitsPerKey bits
+// per key when that is positive, and otherwise sized for fpRate, or
+// defaultBloomFPRate when that is zero. It also returns the false-positive
+// rate the filter is expected to have.
+func newTableFilter(n uint, bitsPerKey int, fpRate float64) (*BloomFilter, float64) {
+	if bitsPerKey <= 0 {
+		if fpRate <= 0 {
+			fpRate = defaultBloomFPRate
+		}
+		return NewBloomFilter(n, fpRate), fpRate
+	}
+	if n == 0 {
+		n = 1
+	}
+	m := n * uint(bitsPerKey)
+	k := max(optimalK(n, m), 1)
+	bf := &BloomFilter{bitset: make([]byte, (m+7)/8), m: m, k: k, scheme: bloomHashFNV1a}
+	return bf, math.Pow(1-math.Exp(-float64(k)/float64(bitsPerKey)), float64(k))
+}
+
+// validateBloomOptions checks the filter settings in opts.
+func validateBloomOptions(opts *Options) error {
+	if opts.BloomBitsPerKey < 0 || opts.BloomBitsPerKey > maxBloomBitsPerKey {
+		return fmt.Errorf("invalid BloomBitsPerKey %d: must be between 0 and %d", opts.BloomBitsPerKey, maxBloomBitsPerKey)
+	}
+	if opts.BloomFPRate != 0 && (opts.BloomFPRate < minBloomFPRate || opts.BloomFPRate >= 1) {
+		return fmt.Errorf("invalid BloomFPRate %g: must be zero or between %g and 1", opts.BloomFPRate, minBloomFPRate)
+	}
+	return nil
+}
+
 func (bf *BloomFilter) Add(data string) {
 	for i := uint(0); i < bf.k; i++ {
 		pos := bf.hash(data, i) % bf.m
@@ -39,6 +103,23 @@ func (bf *BloomFilter) MayContain(data string) bool {
 	return true
 }
 
+// MayContainAll probes the filter for every key in one pass, returning
+// MayContain's answer for each key at the same index.
+func (bf *BloomFilter) MayContainAll(keys []string) []bool {
+	out := make([]bool, len(keys))
+	for j, key := range keys {
+		out[j] = true
+		for i := uint(0); i < bf.k; i++ {
+			pos := bf.hash(key, i) % bf.m
+			if (bf.bitset[pos/8] & (1 << (pos % 8))) == 0 {
+				out[j] = false
+				break
+			}
+		}
+	}
+	return out
+}
+
 func (bf *BloomFilter) hash(data string, seed uint) uint {
 	h := fnv.New64a()
 	h.Write([]byte{byte(seed)})
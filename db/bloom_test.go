@@ -0,0 +1,29 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilterMayContainAllMatchesMayContain(t *testing.T) {
+	bf := NewBloomFilter(100, 0.01)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%2 == 0 {
+			bf.Add(key)
+		}
+		keys = append(keys, key)
+	}
+
+	got := bf.MayContainAll(keys)
+	assert.Len(t, got, len(keys))
+	for i, key := range keys {
+		assert.Equal(t, bf.MayContain(key), got[i], key)
+		if i%2 == 0 {
+			assert.True(t, got[i], "added keys are never filtered out")
+		}
+	}
+}
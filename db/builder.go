@@ -0,0 +1,327 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SSTableBuilder writes an SSTable incrementally. Entries are added in
+// strictly increasing key order and written out a data block at a time;
+// only the keys (for the bloom filter, which is sized when the table is
+// finished) and the per-block index stay in memory until Finish.
+type SSTableBuilder struct {
+	sst  *SSTable
+	file File
+	w    *bufio.Writer
+
+	data    blockBuilder
+	offset  int64
+	lastKey string
+	keys    []string
+
+	// trainer holds back records until it has sampled enough values to
+	// train the table's compression dictionary; dict then compresses
+	// every value. Both are nil for tables without a dictionary.
+	trainer *dictTrainer
+	dict    *zstd.Encoder
+
+	err      error
+	finished bool
+}
+
+// NewSSTableBuilder creates the table file at path. Only the Compression,
+// CompressionDictSize, RecordChecksums, bloom filter and FileSystem options
+// are used; a nil opts means DefaultOptions().
+func NewSSTableBuilder(path string, opts *Options) (*SSTableBuilder, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if err := validateBloomOptions(opts); err != nil {
+		return nil, fmt.Errorf("failed to create SSTable: %w", err)
+	}
+	if err := validateDictOptions(opts); err != nil {
+		return nil, fmt.Errorf("failed to create SSTable: %w", err)
+	}
+	return newTableBuilder(&SSTable{
+		path:            path,
+		fs:              opts.FileSystem,
+		compression:     opts.Compression,
+		dictSize:        opts.CompressionDictSize,
+		recordChecksums: opts.RecordChecksums,
+		fpRate:          opts.BloomFPRate,
+		bitsPerKey:      opts.BloomBitsPerKey,
+	})
+}
+
+// newTableBuilder returns a builder writing to s.path with s's compression,
+// filter rate, level and separation settings, throttled by s's rate limiter
+// if it has one.
+func newTableBuilder(s *SSTable) (*SSTableBuilder, error) {
+	file, err := fsOrDefault(s.fs).Create(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSTable: %w", err)
+	}
+	s.index = nil
+	s.blocks = nil
+	s.props = TableProperties{
+		Level:           s.level,
+		CreatedAt:       time.Now(),
+		SeparatedValues: s.separated,
+		RecordChecksums: s.recordChecksums,
+	}
+	var w io.Writer = file
+	if s.limiter != nil {
+		w = limitedWriter{w: file, limiter: s.limiter}
+	}
+	b := &SSTableBuilder{sst: s, file: file, w: bufio.NewWriter(w)}
+	if s.dictSize > 0 && s.compression == ZstdCompression {
+		b.trainer = &dictTrainer{size: s.dictSize}
+	}
+	return b, nil
+}
+
+// Add appends key and value to the table. key must sort after every key
+// added before it.
+func (b *SSTableBuilder) Add(key, value string) error {
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to add key: %w", err)
+	}
+	return b.add(key, value)
+}
+
+// add is Add without the user key check, for tables written by the database.
+func (b *SSTableBuilder) add(key, value string) error {
+	if b.finished {
+		return fmt.Errorf("failed to add key %s: SSTable already finished", key)
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.keys) > 0 && key <= b.lastKey {
+		return fmt.Errorf("failed to add key %s: keys must be added in increasing order", key)
+	}
+
+	if b.trainer == nil {
+		if err := b.write(key, value); err != nil {
+			return err
+		}
+	} else if b.trainer.add(key, value) {
+		if err := b.trainDict(); err != nil {
+			return err
+		}
+	}
+	b.lastKey = key
+	b.keys = append(b.keys, key)
+
+	p := &b.sst.props
+	if len(b.keys) == 1 {
+		p.SmallestKey = key
+	}
+	p.LargestKey = key
+	p.NumEntries++
+	p.RawKeySize += uint64(len(key))
+	p.RawValueSize += uint64(len(value))
+
+	return nil
+}
+
+// write compresses value into the pending data block, writing the block out
+// once it is full.
+func (b *SSTableBuilder) write(key, value string) error {
+	stored, err := compressValue(b.sst.compression, b.dict, value)
+	if err != nil {
+		return fmt.Errorf("failed to compress value: %w", err)
+	}
+	if b.sst.recordChecksums {
+		stored = string(binary.LittleEndian.AppendUint32([]byte(stored), recordChecksum(key, stored)))
+	}
+	b.data.add(key, []byte(stored))
+	if b.data.estimatedSize() >= tableBlockSize {
+		if err := b.flushBlock(); err != nil {
+			b.err = fmt.Errorf("failed to write data block: %w", err)
+			return b.err
+		}
+	}
+	return nil
+}
+
+// trainDict trains the table's dictionary from the values sampled so far and
+// writes the records held back for it. If no dictionary can be trained the
+// table is compressed without one.
+func (b *SSTableBuilder) trainDict() error {
+	t := b.trainer
+	b.trainer = nil
+	if dict := t.train(); dict != nil {
+		enc, err := newDictEncoder(dict)
+		if err != nil {
+			b.err = err
+			return err
+		}
+		b.dict = enc
+		b.sst.props.CompressionDict = dict
+	}
+	for _, kv := range t.pending {
+		if err := b.write(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBlock writes the pending data block and records its index entry: the
+// block's last key and its offset, which is also the offset of its handle
+// in sst.blocks.
+func (b *SSTableBuilder) flushBlock() error {
+	if b.data.empty() {
+		return nil
+	}
+	lastKey := b.data.lastKey
+	contents := b.data.finish()
+	handle := blockHandle{offset: b.offset, length: uint32(len(contents))}
+	b.sst.blocks = append(b.sst.blocks, handle)
+	b.sst.index = append(b.sst.index, indexEntry{key: lastKey, offset: b.offset})
+
+	contents = binary.LittleEndian.AppendUint32(contents, crc32.Checksum(contents, castagnoli))
+	n, err := b.w.Write(contents)
+	b.offset += int64(n)
+	return err
+}
+
+// Finish writes the filter, index, properties and footer and closes the
+// file. The file is not synced.
+func (b *SSTableBuilder) Finish() error {
+	if b.finished {
+		return fmt.Errorf("failed to finish SSTable %s: already finished", b.sst.path)
+	}
+	b.finished = true
+	defer b.file.Close()
+	if b.err != nil {
+		return b.err
+	}
+	s := b.sst
+
+	if b.trainer != nil {
+		if err := b.trainDict(); err != nil {
+			return err
+		}
+	}
+	if b.dict != nil {
+		b.dict.Close()
+	}
+	if err := b.flushBlock(); err != nil {
+		return fmt.Errorf("failed to write data block: %w", err)
+	}
+
+	s.filter, s.props.FilterFPRate = newTableFilter(uint(len(b.keys)), s.bitsPerKey, s.fpRate)
+	s.props.FilterBitsPerKey = s.bitsPerKey
+	for _, key := range b.keys {
+		s.filter.Add(key)
+	}
+	b.keys = nil
+
+	// The sections after the data blocks are built in memory so their
+	// offsets are known without seeking.
+	var meta bytes.Buffer
+	offset := b.offset
+
+	s.props.DataSize = uint64(offset)
+
+	filterOffset := offset
+	if err := writeBytes(&meta, s.filter.bitset); err != nil {
+		return fmt.Errorf("failed to write bloom filter: %w", err)
+	}
+	var m64, k64 uint64 = uint64(s.filter.m), uint64(s.filter.k)
+	if err := binary.Write(&meta, binary.LittleEndian, m64); err != nil {
+		return fmt.Errorf("failed to write bloom filter size: %w", err)
+	}
+	if err := binary.Write(&meta, binary.LittleEndian, k64); err != nil {
+		return fmt.Errorf("failed to write bloom filter hash count: %w", err)
+	}
+	if err := binary.Write(&meta, binary.LittleEndian, [2]uint32{bloomFilterVersion, s.filter.scheme}); err != nil {
+		return fmt.Errorf("failed to write bloom filter format: %w", err)
+	}
+
+	// Index partitions use the same prefix-compressed block layout as the
+	// data, mapping each data block's last key to its handle.
+	indexOffset := offset + int64(meta.Len())
+	s.partitions = nil
+	var partition blockBuilder
+	for i, entry := range s.index {
+		partition.add(entry.key, encodeBlockHandle(s.blocks[i]))
+		if partition.estimatedSize() >= tableBlockSize || i == len(s.index)-1 {
+			start := meta.Len()
+			meta.Write(partition.finish())
+			s.partitions = append(s.partitions, indexPartition{
+				lastKey: entry.key,
+				offset:  offset + int64(start),
+				length:  uint32(meta.Len() - start),
+			})
+		}
+	}
+
+	topOffset := offset + int64(meta.Len())
+	for _, p := range s.partitions {
+		if err := writeString(&meta, p.lastKey); err != nil {
+			return fmt.Errorf("failed to write index partition key: %w", err)
+		}
+		if err := binary.Write(&meta, binary.LittleEndian, p.offset); err != nil {
+			return fmt.Errorf("failed to write index partition offset: %w", err)
+		}
+		if err := binary.Write(&meta, binary.LittleEndian, p.length); err != nil {
+			return fmt.Errorf("failed to write index partition length: %w", err)
+		}
+	}
+
+	blocksOffset := offset + int64(meta.Len())
+	for _, h := range s.blocks {
+		meta.Write(encodeBlockHandle(h))
+	}
+
+	// meta so far holds everything from the filter to the properties.
+	metaChecksum := crc32.Checksum(meta.Bytes(), castagnoli)
+	propsOffset := offset + int64(meta.Len())
+	meta.Write(s.props.encode())
+
+	footer := tableFooter{
+		indexOffset:  indexOffset,
+		filterOffset: filterOffset,
+		blocksOffset: blocksOffset,
+		propsOffset:  propsOffset,
+		topOffset:    topOffset,
+		metaChecksum: metaChecksum,
+		compression:  s.compression,
+	}
+	meta.Write(footer.encode())
+
+	if _, err := b.w.Write(meta.Bytes()); err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	if err := b.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write SSTable: %w", err)
+	}
+	if err := b.file.Close(); err != nil {
+		return fmt.Errorf("failed to close SSTable: %w", err)
+	}
+
+	s.format = tableFormatVersion
+	return nil
+}
+
+// Abandon closes and removes an unfinished table.
+func (b *SSTableBuilder) Abandon() {
+	if !b.finished {
+		b.finished = true
+		b.file.Close()
+		if b.dict != nil {
+			b.dict.Close()
+		}
+	}
+	fsOrDefault(b.sst.fs).Remove(b.sst.path)
+}
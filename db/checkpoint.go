@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint writes a consistent copy of the database into dir, which must not
+// exist or must be empty. Live SSTables and value log files are hard-linked
+// when dir is on the same filesystem and copied otherwise, the memtables not
+// yet flushed are written out as the checkpoint's WAL, and a MANIFEST describing the level
+// layout is recorded. The result can be opened with Open or archived as a
+// backup.
+func (db *DB) Checkpoint(dir string) error {
+	return db.CheckpointWithOptions(dir, nil)
+}
+
+// CheckpointOptions configures CheckpointWithOptions.
+type CheckpointOptions struct {
+	// IncludeArchivedWALs also links or copies the WALs in the archive,
+	// kept with Options.ArchiveWALs, into the checkpoint's own archive, so
+	// the checkpoint can serve as the source of a point-in-time restore.
+	IncludeArchivedWALs bool
+}
+
+// CheckpointWithOptions is Checkpoint with options; nil opts behaves like
+// Checkpoint.
+func (db *DB) CheckpointWithOptions(dir string, opts *CheckpointOptions) error {
+	_, err := db.checkpoint(dir, opts)
+	return err
+}
+
+// checkpoint writes the checkpoint and returns the sequence number it is
+// at.
+func (db *DB) checkpoint(dir string, opts *CheckpointOptions) (uint64, error) {
+	if opts == nil {
+		opts = &CheckpointOptions{}
+	}
+	if db.closed.Load() {
+		return 0, fmt.Errorf("failed to create checkpoint: %w", ErrClosed)
+	}
+	if entries, err := db.fs.ReadDir(dir); err == nil && len(entries) > 0 {
+		return 0, fmt.Errorf("checkpoint directory %s is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to inspect checkpoint directory: %w", err)
+	}
+	if err := db.fs.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+
+	// Block writers and flushes so the tables and memtable agree.
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, level := range db.levels {
+		for _, sst := range level {
+			dst := filepath.Join(dir, filepath.Base(sst.path))
+			if err := linkOrCopy(db.fs, sst.path, dst); err != nil {
+				return 0, fmt.Errorf("failed to checkpoint SSTable %s: %w", sst.path, err)
+			}
+		}
+	}
+
+	for _, path := range db.vlog.paths() {
+		dst := filepath.Join(dir, filepath.Base(path))
+		if err := linkOrCopy(db.fs, path, dst); err != nil {
+			return 0, fmt.Errorf("failed to checkpoint value log %s: %w", path, err)
+		}
+	}
+
+	if opts.IncludeArchivedWALs {
+		if err := db.checkpointArchive(dir); err != nil {
+			return 0, err
+		}
+	}
+
+	// The WAL ends with a checkpoint record, so the copy continues from the
+	// sequence number the database is at, with or without a memtable.
+	wal, err := openWAL(db.fs, filepath.Join(dir, walFileName(db.newFileNumber())))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create checkpoint WAL: %w", err)
+	}
+	if entries := db.memEntries(); len(entries) > 0 {
+		if err := wal.AppendBatch(entries); err != nil {
+			wal.Close()
+			return 0, fmt.Errorf("failed to write checkpoint WAL: %w", err)
+		}
+	}
+	if err := wal.appendCheckpoint(db.seq); err != nil {
+		wal.Close()
+		return 0, err
+	}
+	if err := wal.sync(); err != nil {
+		wal.Close()
+		return 0, fmt.Errorf("failed to sync checkpoint WAL: %w", err)
+	}
+	if err := wal.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close checkpoint WAL: %w", err)
+	}
+
+	if err := writeManifestSnapshot(db.fs, dir, db.levels, db.compactPointers, db.newFileNumber(), db.logNumber, db.seq); err != nil {
+		return 0, fmt.Errorf("failed to write checkpoint manifest: %w", err)
+	}
+	return db.seq, nil
+}
+
+// checkpointArchive links or copies the archived WALs into dir's archive.
+// The caller holds db.mu, which keeps flushes from adding to or trimming
+// the archive meanwhile.
+func (db *DB) checkpointArchive(dir string) error {
+	wals, err := archivedWALs(db.fs, db.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list archived WALs: %w", err)
+	}
+	if len(wals) == 0 {
+		return nil
+	}
+	archive := walArchiveDir(dir)
+	if err := db.fs.MkdirAll(archive, 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint WAL archive: %w", err)
+	}
+	for _, path := range wals {
+		if err := linkOrCopy(db.fs, path, filepath.Join(archive, filepath.Base(path))); err != nil {
+			return fmt.Errorf("failed to checkpoint archived WAL %s: %w", path, err)
+		}
+	}
+	if err := db.fs.SyncDir(archive); err != nil {
+		return fmt.Errorf("failed to sync checkpoint WAL archive: %w", err)
+	}
+	return nil
+}
+
+func linkOrCopy(fs FileSystem, src, dst string) error {
+	if err := fs.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(fs, src, dst)
+}
+
+// copyFile copies src to dst and syncs the copy.
+func copyFile(fs FileSystem, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
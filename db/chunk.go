@@ -0,0 +1,279 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// A value longer than Options.ValueChunkSize is written as chunks under the
+// internal keys "\x00chunk\x00<id>\x00<index>", one write each, and its key
+// then holds a chunked value record: chunkedValueMagic followed by the id,
+// the chunk size, the chunk count and the total size. Every chunked write
+// draws a fresh id, so a crash part way through leaves only chunks nothing
+// names and the key keeps its previous value. A value that itself starts
+// with chunkedValueMagic is always written as chunks, so a stored value of
+// the record's length with that prefix is always a record.
+const (
+	chunkKeyPrefix    = internalKeyPrefix + "chunk\x00"
+	chunkedValueMagic = "\x00chunked\x00"
+	chunkIDLen        = 16 // hex digits
+	chunkedValueLen   = len(chunkedValueMagic) + chunkIDLen + 16
+)
+
+// chunkedValue is a decoded chunked value record. Every chunk holds
+// chunkSize bytes but the last, which holds the rest.
+type chunkedValue struct {
+	id        string
+	chunkSize int
+	count     int
+	size      int64
+}
+
+func (c chunkedValue) encode() string {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(c.chunkSize))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(c.count))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(c.size))
+	return chunkedValueMagic + c.id + string(buf)
+}
+
+// decodeChunkedValue decodes value as a chunked value record, reporting
+// false if it is an ordinary value.
+func decodeChunkedValue(value string) (chunkedValue, bool) {
+	if len(value) != chunkedValueLen || !strings.HasPrefix(value, chunkedValueMagic) {
+		return chunkedValue{}, false
+	}
+	rest := value[len(chunkedValueMagic):]
+	b := []byte(rest[chunkIDLen:])
+	c := chunkedValue{
+		id:        rest[:chunkIDLen],
+		chunkSize: int(binary.LittleEndian.Uint32(b[0:4])),
+		count:     int(binary.LittleEndian.Uint32(b[4:8])),
+		size:      int64(binary.LittleEndian.Uint64(b[8:16])),
+	}
+	if c.chunkSize <= 0 {
+		return chunkedValue{}, false
+	}
+	if c.count == 0 {
+		return c, c.size == 0
+	}
+	full := int64(c.chunkSize) * int64(c.count)
+	return c, c.size > full-int64(c.chunkSize) && c.size <= full
+}
+
+// chunkLen returns the length of chunk i.
+func (c chunkedValue) chunkLen(i int) int {
+	if i < c.count-1 {
+		return c.chunkSize
+	}
+	return int(c.size - int64(c.chunkSize)*int64(c.count-1))
+}
+
+func chunkKey(id string, i int) string {
+	return fmt.Sprintf("%s%s\x00%08x", chunkKeyPrefix, id, i)
+}
+
+func newChunkID() (string, error) {
+	buf := make([]byte, chunkIDLen/2)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate chunk id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// needsChunks reports whether value must be written as chunks.
+func (db *DB) needsChunks(value string) bool {
+	size := db.opts.ValueChunkSize
+	return size > 0 && len(value) > size || strings.HasPrefix(value, chunkedValueMagic)
+}
+
+// writeValues is write for user writes: the values that need it are written
+// as chunks first and replaced in kvs by their records. The entries deletes
+// names hold tombstones, which are written as they are.
+func (db *DB) writeValues(kvs [][2]string, deletes map[int]bool, atomic bool) error {
+	out := kvs
+	for i, kv := range kvs {
+		if deletes[i] || !db.needsChunks(kv[1]) {
+			continue
+		}
+		if len(out) > 0 && &out[0] == &kvs[0] {
+			// Copied so the caller's batch keeps its values.
+			out = append([][2]string(nil), kvs...)
+		}
+		record, err := db.chunkValue(kv[1])
+		if err != nil {
+			return fmt.Errorf("failed to write chunks of %s: %w", kv[0], err)
+		}
+		out[i][1] = record
+	}
+	return db.replaceValues(out, atomic)
+}
+
+// chunkValue writes value as chunks of Options.ValueChunkSize bytes, or as
+// one chunk when chunking is off, and returns the chunked value record
+// naming them.
+func (db *DB) chunkValue(value string) (string, error) {
+	size := db.opts.ValueChunkSize
+	if size <= 0 {
+		size = len(value)
+	}
+	return db.writeChunks(strings.NewReader(value), size)
+}
+
+// writeChunks writes what r holds as chunks of size bytes and returns the
+// chunked value record naming them.
+func (db *DB) writeChunks(r io.Reader, size int) (string, error) {
+	id, err := newChunkID()
+	if err != nil {
+		return "", err
+	}
+	c := chunkedValue{id: id, chunkSize: size}
+	buf := make([]byte, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := db.write([][2]string{{chunkKey(id, c.count), string(buf[:n])}}, false); err != nil {
+				return "", err
+			}
+			c.count++
+			c.size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return c.encode(), nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read value: %w", err)
+		}
+	}
+}
+
+// replaceValues writes kvs and then, when chunking is enabled, empties the
+// chunks of the chunked values they replaced. A reclaimed chunk is emptied
+// rather than deleted: a read racing the reclaim then finds a chunk of the
+// wrong length, where a tombstone could pass for a chunk holding its bytes.
+func (db *DB) replaceValues(kvs [][2]string, atomic bool) error {
+	var replaced []chunkedValue
+	if db.opts.ValueChunkSize > 0 {
+		for _, kv := range kvs {
+			if prev, err := db.get(kv[0]); err == nil {
+				if c, ok := decodeChunkedValue(prev); ok {
+					replaced = append(replaced, c)
+				}
+			}
+		}
+	}
+	if err := db.write(kvs, atomic); err != nil {
+		return err
+	}
+
+	for _, c := range replaced {
+		db.reclaimChunks(c)
+	}
+	return nil
+}
+
+// reclaimChunks empties the chunks of c, a chunked value that has been
+// replaced.
+func (db *DB) reclaimChunks(c chunkedValue) {
+	if c.count == 0 {
+		return
+	}
+	empty := make([][2]string, c.count)
+	for i := range empty {
+		empty[i][0] = chunkKey(c.id, i)
+	}
+	if err := db.write(empty, false); err != nil {
+		log.Printf("Warning: failed to reclaim chunks %s: %v", c.id, err)
+	}
+}
+
+// getJoined is get for user reads, joining a chunked value's chunks and
+// reporting a deleted key as not found. A writer replacing the value may
+// reclaim the chunks while they are read, which shows as a missing chunk;
+// the read then starts over with the value that replaced it.
+func (db *DB) getJoined(key string) (string, error) {
+	value, err := db.get(key)
+	for err == nil {
+		if isDeleted(key, value) {
+			return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+		}
+		c, ok := decodeChunkedValue(value)
+		if !ok {
+			return value, nil
+		}
+		joined, joinErr := joinChunks(c, db.get)
+		if joinErr == nil {
+			return joined, nil
+		}
+		if !errors.Is(joinErr, ErrCorruption) {
+			return "", fmt.Errorf("failed to get key %s: %w", key, joinErr)
+		}
+		var current string
+		if current, err = db.get(key); err == nil && current == value {
+			return "", fmt.Errorf("failed to get key %s: %w", key, joinErr)
+		}
+		value = current
+	}
+	return "", err
+}
+
+// joinChunks returns the value c's chunks hold, reading them with get.
+func joinChunks(c chunkedValue, get func(string) (string, error)) (string, error) {
+	var b strings.Builder
+	b.Grow(int(c.size))
+	for i := 0; i < c.count; i++ {
+		chunk, err := readChunk(c, i, get)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(chunk)
+	}
+	return b.String(), nil
+}
+
+// readChunk reads chunk i of c with get, reporting a chunk that is missing
+// or of the wrong length as corruption.
+func readChunk(c chunkedValue, i int, get func(string) (string, error)) (string, error) {
+	chunk, err := get(chunkKey(c.id, i))
+	if errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("%w: chunk %d of %s is missing", ErrCorruption, i, c.id)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(chunk) != c.chunkLen(i) {
+		return "", fmt.Errorf("%w: chunk %d of %s has %d bytes, want %d", ErrCorruption, i, c.id, len(chunk), c.chunkLen(i))
+	}
+	return chunk, nil
+}
+
+// chunkReader reads a chunked value a chunk at a time.
+type chunkReader struct {
+	c    chunkedValue
+	get  func(string) (string, error)
+	next int
+	buf  string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for r.buf == "" {
+		if r.next == r.c.count {
+			return 0, io.EOF
+		}
+		chunk, err := readChunk(r.c, r.next, r.get)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
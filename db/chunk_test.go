@@ -0,0 +1,114 @@
+package db_test
+
+import (
+	"io"
+	"mini-leveldb/db"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedValues(t *testing.T) {
+	dir := "testdata/chunked"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueChunkSize = 1000
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+
+	large := strings.Repeat("0123456789", 2550)
+	streamed := strings.Repeat("abcdefghij", 3000)
+	require.NoError(t, store.Put("a-large", large))
+	require.NoError(t, store.PutReader("b-streamed", strings.NewReader(streamed)))
+	require.NoError(t, store.Put("c-small", "small"))
+
+	check := func() {
+		t.Helper()
+		for key, want := range map[string]string{"a-large": large, "b-streamed": streamed, "c-small": "small"} {
+			got, err := store.Get(key)
+			require.NoError(t, err)
+			assert.Equal(t, want, got, key)
+
+			r, err := store.GetReader(key)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, want, string(data), key)
+		}
+
+		results := store.MultiGet([]string{"b-streamed", "a-large"})
+		require.NoError(t, results[0].Error)
+		require.NoError(t, results[1].Error)
+		assert.Equal(t, streamed, results[0].Value)
+		assert.Equal(t, large, results[1].Value)
+
+		snap := store.GetSnapshot()
+		got, err := snap.Get("a-large")
+		snap.Release()
+		require.NoError(t, err)
+		assert.Equal(t, large, got)
+
+		it := store.NewIterator()
+		var keys []string
+		for it.First(); it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+			if it.Key() == "b-streamed" {
+				assert.Equal(t, streamed, it.Value())
+			}
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		assert.Equal(t, []string{"a-large", "b-streamed", "c-small"}, keys)
+	}
+
+	check()
+	require.NoError(t, store.Flush())
+	check()
+	require.NoError(t, store.Close())
+
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+	check()
+
+	// Replacing a chunked value, with a small one or with new chunks,
+	// leaves the key reading the new value.
+	require.NoError(t, store.Put("a-large", "now small"))
+	got, err := store.Get("a-large")
+	require.NoError(t, err)
+	assert.Equal(t, "now small", got)
+
+	again := strings.Repeat("z", 4321)
+	require.NoError(t, store.Put("b-streamed", again))
+	got, err = store.Get("b-streamed")
+	require.NoError(t, err)
+	assert.Equal(t, again, got)
+}
+
+func TestValueLookingLikeChunkRecordRoundTrips(t *testing.T) {
+	dir := "testdata/chunk-magic"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	store, err := db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Starts like a chunked value record and is as long as one.
+	value := "\x00chunked\x00" + strings.Repeat("0", 32)
+	require.NoError(t, store.Put("key", value))
+	require.NoError(t, store.Flush())
+	got, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, value, got)
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+)
+
+// writeRequest is one caller's pending write waiting in the commit queue.
+type writeRequest struct {
+	kvs [][2]string
+	// atomic requests are logged as one batch so that replay applies all of
+	// kvs or none of them.
+	atomic bool
+	// ranges are the [start, end) key ranges a DeleteRange removes. They are
+	// logged as they are, and kvs is set to the tombstones they expand to.
+	ranges [][2]string
+	// update is a read-modify-write of one key, which kvs is set to the
+	// result of.
+	update *update
+	err    error
+	done   chan struct{}
+}
+
+// groupCommitter coalesces concurrent writes into shared WAL appends. The
+// first writer to arrive while no commit is running becomes the leader: it
+// repeatedly drains the queue, appends every queued write to the WAL with a
+// single fsync, applies them to the memtable, and wakes their callers, until
+// the queue is empty. Writers arriving in the meantime simply wait.
+//
+// logMu is held for the whole of a group's WAL append and memtable apply, and
+// by anything that replaces the WAL (Flush, Close). It is always acquired
+// before db.mu.
+type groupCommitter struct {
+	logMu sync.Mutex
+
+	mu     sync.Mutex
+	queue  []*writeRequest
+	active bool
+}
+
+// write commits kvs through the group committer and returns once they are
+// written to the WAL (and synced, unless Options.WALSyncInterval leaves
+// that to the background) and visible to readers. Writes are throttled first
+// while L0 or the memtable is over its limits.
+func (db *DB) write(kvs [][2]string, atomic bool) error {
+	return db.submit(&writeRequest{kvs: kvs, atomic: atomic})
+}
+
+// submit is write for a request built by the caller.
+func (db *DB) submit(req *writeRequest) error {
+	if db.closed.Load() {
+		return fmt.Errorf("failed to write: %w", ErrClosed)
+	}
+	if err := db.throttleWrite(); err != nil {
+		return err
+	}
+
+	gc := &db.committer
+	req.done = make(chan struct{})
+
+	gc.mu.Lock()
+	gc.queue = append(gc.queue, req)
+	if gc.active {
+		gc.mu.Unlock()
+		<-req.done
+		return req.err
+	}
+	gc.active = true
+	gc.mu.Unlock()
+
+	for {
+		gc.mu.Lock()
+		group := gc.queue
+		gc.queue = nil
+		if len(group) == 0 {
+			gc.active = false
+			gc.mu.Unlock()
+			break
+		}
+		gc.mu.Unlock()
+
+		db.commitGroup(group)
+	}
+
+	return req.err
+}
+
+func (db *DB) commitGroup(group []*writeRequest) {
+	gc := &db.committer
+	gc.logMu.Lock()
+	defer gc.logMu.Unlock()
+
+	if err := db.resolveGroup(group); err != nil {
+		for _, req := range group {
+			req.err = fmt.Errorf("failed to expand range delete: %w", err)
+			close(req.done)
+		}
+		return
+	}
+
+	var all [][2]string
+	if len(group) == 1 {
+		all = group[0].kvs
+	} else {
+		for _, req := range group {
+			all = append(all, req.kvs...)
+		}
+	}
+
+	synced := db.syncWALEveryWrite()
+	var err error
+	if db.opts.WALPerColumnFamily {
+		err = db.appendFamilyGroup(group, synced)
+	} else {
+		err = db.wal.appendGroup(group, synced, db.seq)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to append to WAL: %w", err)
+	} else {
+		db.mu.Lock()
+		for i, kv := range all {
+			db.memTable.put(kv[0], kv[1], db.seq+uint64(i)+1)
+		}
+		db.commit(all)
+		if synced {
+			db.durableSeq.Store(db.seq)
+		}
+		db.mu.Unlock()
+		db.waitForSubscribers()
+	}
+
+	for _, req := range group {
+		if req.err == nil {
+			req.err = err
+		}
+		close(req.done)
+	}
+}
+
+// resolveGroup works out, in queue order, the writes of the requests in
+// group that depend on what the database holds: range deletes and
+// read-modify-writes. A read-modify-write that cannot be applied fails on
+// its own; a range delete that cannot be expanded fails the group.
+func (db *DB) resolveGroup(group []*writeRequest) error {
+	for i, req := range group {
+		switch {
+		case len(req.ranges) > 0:
+			if err := db.expandRanges(group[:i], req); err != nil {
+				return err
+			}
+		case req.update != nil:
+			req.err = db.resolveUpdate(group[:i], req)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionDropsTombstonesAtTheBottom(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FileSystem = NewMemFileSystem()
+	opts.DisableAutoCompaction = true
+	db, err := Open("tombstones", opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	entries := func(level int) uint64 {
+		var n uint64
+		for _, sst := range db.levels[level] {
+			n += sst.props.NumEntries
+		}
+		return n
+	}
+	compact := func(level int) {
+		db.compactMu.Lock()
+		defer db.compactMu.Unlock()
+		require.NoError(t, db.compactLevel(level))
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Put(key, "value"))
+	}
+	require.NoError(t, db.Flush())
+	compact(0)
+	compact(1)
+	require.Equal(t, uint64(3), entries(2))
+
+	// L2 still holds b, so the tombstone moving into L1 must stay.
+	require.NoError(t, db.Delete("b"))
+	require.NoError(t, db.Flush())
+	compact(0)
+	assert.Equal(t, uint64(1), entries(1))
+	_, err = db.Get("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Merged into the bottom, it has nothing left to shadow.
+	compact(1)
+	assert.Empty(t, db.levels[1])
+	assert.Equal(t, uint64(2), entries(2))
+	_, err = db.Get("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCompactionPicksLeastOverlapAndRoundRobins(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FileSystem = NewMemFileSystem()
+	opts.DisableAutoCompaction = true
+	db, err := Open("pick", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	compact := func(level int) {
+		db.compactMu.Lock()
+		defer db.compactMu.Unlock()
+		require.NoError(t, db.compactLevel(level))
+	}
+	flushKeys := func(keys ...string) {
+		for _, key := range keys {
+			require.NoError(t, db.Put(key, "value"))
+		}
+		require.NoError(t, db.Flush())
+		compact(0)
+	}
+	smallestKeys := func(level int) []string {
+		var keys []string
+		for _, sst := range db.levels[level] {
+			keys = append(keys, sst.props.SmallestKey)
+		}
+		return keys
+	}
+
+	flushKeys("m1", "m9")
+	compact(1)
+	// L1 holds three tables, of which only m5 overlaps L2.
+	flushKeys("a")
+	flushKeys("z")
+	flushKeys("m5")
+	require.Equal(t, []string{"a", "m5", "z"}, smallestKeys(1))
+
+	// The last compaction out of L1 ended at m9, so of a and z, which
+	// overlap nothing, z comes next.
+	compact(1)
+	assert.Equal(t, []string{"a", "m5"}, smallestKeys(1))
+
+	// The pointer survives a reopen and wraps round to a.
+	require.NoError(t, db.Close())
+	db, err = Open("pick", opts)
+	require.NoError(t, err)
+	assert.Equal(t, "z", db.compactPointers[1])
+	compact(1)
+	assert.Equal(t, []string{"m5"}, smallestKeys(1))
+	assert.Equal(t, "a", db.compactPointers[1])
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"math"
+	"sort"
+)
+
+// pickCompactionInput returns the table of level, L1 or deeper, to compact
+// into the next level: the one whose overlap with the next level is the
+// smallest for its size, so each compaction rewrites as little of the next
+// level as it can for the bytes it moves down. Ties go to the first table
+// after the level's compaction pointer, so tables that overlap nothing, as
+// after a sequential load, are taken in turn round the key space rather
+// than always from its start. db.mu must be held.
+func (db *DB) pickCompactionInput(level int) *SSTable {
+	files := db.levels[level]
+	if len(files) == 0 {
+		return nil
+	}
+	pointer := db.compactPointers[level]
+	first := sort.Search(len(files), func(i int) bool {
+		return files[i].props.SmallestKey > pointer
+	})
+
+	var picked *SSTable
+	best := math.Inf(1)
+	for i := range files {
+		sst := files[(first+i)%len(files)]
+		var overlap int64
+		for _, next := range db.levels[level+1] {
+			if next.overlaps(sst.props.SmallestKey, sst.props.LargestKey) {
+				overlap += next.size
+			}
+		}
+		if ratio := float64(overlap) / float64(max(sst.size, 1)); ratio < best {
+			picked, best = sst, ratio
+		}
+	}
+	return picked
+}
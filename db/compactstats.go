@@ -0,0 +1,74 @@
+package db
+
+import "time"
+
+// LevelCompactionStats totals the work done writing tables into one level
+// since the database was opened.
+type LevelCompactionStats struct {
+	Level        int
+	Compactions  int
+	BytesRead    int64 // table bytes merged, from both input levels
+	BytesWritten int64
+	FilesRead    int
+	FilesWritten int
+	Duration     time.Duration
+}
+
+// CompactionStats is a snapshot of the flush and compaction counters.
+type CompactionStats struct {
+	// Flushes counts memtable flushes into L0, which read no tables.
+	Flushes LevelCompactionStats
+	// Levels counts the compactions writing into each level. Only
+	// universal compaction writes into L0.
+	Levels []LevelCompactionStats
+}
+
+// WriteAmplification returns the bytes written by flushes and compactions
+// divided by the bytes flushed, or zero before the first flush.
+func (s CompactionStats) WriteAmplification() float64 {
+	if s.Flushes.BytesWritten == 0 {
+		return 0
+	}
+	total := s.Flushes.BytesWritten
+	for _, l := range s.Levels {
+		total += l.BytesWritten
+	}
+	return float64(total) / float64(s.Flushes.BytesWritten)
+}
+
+// CompactionStats returns the flush and compaction work done per level
+// since the database was opened.
+func (db *DB) CompactionStats() CompactionStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	levels := append([]LevelCompactionStats(nil), db.compactionStats...)
+	for i := range levels {
+		levels[i].Level = i
+	}
+	return CompactionStats{Flushes: db.flushStats, Levels: levels}
+}
+
+// recordFlush adds a flush that wrote sst. db.mu must be held for writing.
+func (db *DB) recordFlush(sst *SSTable, elapsed time.Duration) {
+	db.flushStats.add(nil, []*SSTable{sst}, elapsed)
+}
+
+// recordCompaction adds a compaction that read inputs and wrote outputs
+// into level. db.mu must be held for writing.
+func (db *DB) recordCompaction(level int, inputs, outputs []*SSTable, elapsed time.Duration) {
+	db.compactionStats[level].add(inputs, outputs, elapsed)
+}
+
+func (s *LevelCompactionStats) add(inputs, outputs []*SSTable, elapsed time.Duration) {
+	s.Compactions++
+	s.FilesRead += len(inputs)
+	for _, sst := range inputs {
+		s.BytesRead += sst.size
+	}
+	s.FilesWritten += len(outputs)
+	for _, sst := range outputs {
+		s.BytesWritten += sst.size
+	}
+	s.Duration += elapsed
+}
@@ -0,0 +1,71 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionStats(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("stats", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// The fourth flush makes L0 due for compaction into L1.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+
+	stats := store.CompactionStats()
+	require.Len(t, stats.Levels, 7)
+	l0, l1 := stats.Flushes, stats.Levels[1]
+	assert.Equal(t, 4, l0.Compactions)
+	assert.Equal(t, 4, l0.FilesWritten)
+	assert.Zero(t, l0.BytesRead)
+	assert.Positive(t, l0.BytesWritten)
+	assert.Zero(t, stats.Levels[0].Compactions)
+
+	assert.Equal(t, 1, l1.Level)
+	assert.Equal(t, 1, l1.Compactions)
+	assert.Equal(t, 4, l1.FilesRead)
+	assert.Equal(t, 1, l1.FilesWritten)
+	assert.Equal(t, l0.BytesWritten, l1.BytesRead)
+	assert.Positive(t, l1.BytesWritten)
+	assert.Positive(t, l1.Duration)
+
+	assert.InDelta(t, float64(l0.BytesWritten+l1.BytesWritten)/float64(l0.BytesWritten), stats.WriteAmplification(), 1e-9)
+}
+
+func TestLifetimeStatsSurviveReopen(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("lifetime", opts)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Put("b", "2"))
+	require.NoError(t, store.Flush())
+	first := store.LifetimeStats()
+	assert.Equal(t, int64(2), first.Writes)
+	assert.Equal(t, int64(1), first.Flushes)
+	assert.Positive(t, first.BytesFlushed)
+	require.NoError(t, store.Close())
+
+	store, err = db.Open("lifetime", opts)
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, first, store.LifetimeStats())
+	assert.Zero(t, store.CompactionStats().Flushes.Compactions, "session counters start over")
+
+	require.NoError(t, store.Put("c", "3"))
+	require.NoError(t, store.Flush())
+	second := store.LifetimeStats()
+	assert.Equal(t, int64(3), second.Writes)
+	assert.Equal(t, int64(2), second.Flushes)
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType selects how SSTable values are compressed. The type is
+// recorded in each table's footer, so tables written with different settings
+// can be read side by side.
+type CompressionType uint32
+
+const (
+	NoCompression CompressionType = iota
+	SnappyCompression
+	ZstdCompression
+)
+
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(c))
+	}
+}
+
+// ParseCompressionType parses the names returned by CompressionType.String.
+func ParseCompressionType(name string) (CompressionType, error) {
+	switch name {
+	case "none", "":
+		return NoCompression, nil
+	case "snappy":
+		return SnappyCompression, nil
+	case "zstd":
+		return ZstdCompression, nil
+	default:
+		return 0, fmt.Errorf("unknown compression type %q", name)
+	}
+}
+
+// In compressed tables every stored value starts with one of these flags, so
+// values that don't shrink are kept raw. valueDictCompressed values were
+// compressed against the table's dictionary; see dict.go.
+const (
+	valueRaw            byte = 0
+	valueCompressed     byte = 1
+	valueDictCompressed byte = 2
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// compressValue encodes value for a table using codec c, or dict if the
+// table has a dictionary.
+func compressValue(c CompressionType, dict *zstd.Encoder, value string) (string, error) {
+	if c == NoCompression {
+		return value, nil
+	}
+
+	flag := valueCompressed
+	var compressed []byte
+	switch {
+	case dict != nil:
+		flag = valueDictCompressed
+		compressed = dict.EncodeAll([]byte(value), nil)
+	case c == SnappyCompression:
+		compressed = snappy.Encode(nil, []byte(value))
+	case c == ZstdCompression:
+		compressed = zstdEncoder.EncodeAll([]byte(value), nil)
+	default:
+		return "", fmt.Errorf("unsupported compression type %s", c)
+	}
+
+	if len(compressed) >= len(value) {
+		return string(valueRaw) + value, nil
+	}
+	return string(flag) + string(compressed), nil
+}
+
+// decompressValue reverses compressValue. dict decodes the values of tables
+// with a dictionary and is nil for the rest.
+func decompressValue(c CompressionType, dict *zstd.Decoder, stored string) (string, error) {
+	if c == NoCompression {
+		return stored, nil
+	}
+	if stored == "" {
+		return "", fmt.Errorf("compressed value is missing its flag byte")
+	}
+
+	flag, payload := stored[0], stored[1:]
+	if flag == valueRaw {
+		return payload, nil
+	}
+	if flag == valueDictCompressed {
+		if dict == nil {
+			return "", fmt.Errorf("value is compressed with a dictionary the table does not have")
+		}
+		out, err := dict.DecodeAll([]byte(payload), nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode zstd value with dictionary: %w", err)
+		}
+		return string(out), nil
+	}
+	if flag != valueCompressed {
+		return "", fmt.Errorf("invalid compressed value flag %d", flag)
+	}
+
+	switch c {
+	case SnappyCompression:
+		out, err := snappy.Decode(nil, []byte(payload))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode snappy value: %w", err)
+		}
+		return string(out), nil
+	case ZstdCompression:
+		out, err := zstdDecoder.DecodeAll([]byte(payload), nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode zstd value: %w", err)
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("unsupported compression type %s", c)
+	}
+}
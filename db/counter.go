@@ -0,0 +1,51 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Increment adds delta, which may be negative, to the counter at key and
+// returns the result. Counters are stored as varints; a key that does not
+// exist or is deleted counts as zero, and one holding anything else is an
+// error. The counter is read and written in the order writes commit, so
+// concurrent increments and writes to key never lose an update.
+func (db *DB) Increment(key string, delta int64) (int64, error) {
+	if err := validateUserKey(key); err != nil {
+		return 0, fmt.Errorf("failed to increment key %s: %w", key, err)
+	}
+	db.trace(TraceRecord{Op: TraceIncrement, Key: key})
+	var sum int64
+	err := db.readModifyWrite(key, func(value string, found bool) (string, bool, error) {
+		var n int64
+		if found {
+			var ok bool
+			if n, ok = decodeCounter(value); !ok {
+				return "", false, fmt.Errorf("failed to increment key %s: value is not a counter", key)
+			}
+		}
+		sum = n + delta
+		if (delta > 0 && sum < n) || (delta < 0 && sum > n) {
+			return "", false, fmt.Errorf("failed to increment key %s: counter overflows", key)
+		}
+		return encodeCounter(sum), true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// encodeCounter returns the stored form of the counter n.
+func encodeCounter(n int64) string {
+	return string(binary.AppendVarint(nil, n))
+}
+
+// decodeCounter parses a counter written by encodeCounter.
+func decodeCounter(value string) (int64, bool) {
+	n, size := binary.Varint([]byte(value))
+	if size <= 0 || size != len(value) {
+		return 0, false
+	}
+	return n, true
+}
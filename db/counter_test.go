@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrement(t *testing.T) {
+	dir := "testdata/counter"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	store, err := db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+
+	n, err := store.Increment("hits", 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	n, err = store.Increment("hits", -7)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-2), n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := store.Increment("hits", 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, store.Close())
+
+	store, err = db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	n, err = store.Increment("hits", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(398), n)
+
+	require.NoError(t, store.Delete("hits"))
+	n, err = store.Increment("hits", 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	require.NoError(t, store.Put("name", "not a number"))
+	_, err = store.Increment("name", 1)
+	assert.Error(t, err)
+}
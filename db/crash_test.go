@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashPoint is the durable state of the filesystem just before one
+// mutation, and the writes acknowledged by then.
+type crashPoint struct {
+	op, name string
+	image    *db.FaultFileSystem
+	acked    map[string]int
+}
+
+// TestCrashConsistency runs a workload of puts, flushes and compactions,
+// simulates power loss before every filesystem mutation it makes, and
+// checks that each crash image reopens with every acknowledged write intact
+// and no value that was never written.
+func TestCrashConsistency(t *testing.T) {
+	for _, threshold := range []int{0, 32} {
+		t.Run(fmt.Sprintf("ValueLogThreshold=%d", threshold), func(t *testing.T) {
+			testCrashConsistency(t, threshold)
+		})
+	}
+}
+
+func testCrashConsistency(t *testing.T, threshold int) {
+	fs := db.NewFaultFileSystem()
+	fs.RequireDirSync(true)
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.ValueLogThreshold = threshold
+
+	store, err := db.Open(faultDir, opts)
+	require.NoError(t, err)
+
+	// Keys are overwritten with increasing versions, so a recovered value
+	// must be at least the last acknowledged version.
+	var mu sync.Mutex
+	acked := make(map[string]int)
+	var points []crashPoint
+	fs.OnMutation(func(op, name string) {
+		mu.Lock()
+		snapshot := make(map[string]int, len(acked))
+		for k, v := range acked {
+			snapshot[k] = v
+		}
+		mu.Unlock()
+		points = append(points, crashPoint{op: op, name: name, image: fs.CrashImage(), acked: snapshot})
+	})
+
+	for version := 0; version < 90; version++ {
+		key := fmt.Sprintf("key%02d", version%25)
+		value := fmt.Sprintf("v%03d-%s", version, make([]byte, version%40))
+		require.NoError(t, store.Put(key, value))
+		mu.Lock()
+		acked[key] = version
+		mu.Unlock()
+		if version%10 == 9 {
+			require.NoError(t, store.Flush())
+		}
+	}
+	fs.OnMutation(nil)
+	points = append(points, crashPoint{op: "end", image: fs.CrashImage(), acked: acked})
+	require.NoError(t, store.Close())
+
+	t.Logf("checking %d crash points", len(points))
+	for i, p := range points {
+		context := fmt.Sprintf("crash %d before %s %s", i, p.op, p.name)
+		opts := db.DefaultOptions()
+		opts.FileSystem = p.image
+		opts.ValueLogThreshold = threshold
+
+		recovered, err := db.Open(faultDir, opts)
+		require.NoError(t, err, context)
+		for key, want := range p.acked {
+			got, err := recovered.Get(key)
+			if !assert.NoError(t, err, "%s: %s", context, key) {
+				continue
+			}
+			var version int
+			_, err = fmt.Sscanf(got, "v%03d-", &version)
+			assert.NoError(t, err, "%s: %s has unexpected value %q", context, key, got)
+			assert.GreaterOrEqual(t, version, want, "%s: %s went back in time", context, key)
+			assert.Equal(t, fmt.Sprintf("v%03d-%s", version, make([]byte, version%40)), got, context)
+		}
+		// The recovered database must keep working across another restart.
+		require.NoError(t, recovered.Put("after", "crash"), context)
+		require.NoError(t, recovered.Flush(), context)
+		require.NoError(t, recovered.Close(), context)
+		reopened, err := db.Open(faultDir, opts)
+		require.NoError(t, err, context)
+		value, err := reopened.Get("after")
+		assert.NoError(t, err, context)
+		assert.Equal(t, "crash", value, context)
+		require.NoError(t, reopened.Close(), context)
+	}
+}
@@ -1,110 +1,516 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type LevelPolicy struct {
-	maxFiles int
-	maxSize  int64
-}
-
 type DB struct {
-	memTable      map[string]string
+	mu            sync.RWMutex
+	memTable      *memTable
 	wal           *WAL
-	levels        [][]*SSTable
+	wals          []string     // WAL files holding memTable's writes; the last is wal's
+	logNumber     uint64       // WALs numbered below it are flushed; guarded by db.mu
+	imm           []*immutable // full memtables waiting to be flushed, oldest first
+	levels        [][]*SSTable // edited under db.mu; readers use current
 	dir           string
+	fs            FileSystem
 	levelPolicies []LevelPolicy
+	opts          *Options
+	manifest      *manifest
+	unloaded      []string // tables that failed to load, kept for Repair
+	walRecovery   WALRecoveryReport
+	vlog          *valueLog
+	limiter       *rateLimiter // nil when flushes and compactions are unthrottled
+	tables        *tableCache  // nil when Options.MaxOpenFiles is zero
+
+	readCount   atomic.Uint64
+	sampleCount atomic.Uint64
+
+	seq        uint64
+	durableSeq atomic.Uint64 // newest seq synced to disk; see DurableSequence
+	nextFile   atomic.Uint64
+	listeners  map[int]func([]commitRecord)
+	nextLID    int
+
+	committer groupCommitter
+
+	// versionMu guards current, the version readers start from.
+	versionMu sync.Mutex
+	current   *version
+
+	// compactMu serializes compactions and ingestion, the only changes to
+	// levels below L0, so a compaction can merge its inputs without db.mu.
+	compactMu sync.Mutex
+
+	// pending names the tables being written by flushes and compactions,
+	// which obsolete file collection must leave alone. Guarded by db.mu.
+	pending map[string]bool
+
+	// memFirstSeq is the first sequence number the active memtable may
+	// hold. Guarded by db.mu.
+	memFirstSeq uint64
+
+	// familyWALs are the open WALs of the column families written since
+	// the memtable was, with Options.WALPerColumnFamily; their paths are
+	// in wals after wal's. Guarded by logMu.
+	familyWALs map[string]*WAL
+
+	// compactPointers[level] is the largest key of the table last
+	// compacted out of level, where the next pick starts. Guarded by db.mu.
+	compactPointers []string
+
+	// walPins counts the LiveFileSets not yet released; while any are,
+	// flushed WALs are kept in pinnedWALs rather than deleted. Guarded by
+	// db.mu.
+	walPins    int
+	pinnedWALs []string
+
+	// flushStats and compactionStats, indexed by output level, are guarded
+	// by db.mu.
+	flushStats      LevelCompactionStats
+	compactionStats []LevelCompactionStats
+	// lifetime holds the counters of earlier sessions, read from the stats
+	// file at open, and openSeq the sequence number this session started
+	// at.
+	lifetime LifetimeStats
+	openSeq  uint64
+
+	stalls struct {
+		slowdowns atomic.Uint64
+		stops     atomic.Uint64
+		nanos     atomic.Int64
+	}
+
+	subsMu sync.Mutex
+	subs   map[<-chan Event]*subscription
+
+	snapMu        sync.Mutex
+	snapshots     map[*Snapshot]struct{}
+	forceReleased atomic.Uint64
+
+	// iterators maps each open iterator to the stack that created it, which
+	// is empty unless Options.TrackIterators is set.
+	iterMu    sync.Mutex
+	iterators map[*Iterator]string
+
+	tracer *tracer // nil unless Options.TraceFile is set
+
+	lock           *dirLock
+	staleLockOwner *LockOwner // nil unless Open took over a stale LOCK
+
+	// flushCond is broadcast, under db.mu, whenever the flush goroutine
+	// finishes with an immutable memtable; flushErr holds its last failure.
+	flushCh   chan struct{}
+	flushCond *sync.Cond
+	flushErr  error
+
+	bgStop chan struct{}
+	closed atomic.Bool
+	bgWG   sync.WaitGroup
+
+	// aborting is set once Shutdown's context ends, telling flushes and
+	// compactions to give up; abandoned describes those that did.
+	aborting  atomic.Bool
+	abandonMu sync.Mutex
+	abandoned []string
+
+	// noAutoCompaction is set while Options.DisableAutoCompaction, or a
+	// later SetAutoCompaction(false), is in effect.
+	noAutoCompaction atomic.Bool
+}
+
+// commitRecord is a single write as seen by commit listeners, tagged with the
+// sequence number it was assigned.
+type commitRecord struct {
+	seq   uint64
+	key   string
+	value string
 }
 
 func NewDB(dir string) (*DB, error) {
-	memTable, err := Replay(dir)
+	return Open(dir, DefaultOptions())
+}
+
+// Open opens the database in dir with the given options. A nil opts is
+// equivalent to DefaultOptions().
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	policies, err := newLevelPolicies(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := validateBloomOptions(opts); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := validateDictOptions(opts); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if opts.ValueChunkSize < 0 {
+		return nil, fmt.Errorf("failed to open database: invalid ValueChunkSize %d: must not be negative", opts.ValueChunkSize)
+	}
+
+	fs := fsOrDefault(opts.FileSystem)
+	exists, err := databaseExists(fs, dir)
 	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if !exists && !opts.CreateIfMissing {
+		return nil, fmt.Errorf("failed to open database %s: %w", dir, ErrDatabaseNotFound)
+	}
+	if exists && opts.ErrorIfExists {
+		return nil, fmt.Errorf("failed to open database %s: %w", dir, ErrDatabaseExists)
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	lock, staleOwner, err := acquireLock(fs, dir, opts.BreakStaleLock)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			lock.release()
+		}
+	}()
+
+	vlog, err := openValueLog(fs, dir, opts.ValueLogFileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		memTable:        newMemTable(),
+		vlog:            vlog,
+		levels:          make([][]*SSTable, len(policies)),
+		compactPointers: make([]string, len(policies)),
+		dir:             dir,
+		fs:              fs,
+		opts:            opts,
+		levelPolicies:   policies,
+		compactionStats: make([]LevelCompactionStats, len(policies)),
+		lock:            lock,
+		staleLockOwner:  staleOwner,
+	}
+
+	if opts.RateLimitBytesPerSec > 0 {
+		db.limiter = newRateLimiter(opts.RateLimitBytesPerSec)
+	}
+	if opts.MaxOpenFiles > 0 {
+		db.tables = newTableCache(opts.MaxOpenFiles)
+	}
+
+	db.flushCh = make(chan struct{}, 1)
+	db.flushCond = sync.NewCond(&db.mu)
+
+	db.pending = make(map[string]bool)
+	db.noAutoCompaction.Store(opts.DisableAutoCompaction)
+	if err := db.loadTables(); err != nil {
+		return nil, err
+	}
+	db.memFirstSeq = db.seq + 1
+	db.installVersion()
+
+	// Memtables that were not flushed before the last shutdown are rebuilt
+	// from their WALs into a single memtable, which keeps those WALs until
+	// it is flushed. WALs the MANIFEST records as flushed are skipped, and
+	// removed below as obsolete.
+	wals, err := liveWALs(fs, dir, db.logNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.replayLog(); err != nil {
 		return nil, fmt.Errorf("failed to replay log: %w", err)
 	}
+	db.openSeq = db.seq
+	db.lifetime = readLifetimeStats(fs, dir)
+	db.wals = wals
 
-	wal, err := NewWAL(dir)
+	walPath := filepath.Join(dir, walFileName(db.newFileNumber()))
+	wal, err := openWAL(fs, walPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
+	db.configureWAL(wal)
+	if err := wal.appendCheckpoint(db.seq); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	db.wal = wal
+	db.wals = append(db.wals, walPath)
 
-	db := &DB{
-		memTable: memTable,
-		wal:      wal,
-		levels:   make([][]*SSTable, 7),
-		dir:      dir,
-		levelPolicies: []LevelPolicy{
-			{maxFiles: 4, maxSize: 0},
-			{maxFiles: 10, maxSize: 10 * 1024 * 1024},
-			{maxFiles: 10, maxSize: 100 * 1024 * 1024},
-			{maxFiles: 10, maxSize: 1000 * 1024 * 1024},
-			{maxFiles: 10, maxSize: 10000 * 1024 * 1024},
-			{maxFiles: 10, maxSize: 100000 * 1024 * 1024},
-			{maxFiles: 10, maxSize: 1000000 * 1024 * 1024},
-		},
-	}
-
-	files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	manifest, err := openManifest(fs, dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan SSTable files: %w", err)
+		return nil, err
 	}
-	sort.Strings(files)
+	manifest.lastSeq = db.seq
+	db.manifest = manifest
 
-	for _, f := range files {
-		sst := &SSTable{path: f}
-		if err := sst.Load(); err != nil {
-			log.Printf("Skipping SSTable %s due to load error: %v", f, err)
-			continue
+	if _, err := db.deleteObsoleteFilesLocked(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if opts.TraceFile != "" {
+		tracer, err := newTracer(fs, opts.TraceFile)
+		if err != nil {
+			db.release(false)
+			return nil, err
 		}
-		db.levels[0] = append(db.levels[0], sst)
+		db.tracer = tracer
+	}
+
+	db.bgStop = make(chan struct{})
+	db.bgWG.Add(1)
+	go db.flushLoop()
+	if opts.MaxSnapshotAge > 0 {
+		db.bgWG.Add(1)
+		go db.snapshotReaper(opts.MaxSnapshotAge)
+	}
+	if opts.ValueLogGCInterval > 0 {
+		db.bgWG.Add(1)
+		go db.valueLogGCLoop(opts.ValueLogGCInterval)
+	}
+	if opts.WALSyncInterval > 0 {
+		db.bgWG.Add(1)
+		go db.walSyncLoop(opts.WALSyncInterval)
+	}
+	if opts.FlushInterval > 0 {
+		db.bgWG.Add(1)
+		go db.flushIntervalLoop(opts.FlushInterval)
+	}
+	if opts.StatsPersistInterval > 0 {
+		db.bgWG.Add(1)
+		go db.statsLoop(opts.StatsPersistInterval)
 	}
 
+	opened = true
 	return db, nil
 }
 
+// replayLog rebuilds the memtable from the WALs the MANIFEST does not
+// record as flushed, expanding range deletes against what the tables and
+// the replayed writes hold, and handling damaged records as
+// Options.WALRecovery says. The sequence number resumes from the last
+// checkpoint record, counting the writes replayed after it.
+func (db *DB) replayLog() error {
+	var errs []error
+	apply := func(key, value string) {
+		db.seq++
+		db.memTable.put(key, value, db.seq)
+	}
+	replay := func(rec walRecord) {
+		switch rec.typ {
+		case walPut:
+			apply(rec.key, rec.value)
+		case walDelete:
+			apply(rec.key, tombstone)
+		case walRangeDelete:
+			keys, err := db.liveKeysInRange(rec.key, rec.value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to replay range delete: %w", err))
+				return
+			}
+			for _, key := range keys {
+				apply(key, tombstone)
+			}
+		case walCheckpoint:
+			seq, _, err := rec.checkpoint()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			db.seq = seq
+		}
+	}
+	var err error
+	if db.opts.WALRecovery == WALRecoveryTruncate {
+		db.walRecovery, err = replayWALTruncating(db.fs, db.dir, db.logNumber, replay)
+	} else {
+		err = replayWAL(db.fs, db.dir, db.logNumber, replay)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	db.durableSeq.Store(db.seq)
+	return errors.Join(errs...)
+}
+
+// WALRecovery reports what WALRecoveryTruncate cut off the WALs
+// when the database was opened. It is empty when nothing was, or with
+// WALRecoveryFail.
+func (db *DB) WALRecovery() WALRecoveryReport {
+	return db.walRecovery
+}
+
+// loadTables opens the SSTables listed in the MANIFEST and sets up file
+// numbering. Directories written before the MANIFEST existed have every *.sst
+// file loaded into L0; for them, and for directories with an unnumbered
+// MANIFEST, a numbered MANIFEST describing the layout is written and CURRENT
+// pointed at it.
+func (db *DB) loadTables() error {
+	state, err := readManifest(db.fs, db.dir, len(db.levels))
+	if err != nil {
+		return err
+	}
+
+	maxNum, err := maxFileNumber(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	next := maxNum + 1
+	if state != nil && state.nextFile > next {
+		next = state.nextFile
+	}
+	db.nextFile.Store(next)
+
+	if state == nil {
+		files, err := db.fs.Glob(filepath.Join(db.dir, "*.sst"))
+		if err != nil {
+			return fmt.Errorf("failed to scan SSTable files: %w", err)
+		}
+		sort.Strings(files)
+
+		for _, f := range files {
+			sst := db.newTable(f)
+			if err := sst.Load(); err != nil {
+				log.Printf("Skipping SSTable %s due to load error: %v", f, err)
+				db.unloaded = append(db.unloaded, filepath.Base(f))
+				continue
+			}
+			db.levels[0] = append(db.levels[0], sst)
+		}
+		return writeManifestSnapshot(db.fs, db.dir, db.levels, db.compactPointers, db.newFileNumber(), db.logNumber, db.seq)
+	}
+
+	db.logNumber = state.logNumber
+	db.seq = state.lastSeq
+	db.compactPointers = state.pointers
+	for levelNum, level := range state.levels {
+		for _, name := range level {
+			sst := db.newTable(filepath.Join(db.dir, name))
+			if err := sst.Load(); err != nil {
+				log.Printf("Skipping SSTable %s due to load error: %v", name, err)
+				db.unloaded = append(db.unloaded, name)
+				continue
+			}
+			sst.smallestSeq, sst.largestSeq = state.seqs[name].smallestSeq, state.seqs[name].largestSeq
+			db.levels[levelNum] = append(db.levels[levelNum], sst)
+		}
+		// The MANIFEST lists tables in the order they were added, but
+		// iterators and range deletes rely on every level below L0 being
+		// sorted by key, as compactions leave it.
+		if levelNum > 0 {
+			next := db.levels[levelNum]
+			sort.Slice(next, func(i, j int) bool {
+				return next[i].props.SmallestKey < next[j].props.SmallestKey
+			})
+		}
+	}
+	if state.legacy {
+		return writeManifestSnapshot(db.fs, db.dir, db.levels, db.compactPointers, db.newFileNumber(), db.logNumber, db.seq)
+	}
+	return nil
+}
+
 func (db *DB) Get(key string) (string, error) {
-	if value, ok := db.memTable[key]; ok {
+	if db.closed.Load() {
+		return "", fmt.Errorf("failed to get key %s: %w", key, ErrClosed)
+	}
+	if isInternalKey(key) {
+		return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+	db.trace(TraceRecord{Op: TraceGet, Key: key})
+	return db.getJoined(key)
+}
+
+// get looks in the memtables under db.mu and then in the current version,
+// which needs no lock, so a flush or compaction installing its output never
+// holds up the table search.
+func (db *DB) get(key string) (string, error) {
+	db.mu.RLock()
+	value, ok := db.memGet(key)
+	db.mu.RUnlock()
+	if ok {
 		return value, nil
 	}
 
-	for levelNum := 0; levelNum < len(db.levels); levelNum++ {
-		level := db.levels[levelNum]
+	v := db.currentVersion()
+	defer v.unref()
+	sample := db.sampleRead(v.levels)
+	value, ok, err := searchLevels(v.levels, key, sample)
+	if err != nil {
+		return "", fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	if ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+}
+
+// searchLevels looks key up in levels, newest L0 table first. When sample is
+// set, each probed table records the outcome in its read statistics. A
+// corrupt record ends the search with a *CorruptionError rather than falling
+// through to older data.
+func searchLevels(levels [][]*SSTable, key string, sample bool) (string, bool, error) {
+	return walkLevels(levels, key, func(sst *SSTable) (string, lookupResult, error) {
+		value, res, err := sst.lookup(key)
+		if sample {
+			sst.stats.record(res)
+		}
+		return value, res, err
+	})
+}
+
+// walkLevels calls probe on every table whose key range covers key, newest
+// first, until one finds it or fails.
+func walkLevels(levels [][]*SSTable, key string, probe func(*SSTable) (string, lookupResult, error)) (string, bool, error) {
+	for levelNum := 0; levelNum < len(levels); levelNum++ {
+		level := levels[levelNum]
 
 		if levelNum == 0 {
 			for i := len(level) - 1; i >= 0; i-- {
 				sst := level[i]
-				if sst == nil || len(sst.index) == 0 {
+				if sst == nil || !sst.overlaps(key, key) {
 					continue
 				}
-				if value, ok := sst.BinarySearch(key); ok {
-					return value, nil
+				value, res, err := probe(sst)
+				if err != nil {
+					return "", false, err
+				}
+				if res == lookupFound {
+					return value, true, nil
 				}
 			}
 		} else {
+			// Tables below L0 do not overlap, so at most one can hold key.
 			for _, sst := range level {
-				if sst == nil || len(sst.index) == 0 {
+				if sst == nil || !sst.overlaps(key, key) {
 					continue
 				}
-
-				firstKey := sst.index[0].key
-				lastKey := sst.index[len(sst.index)-1].key
-
-				if key >= firstKey && key <= lastKey {
-					if value, ok := sst.BinarySearch(key); ok {
-						return value, nil
-					}
-					break
+				value, res, err := probe(sst)
+				if err != nil {
+					return "", false, err
 				}
+				if res == lookupFound {
+					return value, true, nil
+				}
+				break
 			}
 		}
 	}
-	return "", fmt.Errorf("failed to get key %s: not found", key)
+	return "", false, nil
 }
 
 type GetResult struct {
@@ -147,102 +553,95 @@ func (db *DB) GetBatchParallel(keys []string) []GetResult {
 }
 
 func (db *DB) Put(key, value string) error {
-	if key == "" {
-		return fmt.Errorf("failed to put key %s: key cannot be empty", key)
-	}
-
-	if err := db.wal.Append(key, value); err != nil {
-		return fmt.Errorf("failed to append to WAL: %w", err)
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to put key %s: %w", key, err)
 	}
 
-	db.memTable[key] = value
-	return nil
+	db.trace(TraceRecord{Op: TracePut, Key: key, Size: int64(len(value))})
+	return db.writeValues([][2]string{{key, value}}, nil, false)
 }
 
+// PutBatch writes kvs as one batch: after a crash either all of them or
+// none are replayed.
 func (db *DB) PutBatch(kvs [][2]string) error {
 	if len(kvs) == 0 {
 		return nil
 	}
 
 	for _, kv := range kvs {
-		if kv[0] == "" {
-			return fmt.Errorf("failed to put batch: key cannot be empty")
+		if err := validateUserKey(kv[0]); err != nil {
+			return fmt.Errorf("failed to put batch: %w", err)
 		}
 	}
 
-	if err := db.wal.AppendBatch(kvs); err != nil {
-		return fmt.Errorf("failed to append batch to WAL: %w", err)
-	}
-
-	for _, kv := range kvs {
-		db.memTable[kv[0]] = kv[1]
-	}
-
-	return nil
+	db.traceBatch(kvs, nil)
+	return db.writeValues(kvs, nil, true)
 }
 
-func (db *DB) Flush() error {
-	if len(db.memTable) == 0 {
-		return nil
-	}
-
-	kvs := make([][2]string, 0, len(db.memTable))
-	keys := make([]string, 0, len(db.memTable))
-	for k := range db.memTable {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		kvs = append(kvs, [2]string{k, db.memTable[k]})
-	}
-
-	filename := fmt.Sprintf("sstable_%d.sst", time.Now().UnixNano())
-	sstablePath := filepath.Join(db.dir, filename)
-	tmpPath := sstablePath + ".tmp"
+// CloseOptions controls how CloseWithOptions shuts the database down.
+type CloseOptions struct {
+	// FlushMemtable writes the memtable to an SSTable before closing, so the
+	// next Open has no WAL to replay. Without it Close is fast and the
+	// memtable is rebuilt from the WAL on the next Open.
+	FlushMemtable bool
+
+	// Timeout bounds how long Close waits for the final flush; zero waits
+	// as long as it takes. If it expires, Close stops waiting and falls
+	// back to a fast close, leaving unflushed writes in the WAL.
+	Timeout time.Duration
+}
 
-	sst := &SSTable{path: tmpPath}
-	if err := sst.Write(kvs); err != nil {
-		return fmt.Errorf("failed to write SSTable: %w", err)
-	}
+// Close closes the database without flushing the memtable. It is
+// CloseWithOptions with the zero CloseOptions.
+func (db *DB) Close() error {
+	return db.CloseWithOptions(CloseOptions{})
+}
 
-	if err := fileSync(tmpPath); err != nil {
-		return fmt.Errorf("failed to sync SSTable file: %w", err)
+// CloseWithOptions closes the database, first flushing the memtable if
+// opts.FlushMemtable is set. The database is closed even if the flush fails,
+// in which case the flush error is returned. Once it is called, every
+// operation, including another Close, fails with ErrClosed.
+func (db *DB) CloseWithOptions(opts CloseOptions) error {
+	if db.closed.Swap(true) {
+		return fmt.Errorf("failed to close database: %w", ErrClosed)
 	}
-
-	if err := os.Rename(tmpPath, sstablePath); err != nil {
-		return fmt.Errorf("failed to rename SSTable file: %w", err)
+	var flushErr error
+	if opts.FlushMemtable {
+		flushErr = db.finalFlush(opts.Timeout)
 	}
-
-	sst.path = sstablePath
-	if err := sst.Load(); err != nil {
-		return fmt.Errorf("failed to load SSTable after writing: %w", err)
+	db.stopBackground()
+	err := db.release(opts.FlushMemtable && flushErr == nil)
+	if flushErr != nil {
+		return flushErr
 	}
+	return err
+}
 
-	if err := db.wal.Close(); err != nil {
-		return fmt.Errorf("failed to close WAL: %w", err)
-	}
-	if err := os.Remove(walFilePath(db.dir)); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove old WAL during rollover: %w", err)
+// release closes the files of a database whose background goroutines have
+// stopped, removing the WALs of the active memtable if removeWALs is set
+// and it and the immutable queue are empty.
+func (db *DB) release(removeWALs bool) error {
+	db.reportLeakedIterators()
+	db.releaseAllSnapshots()
+	db.closeSubscriptions()
+	if err := db.saveLifetimeStats(); err != nil {
+		log.Printf("Warning: %v", err)
 	}
 
-	newWal, err := NewWAL(db.dir)
-	if err != nil {
-		return fmt.Errorf("failed to create new WAL: %w", err)
-	}
-	db.wal = newWal
-	db.memTable = make(map[string]string)
-	db.levels[0] = append(db.levels[0], sst)
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	log.Printf("Flushed %d entries to SSTable", len(kvs))
+	db.listeners = nil
 
-	if err := db.maybeCompact(); err != nil {
-		log.Printf("Compaction failed: %v", err)
+	db.versionMu.Lock()
+	if db.current != nil {
+		db.current.unref()
+		db.current = nil
 	}
+	db.versionMu.Unlock()
 
-	return nil
-}
-
-func (db *DB) Close() error {
 	var firstErr error
 
 	for _, level := range db.levels {
@@ -255,23 +654,184 @@ func (db *DB) Close() error {
 		}
 	}
 
+	if !db.syncWALEveryWrite() {
+		if err := db.syncWALs(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := db.closeFamilyWALs(); err != nil && firstErr == nil {
+		firstErr = err
+	}
 	if err := db.wal.Close(); err != nil && firstErr == nil {
 		firstErr = err
 	}
+	if removeWALs && firstErr == nil {
+		db.removeEmptyWALs()
+	}
+	if err := db.manifest.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := db.vlog.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if db.tracer != nil {
+		if err := db.tracer.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	db.lock.release()
 	return firstErr
 }
 
+// stopBackground stops the background goroutines and waits for them to
+// exit. It is a no-op once they have been stopped.
+func (db *DB) stopBackground() {
+	if db.bgStop != nil {
+		close(db.bgStop)
+		db.bgWG.Wait()
+		db.bgStop = nil
+	}
+}
+
+// LastSequence returns the sequence number assigned to the most recent write.
+// A reopened database continues from where it left off.
+func (db *DB) LastSequence() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+// commit assigns sequence numbers to kvs and hands them to every registered
+// listener. It must be called with db.mu held for writing, after the writes
+// are durable in the WAL and applied to the memtable.
+func (db *DB) commit(kvs [][2]string) {
+	records := make([]commitRecord, len(kvs))
+	for i, kv := range kvs {
+		db.seq++
+		records[i] = commitRecord{seq: db.seq, key: kv[0], value: kv[1]}
+	}
+	for _, fn := range db.listeners {
+		fn(records)
+	}
+}
+
+// addListener registers fn to be called with every committed write. Listeners
+// run under the write lock and must not block or call back into the DB.
+func (db *DB) addListener(fn func([]commitRecord)) (remove func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.listeners == nil {
+		db.listeners = make(map[int]func([]commitRecord))
+	}
+	id := db.nextLID
+	db.nextLID++
+	db.listeners[id] = fn
+
+	return func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		delete(db.listeners, id)
+	}
+}
+
+// snapshotKVs returns every live key-value pair in key order, with newer
+// entries shadowing older ones and deleted keys left out. It must be called
+// with db.mu held.
+func (db *DB) snapshotKVs() ([][2]string, error) {
+	stored := db.storedForm(db.levels...)
+	sources := []internalIterator{newMemIterator(db.memTable, math.MaxUint64, stored)}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		sources = append(sources, newMemIterator(db.imm[i].mem, math.MaxUint64, stored))
+	}
+	for level, tables := range db.levels {
+		sources = append(sources, levelIterators(level, tables, stored)...)
+	}
+
+	deleted := tombstone
+	if stored {
+		deleted = encodeInline(tombstone)
+	}
+	var kvs [][2]string
+	m := newMergingIterator(sources)
+	for m.seek(""); m.ok; m.next() {
+		if m.curValue == deleted && isDeleted(m.curKey, tombstone) {
+			continue
+		}
+		kvs = append(kvs, [2]string{m.curKey, m.curValue})
+	}
+	if m.mergeErr != nil {
+		return nil, fmt.Errorf("failed to extract KVs from SSTables: %w", m.mergeErr)
+	}
+	if !stored {
+		return kvs, nil
+	}
+	return db.resolveValues(kvs)
+}
+
+// SetAutoCompaction turns automatic compaction on or off at runtime,
+// overriding Options.DisableAutoCompaction. Turning it on runs every
+// compaction that has become due meanwhile before returning.
+func (db *DB) SetAutoCompaction(enabled bool) error {
+	if db.closed.Load() {
+		return fmt.Errorf("failed to set auto compaction: %w", ErrClosed)
+	}
+	db.noAutoCompaction.Store(!enabled)
+	if !enabled {
+		return nil
+	}
+	return db.maybeCompact()
+}
+
+// maybeCompact runs every compaction that is due, unless automatic
+// compaction is disabled. It must be called without db.mu held: the merge
+// runs unlocked, so reads and flushes carry on while it does.
 func (db *DB) maybeCompact() error {
+	if db.noAutoCompaction.Load() {
+		return nil
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	if db.universal() {
+		return db.compactUniversalWhileDue()
+	}
 	for level := 0; level < len(db.levels)-1; level++ {
-		if db.needsCompaction(level) {
+		db.mu.RLock()
+		due := db.needsCompaction(level)
+		intraL0 := due && level == 0 && db.intraL0Due()
+		db.mu.RUnlock()
+		if intraL0 {
+			if err := db.compactL0Runs(0, "intra-L0", "L1 overlap too large"); err != nil {
+				if errors.Is(err, errShutdownAborted) {
+					db.noteAbandoned("intra-L0 compaction")
+				}
+				return err
+			}
+			continue
+		}
+		// Below L0 each compaction moves one table down, so a level is
+		// compacted until it is back within its policy.
+		for due {
 			if err := db.compactLevel(level); err != nil {
+				if errors.Is(err, errShutdownAborted) {
+					db.noteAbandoned(fmt.Sprintf("L%d→L%d compaction", level, level+1))
+				}
 				return err
 			}
+			if level == 0 {
+				break
+			}
+			db.mu.RLock()
+			due = db.needsCompaction(level)
+			db.mu.RUnlock()
 		}
 	}
 	return nil
 }
 
+// needsCompaction reports whether level is over its policy. db.mu must be
+// held.
 func (db *DB) needsCompaction(level int) bool {
 	policy := db.levelPolicies[level]
 	levelFiles := db.levels[level]
@@ -283,10 +843,8 @@ func (db *DB) needsCompaction(level int) bool {
 	if policy.maxSize > 0 {
 		totalSize := int64(0)
 		for _, sst := range levelFiles {
-			if sst != nil && sst.file != nil {
-				if stat, err := sst.file.Stat(); err == nil {
-					totalSize += stat.Size()
-				}
+			if sst != nil {
+				totalSize += sst.size
 			}
 		}
 		if totalSize >= policy.maxSize {
@@ -297,109 +855,205 @@ func (db *DB) needsCompaction(level int) bool {
 	return false
 }
 
+// compactLevel merges every table in L0, or the one table of a deeper level
+// pickCompactionInput picks, with the tables in level+1 whose key ranges
+// overlap them, found from the tables' properties, into new tables in
+// level+1, cut at the level's target file size and split further when
+// Options.MaxSubcompactions runs sub-compactions. The output is in strictly ascending
+// key order and, for each key, holds the value from the newest input;
+// deleted keys are left out when no deeper level holds them.
+//
+// compactMu must be held and db.mu must not be. The inputs are chosen under
+// db.mu and merged without it; flushes may add L0 tables meanwhile, but
+// nothing else changes the levels involved until the result is installed.
 func (db *DB) compactLevel(level int) error {
 	nextLevel := level + 1
 	log.Printf("Starting L%d→L%d compaction", level, nextLevel)
-
-	allKVs := make(map[string]string)
-
-	for _, sst := range db.levels[level] {
-		kvs, err := db.extractAllKVsFromSSTable(sst)
-		if err != nil {
-			return fmt.Errorf("failed to extract KVs from L%d SSTable: %w", level, err)
+	start := time.Now()
+
+	db.mu.RLock()
+	var inputs []*SSTable
+	if level == 0 {
+		inputs = append(inputs, db.levels[0]...)
+	} else if sst := db.pickCompactionInput(level); sst != nil {
+		inputs = append(inputs, sst)
+	}
+	if len(inputs) == 0 {
+		db.mu.RUnlock()
+		return nil
+	}
+	var smallest, largest string
+	for i, sst := range inputs {
+		p := sst.Properties()
+		if i == 0 || p.SmallestKey < smallest {
+			smallest = p.SmallestKey
 		}
-		for _, kv := range kvs {
-			allKVs[kv[0]] = kv[1]
+		if i == 0 || p.LargestKey > largest {
+			largest = p.LargestKey
 		}
 	}
-
+	var overlapping, untouched []*SSTable
 	for _, sst := range db.levels[nextLevel] {
-		kvs, err := db.extractAllKVsFromSSTable(sst)
-		if err != nil {
-			return fmt.Errorf("failed to extract KVs from L%d SSTable: %w", nextLevel, err)
+		if sst.overlaps(smallest, largest) {
+			overlapping = append(overlapping, sst)
+		} else {
+			untouched = append(untouched, sst)
 		}
-		for _, kv := range kvs {
-			if _, exists := allKVs[kv[0]]; !exists {
-				allKVs[kv[0]] = kv[1]
-			}
+	}
+	dropDeletes := db.bottommost(nextLevel+1, append(append([]*SSTable(nil), inputs...), overlapping...))
+	db.mu.RUnlock()
+
+	// L0 tables overlap, so each is its own run; the newest entry for a key
+	// always wins and the output order is fully determined by the inputs.
+	// Separated values move as pointers; with separation turned off they
+	// are brought back inline.
+	c := &compaction{level: level, output: nextLevel, inputs: inputs, overlapping: overlapping, dropDeletes: dropDeletes,
+		targetFileSize: db.levelPolicies[nextLevel].targetFileSize}
+	c.stored = db.storedForm(inputs, overlapping)
+	c.separated = c.stored && db.opts.ValueLogThreshold > 0
+	if db.opts.AutoTuneFilters {
+		c.fpRate = tunedFPRate(c.tables())
+	}
+
+	// Large compactions are split by key range into sub-compactions that
+	// run concurrently, each writing its own output tables.
+	bounds := db.subcompactionBounds(c)
+	results := make([][]*SSTable, len(bounds)+1)
+	errs := make([]error, len(results))
+	defer func() { db.removePending(c.paths...) }()
+
+	var wg sync.WaitGroup
+	for i := range results {
+		var start, end string
+		if i > 0 {
+			start = bounds[i-1]
+		}
+		if i < len(bounds) {
+			end = bounds[i]
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = db.runSubcompaction(c, start, end)
+		}()
 	}
+	wg.Wait()
 
-	sortedKVs := make([][2]string, 0, len(allKVs))
-	keys := make([]string, 0, len(allKVs))
-	for k := range allKVs {
-		keys = append(keys, k)
+	var outputs []*SSTable
+	for _, tables := range results {
+		outputs = append(outputs, tables...)
 	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		sortedKVs = append(sortedKVs, [2]string{k, allKVs[k]})
+	discard := func() {
+		for _, sst := range outputs {
+			sst.Close()
+			db.fs.Remove(sst.path)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			discard()
+			return err
+		}
+	}
+	if len(bounds) > 0 {
+		log.Printf("L%d→L%d compaction ran as %d sub-compactions", level, nextLevel, len(results))
 	}
 
-	filename := fmt.Sprintf("sstable_l%d_%d.sst", nextLevel, time.Now().UnixNano())
-	sstablePath := filepath.Join(db.dir, filename)
-	tmpPath := sstablePath + ".tmp"
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	newSST := &SSTable{path: tmpPath}
-	if err := newSST.Write(sortedKVs); err != nil {
-		return fmt.Errorf("failed to write L%d SSTable: %w", nextLevel, err)
+	edit := &versionEdit{}
+	for _, sst := range outputs {
+		edit.addFile(nextLevel, sst)
 	}
-
-	if err := fileSync(tmpPath); err != nil {
-		return fmt.Errorf("failed to sync L%d SSTable: %w", nextLevel, err)
+	for _, sst := range inputs {
+		edit.deleteFile(level, sst.path)
 	}
-
-	if err := os.Rename(tmpPath, sstablePath); err != nil {
-		return fmt.Errorf("failed to rename L%d SSTable: %w", nextLevel, err)
+	for _, sst := range overlapping {
+		edit.deleteFile(nextLevel, sst.path)
 	}
-
-	newSST.path = sstablePath
-	if err := newSST.Load(); err != nil {
-		return fmt.Errorf("failed to load L%d SSTable: %w", nextLevel, err)
+	if level > 0 {
+		edit.pointers = append(edit.pointers, compactPointer{level: level, key: largest})
 	}
-
-	for _, sst := range db.levels[level] {
-		if err := sst.Close(); err != nil {
-			log.Printf("Warning: failed to close L%d SSTable: %v", level, err)
-		}
-		if err := os.Remove(sst.path); err != nil {
-			log.Printf("Warning: failed to remove L%d file: %v", level, err)
-		}
+	if err := db.logEdit(edit); err != nil {
+		discard()
+		return fmt.Errorf("failed to record L%d compaction in manifest: %w", nextLevel, err)
 	}
 
-	for _, sst := range db.levels[nextLevel] {
-		if err := sst.Close(); err != nil {
-			log.Printf("Warning: failed to close L%d SSTable: %v", nextLevel, err)
-		}
-		if err := os.Remove(sst.path); err != nil {
-			log.Printf("Warning: failed to remove L%d file: %v", nextLevel, err)
-		}
+	// Inputs are closed and removed once no snapshot or version references
+	// them.
+	for _, sst := range inputs {
+		sst.obsolete.Store(true)
+		sst.unref()
+	}
+	for _, sst := range overlapping {
+		sst.obsolete.Store(true)
+		sst.unref()
 	}
 
-	db.levels[level] = nil
-	db.levels[nextLevel] = []*SSTable{newSST}
+	var entries uint64
+	for _, sst := range outputs {
+		entries += sst.props.NumEntries
+	}
+	next := append(untouched, outputs...)
+	sort.Slice(next, func(i, j int) bool {
+		return next[i].props.SmallestKey < next[j].props.SmallestKey
+	})
+	// Tables flushed to L0 while the merge ran are newer than its output
+	// and stay behind.
+	db.levels[level] = slices.DeleteFunc(append([]*SSTable(nil), db.levels[level]...), func(sst *SSTable) bool {
+		return slices.Contains(inputs, sst)
+	})
+	if level > 0 {
+		db.compactPointers[level] = largest
+	}
+	db.levels[nextLevel] = next
+	db.installVersion()
+	db.recordCompaction(nextLevel, append(append([]*SSTable(nil), inputs...), overlapping...), outputs, time.Since(start))
 
-	log.Printf("L%d→L%d compaction completed: all data moved to L%d (%d keys)",
-		level, nextLevel, nextLevel, len(sortedKVs))
+	log.Printf("L%d→L%d compaction completed: merged %d tables into %d L%d tables (%d keys, %d L%d tables untouched)",
+		level, nextLevel, len(inputs)+len(overlapping), len(outputs), nextLevel, entries, len(untouched), nextLevel)
 
 	return nil
 }
 
-func (db *DB) extractAllKVsFromSSTable(sst *SSTable) ([][2]string, error) {
-	var kvs [][2]string
+// addPending marks the tables at paths as being written.
+func (db *DB) addPending(paths ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, path := range paths {
+		db.pending[filepath.Base(path)] = true
+	}
+}
 
-	for _, entry := range sst.index {
-		key, value, ok := sst.readKVFromMmap(entry.offset)
-		if !ok {
-			continue
-		}
-		kvs = append(kvs, [2]string{key, value})
+// removePending clears the marks set by addPending.
+func (db *DB) removePending(paths ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, path := range paths {
+		delete(db.pending, filepath.Base(path))
 	}
+}
 
-	return kvs, nil
+// newTable returns an SSTable at path configured from the options.
+func (db *DB) newTable(path string) *SSTable {
+	return &SSTable{
+		path:            path,
+		fs:              db.fs,
+		compression:     db.opts.Compression,
+		verifyChecksums: db.opts.VerifyChecksums,
+		recordChecksums: db.opts.RecordChecksums,
+		vlog:            db.vlog,
+		limiter:         db.limiter,
+		cache:           db.tables,
+		pread:           db.opts.ReadMode == ReadModePread,
+		fpRate:          db.opts.BloomFPRate,
+		bitsPerKey:      db.opts.BloomBitsPerKey,
+	}
 }
 
-func fileSync(path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR, 0)
+func fileSync(fs FileSystem, path string) error {
+	f, err := fs.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
 		return err
 	}
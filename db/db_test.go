@@ -1,11 +1,18 @@
 package db_test
 
 import (
+	"errors"
+	"fmt"
 	"mini-leveldb/db"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDBGetAndPut(t *testing.T) {
@@ -48,3 +55,764 @@ func TestDBGetAndPut(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterAdviceFromSampledReads(t *testing.T) {
+	dir := "testdata/tuning"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.Open(dir, &db.Options{CreateIfMissing: true, ReadSampleInterval: 1})
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	// The absent keys fall inside the table's key range, so every lookup
+	// reaches the table instead of being skipped by its properties.
+	assert.NoError(t, store.Put("present", "value"))
+	assert.NoError(t, store.Put("a", "value"))
+	assert.NoError(t, store.Flush())
+
+	for i := 0; i < 200; i++ {
+		_, _ = store.Get(fmt.Sprintf("absent%d", i))
+	}
+
+	advice := store.FilterAdvice()
+	if assert.Len(t, advice, 1) {
+		assert.Equal(t, uint64(200), advice[0].Lookups)
+		assert.Equal(t, uint64(0), advice[0].Hits)
+		assert.Less(t, advice[0].SuggestedFPRate, 0.01)
+	}
+}
+
+func TestConcurrentPutsShareGroupCommit(t *testing.T) {
+	dir := "testdata/group_commit"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				assert.NoError(t, store.Put(fmt.Sprintf("w%d-k%d", w, i), fmt.Sprintf("v%d", i)))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(writers*perWriter), store.LastSequence())
+	store.Close()
+
+	reopened, err := db.NewDB(dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			got, err := reopened.Get(fmt.Sprintf("w%d-k%d", w, i))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("v%d", i), got)
+		}
+	}
+}
+
+func TestWriteBatchAcrossColumnFamilies(t *testing.T) {
+	dir := "testdata/column_families"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	users, err := store.ColumnFamily("users")
+	assert.NoError(t, err)
+	byEmail, err := store.ColumnFamily("users_by_email")
+	assert.NoError(t, err)
+
+	var batch db.WriteBatch
+	batch.PutCF(users, "1", "alice@example.com")
+	batch.PutCF(byEmail, "alice@example.com", "1")
+	batch.Put("1", "default")
+	assert.NoError(t, store.Write(&batch))
+	assert.NoError(t, store.Close())
+
+	before, err := filepath.Glob(filepath.Join(dir, "*.walb"))
+	assert.NoError(t, err)
+
+	// A torn batch record must not be replayed at all. The reopened
+	// database logs it to a WAL of its own.
+	var torn db.WriteBatch
+	torn.PutCF(users, "2", "bob@example.com")
+	torn.PutCF(byEmail, "bob@example.com", "2")
+	store, err = db.NewDB(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Write(&torn))
+	assert.NoError(t, store.Close())
+	after, err := filepath.Glob(filepath.Join(dir, "*.walb"))
+	assert.NoError(t, err)
+	require.Len(t, after, len(before)+1)
+	walPath := after[len(after)-1]
+	assert.NoError(t, os.Truncate(walPath, 10))
+
+	replayed, err := db.Replay(dir)
+	assert.Error(t, err)
+	assert.Len(t, replayed, 3)
+	assert.NoError(t, os.Truncate(walPath, 0))
+
+	store, err = db.NewDB(dir)
+	assert.NoError(t, err)
+	defer store.Close()
+	users, _ = store.ColumnFamily("users")
+	byEmail, _ = store.ColumnFamily("users_by_email")
+
+	got, err := users.Get("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", got)
+	got, err = byEmail.Get("alice@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", got)
+	got, err = store.Get("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", got)
+
+	_, err = users.Get("2")
+	assert.Error(t, err)
+}
+
+func TestWALPerColumnFamilyReplaysInCommitOrder(t *testing.T) {
+	dir := "testdata/family_wals"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.WALPerColumnFamily = true
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	users, err := store.ColumnFamily("users")
+	require.NoError(t, err)
+	orders, err := store.ColumnFamily("orders")
+	require.NoError(t, err)
+
+	// The batch lands in the shared WAL between writes logged in the
+	// families' own, and replay has to keep it there.
+	require.NoError(t, users.Put("1", "alice"))
+	require.NoError(t, orders.Put("1", "book"))
+	var batch db.WriteBatch
+	batch.PutCF(users, "1", "alice@batch")
+	batch.PutCF(orders, "1", "pen")
+	batch.Put("k", "default")
+	require.NoError(t, store.Write(&batch))
+	require.NoError(t, orders.Put("1", "lamp"))
+	require.NoError(t, store.Put("k", "default2"))
+	require.NoError(t, orders.Delete("1"))
+	require.NoError(t, users.Put("2", "bob"))
+	last := store.LastSequence()
+	require.NoError(t, store.Close())
+
+	for _, family := range []string{"users", "orders"} {
+		wals, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("*.cf-%x.walb", family)))
+		require.NoError(t, err)
+		assert.Len(t, wals, 1, family)
+	}
+
+	// Reopening without the option still replays the family WALs.
+	for _, perFamily := range []bool{true, false} {
+		opts.WALPerColumnFamily = perFamily
+		store, err = db.Open(dir, opts)
+		require.NoError(t, err)
+		assert.Equal(t, last, store.LastSequence())
+		users, _ = store.ColumnFamily("users")
+		orders, _ = store.ColumnFamily("orders")
+		got, err := users.Get("1")
+		require.NoError(t, err)
+		assert.Equal(t, "alice@batch", got)
+		got, err = users.Get("2")
+		require.NoError(t, err)
+		assert.Equal(t, "bob", got)
+		_, err = orders.Get("1")
+		assert.ErrorIs(t, err, db.ErrNotFound)
+		got, err = store.Get("k")
+		require.NoError(t, err)
+		assert.Equal(t, "default2", got)
+		require.NoError(t, store.Close())
+	}
+}
+
+func TestDropColumnFamilyRetiresItsWALs(t *testing.T) {
+	dir := "testdata/drop_family"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.WALPerColumnFamily = true
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	users, err := store.ColumnFamily("users")
+	require.NoError(t, err)
+	orders, err := store.ColumnFamily("orders")
+	require.NoError(t, err)
+
+	require.NoError(t, users.Put("flushed", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, users.Put("logged", "1"))
+	require.NoError(t, orders.Put("1", "book"))
+	usersWALs := filepath.Join(dir, fmt.Sprintf("*.cf-%x.walb", "users"))
+	ordersWALs := filepath.Join(dir, fmt.Sprintf("*.cf-%x.walb", "orders"))
+	wals, err := filepath.Glob(usersWALs)
+	require.NoError(t, err)
+	require.NotEmpty(t, wals)
+
+	require.NoError(t, store.DropColumnFamily("users"))
+	wals, err = filepath.Glob(usersWALs)
+	require.NoError(t, err)
+	assert.Empty(t, wals, "dropped family's WALs left behind")
+	wals, err = filepath.Glob(ordersWALs)
+	require.NoError(t, err)
+	assert.Len(t, wals, 1)
+	for _, key := range []string{"flushed", "logged"} {
+		_, err := users.Get(key)
+		assert.ErrorIs(t, err, db.ErrNotFound, key)
+	}
+
+	// The family starts over empty.
+	require.NoError(t, users.Put("new", "2"))
+	require.NoError(t, store.Close())
+
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+	users, _ = store.ColumnFamily("users")
+	orders, _ = store.ColumnFamily("orders")
+	for _, key := range []string{"flushed", "logged"} {
+		_, err := users.Get(key)
+		assert.ErrorIs(t, err, db.ErrNotFound, key)
+	}
+	got, err := users.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, "2", got)
+	got, err = orders.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, "book", got)
+}
+
+func TestCheckpointProducesOpenableCopy(t *testing.T) {
+	dir := "testdata/checkpoint_src"
+	checkpointDir := "testdata/checkpoint_dst"
+	_ = os.RemoveAll(dir)
+	_ = os.RemoveAll(checkpointDir)
+
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.Put(fmt.Sprintf("flushed%d", i), "on-disk"))
+		assert.NoError(t, store.Flush())
+	}
+	assert.NoError(t, store.Put("pending", "in-memtable"))
+
+	assert.NoError(t, store.Checkpoint(checkpointDir))
+	assert.NoError(t, store.Put("after", "not-in-checkpoint"))
+
+	copied, err := db.NewDB(checkpointDir)
+	assert.NoError(t, err)
+	defer copied.Close()
+
+	for i := 0; i < 5; i++ {
+		got, err := copied.Get(fmt.Sprintf("flushed%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "on-disk", got)
+	}
+	got, err := copied.Get("pending")
+	assert.NoError(t, err)
+	assert.Equal(t, "in-memtable", got)
+	_, err = copied.Get("after")
+	assert.Error(t, err)
+
+	assert.Error(t, store.Checkpoint(checkpointDir), "checkpoint into a non-empty directory")
+}
+
+func TestCompressedTablesAreReadableAcrossCodecs(t *testing.T) {
+	dir := "testdata/compression"
+	_ = os.RemoveAll(dir)
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	value := strings.Repeat("compressible ", 512)
+	for _, codec := range []db.CompressionType{db.SnappyCompression, db.ZstdCompression} {
+		opts := db.DefaultOptions()
+		opts.Compression = codec
+		store, err := db.Open(dir, opts)
+		assert.NoError(t, err)
+
+		assert.NoError(t, store.Put(codec.String(), value))
+		assert.NoError(t, store.Put(codec.String()+"-short", "x"))
+		assert.NoError(t, store.Flush())
+		assert.NoError(t, store.Close())
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	for _, path := range tables {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Less(t, info.Size(), int64(len(value)), "table %s should be compressed", path)
+	}
+
+	// Reopen without compression; each table's footer names its codec.
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+	defer store.Close()
+	for _, codec := range []db.CompressionType{db.SnappyCompression, db.ZstdCompression} {
+		got, err := store.Get(codec.String())
+		assert.NoError(t, err)
+		assert.Equal(t, value, got)
+		got, err = store.Get(codec.String() + "-short")
+		assert.NoError(t, err)
+		assert.Equal(t, "x", got)
+	}
+}
+
+func TestCompactionTrainsCompressionDictionary(t *testing.T) {
+	value := func(i int) string {
+		return fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t,"roles":["reader","writer"]}`, i, i, i, i%3 == 0)
+	}
+	compacted := func(dictSize int) int64 {
+		fs := db.NewMemFileSystem()
+		opts := db.DefaultOptions()
+		opts.FileSystem = fs
+		opts.Compression = db.ZstdCompression
+		opts.CompressionDictSize = dictSize
+		store, err := db.Open("dictdb", opts)
+		require.NoError(t, err)
+
+		// The fourth flush compacts L0 into L1.
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 500; j++ {
+				require.NoError(t, store.Put(fmt.Sprintf("user%05d", i*500+j), value(i*500+j)))
+			}
+			require.NoError(t, store.Flush())
+		}
+		levels := store.Levels()
+		require.NotEmpty(t, levels[1].Files)
+		require.NoError(t, store.Close())
+
+		store, err = db.Open("dictdb", opts)
+		require.NoError(t, err)
+		defer store.Close()
+		for i := 0; i < 2000; i++ {
+			got, err := store.Get(fmt.Sprintf("user%05d", i))
+			require.NoError(t, err)
+			require.Equal(t, value(i), got)
+		}
+		return levels[1].Size
+	}
+
+	plain := compacted(0)
+	withDict := compacted(4096)
+	assert.Less(t, withDict, plain*2/3, "a dictionary should shrink tables of similar small values")
+}
+
+func TestCompactionOfIdenticalValuesSkipsDictionary(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.Compression = db.ZstdCompression
+	opts.CompressionDictSize = 4096
+	store, err := db.Open("dict-identical", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// zstd cannot train a dictionary from samples that are all alike, so
+	// the compaction writes its table without one.
+	value := strings.Repeat("same", 16)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 1000; j++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%05d", i*1000+j), value))
+		}
+		require.NoError(t, store.Flush())
+	}
+	require.NotEmpty(t, store.Levels()[1].Files)
+	for _, key := range []string{"key00000", "key01999", "key03999"} {
+		got, err := store.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestCorruptBlockIsReportedNotMissing(t *testing.T) {
+	dir := "testdata/checksums"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, store.Put(fmt.Sprintf("key%04d", i), "value"))
+	}
+	assert.NoError(t, store.Flush())
+	assert.NoError(t, store.Close())
+
+	// Flip a byte inside the first data block: the value of key0000.
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	assert.Len(t, tables, 1)
+	data, err := os.ReadFile(tables[0])
+	assert.NoError(t, err)
+	data[4+len("key0000")+4] ^= 0xff
+	assert.NoError(t, os.WriteFile(tables[0], data, 0644))
+
+	store, err = db.NewDB(dir)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.Get("key0000")
+	var corruption *db.CorruptionError
+	assert.True(t, errors.As(err, &corruption), "got %v", err)
+	assert.ErrorIs(t, err, db.ErrCorruption)
+	assert.NotErrorIs(t, err, db.ErrNotFound)
+
+	// Records in other blocks still verify.
+	got, err := store.Get("key0999")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", got)
+}
+
+func TestRecordChecksumCatchesFlippedValue(t *testing.T) {
+	dir := "testdata/recordchecksums"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.RecordChecksums = true
+	opts.VerifyChecksums = false
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("account", "balance=1000"))
+	require.NoError(t, store.Put("other", "untouched"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Close())
+
+	// Turn the balance into 9000 without touching the block checksum's
+	// verification, which is off.
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.Len(t, tables, 1)
+	data, err := os.ReadFile(tables[0])
+	require.NoError(t, err)
+	at := strings.Index(string(data), "balance=1000")
+	require.GreaterOrEqual(t, at, 0)
+	data[at+len("balance=")] = '9'
+	require.NoError(t, os.WriteFile(tables[0], data, 0644))
+
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.Get("account")
+	assert.ErrorIs(t, err, db.ErrCorruption)
+	_, _, err = store.GetPinned("account")
+	assert.ErrorIs(t, err, db.ErrCorruption)
+	results := store.GetBatch([]string{"account"})
+	assert.ErrorIs(t, results[0].Error, db.ErrCorruption)
+	got, err := store.Get("other")
+	require.NoError(t, err)
+	assert.Equal(t, "untouched", got)
+}
+
+func TestCloseWithFinalFlush(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+
+	walBytes := func() int64 {
+		matches, err := fs.Glob("close/*.walb")
+		require.NoError(t, err)
+		var total int64
+		for _, path := range matches {
+			info, err := fs.Stat(path)
+			require.NoError(t, err)
+			total += info.Size()
+		}
+		return total
+	}
+
+	store, err := db.Open("close", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("fast", "value"))
+	require.NoError(t, store.Close())
+	assert.Positive(t, walBytes(), "a fast close leaves the memtable in the WAL")
+
+	store, err = db.Open("close", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("clean", "value"))
+	require.NoError(t, store.CloseWithOptions(db.CloseOptions{FlushMemtable: true, Timeout: time.Minute}))
+	assert.Zero(t, walBytes(), "a clean close leaves no WAL to replay")
+
+	store, err = db.Open("close", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	for _, key := range []string{"fast", "clean"} {
+		value, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("sentinel", opts)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("present", "value"))
+	cf, err := store.ColumnFamily("users")
+	require.NoError(t, err)
+
+	_, err = store.Get("absent")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	_, err = cf.Get("absent")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorIs(t, store.MultiGet([]string{"absent"})[0].Error, db.ErrNotFound)
+
+	require.NoError(t, store.Close())
+	_, err = store.Get("present")
+	assert.ErrorIs(t, err, db.ErrClosed)
+	assert.ErrorIs(t, store.Put("key", "value"), db.ErrClosed)
+	assert.ErrorIs(t, store.Flush(), db.ErrClosed)
+	assert.ErrorIs(t, store.Close(), db.ErrClosed)
+}
+
+func TestDisableAutoCompaction(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.DisableAutoCompaction = true
+	opts.L0StopWritesTrigger = 6
+	store, err := db.Open("bulk", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Well past both the compaction and the stop trigger, L0 keeps every
+	// flush and writes are never stopped.
+	for i := 0; i < 8; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+	assert.Len(t, store.Levels()[0].Files, 8)
+	assert.Zero(t, store.WriteStallStats().Stops)
+
+	require.NoError(t, store.SetAutoCompaction(true))
+	levels := store.Levels()
+	assert.Empty(t, levels[0].Files)
+	assert.Len(t, levels[1].Files, 1)
+	for i := 0; i < 8; i++ {
+		value, err := store.Get(fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.FlushInterval = 10 * time.Millisecond
+	store, err := db.Open("timed", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	require.NoError(t, store.Put("a", "1"))
+	assert.Eventually(t, func() bool {
+		return len(store.Levels()[0].Files) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// An empty memtable is left alone.
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, store.Levels()[0].Files, 1)
+	value, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+}
+
+func TestIntraL0Compaction(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.IntraL0CompactionRatio = 10
+	store, err := db.Open("intra-l0", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Four large flushes fill L1.
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 500; j++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%04d", j*4+i), strings.Repeat("v", 100)))
+		}
+		require.NoError(t, store.Flush())
+	}
+	l1 := store.Levels()[1].Files
+	require.NotEmpty(t, l1)
+	require.Empty(t, store.Levels()[0].Files)
+
+	// Four tiny flushes across L1's range are merged within L0.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%04d", i), "new"))
+		require.NoError(t, store.Put(fmt.Sprintf("key%04d", 1999-i), "new"))
+		require.NoError(t, store.Flush())
+	}
+	levels := store.Levels()
+	assert.Len(t, levels[0].Files, 1)
+	assert.Equal(t, uint64(8), levels[0].Files[0].NumEntries)
+	assert.Equal(t, l1, levels[1].Files, "L1 is untouched")
+	for _, key := range []string{"key0000", "key1996", "key0004"} {
+		value, err := store.Get(key)
+		require.NoError(t, err)
+		if key == "key0004" {
+			assert.Equal(t, strings.Repeat("v", 100), value)
+		} else {
+			assert.Equal(t, "new", value)
+		}
+	}
+}
+
+func TestCompactionCutsOutputAtTargetFileSize(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.TargetFileSizeBase = 64 << 10
+	store, err := db.Open("target-file-size", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 500; j++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%04d", j*4+i), strings.Repeat("v", 100)))
+		}
+		require.NoError(t, store.Flush())
+	}
+
+	files := store.Levels()[1].Files
+	require.Greater(t, len(files), 1, "the L1 output is cut into several tables")
+	var entries uint64
+	for i, f := range files {
+		entries += f.NumEntries
+		if i > 0 {
+			assert.Less(t, files[i-1].LargestKey, f.SmallestKey, "tables do not overlap")
+		}
+		if i < len(files)-1 {
+			assert.Less(t, f.Size, int64(2*opts.TargetFileSizeBase))
+		}
+	}
+	assert.Equal(t, uint64(2000), entries)
+	for _, key := range []string{"key0000", "key0999", "key1999"} {
+		value, err := store.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("v", 100), value)
+	}
+}
+
+func TestReopenKeepsLevelsSortedByKey(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.TargetFileSizeBase = 4096
+	store, err := db.Open("sorted-levels", opts)
+	require.NoError(t, err)
+
+	// Every fourth flush compacts L0 into L1. The first compaction fills
+	// L1; the second rewrites only the tables below k200, which the
+	// MANIFEST then lists after the ones above it.
+	want := map[string]string{}
+	for _, round := range []struct {
+		prefix      string
+		every, keys int
+	}{{"a", 1, 500}, {"b", 3, 500}, {"c", 7, 500}, {"d", 11, 500}, {"e", 2, 200}, {"f", 5, 200}, {"g", 13, 200}, {"h", 17, 200}} {
+		for i := 0; i < round.keys; i += round.every {
+			key := fmt.Sprintf("k%03d", i)
+			value := round.prefix + key + strings.Repeat("v", 100)
+			require.NoError(t, store.Put(key, value))
+			want[key] = value
+		}
+		require.NoError(t, store.Flush())
+	}
+	require.Greater(t, len(store.Levels()[1].Files), 2)
+	// The range delete stays in the WAL, so reopening replays it against
+	// the tables.
+	require.NoError(t, store.DeleteRange("k041", "k098"))
+	for i := 41; i < 98; i++ {
+		delete(want, fmt.Sprintf("k%03d", i))
+	}
+
+	check := func(context string) {
+		t.Helper()
+		files := store.Levels()[1].Files
+		for i := 1; i < len(files); i++ {
+			assert.Less(t, files[i-1].LargestKey, files[i].SmallestKey, context)
+		}
+		got := map[string]string{}
+		it := store.NewIterator()
+		for it.First(); it.Valid(); it.Next() {
+			got[it.Key()] = it.Value()
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		assert.Equal(t, want, got, context)
+		_, err := store.Get("k050")
+		assert.ErrorIs(t, err, db.ErrNotFound, context)
+	}
+	check("before reopen")
+	require.NoError(t, store.Close())
+
+	store, err = db.Open("sorted-levels", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	check("after reopen")
+}
+
+func TestCreateIfMissingAndErrorIfExists(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.CreateIfMissing = false
+
+	_, err := db.Open("missing", opts)
+	require.ErrorIs(t, err, db.ErrDatabaseNotFound)
+	_, err = fs.Stat("missing")
+	assert.Error(t, err, "nothing is created")
+
+	opts.CreateIfMissing = true
+	opts.ErrorIfExists = true
+	store, err := db.Open("missing", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	_, err = db.Open("missing", opts)
+	require.ErrorIs(t, err, db.ErrDatabaseExists)
+
+	opts.CreateIfMissing = false
+	opts.ErrorIfExists = false
+	store, err = db.Open("missing", opts)
+	require.NoError(t, err, "an existing database opens without CreateIfMissing")
+	require.NoError(t, store.Close())
+}
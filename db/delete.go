@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A deleted key holds tombstone as its value, shadowing older values in
+// the memtables and tables below it. tombstone starts with
+// chunkedValueMagic, and a value that does is always written as chunks, so
+// no key a user writes ever holds it. Chunks are stored verbatim, so the
+// value of a chunk key is always data, even when it reads as tombstone.
+const tombstone = chunkedValueMagic + "deleted"
+
+// isDeleted reports whether value marks key as deleted.
+func isDeleted(key, value string) bool {
+	return value == tombstone && !strings.HasPrefix(key, chunkKeyPrefix)
+}
+
+// Delete removes key. Deleting a key that does not exist is not an error.
+func (db *DB) Delete(key string) error {
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	db.trace(TraceRecord{Op: TraceDelete, Key: key})
+	return db.replaceValues([][2]string{{key, tombstone}}, false)
+}
+
+// DeleteRange removes every key in [start, end). It is logged as a single
+// WAL record, and applied, like on replay, as a tombstone for every key the
+// range holds at that point, so keys written after DeleteRange returns are
+// unaffected. The chunks of chunked values it removes are not reclaimed.
+func (db *DB) DeleteRange(start, end string) error {
+	if err := validateUserKey(start); err != nil {
+		return fmt.Errorf("failed to delete range: %w", err)
+	}
+	if err := validateUserKey(end); err != nil {
+		return fmt.Errorf("failed to delete range: %w", err)
+	}
+	if start >= end {
+		return nil
+	}
+	db.trace(TraceRecord{Op: TraceDeleteRange, Key: start, EndKey: end})
+	return db.submit(&writeRequest{ranges: [][2]string{{start, end}}})
+}
+
+// Delete adds a deletion of key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	if err := validateUserKey(key); err != nil {
+		b.setErr(fmt.Errorf("failed to add key %s to batch: %w", key, err))
+		return
+	}
+	b.addDelete(key)
+}
+
+// DeleteCF adds a deletion of key in column family cf to the batch.
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	if key == "" {
+		b.setErr(fmt.Errorf("failed to add key to batch for column family %s: key cannot be empty", cf.name))
+		return
+	}
+	b.addDelete(cf.prefix + key)
+}
+
+func (b *WriteBatch) addDelete(key string) {
+	if b.deletes == nil {
+		b.deletes = make(map[int]bool)
+	}
+	b.deletes[len(b.kvs)] = true
+	b.kvs = append(b.kvs, [2]string{key, tombstone})
+}
+
+// Delete removes key from the family.
+func (cf *ColumnFamily) Delete(key string) error {
+	if key == "" {
+		return fmt.Errorf("failed to delete key %s: key cannot be empty", key)
+	}
+	cf.db.trace(TraceRecord{Op: TraceDelete, Key: cf.prefix + key})
+	return cf.db.replaceValues([][2]string{{cf.prefix + key, tombstone}}, false)
+}
+
+// liveKeysInRange returns the keys in [start, end) that the memtables and
+// current tables hold and that are not deleted. db.mu must be held, or the
+// database not yet shared.
+func (db *DB) liveKeysInRange(start, end string) ([]string, error) {
+	stored := db.storedForm(db.levels...)
+	sources := []internalIterator{newMemIterator(db.memTable, math.MaxUint64, stored)}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		sources = append(sources, newMemIterator(db.imm[i].mem, math.MaxUint64, stored))
+	}
+	for level, tables := range db.levels {
+		sources = append(sources, levelIterators(level, tables, stored)...)
+	}
+
+	deleted := tombstone
+	if stored {
+		deleted = encodeInline(tombstone)
+	}
+	var keys []string
+	m := newMergingIterator(sources)
+	for m.seek(start); m.ok && m.curKey < end; m.next() {
+		if m.curValue != deleted {
+			keys = append(keys, m.curKey)
+		}
+	}
+	if m.mergeErr != nil {
+		return nil, fmt.Errorf("failed to read keys in range: %w", m.mergeErr)
+	}
+	return keys, nil
+}
+
+// expandRanges sets the writes of the range delete req to a tombstone for
+// each live key in its ranges, counting the writes of the requests queued
+// before it in its group. logMu must be held, so no other write can change
+// what the ranges hold before the group is applied.
+func (db *DB) expandRanges(earlier []*writeRequest, req *writeRequest) error {
+	live := make(map[string]bool)
+	for _, r := range req.ranges {
+		db.mu.RLock()
+		keys, err := db.liveKeysInRange(r[0], r[1])
+		db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			live[key] = true
+		}
+		for _, e := range earlier {
+			for _, kv := range e.kvs {
+				if kv[0] >= r[0] && kv[0] < r[1] {
+					live[kv[0]] = !isDeleted(kv[0], kv[1])
+				}
+			}
+		}
+	}
+	req.kvs = req.kvs[:0]
+	for key, ok := range live {
+		if ok {
+			req.kvs = append(req.kvs, [2]string{key, tombstone})
+		}
+	}
+	sort.Slice(req.kvs, func(a, b int) bool { return req.kvs[a][0] < req.kvs[b][0] })
+	return nil
+}
+
+// keysInRuns returns the keys in [start, end) that appear in any of runs,
+// each sorted by key, deleted or not.
+func keysInRuns(runs [][][2]string, start, end string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, run := range runs {
+		i := sort.Search(len(run), func(i int) bool { return run[i][0] >= start })
+		for ; i < len(run) && run[i][0] < end; i++ {
+			if !seen[run[i][0]] {
+				seen[run[i][0]] = true
+				keys = append(keys, run[i][0])
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package db_test
+
+import (
+	"errors"
+	"mini-leveldb/db"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteAndDeleteRange(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	for _, flush := range []bool{false, true} {
+		name := map[bool]string{false: "replayed", true: "flushed"}[flush]
+		t.Run(name, func(t *testing.T) {
+			dir := "testdata/delete/" + name
+			_ = os.RemoveAll(dir)
+			store, err := db.Open(dir, db.DefaultOptions())
+			require.NoError(t, err)
+
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				require.NoError(t, store.Put(key, "v-"+key))
+			}
+			require.NoError(t, store.Flush())
+			require.NoError(t, store.Delete("b"))
+			require.NoError(t, store.Put("cc", "v-cc"))
+			require.NoError(t, store.DeleteRange("c", "e"))
+			var batch db.WriteBatch
+			batch.Put("f", "v-f")
+			batch.Delete("a")
+			require.NoError(t, store.Write(&batch))
+			require.NoError(t, store.Put("d", "rewritten"))
+
+			check := func(context string) {
+				t.Helper()
+				for _, key := range []string{"a", "b", "c", "cc"} {
+					_, err := store.Get(key)
+					assert.True(t, errors.Is(err, db.ErrNotFound), "%s: %s: %v", context, key, err)
+				}
+				results := store.MultiGet([]string{"b", "e"})
+				assert.True(t, errors.Is(results[0].Error, db.ErrNotFound), context)
+				assert.Equal(t, "v-e", results[1].Value, context)
+
+				it := store.NewIterator()
+				got := map[string]string{}
+				for it.First(); it.Valid(); it.Next() {
+					got[it.Key()] = it.Value()
+				}
+				require.NoError(t, it.Err())
+				it.Close()
+				assert.Equal(t, map[string]string{"d": "rewritten", "e": "v-e", "f": "v-f"}, got, context)
+			}
+
+			check("before reopen")
+			if flush {
+				require.NoError(t, store.Flush())
+				check("after flush")
+			}
+			seq := store.LastSequence()
+			require.NoError(t, store.Close())
+
+			store, err = db.Open(dir, db.DefaultOptions())
+			require.NoError(t, err)
+			defer store.Close()
+			check("after reopen")
+			if !flush {
+				assert.Equal(t, seq, store.LastSequence(), "sequence resumes from the WAL")
+			}
+		})
+	}
+}
+
+func TestSubscribersSeeDeletes(t *testing.T) {
+	dir := "testdata/delete-events"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	store, err := db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+	defer store.Close()
+
+	events := store.Subscribe("k")
+	require.NoError(t, store.Put("k1", "v"))
+	require.NoError(t, store.Delete("k1"))
+
+	put, del := <-events, <-events
+	assert.Equal(t, db.EventPut, put.Type)
+	assert.Equal(t, db.Event{Type: db.EventDelete, Key: "k1", Seq: put.Seq + 1}, del)
+}
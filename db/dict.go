@@ -0,0 +1,128 @@
+package db
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Tables of many small, similar values, such as JSON documents, compress
+// poorly value by value: each value is too short for zstd to learn its
+// repetitions. With Options.CompressionDictSize set, a compaction output
+// holds back its first records while it samples their values, trains a
+// dictionary from the samples, and then compresses every value of the
+// table against it. The dictionary is stored in the table's properties and
+// values compressed with it are flagged valueDictCompressed, so readers
+// that predate dictionaries reject them rather than misread them.
+
+const (
+	// dictSampleFactor is how many times the dictionary size of values
+	// are sampled before training; zstd suggests about a hundred, but a
+	// table's values tend to be alike and the records are held in memory.
+	dictSampleFactor = 32
+
+	// maxDictSampleValue is the largest value sampled. Larger values
+	// compress well on their own.
+	maxDictSampleValue = 4096
+
+	// minDictSamples is the fewest samples a dictionary is trained from;
+	// tables with fewer values are compressed without one.
+	minDictSamples = 16
+
+	// maxCompressionDictSize bounds Options.CompressionDictSize.
+	maxCompressionDictSize = 1 << 20
+)
+
+// validateDictOptions checks Options.CompressionDictSize.
+func validateDictOptions(opts *Options) error {
+	if opts.CompressionDictSize < 0 || opts.CompressionDictSize > maxCompressionDictSize {
+		return fmt.Errorf("invalid CompressionDictSize %d: must be between 0 and %d", opts.CompressionDictSize, maxCompressionDictSize)
+	}
+	return nil
+}
+
+// dictTrainer collects the records a builder holds back and samples their
+// values.
+type dictTrainer struct {
+	size    int
+	pending [][2]string
+	samples [][]byte
+	sampled int
+}
+
+// add holds back a record, reporting whether enough has been sampled to
+// train.
+func (t *dictTrainer) add(key, value string) bool {
+	t.pending = append(t.pending, [2]string{key, value})
+	if len(value) > 0 && len(value) <= maxDictSampleValue {
+		t.samples = append(t.samples, []byte(value))
+		t.sampled += len(value)
+	}
+	return t.sampled >= t.size*dictSampleFactor
+}
+
+// train builds a zstd dictionary of up to t.size bytes from the samples.
+// The dictionary's content is made of samples spread over the whole set,
+// with the entropy tables fitted to all of them. It returns nil when there
+// are too few samples or zstd cannot build one.
+func (t *dictTrainer) train() (dict []byte) {
+	if len(t.samples) < minDictSamples {
+		return nil
+	}
+	// Later bytes of the content are cheapest to reference, so the
+	// samples are taken from the end of the set back to its start.
+	step := max(1, t.sampled/t.size)
+	var picked [][]byte
+	var n int
+	for i := len(t.samples) - 1; i >= 0 && n < t.size; i -= step {
+		sample := t.samples[i]
+		if n+len(sample) > t.size {
+			sample = sample[len(sample)-(t.size-n):]
+		}
+		picked = append(picked, sample)
+		n += len(sample)
+	}
+	history := make([]byte, 0, n)
+	for i := len(picked) - 1; i >= 0; i-- {
+		history = append(history, picked[i]...)
+	}
+
+	// BuildDict panics, dividing by zero, when the history matches every
+	// sample and leaves no literals to fit a table to, as when the values
+	// are all alike. The table is then written without a dictionary.
+	defer func() {
+		if recover() != nil {
+			dict = nil
+		}
+	}()
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       crc32.Checksum(history, castagnoli) | 1,
+		Contents: t.samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return nil
+	}
+	return dict
+}
+
+// newDictEncoder returns an encoder compressing against dict.
+func newDictEncoder(dict []byte) (*zstd.Encoder, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load compression dictionary: %w", err)
+	}
+	return enc, nil
+}
+
+// newDictDecoder returns a decoder for values compressed against dict.
+func newDictDecoder(dict []byte) (*zstd.Decoder, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load compression dictionary: %w", err)
+	}
+	return dec, nil
+}
@@ -1,17 +1,48 @@
 package db
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
+// maxEncodedLength caps any single length-prefixed field or record decoded
+// from a file or connection.
+const maxEncodedLength = 1 << 30
+
+// readFullBounded reads exactly n bytes from r. Large buffers grow as data
+// arrives, so a corrupt length prefix on a short input fails with
+// io.ErrUnexpectedEOF instead of allocating n bytes up front.
+func readFullBounded(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 || n > maxEncodedLength {
+		return nil, fmt.Errorf("length %d out of range", n)
+	}
+	const chunk = 64 << 10
+	if n <= chunk {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func readString(r io.Reader) (string, error) {
 	var length int32
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return "", err
 	}
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
+	buf, err := readFullBounded(r, int64(length))
+	if err != nil {
 		return "", err
 	}
 	return string(buf), nil
@@ -38,9 +69,5 @@ func readBytes(r io.Reader) ([]byte, error) {
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return nil, err
 	}
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return nil, err
-	}
-	return buf, nil
+	return readFullBounded(r, int64(length))
 }
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned, wrapped, by reads of a key that does not
+	// exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrCorruption is matched by errors.Is for every error reporting data
+	// on disk that failed its checksum or could not be decoded, including
+	// each *CorruptionError.
+	ErrCorruption = errors.New("corruption")
+
+	// ErrClosed is returned, wrapped, by operations on a closed database.
+	ErrClosed = errors.New("database closed")
+
+	// ErrDatabaseNotFound is returned, wrapped, by Open when the directory
+	// holds no database and Options.CreateIfMissing is not set.
+	ErrDatabaseNotFound = errors.New("database does not exist")
+
+	// ErrDatabaseExists is returned, wrapped, by Open when the directory
+	// already holds a database and Options.ErrorIfExists is set.
+	ErrDatabaseExists = errors.New("database already exists")
+
+	// ErrLocked is returned, wrapped, by Open when another process, or
+	// another DB in this one, has the database open.
+	ErrLocked = errors.New("database locked")
+
+	// ErrStaleLock is returned, wrapped, by Open when the database's LOCK
+	// file was left by a process that is no longer running and
+	// Options.BreakStaleLock is not set.
+	ErrStaleLock = errors.New("stale database lock")
+)
+
+// CorruptionError reports SSTable data that failed its checksum or could not
+// be decoded.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// Is makes every CorruptionError match ErrCorruption.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
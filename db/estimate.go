@@ -0,0 +1,183 @@
+package db
+
+// estimateSampleKeys bounds the keys sampled from each memtable or table
+// when estimating how many of its entries are overwrites.
+const estimateSampleKeys = 256
+
+// estimateSampleBlocks bounds the data blocks read from each table for its
+// key sample.
+const estimateSampleBlocks = 8
+
+// EstimateNumKeys returns an estimate of the number of distinct keys in the
+// database without scanning it. It adds the entry counts of the memtables
+// and of every table's properties, then subtracts the entries expected to
+// be older versions of keys written again later: a sample of each memtable
+// and table is checked against the bloom filters of the older tables
+// covering those keys, and the fraction that may be present there is
+// discounted. Tombstones count as keys until compaction drops them, so the
+// estimate leans high after deletes; filter false positives make it lean
+// slightly low.
+func (db *DB) EstimateNumKeys() uint64 {
+	return db.EstimateNumKeysInRange("", "")
+}
+
+// EstimateNumKeysInRange is EstimateNumKeys for the keys k with start <= k
+// < end, where an empty end means no upper bound. The entries of each
+// memtable and table that fall in the range are estimated from the share of
+// its key sample that does.
+func (db *DB) EstimateNumKeysInRange(start, end string) uint64 {
+	if db.closed.Load() {
+		return 0
+	}
+
+	// Holding db.mu keeps the memtables and version consistent: a flush
+	// cannot move entries from one to the other meanwhile.
+	db.mu.RLock()
+	mems := []*memTable{db.memTable}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		mems = append(mems, db.imm[i].mem)
+	}
+	type source struct {
+		entries uint64
+		sample  []string
+	}
+	var sources []source
+	for _, mem := range mems {
+		sources = append(sources, source{entries: uint64(mem.len()), sample: mem.sampleKeys(estimateSampleKeys)})
+	}
+	v := db.currentVersion()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	// tables lists every table newest first, so the tables older than
+	// tables[i] are tables[i+1:].
+	var tables []*SSTable
+	for levelNum, level := range v.levels {
+		for i := range level {
+			sst := level[i]
+			if levelNum == 0 {
+				sst = level[len(level)-1-i]
+			}
+			if sst != nil {
+				tables = append(tables, sst)
+			}
+		}
+	}
+
+	whole := start == "" && end == ""
+	// inRange returns the estimated entries of a source in the range and
+	// the sampled keys that are.
+	inRange := func(entries uint64, sample []string) (float64, []string) {
+		if whole {
+			return float64(entries), sample
+		}
+		var keys []string
+		for _, key := range sample {
+			if key >= start && (end == "" || key < end) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return 0, nil
+		}
+		return float64(entries) * float64(len(keys)) / float64(len(sample)), keys
+	}
+
+	var total, overwritten float64
+	for _, src := range sources {
+		entries, sample := inRange(src.entries, src.sample)
+		total += entries
+		overwritten += entries * olderFraction(sample, tables)
+	}
+	for i, sst := range tables {
+		if !whole && (sst.props.LargestKey < start || end != "" && sst.props.SmallestKey >= end) {
+			continue
+		}
+		entries, sample := inRange(sst.props.NumEntries, sst.sampleKeys(estimateSampleKeys))
+		total += entries
+		if i < len(tables)-1 {
+			overwritten += entries * olderFraction(sample, tables[i+1:])
+		}
+	}
+	if overwritten >= total {
+		return 0
+	}
+	return uint64(total - overwritten + 0.5)
+}
+
+// olderFraction returns the fraction of sample that may also be stored in
+// older, according to their key ranges and bloom filters.
+func olderFraction(sample []string, older []*SSTable) float64 {
+	if len(sample) == 0 || len(older) == 0 {
+		return 0
+	}
+	found := 0
+	for _, key := range sample {
+		for _, sst := range older {
+			if sst.overlaps(key, key) && (sst.filter == nil || sst.filter.MayContain(key)) {
+				found++
+				break
+			}
+		}
+	}
+	return float64(found) / float64(len(sample))
+}
+
+// sampleKeys returns up to max keys spread evenly across the memtable.
+func (m *memTable) sampleKeys(max int) []string {
+	stride := m.len()/max + 1
+	var keys []string
+	i := 0
+	m.forEach(func(key, _ string) bool {
+		if i%stride == 0 {
+			keys = append(keys, key)
+		}
+		i++
+		return len(keys) < max
+	})
+	return keys
+}
+
+// sampleKeys returns up to max keys spread across the table. Block-format
+// tables read a few data blocks spread across the file; older tables use
+// the keys their index holds in memory.
+func (s *SSTable) sampleKeys(max int) []string {
+	if err := s.acquire(); err != nil {
+		return nil
+	}
+	defer s.release()
+	if s.file == nil {
+		return nil
+	}
+	var keys []string
+	switch {
+	case s.format >= blockFormatVersion && len(s.blocks) > 0:
+		n := min(len(s.blocks), estimateSampleBlocks)
+		for j := 0; j < n; j++ {
+			b, err := s.readBlock(s.blocks[j*len(s.blocks)/n])
+			if err != nil {
+				continue
+			}
+			b.forEach(func(key string, _ []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+		}
+	case len(s.partitions) > 0:
+		for _, p := range s.partitions {
+			keys = append(keys, p.lastKey)
+		}
+	default:
+		for _, e := range s.index {
+			keys = append(keys, e.key)
+		}
+	}
+	if len(keys) <= max {
+		return keys
+	}
+	sample := make([]string, max)
+	for i := range sample {
+		sample[i] = keys[i*len(keys)/max]
+	}
+	return sample
+}
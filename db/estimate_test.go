@@ -0,0 +1,47 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateNumKeys(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("estimate", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	assert.Zero(t, store.EstimateNumKeys())
+
+	put := func(i int, value string) {
+		require.NoError(t, store.Put(fmt.Sprintf("key%05d", i), value))
+	}
+	for i := 0; i < 1000; i++ {
+		put(i, "v1")
+	}
+	require.NoError(t, store.Flush())
+	assert.Equal(t, uint64(1000), store.EstimateNumKeys(), "a single table is counted exactly")
+
+	// Overwrite half the keys in a newer table, then add new keys and more
+	// overwrites in the memtable: 1200 distinct keys from 1800 entries.
+	for i := 0; i < 1000; i += 2 {
+		put(i, "v2")
+	}
+	require.NoError(t, store.Flush())
+	for i := 1000; i < 1200; i++ {
+		put(i, "v3")
+	}
+	for i := 1; i < 200; i += 2 {
+		put(i, "v3")
+	}
+
+	assert.InEpsilon(t, 1200, store.EstimateNumKeys(), 0.1)
+	assert.InEpsilon(t, 500, store.EstimateNumKeysInRange("key00500", "key01000"), 0.2)
+	assert.InEpsilon(t, 200, store.EstimateNumKeysInRange("key01000", ""), 0.2)
+	assert.Zero(t, store.EstimateNumKeysInRange("other", ""))
+}
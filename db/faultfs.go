@@ -0,0 +1,253 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// FaultFileSystem is an in-memory FileSystem that injects failures, for
+// durability testing. It remembers what each file held when it was last
+// synced, so DropUnsyncedData can simulate a crash that loses everything
+// the operating system had not yet written out. Creating, renaming, linking
+// and removing files are treated as immediately durable unless
+// RequireDirSync is set.
+type FaultFileSystem struct {
+	*MemFileSystem
+
+	mu        sync.Mutex
+	synced    map[*memData][]byte
+	dirSync   bool
+	durable   map[string]*memData // the names a crash keeps, with dirSync
+	writes    int
+	failWrite int // fail the write with this count; zero disables
+	failSyncs bool
+	hook      func(op, name string)
+}
+
+// NewFaultFileSystem returns an empty FaultFileSystem with no failures
+// armed.
+func NewFaultFileSystem() *FaultFileSystem {
+	return &FaultFileSystem{
+		MemFileSystem: NewMemFileSystem(),
+		synced:        make(map[*memData][]byte),
+	}
+}
+
+// FailWriteAfter makes the nth write from now fail with EIO without
+// writing anything. Later writes succeed again. n <= 0 disarms it.
+func (fs *FaultFileSystem) FailWriteAfter(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if n <= 0 {
+		fs.failWrite = 0
+		return
+	}
+	fs.failWrite = fs.writes + n
+}
+
+// FailSyncs makes every Sync fail with EIO while on is set. A failed sync
+// leaves the file's data unsynced.
+func (fs *FaultFileSystem) FailSyncs(on bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failSyncs = on
+}
+
+// RequireDirSync makes creating, renaming, linking and removing files
+// durable only once SyncDir is called on their directory, as on a real
+// filesystem: a crash while on is set brings back the names as of each
+// directory's last sync. The names that exist when it is turned on are
+// taken as synced.
+func (fs *FaultFileSystem) RequireDirSync(on bool) {
+	fs.MemFileSystem.mu.Lock()
+	defer fs.MemFileSystem.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dirSync = on
+	fs.durable = nil
+	if on {
+		fs.durable = make(map[string]*memData, len(fs.MemFileSystem.files))
+		for name, d := range fs.MemFileSystem.files {
+			fs.durable[name] = d
+		}
+	}
+}
+
+// Writes returns the number of writes attempted so far.
+func (fs *FaultFileSystem) Writes() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.writes
+}
+
+// OnMutation arranges for fn to be called before every write, sync,
+// directory sync, create, rename, link and remove, with the operation and
+// file name. It is called without any filesystem lock held, so it may take
+// a CrashImage.
+func (fs *FaultFileSystem) OnMutation(fn func(op, name string)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.hook = fn
+}
+
+func (fs *FaultFileSystem) mutating(op, name string) {
+	fs.mu.Lock()
+	hook := fs.hook
+	fs.mu.Unlock()
+	if hook != nil {
+		hook(op, name)
+	}
+}
+
+// CrashImage returns a new FaultFileSystem holding what would survive a
+// crash right now: every file with its synced contents only. Names linked
+// to the same file stay linked.
+func (fs *FaultFileSystem) CrashImage() *FaultFileSystem {
+	fs.MemFileSystem.mu.Lock()
+	defer fs.MemFileSystem.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	image := NewFaultFileSystem()
+	for dir := range fs.MemFileSystem.dirs {
+		image.MemFileSystem.dirs[dir] = true
+	}
+	files := fs.MemFileSystem.files
+	if fs.dirSync {
+		files = fs.durable
+	}
+	copies := make(map[*memData]*memData)
+	for name, d := range files {
+		c, ok := copies[d]
+		if !ok {
+			data := append([]byte(nil), fs.synced[d]...)
+			c = &memData{data: data, modTime: d.modTime}
+			copies[d] = c
+			image.synced[c] = data
+		}
+		image.MemFileSystem.files[name] = c
+	}
+	return image
+}
+
+// DropUnsyncedData simulates a crash: every file is cut back to the
+// contents it had at its last successful Sync, or emptied if it was never
+// synced, and with RequireDirSync the names go back to those last synced.
+// Handles opened before the crash must not be used afterwards.
+func (fs *FaultFileSystem) DropUnsyncedData() {
+	fs.MemFileSystem.mu.Lock()
+	defer fs.MemFileSystem.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.dirSync {
+		fs.MemFileSystem.files = make(map[string]*memData, len(fs.durable))
+		for name, d := range fs.durable {
+			fs.MemFileSystem.files[name] = d
+		}
+	}
+
+	for _, d := range fs.MemFileSystem.files {
+		d.mu.Lock()
+		d.data = append([]byte(nil), fs.synced[d]...)
+		d.mu.Unlock()
+	}
+}
+
+func (fs *FaultFileSystem) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *FaultFileSystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FaultFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		fs.mutating("create", name)
+	}
+	f, err := fs.MemFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{memFile: f.(*memFile), fs: fs}, nil
+}
+
+func (fs *FaultFileSystem) Remove(name string) error {
+	fs.mutating("remove", name)
+	return fs.MemFileSystem.Remove(name)
+}
+
+func (fs *FaultFileSystem) Rename(oldname, newname string) error {
+	fs.mutating("rename", oldname)
+	return fs.MemFileSystem.Rename(oldname, newname)
+}
+
+func (fs *FaultFileSystem) Link(oldname, newname string) error {
+	fs.mutating("link", oldname)
+	return fs.MemFileSystem.Link(oldname, newname)
+}
+
+// SyncDir fails with EIO while FailSyncs is set. With RequireDirSync it
+// makes the current names in dir the ones a crash keeps.
+func (fs *FaultFileSystem) SyncDir(dir string) error {
+	fs.mutating("syncdir", dir)
+	fs.MemFileSystem.mu.Lock()
+	defer fs.MemFileSystem.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.failSyncs {
+		return &os.PathError{Op: "sync", Path: dir, Err: syscall.EIO}
+	}
+	if !fs.dirSync {
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	for name := range fs.durable {
+		if filepath.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+	for name, d := range fs.MemFileSystem.files {
+		if filepath.Dir(name) == dir {
+			fs.durable[name] = d
+		}
+	}
+	return nil
+}
+
+// faultFile routes writes and syncs through its FaultFileSystem.
+type faultFile struct {
+	*memFile
+	fs *FaultFileSystem
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mutating("write", f.name)
+	f.fs.mu.Lock()
+	f.fs.writes++
+	fail := f.fs.writes == f.fs.failWrite
+	f.fs.mu.Unlock()
+	if fail {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EIO}
+	}
+	return f.memFile.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mutating("sync", f.name)
+	if err := f.memFile.Sync(); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.failSyncs {
+		return &os.PathError{Op: "sync", Path: f.name, Err: syscall.EIO}
+	}
+	f.d.mu.RLock()
+	f.fs.synced[f.d] = append([]byte(nil), f.d.data...)
+	f.d.mu.RUnlock()
+	return nil
+}
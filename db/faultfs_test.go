@@ -0,0 +1,149 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mini-leveldb/db"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const faultDir = "fault/db"
+
+func faultOptions(fs db.FileSystem) *db.Options {
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	return opts
+}
+
+// faultWorkload writes keys, flushing every 20 writes so the run covers the
+// WAL, SSTables, the MANIFEST and compaction. It stops at the first error
+// and returns the writes that were acknowledged.
+func faultWorkload(store *db.DB, n int) (map[string]string, error) {
+	acked := make(map[string]string)
+	for i := 0; i < n; i++ {
+		key, value := fmt.Sprintf("key%03d", i%70), fmt.Sprintf("value%d", i)
+		if err := store.Put(key, value); err != nil {
+			return acked, err
+		}
+		acked[key] = value
+		if i%20 == 19 {
+			if err := store.Flush(); err != nil {
+				return acked, err
+			}
+		}
+	}
+	return acked, nil
+}
+
+// assertRecovered reopens the database after a crash and checks that every
+// acknowledged write is there and that it still accepts writes.
+func assertRecovered(t *testing.T, fs *db.FaultFileSystem, acked map[string]string, context string) {
+	t.Helper()
+	fs.DropUnsyncedData()
+
+	store, err := db.Open(faultDir, faultOptions(fs))
+	require.NoError(t, err, context)
+	for key, want := range acked {
+		got, err := store.Get(key)
+		if assert.NoError(t, err, "%s: %s", context, key) {
+			assert.Equal(t, want, got, "%s: %s", context, key)
+		}
+	}
+	require.NoError(t, store.Put("after-recovery", "ok"), context)
+	require.NoError(t, store.Flush(), context)
+	require.NoError(t, store.Close(), context)
+}
+
+func TestCrashKeepsAcknowledgedWrites(t *testing.T) {
+	for _, n := range []int{0, 1, 19, 20, 21, 95, 200} {
+		fs := db.NewFaultFileSystem()
+		store, err := db.Open(faultDir, faultOptions(fs))
+		require.NoError(t, err)
+
+		acked, err := faultWorkload(store, n)
+		require.NoError(t, err)
+		// The store is abandoned, not closed, as a crash would leave it.
+		assertRecovered(t, fs, acked, fmt.Sprintf("crash after %d writes", n))
+	}
+}
+
+func TestFailedWriteLosesNoAcknowledgedData(t *testing.T) {
+	// Count the writes a clean run makes, then fail each one in turn.
+	probe := db.NewFaultFileSystem()
+	store, err := db.Open(faultDir, faultOptions(probe))
+	require.NoError(t, err)
+	start := probe.Writes()
+	_, err = faultWorkload(store, 120)
+	require.NoError(t, err)
+	total := probe.Writes() - start
+	require.Greater(t, total, 0)
+
+	for n := 1; n <= total; n++ {
+		fs := db.NewFaultFileSystem()
+		store, err := db.Open(faultDir, faultOptions(fs))
+		require.NoError(t, err)
+
+		fs.FailWriteAfter(n)
+		// A failed compaction is logged rather than returned, so the
+		// workload may finish; either way nothing acknowledged is lost.
+		acked, err := faultWorkload(store, 120)
+		if err != nil {
+			assert.True(t, errors.Is(err, syscall.EIO), "write %d: %v", n, err)
+		}
+		assertRecovered(t, fs, acked, fmt.Sprintf("write %d failed", n))
+	}
+}
+
+func TestSyncFailureIsReportedAndRecoverable(t *testing.T) {
+	fs := db.NewFaultFileSystem()
+	store, err := db.Open(faultDir, faultOptions(fs))
+	require.NoError(t, err)
+
+	acked, err := faultWorkload(store, 30)
+	require.NoError(t, err)
+
+	fs.FailSyncs(true)
+	err = store.Put("unsynced", "value")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.EIO), "%v", err)
+	assert.Error(t, store.Flush())
+	fs.FailSyncs(false)
+
+	assertRecovered(t, fs, acked, "sync failed")
+}
+
+func TestFlushedWALIsNotReplayed(t *testing.T) {
+	fs := db.NewFaultFileSystem()
+	store, err := db.Open(faultDir, faultOptions(fs))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key", "old"))
+	wals, err := fs.Glob(faultDir + "/*.walb")
+	require.NoError(t, err)
+	require.Len(t, wals, 1)
+	f, err := fs.Open(wals[0])
+	require.NoError(t, err)
+	flushed, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Put("key", "new"))
+	require.NoError(t, store.Flush())
+
+	// Bring the first WAL back, as if removing it after its flush had
+	// failed or been lost in a crash.
+	f, err = fs.Create(wals[0])
+	require.NoError(t, err)
+	_, err = f.Write(flushed)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+
+	assertRecovered(t, fs, map[string]string{"key": "new"}, "flushed WAL left behind")
+}
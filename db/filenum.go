@@ -0,0 +1,121 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Every SSTable, WAL and MANIFEST is named after a number from a single
+// monotonically increasing counter, so later files always sort after
+// earlier ones and names never collide however coarse the clock. The next
+// number is recorded in each MANIFEST edit.
+
+// fileNumberPattern matches numbered files: SSTables, their temporary files
+// and MANIFESTs in the first group, WALs, column family WALs included, in
+// the second.
+var fileNumberPattern = regexp.MustCompile(`^(?:(?:sstable_(?:l\d+_)?|MANIFEST-)(\d+)(?:\.sst)?(?:\.tmp)?|(\d+)(?:\.cf-[0-9a-f]+)?\.walb)$`)
+
+// tableFileName returns the name of the SSTable with file number num.
+// Tables written by compaction carry their level in the name, which Repair
+// uses to order tables it finds without a MANIFEST.
+func tableFileName(level int, num uint64) string {
+	if level == 0 {
+		return fmt.Sprintf("sstable_%06d.sst", num)
+	}
+	return fmt.Sprintf("sstable_l%d_%06d.sst", level, num)
+}
+
+// maxFileNumber returns the largest file number among the SSTables,
+// temporary tables, WALs and MANIFESTs in dir. Tables from before file numbering
+// carry a nanosecond timestamp in that position, so numbering resumes above
+// them too.
+func maxFileNumber(fs FileSystem, dir string) (uint64, error) {
+	names, err := fs.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan file numbers: %w", err)
+	}
+	var max uint64
+	for _, path := range names {
+		m := fileNumberPattern.FindStringSubmatch(filepath.Base(path))
+		if m == nil {
+			continue
+		}
+		if num, err := strconv.ParseUint(m[1]+m[2], 10, 64); err == nil && num > max {
+			max = num
+		}
+	}
+	return max, nil
+}
+
+// walFileName returns the name of the WAL with file number num.
+func walFileName(num uint64) string {
+	return fmt.Sprintf("%06d.walb", num)
+}
+
+// familyWALFileName returns the name of the WAL with file number num that
+// logs the writes to column family family alone, kept with
+// Options.WALPerColumnFamily. The family's name is hex-encoded, as it may
+// hold any byte but 0x00.
+func familyWALFileName(num uint64, family string) string {
+	return fmt.Sprintf("%06d%s", num, familyWALSuffix(family))
+}
+
+// familyWALSuffix is how the name of every WAL of family ends.
+func familyWALSuffix(family string) string {
+	return fmt.Sprintf(".cf-%x.walb", family)
+}
+
+// newFileNumber allocates an unused file number.
+func (db *DB) newFileNumber() uint64 {
+	return db.nextFile.Add(1) - 1
+}
+
+// logEdit appends edit to the MANIFEST together with the next file number,
+// so numbers handed out before it are never reused after a restart. A
+// MANIFEST grown past Options.MaxManifestFileSize is first replaced by a
+// snapshot of the tree. db.mu must be held.
+func (db *DB) logEdit(edit *versionEdit) error {
+	limit := db.opts.MaxManifestFileSize
+	if limit == 0 {
+		limit = defaultMaxManifestFileSize
+	}
+	if db.manifest.size >= limit && db.walPins == 0 {
+		if err := db.rollManifest(); err != nil {
+			return fmt.Errorf("failed to replace manifest: %w", err)
+		}
+	}
+	edit.nextFile = db.nextFile.Load()
+	edit.time = time.Now()
+	return db.manifest.append(edit)
+}
+
+// rollManifest writes the current tree to a new MANIFEST, points CURRENT at
+// it and removes the old one. The tree is the one the old MANIFEST
+// describes, as edits reach db.levels only once they are logged. It is not
+// done while a LiveFileSet is held, since the set lists the old MANIFEST.
+// db.mu must be held.
+func (db *DB) rollManifest() error {
+	old := db.manifest
+	err := writeManifestSnapshot(db.fs, db.dir, db.levels, db.compactPointers, db.newFileNumber(), db.logNumber, old.lastSeq)
+	if err != nil {
+		return err
+	}
+	m, err := openManifest(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	m.lastSeq = old.lastSeq
+	db.manifest = m
+	if err := old.close(); err != nil {
+		log.Printf("Warning: failed to close old manifest: %v", err)
+	}
+	if err := db.fs.Remove(old.path); err != nil {
+		log.Printf("Warning: failed to remove old manifest: %v", err)
+	}
+	log.Printf("Replaced %d-byte manifest with %s (%d bytes)", old.size, filepath.Base(m.path), m.size)
+	return nil
+}
@@ -0,0 +1,130 @@
+package db_test
+
+import (
+	"io"
+	"mini-leveldb/db"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readMemFile(t *testing.T, fs db.FileSystem, name string) string {
+	f, err := fs.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFileNumbersAndCurrent(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+
+	pattern := regexp.MustCompile(`^sstable_(\d+)\.sst$`)
+	tableNumbers := func() []uint64 {
+		names, err := fs.ReadDir("num")
+		require.NoError(t, err)
+		var nums []uint64
+		for _, name := range names {
+			if m := pattern.FindStringSubmatch(name); m != nil {
+				n, err := strconv.ParseUint(m[1], 10, 64)
+				require.NoError(t, err)
+				nums = append(nums, n)
+			}
+		}
+		return nums
+	}
+
+	store, err := db.Open("num", opts)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b"} {
+		require.NoError(t, store.Put(key, "1"))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Close())
+
+	current := readMemFile(t, fs, "num/CURRENT")
+	assert.Regexp(t, `^MANIFEST-\d{6}\n$`, current)
+	first := tableNumbers()
+	require.Len(t, first, 2)
+	assert.Less(t, first[0], first[1])
+
+	store, err = db.Open("num", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("c", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Close())
+	nums := tableNumbers()
+	require.Len(t, nums, 3)
+	assert.Greater(t, nums[2], first[1], "numbering resumes after a restart")
+
+	// An unnumbered MANIFEST without CURRENT, as older versions wrote, is
+	// read and replaced by a numbered one.
+	manifest := filepath.Join("num", strings.TrimSpace(current))
+	require.NoError(t, fs.Rename(manifest, "num/MANIFEST"))
+	require.NoError(t, fs.Remove("num/CURRENT"))
+
+	store, err = db.Open("num", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	for _, key := range []string{"a", "b", "c"} {
+		value, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "1", value)
+	}
+	assert.Regexp(t, `^MANIFEST-\d{6}\n$`, readMemFile(t, fs, "num/CURRENT"))
+	_, err = fs.Stat("num/MANIFEST")
+	assert.Error(t, err, "the legacy MANIFEST is removed once replaced")
+}
+
+func TestManifestIsReplacedBySnapshotWhenLarge(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.MaxManifestFileSize = 256
+
+	manifests := func() []string {
+		names, err := fs.ReadDir("roll")
+		require.NoError(t, err)
+		var found []string
+		for _, name := range names {
+			if strings.HasPrefix(name, "MANIFEST") {
+				found = append(found, name)
+			}
+		}
+		return found
+	}
+
+	store, err := db.Open("roll", opts)
+	require.NoError(t, err)
+	first := manifests()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Put(strconv.Itoa(i), "value"))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Close())
+
+	names := manifests()
+	require.Len(t, names, 1, "the old MANIFEST is removed")
+	assert.NotEqual(t, first, names)
+	assert.Equal(t, names[0]+"\n", readMemFile(t, fs, "roll/CURRENT"))
+	info, err := fs.Stat(filepath.Join("roll", names[0]))
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(2*opts.MaxManifestFileSize))
+
+	store, err = db.Open("roll", opts)
+	require.NoError(t, err)
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		value, err := store.Get(strconv.Itoa(i))
+		require.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+}
@@ -0,0 +1,446 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// immutable is a full memtable waiting for the background flush, with the
+// WAL files that hold its writes.
+type immutable struct {
+	mem  *memTable
+	wals []string
+	// firstSeq and lastSeq span the sequence numbers mem may hold.
+	firstSeq, lastSeq uint64
+	// abandoned is set, under db.mu, once Shutdown cut its flush short.
+	abandoned bool
+}
+
+// Flush writes the memtable to a new L0 SSTable and returns once it, and
+// every memtable queued before it, is on disk and any compaction it made
+// due has run. Entries are written in strictly ascending key order, so
+// flushing the same writes always produces byte-identical table contents.
+func (db *DB) Flush() error {
+	if db.closed.Load() {
+		return fmt.Errorf("failed to flush: %w", ErrClosed)
+	}
+	db.committer.logMu.Lock()
+	db.mu.Lock()
+	err := db.flushLocked()
+	db.mu.Unlock()
+	db.committer.logMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := db.maybeCompact(); err != nil && !errors.Is(err, errShutdownAborted) {
+		log.Printf("Compaction failed: %v", err)
+	}
+	return nil
+}
+
+// flushLocked is Flush for callers already holding logMu and db.mu. db.mu is
+// released while it waits for the background flush.
+func (db *DB) flushLocked() error {
+	if err := db.rotateMemTable(); err != nil {
+		return err
+	}
+	if len(db.imm) == 0 {
+		return nil
+	}
+	target := db.imm[len(db.imm)-1]
+	db.flushErr = nil
+	db.scheduleFlush()
+	for db.queued(target) && db.flushErr == nil {
+		db.flushCond.Wait()
+	}
+	if db.queued(target) {
+		return db.flushErr
+	}
+	return nil
+}
+
+// queued reports whether imm is still waiting to be flushed. db.mu must be
+// held.
+func (db *DB) queued(imm *immutable) bool {
+	for _, m := range db.imm {
+		if m == imm {
+			return true
+		}
+	}
+	return false
+}
+
+// maxImmutable returns how many memtables may wait to be flushed.
+func (db *DB) maxImmutable() int {
+	if db.opts.MaxImmutableMemTables > 0 {
+		return db.opts.MaxImmutableMemTables
+	}
+	return 1
+}
+
+// rotateMemTable makes the active memtable immutable, queues it for the
+// background flush, and starts a fresh memtable with a WAL of its own, so
+// writes can continue while the old one is written out. An empty memtable
+// is left in place. logMu and db.mu must be held.
+func (db *DB) rotateMemTable() error {
+	if db.memTable.len() == 0 {
+		return nil
+	}
+
+	// The retired WAL must be durable before it is closed, as nothing
+	// syncs it afterwards.
+	if !db.syncWALEveryWrite() {
+		if err := db.syncWALs(); err != nil {
+			return err
+		}
+		db.durableSeq.Store(db.seq)
+	}
+
+	path := filepath.Join(db.dir, walFileName(db.newFileNumber()))
+	wal, err := openWAL(db.fs, path)
+	if err != nil {
+		return fmt.Errorf("failed to create new WAL: %w", err)
+	}
+	db.configureWAL(wal)
+	if err := wal.appendCheckpoint(db.seq); err != nil {
+		wal.Close()
+		db.fs.Remove(path)
+		return err
+	}
+	if err := db.wal.Close(); err != nil {
+		wal.Close()
+		db.fs.Remove(path)
+		return fmt.Errorf("failed to close WAL: %w", err)
+	}
+	if err := db.closeFamilyWALs(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	db.imm = append(db.imm, &immutable{mem: db.memTable, wals: db.wals, firstSeq: db.memFirstSeq, lastSeq: db.seq})
+	db.memFirstSeq = db.seq + 1
+	db.memTable = newMemTable()
+	db.wal = wal
+	db.wals = []string{path}
+	db.scheduleFlush()
+	return nil
+}
+
+// scheduleFlush wakes the flush goroutine.
+func (db *DB) scheduleFlush() {
+	select {
+	case db.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop persists immutable memtables in the background, oldest first.
+// After a failed flush it waits to be scheduled again before retrying. Once
+// the database is closing it starts no further flushes, leaving the queued
+// memtables to be replayed from their WALs.
+func (db *DB) flushLoop() {
+	defer db.bgWG.Done()
+
+	for {
+		select {
+		case <-db.bgStop:
+			db.mu.Lock()
+			db.flushErr = ErrClosed
+			db.flushCond.Broadcast()
+			db.mu.Unlock()
+			return
+		case <-db.flushCh:
+		}
+		for !db.stopping() && db.flushOldest() {
+		}
+	}
+}
+
+// stopping reports whether the background goroutines have been told to stop.
+func (db *DB) stopping() bool {
+	select {
+	case <-db.bgStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushIntervalLoop rotates the memtable every interval if it holds any
+// writes, leaving the flush itself to flushLoop. A tick is skipped while
+// the immutable queue is full, as a flush is then already under way.
+func (db *DB) flushIntervalLoop(interval time.Duration) {
+	defer db.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.committer.logMu.Lock()
+			db.mu.Lock()
+			var err error
+			if len(db.imm) < db.maxImmutable() {
+				err = db.rotateMemTable()
+			}
+			db.mu.Unlock()
+			db.committer.logMu.Unlock()
+			if err != nil {
+				log.Printf("Warning: periodic flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// flushOldest writes the oldest immutable memtable to an L0 SSTable without
+// holding db.mu, then installs the table, drops the memtable and its WALs,
+// and runs any compaction that is due. It reports whether a memtable was
+// flushed.
+func (db *DB) flushOldest() bool {
+	db.mu.RLock()
+	var imm *immutable
+	if len(db.imm) > 0 && db.flushErr == nil {
+		imm = db.imm[0]
+	}
+	db.mu.RUnlock()
+	if imm == nil {
+		return false
+	}
+
+	sstablePath := filepath.Join(db.dir, tableFileName(0, db.newFileNumber()))
+	db.addPending(sstablePath)
+	start := time.Now()
+	sst, err := db.writeL0Table(imm.mem, sstablePath)
+
+	db.mu.Lock()
+	delete(db.pending, filepath.Base(sstablePath))
+	if err == nil {
+		err = db.installL0Table(sst, imm)
+	}
+	if errors.Is(err, errShutdownAborted) {
+		imm.abandoned = true
+		db.noteAbandoned(fmt.Sprintf("flush of %d entries to L0", imm.mem.len()))
+		db.flushErr = err
+	} else if err != nil {
+		log.Printf("Flush failed: %v", err)
+		db.flushErr = err
+	} else {
+		db.recordFlush(sst, time.Since(start))
+	}
+	db.flushCond.Broadcast()
+	db.mu.Unlock()
+	if err != nil {
+		return false
+	}
+
+	if err := db.maybeCompact(); err != nil {
+		log.Printf("Compaction failed: %v", err)
+	}
+	return true
+}
+
+// writeL0Table writes mem to a new SSTable at sstablePath, moving large
+// values to the value log if separation is enabled.
+func (db *DB) writeL0Table(mem *memTable, sstablePath string) (*SSTable, error) {
+	tmpPath := sstablePath + ".tmp"
+
+	sst := db.newTable(tmpPath)
+	sst.separated = db.opts.ValueLogThreshold > 0
+	builder, err := newTableBuilder(sst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write SSTable: %w", err)
+	}
+	mem.forEach(func(key, value string) bool {
+		if db.aborting.Load() {
+			err = errShutdownAborted
+			return false
+		}
+		if sst.separated {
+			if value, err = db.separateValue(key, value); err != nil {
+				err = fmt.Errorf("failed to separate values: %w", err)
+				return false
+			}
+		}
+		err = builder.add(key, value)
+		return err == nil
+	})
+	if err == nil && sst.separated {
+		if err = db.vlog.sync(); err != nil {
+			err = fmt.Errorf("failed to sync value log: %w", err)
+		}
+	}
+	if err != nil {
+		builder.Abandon()
+		return nil, err
+	}
+	if err := builder.Finish(); err != nil {
+		builder.Abandon()
+		return nil, fmt.Errorf("failed to write SSTable: %w", err)
+	}
+
+	if err := fileSync(db.fs, tmpPath); err != nil {
+		return nil, fmt.Errorf("failed to sync SSTable file: %w", err)
+	}
+
+	if err := db.fs.Rename(tmpPath, sstablePath); err != nil {
+		return nil, fmt.Errorf("failed to rename SSTable file: %w", err)
+	}
+	if err := syncDirOf(db.fs, sstablePath); err != nil {
+		return nil, err
+	}
+
+	sst.path = sstablePath
+	if err := sst.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load SSTable after writing: %w", err)
+	}
+	return sst, nil
+}
+
+// installL0Table records sst, the flushed form of imm, in the MANIFEST and
+// the tree, and retires imm and its WALs. db.mu must be held.
+//
+// By now sst is synced and durably named. The same MANIFEST edit that adds
+// it advances the log number past imm's WALs, so recovery replays them
+// until the edit is durable and never after, whether or not the WALs were
+// removed: a crash before the edit finds the table unlisted, deletes it as
+// obsolete and replays the WALs; a crash after it loads the table and
+// deletes the WALs.
+func (db *DB) installL0Table(sst *SSTable, imm *immutable) error {
+	sst.smallestSeq, sst.largestSeq = imm.firstSeq, imm.lastSeq
+	edit := &versionEdit{}
+	edit.addFile(0, sst)
+	edit.logNumber = db.oldestLiveWAL()
+	edit.lastSeq = db.seq
+	if err := db.logEdit(edit); err != nil {
+		sst.Close()
+		return fmt.Errorf("failed to record SSTable in manifest: %w", err)
+	}
+	db.logNumber = edit.logNumber
+
+	db.levels[0] = append(db.levels[0], sst)
+	db.installVersion()
+	db.imm = db.imm[1:]
+	if db.walPins > 0 {
+		db.pinnedWALs = append(db.pinnedWALs, imm.wals...)
+	} else {
+		db.retireWALs(imm.wals)
+	}
+
+	log.Printf("Flushed %d entries to SSTable", sst.props.NumEntries)
+	return nil
+}
+
+// oldestLiveWAL returns the number of the oldest WAL left once db.imm[0] is
+// flushed: the first of the next immutable memtable's, or the active one's.
+// db.mu must be held.
+func (db *DB) oldestLiveWAL() uint64 {
+	if len(db.imm) > 1 {
+		return walNumber(db.imm[1].wals[0])
+	}
+	return walNumber(db.wals[0])
+}
+
+// removeWALs deletes flushed WALs.
+func (db *DB) removeWALs(paths []string) {
+	for _, path := range paths {
+		if err := db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove flushed WAL %s: %v", path, err)
+		}
+	}
+	db.syncRemovals(paths)
+}
+
+// syncRemovals makes the removal of paths, files in the database directory,
+// durable. A removal that is lost leaves a file the next open collects, so
+// failing to sync only warrants a warning.
+func (db *DB) syncRemovals(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	if err := db.fs.SyncDir(db.dir); err != nil {
+		log.Printf("Warning: failed to sync database directory: %v", err)
+	}
+}
+
+// memGet looks key up in the active memtable and then the immutable ones,
+// newest first. db.mu must be held.
+func (db *DB) memGet(key string) (string, bool) {
+	if value, ok := db.memTable.get(key); ok {
+		return value, true
+	}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		if value, ok := db.imm[i].mem.get(key); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// memEntries returns the entries of the immutable and active memtables
+// combined in key order, newer entries replacing older ones. db.mu must be
+// held.
+func (db *DB) memEntries() [][2]string {
+	runs := [][][2]string{db.memTable.entries()}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		runs = append(runs, db.imm[i].mem.entries())
+	}
+	return mergeRuns(runs)
+}
+
+// finalFlush flushes every memtable for a clean close, giving up after
+// timeout if it is positive. On timeout the background goroutines are
+// stopped, which ends the wait once any table being written is installed.
+func (db *DB) finalFlush(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		db.committer.logMu.Lock()
+		defer db.committer.logMu.Unlock()
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		done <- db.flushLocked()
+	}()
+
+	if timeout <= 0 {
+		if err := <-done; err != nil {
+			return fmt.Errorf("failed to flush memtable on close: %w", err)
+		}
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to flush memtable on close: %w", err)
+		}
+		return nil
+	case <-timer.C:
+	}
+	db.stopBackground()
+	if err := <-done; err != nil {
+		return fmt.Errorf("failed to flush memtable on close within %v: %w", timeout, err)
+	}
+	return nil
+}
+
+// removeEmptyWALs deletes the WALs of the active memtable once a clean close
+// has left it and the immutable queue empty. The WAL must be closed.
+func (db *DB) removeEmptyWALs() {
+	if db.memTable.len() > 0 || len(db.imm) > 0 {
+		return
+	}
+	for _, path := range db.wals {
+		if err := db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove WAL %s: %v", path, err)
+		}
+	}
+	db.syncRemovals(db.wals)
+	db.wals = nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// fuzzTable returns the bytes of a small table in the current format.
+func fuzzTable(f *testing.F, compression CompressionType) []byte {
+	fs := NewMemFileSystem()
+	sst := &SSTable{path: "seed.sst", fs: fs, compression: compression}
+	var kvs [][2]string
+	for i := 0; i < 40; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)})
+	}
+	if err := sst.Write(kvs); err != nil {
+		f.Fatal(err)
+	}
+	data, err := readFile(fs, "seed.sst")
+	if err != nil {
+		f.Fatal(err)
+	}
+	return data
+}
+
+func FuzzSSTableLoad(f *testing.F) {
+	f.Add(fuzzTable(f, NoCompression))
+	f.Add(fuzzTable(f, SnappyCompression))
+	f.Add([]byte{})
+	f.Add(make([]byte, legacyFooterSize))
+
+	// A filter claiming zero bits but a non-zero hash count.
+	zeroBits := fuzzTable(f, NoCompression)
+	footer, err := parseFooter(zeroBits)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, metaOffset, err := readBytesFromMmap(zeroBits, int(footer.filterOffset))
+	if err != nil {
+		f.Fatal(err)
+	}
+	binary.LittleEndian.PutUint64(zeroBits[metaOffset:], 0)
+	f.Add(zeroBits)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := NewMemFileSystem()
+		file, err := fs.Create("fuzz.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(data)
+		file.Close()
+
+		sst := &SSTable{path: "fuzz.sst", fs: fs, verifyChecksums: true}
+		defer sst.Close()
+		if err := sst.Load(); err != nil {
+			return
+		}
+		// A table that loads must answer reads without panicking, and
+		// can never hold more records than it has bytes.
+		kvs, err := sst.entries()
+		if err == nil && len(kvs) > len(data) {
+			t.Fatalf("%d records decoded from %d bytes", len(kvs), len(data))
+		}
+		for _, key := range []string{"", "key00", "key20", "zzz"} {
+			sst.lookup(key)
+		}
+		it := newMergingIterator(levelIterators(0, []*SSTable{sst}, false))
+		for it.seek("key10"); it.ok; it.next() {
+		}
+	})
+}
+
+func FuzzReadStringFromMmap(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 0, 'a', 'b', 'c'}, 0)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	f.Add([]byte{1, 0}, -3)
+
+	f.Fuzz(func(t *testing.T, data []byte, offset int) {
+		s, next, err := readStringFromMmap(data, offset)
+		if err != nil {
+			return
+		}
+		if len(s) > len(data) || next > len(data) || next != offset+4+len(s) {
+			t.Fatalf("decoded %d bytes ending at %d from %d bytes", len(s), next, len(data))
+		}
+	})
+}
+
+func FuzzReadWALRecord(f *testing.F) {
+	var seed bytes.Buffer
+	for _, kv := range [][2]string{{"key", "value"}, {batchRecordKey, string(encodeBatch([][2]string{{"a", "1"}}))}} {
+		data := make([]byte, 8+len(kv[0])+len(kv[1]))
+		binary.LittleEndian.PutUint32(data[0:4], uint32(len(kv[0])))
+		copy(data[4:], kv[0])
+		binary.LittleEndian.PutUint32(data[4+len(kv[0]):], uint32(len(kv[1])))
+		copy(data[8+len(kv[0]):], kv[1])
+		binary.Write(&seed, binary.LittleEndian, uint32(len(data)))
+		binary.Write(&seed, binary.LittleEndian, crc32.ChecksumIEEE(data))
+		seed.Write(data)
+	}
+	typed := &WAL{writer: bufio.NewWriter(&seed)}
+	typed.writeBatch([][2]string{{"a", "1"}, {"b", tombstone}})
+	typed.writeRecord(walRecord{typ: walRangeDelete, key: "a", value: "c"})
+	typed.appendCheckpoint(7)
+	typed.writer.Flush()
+	f.Add(seed.Bytes())
+	f.Add([]byte{0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			rec, err := readWALRecord(r)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			if len(rec.key)+len(rec.value)+16 > len(data) {
+				t.Fatalf("decoded %d bytes from %d", len(rec.key)+len(rec.value), len(data))
+			}
+			if rec.key == batchRecordKey {
+				decodeBatch([]byte(rec.value))
+			}
+			if rec.typ == walBatch {
+				decodeWALBatch(rec.value)
+			}
+		}
+	})
+}
+
+// A length prefix larger than the input must fail without allocating the
+// claimed size.
+func TestReadWALRecordBoundsAllocation(t *testing.T) {
+	truncated := []byte{0xff, 0xff, 0xff, 0x3f, 0, 0, 0, 0, 'x'}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := readWALRecord(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated record: got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes for a 9-byte input", n)
+	}
+
+	tooLarge := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if _, err := readWALRecord(bytes.NewReader(tooLarge)); err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatalf("length above maxEncodedLength: got %v", err)
+	}
+}
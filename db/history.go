@@ -0,0 +1,79 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// ManifestFile is a table a ManifestEdit adds to or removes from the tree.
+type ManifestFile struct {
+	Level int
+	Name  string
+	// SmallestSeq and LargestSeq span the sequence numbers of the writes
+	// an added table holds: those of its memtable for a flush, those of
+	// its inputs for a compaction. Both are zero when that is not known,
+	// as for removed tables, ingested tables and tables added before
+	// ranges were recorded.
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// ManifestEdit is one change to the tree, as recorded in the MANIFEST.
+type ManifestEdit struct {
+	// Time is when the edit was logged; zero for edits logged before times
+	// were recorded.
+	Time    time.Time
+	Added   []ManifestFile
+	Removed []ManifestFile
+	// NextFileNumber, LogNumber and LastSequence are the file number,
+	// oldest live WAL and sequence number the edit recorded, or zero.
+	NextFileNumber uint64
+	LogNumber      uint64
+	LastSequence   uint64
+	// CompactionPointers maps each level a compaction moved a table out
+	// of to the largest key of that table.
+	CompactionPointers map[int]string
+}
+
+// ManifestHistory returns the edits of the MANIFEST, oldest first, so the
+// evolution of the tree can be traced: every flush, compaction and
+// ingestion, with the tables it added and removed. The first edit lists
+// the tree as it stood when the MANIFEST was started, at open or when the
+// last one grew past Options.MaxManifestFileSize; history before that is
+// not kept.
+func (db *DB) ManifestHistory() ([]ManifestEdit, error) {
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to read manifest history: %w", ErrClosed)
+	}
+	// Holding db.mu keeps the MANIFEST from being replaced while it is read.
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	edits, err := readVersionEdits(db.fs, db.manifest.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest history: %w", err)
+	}
+
+	history := make([]ManifestEdit, len(edits))
+	for i, e := range edits {
+		h := &history[i]
+		h.Time = e.time
+		h.NextFileNumber, h.LogNumber, h.LastSequence = e.nextFile, e.logNumber, e.lastSeq
+		for _, ref := range e.added {
+			h.Added = append(h.Added, manifestFile(ref))
+		}
+		for _, ref := range e.deleted {
+			h.Removed = append(h.Removed, manifestFile(ref))
+		}
+		for _, p := range e.pointers {
+			if h.CompactionPointers == nil {
+				h.CompactionPointers = make(map[int]string)
+			}
+			h.CompactionPointers[p.level] = p.key
+		}
+	}
+	return history, nil
+}
+
+func manifestFile(ref tableRef) ManifestFile {
+	return ManifestFile{Level: ref.level, Name: ref.name, SmallestSeq: ref.smallestSeq, LargestSeq: ref.largestSeq}
+}
@@ -0,0 +1,48 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestHistoryRecordsFlushesAndCompactions(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("history", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// The fourth flush fills L0 and moves it into L1.
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, store.Put(key, "1"))
+		require.NoError(t, store.Flush())
+	}
+
+	history, err := store.ManifestHistory()
+	require.NoError(t, err)
+	var flushed []db.ManifestFile
+	var compacted *db.ManifestEdit
+	for i, e := range history {
+		assert.False(t, e.Time.IsZero())
+		for _, f := range e.Added {
+			if f.Level == 0 {
+				flushed = append(flushed, f)
+			} else if len(e.Removed) > 0 {
+				compacted = &history[i]
+			}
+		}
+	}
+	require.Len(t, flushed, 4)
+	for i, f := range flushed {
+		seq := uint64(i + 1)
+		assert.Equal(t, [2]uint64{seq, seq}, [2]uint64{f.SmallestSeq, f.LargestSeq})
+	}
+
+	require.NotNil(t, compacted)
+	require.Len(t, compacted.Removed, 4)
+	out := compacted.Added[0]
+	assert.Equal(t, [2]uint64{1, 4}, [2]uint64{out.SmallestSeq, out.LargestSeq}, "outputs span their inputs")
+}
@@ -0,0 +1,323 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+// SSTableWriter builds an SSTable file outside of any database, for bulk
+// loading with DB.IngestSSTables. Keys must be added in strictly increasing
+// order. It wraps an SSTableBuilder, creating the file on first use, and
+// syncs the file when finished.
+type SSTableWriter struct {
+	path     string
+	opts     *Options
+	builder  *SSTableBuilder
+	finished bool
+}
+
+// NewSSTableWriter returns a writer for a new table at path, built with the
+// table options of opts (compression and its dictionary, record checksums,
+// the bloom filter and the file system), so a database opened with opts
+// writes the same tables. A nil opts means DefaultOptions().
+func NewSSTableWriter(path string, opts *Options) *SSTableWriter {
+	return &SSTableWriter{path: path, opts: opts}
+}
+
+func (w *SSTableWriter) open() error {
+	if w.builder != nil {
+		return nil
+	}
+	b, err := NewSSTableBuilder(w.path, w.opts)
+	if err != nil {
+		return err
+	}
+	w.builder = b
+	return nil
+}
+
+// Add appends key and value to the table.
+func (w *SSTableWriter) Add(key, value string) error {
+	if w.finished {
+		return fmt.Errorf("failed to add key %s: writer already finished", key)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	return w.builder.Add(key, value)
+}
+
+// Finish writes the table and syncs it to disk.
+func (w *SSTableWriter) Finish() error {
+	if w.finished {
+		return fmt.Errorf("failed to finish SSTable %s: already finished", w.path)
+	}
+	w.finished = true
+	if err := w.open(); err != nil {
+		return err
+	}
+	if err := w.builder.Finish(); err != nil {
+		w.builder.Abandon()
+		return fmt.Errorf("failed to write SSTable: %w", err)
+	}
+	if err := fileSync(fsOrDefault(w.builder.sst.fs), w.path); err != nil {
+		w.builder.Abandon()
+		return fmt.Errorf("failed to sync SSTable: %w", err)
+	}
+	return nil
+}
+
+// Abandon stops writing the table and removes its file, for when an Add
+// fails or the table is no longer wanted.
+func (w *SSTableWriter) Abandon() {
+	w.finished = true
+	if w.builder != nil {
+		w.builder.Abandon()
+	}
+}
+
+// IngestSSTables adds externally built tables to the database in one step,
+// bypassing the WAL and memtable. The files are linked (or copied) into the
+// database directory and left in place. Their key ranges must not overlap
+// each other. Ingested data is newer than everything already in the
+// database: if the memtable holds keys in an ingested range it is flushed
+// first, and each table is placed in the deepest level above every table it
+// overlaps. Ingestion does not assign sequence numbers or notify subscribers.
+func (db *DB) IngestSSTables(paths []string) error {
+	if db.closed.Load() {
+		return fmt.Errorf("failed to ingest SSTables: %w", ErrClosed)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var tables []*SSTable
+	closeAll := func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+	}
+	for _, path := range paths {
+		sst := &SSTable{path: path, fs: db.fs, verifyChecksums: true}
+		if err := sst.Load(); err != nil {
+			sst.Close()
+			closeAll()
+			return fmt.Errorf("failed to open ingested SSTable %s: %w", path, err)
+		}
+		tables = append(tables, sst)
+		if err := validateIngested(sst); err != nil {
+			closeAll()
+			return fmt.Errorf("failed to ingest SSTable %s: %w", path, err)
+		}
+	}
+	defer closeAll()
+
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].props.SmallestKey < tables[j].props.SmallestKey
+	})
+	// Sorted by smallest key, a table overlaps an earlier one exactly when
+	// it starts at or before the furthest any of them reaches.
+	furthest := 0
+	for i := 1; i < len(tables); i++ {
+		if tables[i].props.SmallestKey <= tables[furthest].props.LargestKey {
+			return fmt.Errorf("failed to ingest SSTables: %s and %s overlap", tables[furthest].path, tables[i].path)
+		}
+		if tables[i].props.LargestKey > tables[furthest].props.LargestKey {
+			furthest = i
+		}
+	}
+
+	if err := db.installIngested(tables); err != nil {
+		return err
+	}
+
+	if err := db.maybeCompact(); err != nil {
+		log.Printf("Compaction failed: %v", err)
+	}
+	return nil
+}
+
+// installIngested flushes the memtable if it overlaps tables, then copies
+// tables into the database and records them in the manifest and a new
+// version.
+func (db *DB) installIngested(tables []*SSTable) error {
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	// The flush comes before compactMu is taken: the background flush it
+	// waits for runs due compactions after each memtable, and would block
+	// on compactMu with the memtable it is waiting for still queued.
+	// Holding logMu keeps writes out of the memtable until tables are
+	// installed.
+	if err := db.flushOverlapping(tables); err != nil {
+		return err
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	levels := make([]int, len(tables))
+	for i, src := range tables {
+		levels[i] = db.ingestLevel(src.props.SmallestKey, src.props.LargestKey)
+		if levels[i] == 0 {
+			continue
+		}
+		for _, sst := range db.levels[levels[i]] {
+			if sst.overlaps(src.props.SmallestKey, src.props.LargestKey) {
+				return fmt.Errorf("failed to ingest SSTable %s: it overlaps %s in L%d", src.path, filepath.Base(sst.path), levels[i])
+			}
+		}
+	}
+
+	edit := &versionEdit{}
+	added := make([]*SSTable, len(tables))
+	for i, src := range tables {
+		dst := filepath.Join(db.dir, tableFileName(levels[i], db.newFileNumber()))
+		if err := linkOrCopy(db.fs, src.path, dst); err != nil {
+			return fmt.Errorf("failed to copy ingested SSTable %s: %w", src.path, err)
+		}
+		sst := db.newTable(dst)
+		if err := sst.Load(); err != nil {
+			return fmt.Errorf("failed to load ingested SSTable %s: %w", dst, err)
+		}
+		added[i] = sst
+		edit.addFile(levels[i], sst)
+	}
+	if err := db.fs.SyncDir(db.dir); err != nil {
+		for _, sst := range added {
+			sst.Close()
+			db.fs.Remove(sst.path)
+		}
+		return fmt.Errorf("failed to sync ingested SSTables: %w", err)
+	}
+	if err := db.logEdit(edit); err != nil {
+		for _, sst := range added {
+			sst.Close()
+			db.fs.Remove(sst.path)
+		}
+		return fmt.Errorf("failed to record ingested SSTables in manifest: %w", err)
+	}
+
+	// Build fresh level slices so versions sharing the old ones are
+	// unaffected.
+	for i, sst := range added {
+		level := levels[i]
+		next := append(append([]*SSTable(nil), db.levels[level]...), sst)
+		if level > 0 {
+			sort.Slice(next, func(i, j int) bool {
+				return next[i].props.SmallestKey < next[j].props.SmallestKey
+			})
+		}
+		db.levels[level] = next
+	}
+	db.installVersion()
+	log.Printf("Ingested %d SSTables", len(added))
+	return nil
+}
+
+// flushOverlapping flushes the memtables if any of them holds a key in the
+// range of one of tables. logMu must be held.
+func (db *DB) flushOverlapping(tables []*SSTable) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, sst := range tables {
+		if db.memTableOverlaps(sst.props.SmallestKey, sst.props.LargestKey) {
+			if err := db.flushLocked(); err != nil {
+				return fmt.Errorf("failed to flush memtable before ingestion: %w", err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func validateIngested(sst *SSTable) error {
+	if sst.props.NumEntries == 0 {
+		return fmt.Errorf("table is empty")
+	}
+	if sst.separated {
+		return fmt.Errorf("table points into another database's value log")
+	}
+	// The ranges of the ingested tables are checked against each other
+	// and the levels by their properties, so the properties must match
+	// what the table holds.
+	first, last, err := sst.keyBounds()
+	if err != nil {
+		return err
+	}
+	if first != sst.props.SmallestKey || last != sst.props.LargestKey {
+		return fmt.Errorf("table holds keys %q to %q but its properties record %q to %q", first, last, sst.props.SmallestKey, sst.props.LargestKey)
+	}
+	if first > last {
+		return fmt.Errorf("table's smallest key %q is after its largest key %q", first, last)
+	}
+	if isInternalKey(first) || isInternalKey(last) {
+		return fmt.Errorf("table contains reserved keys")
+	}
+	return nil
+}
+
+// keyBounds returns the first and last keys s holds, read from its first
+// and last data blocks.
+func (s *SSTable) keyBounds() (first, last string, err error) {
+	if s.format < blockFormatVersion {
+		kvs, err := s.rawEntries()
+		if err != nil || len(kvs) == 0 {
+			return "", "", err
+		}
+		return kvs[0][0], kvs[len(kvs)-1][0], nil
+	}
+	if len(s.blocks) == 0 {
+		return "", "", nil
+	}
+	head, err := s.blockEntries(s.blocks[0])
+	if err != nil {
+		return "", "", err
+	}
+	tail, err := s.blockEntries(s.blocks[len(s.blocks)-1])
+	if err != nil {
+		return "", "", err
+	}
+	if len(head) == 0 || len(tail) == 0 {
+		return "", "", s.corruption(s.blocks[0].offset, "empty data block")
+	}
+	return head[0][0], tail[len(tail)-1][0], nil
+}
+
+// memTableOverlaps reports whether the active or an immutable memtable holds
+// a key in [smallest, largest]. db.mu must be held.
+func (db *DB) memTableOverlaps(smallest, largest string) bool {
+	mems := []*memTable{db.memTable}
+	for _, imm := range db.imm {
+		mems = append(mems, imm.mem)
+	}
+	for _, mem := range mems {
+		if n := mem.findGreaterOrEqual(smallest, nil); n != nil && n.key <= largest {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestLevel picks the level for a table covering [smallest, largest]: L0
+// if it overlaps any L0 table, and otherwise the deepest level that neither
+// it nor any level above it overlaps. db.mu must be held.
+func (db *DB) ingestLevel(smallest, largest string) int {
+	for _, sst := range db.levels[0] {
+		if sst.overlaps(smallest, largest) {
+			return 0
+		}
+	}
+	target := 0
+	for level := 1; level < len(db.levels); level++ {
+		for _, sst := range db.levels[level] {
+			if sst.overlaps(smallest, largest) {
+				return target
+			}
+		}
+		target = level
+	}
+	return target
+}
@@ -0,0 +1,156 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestSSTables(t *testing.T) {
+	dir := "testdata/ingest"
+	src := "testdata/ingest_src"
+	_ = os.RemoveAll(dir)
+	_ = os.RemoveAll(src)
+	assert.NoError(t, os.MkdirAll(src, 0755))
+
+	store, err := db.NewDB(dir)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	assert.NoError(t, store.Put("key050", "old"))
+
+	var paths []string
+	for f := 0; f < 2; f++ {
+		path := filepath.Join(src, fmt.Sprintf("bulk%d.sst", f))
+		w := db.NewSSTableWriter(path, nil)
+		for i := f * 100; i < (f+1)*100; i++ {
+			assert.NoError(t, w.Add(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)))
+		}
+		assert.Error(t, w.Add("key000", "out of order"))
+		assert.NoError(t, w.Finish())
+		paths = append(paths, path)
+	}
+
+	assert.NoError(t, store.IngestSSTables(paths))
+	assert.Error(t, store.IngestSSTables([]string{paths[0], paths[0]}), "overlapping files are rejected")
+
+	abandoned := filepath.Join(src, "abandoned.sst")
+	w := db.NewSSTableWriter(abandoned, nil)
+	assert.NoError(t, w.Add("key500", "value"))
+	w.Abandon()
+	assert.NoFileExists(t, abandoned)
+
+	check := func() {
+		for _, i := range []int{0, 50, 99, 100, 199} {
+			value, err := store.Get(fmt.Sprintf("key%03d", i))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("value%d", i), value)
+		}
+	}
+	check()
+
+	assert.NoError(t, store.Close())
+	store, err = db.NewDB(dir)
+	assert.NoError(t, err)
+	check()
+}
+
+func TestIngestRejectsOverlappingTables(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	store, err := db.Open("ingest-overlap", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	write := func(name string, from, to int) string {
+		w := db.NewSSTableWriter(name, opts)
+		for i := from; i <= to; i++ {
+			require.NoError(t, w.Add(fmt.Sprintf("key%03d", i), "bulk"))
+		}
+		require.NoError(t, w.Finish())
+		return name
+	}
+	for _, tc := range []struct {
+		name  string
+		paths []string
+	}{
+		{"largest key inside the next table", []string{write("a.sst", 0, 150), write("b.sst", 100, 199)}},
+		{"one table inside another", []string{write("outer.sst", 0, 199), write("inner.sst", 50, 60)}},
+		{"shared boundary key", []string{write("low.sst", 0, 100), write("high.sst", 100, 199)}},
+		{"spanning past a gap", []string{write("wide.sst", 0, 199), write("x.sst", 50, 60), write("y.sst", 150, 160)}},
+	} {
+		assert.ErrorContains(t, store.IngestSSTables(tc.paths), "overlap", tc.name)
+	}
+	for _, level := range store.Levels() {
+		assert.Empty(t, level.Files, "nothing was ingested")
+	}
+	_, err = store.Get("key100")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	require.NoError(t, store.IngestSSTables([]string{write("first.sst", 0, 99), write("second.sst", 100, 199)}))
+	value, err := store.Get("key100")
+	require.NoError(t, err)
+	assert.Equal(t, "bulk", value)
+}
+
+func TestIngestWhileFlushIsQueued(t *testing.T) {
+	fs := db.NewFaultFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.WriteBufferSize = 4 << 10
+	opts.MaxImmutableMemTables = 2
+	w := db.NewSSTableWriter("bulk.sst", opts)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, w.Add(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)))
+	}
+	require.NoError(t, w.Finish())
+
+	// The first flush blocks as it creates its table, so a rotated
+	// memtable is still queued when the ingestion starts.
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fs.OnMutation(func(op, name string) {
+		if op == "create" && strings.HasSuffix(name, ".sst.tmp") {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+		}
+	})
+	store, err := db.Open("ingest-queued", opts)
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("fill%d", i), strings.Repeat("x", 1<<10)))
+	}
+	<-started
+	require.NoError(t, store.Put("key050", "old"))
+
+	done := make(chan error, 1)
+	go func() { done <- store.IngestSSTables([]string{"bulk.sst"}) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("ingestion deadlocked with the queued flush")
+	}
+
+	value, err := store.Get("key050")
+	assert.NoError(t, err)
+	assert.Equal(t, "value50", value)
+	assert.NoError(t, store.Close())
+}
@@ -0,0 +1,38 @@
+package db
+
+// intraL0Due reports whether L0, due for compaction, should be merged into
+// itself rather than into L1: Options.IntraL0CompactionRatio is set, L0 is
+// over its file limit but not its size limit, and the L1 tables its key
+// range overlaps are more than the ratio times its size. db.mu must be
+// held.
+func (db *DB) intraL0Due() bool {
+	ratio := int64(db.opts.IntraL0CompactionRatio)
+	level0 := db.levels[0]
+	if ratio <= 0 || len(level0) < 2 {
+		return false
+	}
+	policy := db.levelPolicies[0]
+	var size int64
+	var smallest, largest string
+	for i, sst := range level0 {
+		size += sst.size
+		p := sst.Properties()
+		if i == 0 || p.SmallestKey < smallest {
+			smallest = p.SmallestKey
+		}
+		if i == 0 || p.LargestKey > largest {
+			largest = p.LargestKey
+		}
+	}
+	if policy.maxSize > 0 && size >= policy.maxSize {
+		return false
+	}
+
+	var overlap int64
+	for _, sst := range db.levels[1] {
+		if sst.overlaps(smallest, largest) {
+			overlap += sst.size
+		}
+	}
+	return overlap > ratio*size
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Iterator walks the database's keys in ascending order as of the moment it
+// was created. Newer values shadow older ones, and deleted keys and
+// engine-internal keys such as column family entries are skipped. An
+// Iterator is not safe for concurrent use.
+//
+//	it := store.NewIterator()
+//	defer it.Close()
+//	for it.First(); it.Valid(); it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	snap    *Snapshot
+	owned   bool // snap was taken for this iterator and is released by Close
+	merge   *mergingIterator
+	stored  bool
+	vlog    *valueLog
+	value   string
+	iterErr error
+	closed  bool
+
+	// The first Seek, and the keys stepped through after it, are traced as
+	// a scan when the iterator is closed.
+	traceKey   string
+	traceTime  time.Time
+	traceSteps int64
+}
+
+// NewIterator returns an iterator over a snapshot of the database taken
+// now. Close releases the snapshot.
+func (db *DB) NewIterator() *Iterator {
+	it := db.GetSnapshot().NewIterator()
+	it.owned = true
+	return it
+}
+
+// NewIterator returns an iterator over the snapshot. The snapshot must not
+// be released while the iterator is in use.
+func (s *Snapshot) NewIterator() *Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it := &Iterator{snap: s, vlog: s.db.vlog}
+	s.db.trackIterator(it)
+	if s.released {
+		it.iterErr = fmt.Errorf("failed to create iterator: snapshot already released")
+		it.merge = newMergingIterator(nil)
+		return it
+	}
+	it.stored = s.db.storedForm(s.levels...)
+	var sources []internalIterator
+	for _, mem := range s.mems {
+		sources = append(sources, newMemIterator(mem, s.seq, it.stored))
+	}
+	for level, tables := range s.levels {
+		sources = append(sources, levelIterators(level, tables, it.stored)...)
+	}
+	it.merge = newMergingIterator(sources)
+	return it
+}
+
+// First moves to the smallest key.
+func (it *Iterator) First() {
+	it.Seek("")
+}
+
+// Seek moves to the first key >= key.
+func (it *Iterator) Seek(key string) {
+	if it.iterErr != nil {
+		return
+	}
+	if it.snap.db.tracer != nil && it.traceTime.IsZero() {
+		it.traceKey, it.traceTime = key, time.Now()
+	}
+	it.merge.seek(key)
+	it.settle()
+}
+
+// Next moves to the following key. It must only be called while Valid.
+func (it *Iterator) Next() {
+	it.traceSteps++
+	it.merge.next()
+	it.settle()
+}
+
+// settle skips internal and deleted keys and resolves the value at the new
+// position.
+func (it *Iterator) settle() {
+	for {
+		for it.merge.ok && isInternalKey(it.merge.curKey) {
+			it.merge.next()
+		}
+		if it.merge.mergeErr != nil {
+			it.iterErr = fmt.Errorf("failed to iterate: %w", it.merge.mergeErr)
+			return
+		}
+		if !it.merge.ok {
+			return
+		}
+		it.value = it.merge.curValue
+		if it.stored {
+			value, err := it.vlog.resolve(it.value)
+			if err != nil {
+				it.iterErr = fmt.Errorf("failed to resolve value of %s: %w", it.merge.curKey, err)
+				return
+			}
+			it.value = value
+		}
+		if isDeleted(it.merge.curKey, it.value) {
+			it.merge.next()
+			continue
+		}
+		if c, ok := decodeChunkedValue(it.value); ok {
+			value, err := joinChunks(c, it.snap.get)
+			if err != nil {
+				it.iterErr = fmt.Errorf("failed to read chunks of %s: %w", it.merge.curKey, err)
+				return
+			}
+			it.value = value
+		}
+		return
+	}
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.iterErr == nil && it.merge.ok
+}
+
+// Key returns the current key. It must only be called while Valid.
+func (it *Iterator) Key() string {
+	return it.merge.curKey
+}
+
+// Value returns the current value. It must only be called while Valid.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *Iterator) Err() error {
+	return it.iterErr
+}
+
+// Close releases the iterator's snapshot if it owns one. It is safe to call
+// more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.snap.db.untrackIterator(it)
+	if !it.traceTime.IsZero() {
+		it.snap.db.trace(TraceRecord{Op: TraceScan, Time: it.traceTime, Key: it.traceKey, Size: it.traceSteps})
+	}
+	if it.owned {
+		it.snap.Release()
+	}
+	return nil
+}
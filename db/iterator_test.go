@@ -0,0 +1,100 @@
+package db_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mini-leveldb/db"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIteratorMergesMemtableAndTables(t *testing.T) {
+	dir := "testdata/iterator"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	// Three generations of values: the oldest in one table, overwrites of
+	// every third key in a newer table, and every fifth key in the memtable.
+	want := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		require.NoError(t, store.Put(key, "v1"))
+		want[key] = "v1"
+	}
+	require.NoError(t, store.Flush())
+	for i := 0; i < 300; i += 3 {
+		key := fmt.Sprintf("key%03d", i)
+		require.NoError(t, store.Put(key, "v2"))
+		want[key] = "v2"
+	}
+	require.NoError(t, store.Flush())
+	for i := 0; i < 300; i += 5 {
+		key := fmt.Sprintf("key%03d", i)
+		require.NoError(t, store.Put(key, "v3"))
+		want[key] = "v3"
+	}
+	cf, err := store.ColumnFamily("other")
+	require.NoError(t, err)
+	require.NoError(t, cf.Put("hidden", "x"))
+
+	it := store.NewIterator()
+	defer it.Close()
+
+	// Writes after the iterator was created are not visible.
+	require.NoError(t, store.Put("key999", "late"))
+
+	var got []string
+	for it.First(); it.Valid(); it.Next() {
+		assert.Equal(t, want[it.Key()], it.Value(), it.Key())
+		got = append(got, it.Key())
+	}
+	require.NoError(t, it.Err())
+	assert.Len(t, got, 300)
+	assert.IsIncreasing(t, got)
+
+	it.Seek("key150")
+	require.True(t, it.Valid())
+	assert.Equal(t, "key150", it.Key())
+	assert.Equal(t, "v3", it.Value())
+
+	it.Seek("key1505")
+	require.True(t, it.Valid())
+	assert.Equal(t, "key151", it.Key())
+
+	it.Seek("zzz")
+	assert.False(t, it.Valid())
+}
+
+func TestLeakedIteratorsAreReportedOnClose(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.TrackIterators = true
+	store, err := db.Open("leak", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", "1"))
+
+	closed := store.NewIterator()
+	leaked := store.NewIterator()
+	leaked.First()
+	assert.Equal(t, 2, store.OpenIterators())
+	require.NoError(t, closed.Close())
+	require.NoError(t, closed.Close())
+	assert.Equal(t, 1, store.OpenIterators())
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	require.NoError(t, store.Close())
+	assert.Contains(t, logged.String(), "1 iterators were never closed")
+	assert.Contains(t, logged.String(), "TestLeakedIteratorsAreReportedOnClose", "the creation stack is logged")
+}
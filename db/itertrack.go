@@ -0,0 +1,58 @@
+package db
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// trackIterator registers it as open, recording the stack that created it
+// if Options.TrackIterators is set.
+func (db *DB) trackIterator(it *Iterator) {
+	var stack string
+	if db.opts.TrackIterators {
+		stack = string(debug.Stack())
+	}
+	db.iterMu.Lock()
+	if db.iterators == nil {
+		db.iterators = make(map[*Iterator]string)
+	}
+	db.iterators[it] = stack
+	db.iterMu.Unlock()
+}
+
+// untrackIterator forgets a closed iterator.
+func (db *DB) untrackIterator(it *Iterator) {
+	db.iterMu.Lock()
+	delete(db.iterators, it)
+	db.iterMu.Unlock()
+}
+
+// OpenIterators returns the number of iterators created and not yet
+// closed. Each one keeps the tables it reads from on disk, and an iterator
+// from NewIterator also holds a snapshot, so a count that only grows points
+// at iterators that are never closed.
+func (db *DB) OpenIterators() int {
+	db.iterMu.Lock()
+	defer db.iterMu.Unlock()
+	return len(db.iterators)
+}
+
+// reportLeakedIterators logs the iterators still open as the database
+// closes, with where each was created if Options.TrackIterators is set, and
+// forgets them.
+func (db *DB) reportLeakedIterators() {
+	db.iterMu.Lock()
+	leaked := db.iterators
+	db.iterators = nil
+	db.iterMu.Unlock()
+
+	if len(leaked) == 0 {
+		return
+	}
+	log.Printf("Warning: %d iterators were never closed", len(leaked))
+	for _, stack := range leaked {
+		if stack != "" {
+			log.Printf("Warning: leaked iterator created at:\n%s", stack)
+		}
+	}
+}
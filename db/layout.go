@@ -0,0 +1,53 @@
+package db
+
+// FileInfo describes one SSTable in the tree.
+type FileInfo struct {
+	Path        string
+	Size        int64
+	SmallestKey string
+	LargestKey  string
+	NumEntries  uint64
+}
+
+// LevelInfo describes one level of the tree. Files are in search order:
+// newest first in L0, by key elsewhere.
+type LevelInfo struct {
+	Level int
+	Files []FileInfo
+	Size  int64
+}
+
+// Levels returns the layout of every level of the current version, L0
+// first, including empty levels. It returns nil once the database is
+// closed.
+func (db *DB) Levels() []LevelInfo {
+	if db.closed.Load() {
+		return nil
+	}
+	v := db.currentVersion()
+	defer v.unref()
+
+	infos := make([]LevelInfo, len(v.levels))
+	for levelNum, level := range v.levels {
+		info := LevelInfo{Level: levelNum}
+		for i := range level {
+			sst := level[i]
+			if levelNum == 0 {
+				sst = level[len(level)-1-i]
+			}
+			if sst == nil {
+				continue
+			}
+			info.Files = append(info.Files, FileInfo{
+				Path:        sst.path,
+				Size:        sst.size,
+				SmallestKey: sst.props.SmallestKey,
+				LargestKey:  sst.props.LargestKey,
+				NumEntries:  sst.props.NumEntries,
+			})
+			info.Size += sst.size
+		}
+		infos[levelNum] = info
+	}
+	return infos
+}
@@ -0,0 +1,44 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelsDescribeTree(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("layout", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Four flushes compact into one L1 table; two more stay in L0.
+	for i := 0; i < 6; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+
+	levels := store.Levels()
+	require.Len(t, levels, 7)
+	require.Len(t, levels[0].Files, 2)
+	assert.Equal(t, "key5", levels[0].Files[0].SmallestKey, "L0 is listed newest first")
+	assert.Equal(t, "key4", levels[0].Files[1].SmallestKey)
+
+	require.Len(t, levels[1].Files, 1)
+	l1 := levels[1].Files[0]
+	assert.Equal(t, 1, levels[1].Level)
+	assert.Equal(t, "key0", l1.SmallestKey)
+	assert.Equal(t, "key3", l1.LargestKey)
+	assert.Equal(t, uint64(4), l1.NumEntries)
+	assert.Positive(t, l1.Size)
+	assert.Equal(t, l1.Size, levels[1].Size)
+	assert.Contains(t, l1.Path, "sstable_l1_")
+
+	for _, level := range levels[2:] {
+		assert.Empty(t, level.Files)
+	}
+}
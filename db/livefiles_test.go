@@ -0,0 +1,81 @@
+package db_test
+
+import (
+	"fmt"
+	"io"
+	"mini-leveldb/db"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyLiveFiles copies set into dir the way a backup agent would, taking
+// only the recorded prefix of each file.
+func copyLiveFiles(t *testing.T, fs db.FileSystem, set *db.LiveFileSet, dir string) {
+	require.NoError(t, fs.MkdirAll(dir, 0755))
+	for _, file := range set.Files {
+		in, err := fs.Open(file.Path)
+		require.NoError(t, err, file.Path)
+		out, err := fs.Create(filepath.Join(dir, filepath.Base(file.Path)))
+		require.NoError(t, err)
+		_, err = io.Copy(out, io.LimitReader(in, file.Size))
+		require.NoError(t, err)
+		require.NoError(t, out.Sync())
+		require.NoError(t, out.Close())
+		require.NoError(t, in.Close())
+	}
+}
+
+func TestLiveFilesBackup(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	store, err := db.Open("live", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("flushed%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Put("unflushed", "value"))
+
+	// Without a flush the WAL carries the memtable.
+	set, err := store.LiveFiles(false)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("live", "CURRENT"), set.Files[0].Path)
+
+	// Compacting away the listed tables must not delete them before the
+	// copy is made.
+	require.NoError(t, store.Put("later", "value"))
+	require.NoError(t, store.Flush())
+	copyLiveFiles(t, fs, set, "backup-wal")
+	set.Release()
+
+	flushed, err := store.LiveFiles(true)
+	require.NoError(t, err)
+	copyLiveFiles(t, fs, flushed, "backup-flushed")
+	flushed.Release()
+
+	for dir, keys := range map[string][]string{
+		"backup-wal":     {"flushed0", "flushed2", "unflushed"},
+		"backup-flushed": {"flushed0", "unflushed", "later"},
+	} {
+		backup, err := db.Open(dir, opts)
+		require.NoError(t, err)
+		for _, key := range keys {
+			value, err := backup.Get(key)
+			assert.NoError(t, err, "%s in %s", key, dir)
+			assert.Equal(t, "value", value)
+		}
+		require.NoError(t, backup.Close())
+	}
+
+	backup, err := db.Open("backup-wal", opts)
+	require.NoError(t, err)
+	defer backup.Close()
+	_, err = backup.Get("later")
+	assert.ErrorIs(t, err, db.ErrNotFound, "writes after LiveFiles are not in the set")
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockFileName is the file an open database holds in its directory, naming
+// the process that opened it.
+const lockFileName = "LOCK"
+
+// LockOwner identifies the process that holds, or held, a database's LOCK
+// file.
+type LockOwner struct {
+	PID     int
+	Host    string
+	Started time.Time
+}
+
+func (o LockOwner) String() string {
+	if o.PID == 0 {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("process %d on %s, since %s", o.PID, o.Host, o.Started.Format(time.RFC3339))
+}
+
+// openLocks holds the databases this process has open, by filesystem and
+// directory, so a second Open of one fails even though its LOCK names a
+// live process: this one.
+var (
+	openLocksMu sync.Mutex
+	openLocks   = make(map[lockKey]bool)
+)
+
+type lockKey struct {
+	fs  FileSystem
+	dir string
+}
+
+// dirLock is a held LOCK file, or nothing for a database that is not
+// locked. file stays open, holding an advisory lock on the LOCK file, for
+// as long as the database is open.
+type dirLock struct {
+	key  lockKey
+	path string
+	file *os.File
+	once sync.Once
+}
+
+// errLockHeld is returned by flockFile when another open file holds the
+// advisory lock.
+var errLockHeld = errors.New("lock held by another open file")
+
+// maxLockAttempts bounds how often acquireLock starts over when the LOCK
+// file it opened was replaced or removed before it could lock it.
+const maxLockAttempts = 10
+
+// acquireLock takes the LOCK file of dir for this process. A LOCK left by a
+// process that is no longer running, as after a crash, is stale: it is
+// taken over, with a warning, when breakStale is set, and otherwise
+// reported as ErrStaleLock. LOCKs of processes on other hosts cannot be
+// checked and are always treated as held. It returns the owner of a stale
+// LOCK it took over, if any.
+//
+// The owner is written to a new file, created exclusively and locked with
+// an advisory lock, which then takes the name LOCK: by a hard link when
+// there is no LOCK, which fails if another process made one first, or, to
+// take over a stale LOCK, by a rename while holding the advisory lock of
+// the LOCK it replaces. Other processes therefore never see a LOCK that is
+// empty or unlocked, and of several opening the directory at once exactly
+// one gets it. The advisory lock is held until the database is closed, and
+// a process that dies releases it.
+//
+// Only databases on the operating system's filesystem are locked: other
+// filesystems live inside this process, where tests open a crashed
+// database again while the instance that crashed is still around.
+func acquireLock(fs FileSystem, dir string, breakStale bool) (*dirLock, *LockOwner, error) {
+	if _, ok := fs.(osFS); !ok {
+		return &dirLock{}, nil, nil
+	}
+	key := lockKey{fs: fs, dir: filepath.Clean(dir)}
+	openLocksMu.Lock()
+	defer openLocksMu.Unlock()
+	if openLocks[key] {
+		return nil, nil, fmt.Errorf("failed to lock database %s: already open in this process: %w", dir, ErrLocked)
+	}
+
+	host, _ := os.Hostname()
+	path := filepath.Join(dir, lockFileName)
+	newPath := fmt.Sprintf("%s.%d", path, os.Getpid())
+	file, err := createLockFile(newPath, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Once published the file lives on as LOCK; this only drops the
+	// name it was created under.
+	defer os.Remove(newPath)
+
+	stale, err := publishLock(newPath, path, host, breakStale)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		log.Printf("Warning: failed to sync directory of lock file: %v", err)
+	}
+	openLocks[key] = true
+	return &dirLock{key: key, path: path, file: file}, stale, nil
+}
+
+// createLockFile creates the file at path exclusively, takes its advisory
+// lock and writes this process's details into it. A file already at path
+// was left by an earlier process with this PID and is replaced.
+func createLockFile(path, host string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		os.Remove(path)
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %w", err)
+	}
+	if err := flockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock lock file: %w", err)
+	}
+	if _, err := fmt.Fprintf(file, "pid=%d\nhost=%s\nstarted=%s\n", os.Getpid(), host, time.Now().Format(time.RFC3339Nano)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write lock file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to sync lock file: %w", err)
+	}
+	return file, nil
+}
+
+// publishLock gives the locked file at newPath the name path, as
+// acquireLock describes, and returns the owner of a stale LOCK it replaced.
+func publishLock(newPath, path, host string, breakStale bool) (*LockOwner, error) {
+	dir := filepath.Dir(path)
+	for attempt := 0; attempt < maxLockAttempts; attempt++ {
+		err := os.Link(newPath, path)
+		if err == nil {
+			return nil, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		existing, err := os.OpenFile(path, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			continue // released since the link failed
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+		if err := flockFile(existing); err != nil {
+			data, _ := io.ReadAll(existing)
+			existing.Close()
+			if errors.Is(err, errLockHeld) {
+				return nil, fmt.Errorf("failed to lock database %s: held by %s: %w", dir, parseLockOwner(data), ErrLocked)
+			}
+			return nil, fmt.Errorf("failed to lock lock file: %w", err)
+		}
+		// The LOCK may have been released, or taken over, between
+		// opening it and locking it; then the lock is on a file that no
+		// longer has the name.
+		if !isFileAt(existing, path) {
+			existing.Close()
+			continue
+		}
+
+		data, err := io.ReadAll(existing)
+		if err != nil {
+			existing.Close()
+			return nil, fmt.Errorf("failed to read lock file: %w", err)
+		}
+		owner := parseLockOwner(data)
+		// A LOCK naming this process was left by an earlier process with
+		// the same PID. One naming another live process is respected even
+		// though its advisory lock is not held, as by binaries that
+		// predate advisory locks.
+		if owner.PID != 0 && (owner.Host != host || owner.PID != os.Getpid() && processAlive(owner.PID)) {
+			existing.Close()
+			return nil, fmt.Errorf("failed to lock database %s: held by %s: %w", dir, owner, ErrLocked)
+		}
+		if !breakStale {
+			existing.Close()
+			return nil, fmt.Errorf("failed to lock database %s: left by %s, which is no longer running; "+
+				"make sure no other process uses the database and set Options.BreakStaleLock to take it over: %w",
+				dir, owner, ErrStaleLock)
+		}
+		log.Printf("Warning: taking over stale lock of %s left by %s", dir, owner)
+		err = os.Rename(newPath, path)
+		existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to replace lock file: %w", err)
+		}
+		return &owner, nil
+	}
+	return nil, fmt.Errorf("failed to lock database %s: LOCK kept changing: %w", dir, ErrLocked)
+}
+
+// isFileAt reports whether f is the file path names.
+func isFileAt(f *os.File, path string) bool {
+	a, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	return err == nil && os.SameFile(a, b)
+}
+
+// release removes the LOCK file and then drops its advisory lock, so a
+// process waiting to lock it finds the name gone. It is safe to call more
+// than once.
+func (l *dirLock) release() {
+	l.once.Do(func() {
+		if l.path == "" {
+			return
+		}
+		if err := l.key.fs.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove lock file: %v", err)
+		}
+		l.file.Close()
+		openLocksMu.Lock()
+		delete(openLocks, l.key)
+		openLocksMu.Unlock()
+	})
+}
+
+// parseLockOwner reads the owner a LOCK file names. A file it cannot make
+// sense of, as when a crash cut it short, names an owner with PID zero.
+func parseLockOwner(data []byte) LockOwner {
+	var owner LockOwner
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		name, value, _ := strings.Cut(s.Text(), "=")
+		switch name {
+		case "pid":
+			owner.PID, _ = strconv.Atoi(value)
+		case "host":
+			owner.Host = value
+		case "started":
+			owner.Started, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	return owner
+}
+
+// StaleLockOwner returns the process whose stale LOCK file Open took over
+// under Options.BreakStaleLock, or nil if the database was not left locked.
+func (db *DB) StaleLockOwner() *LockOwner {
+	return db.staleLockOwner
+}
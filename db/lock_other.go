@@ -0,0 +1,24 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// processAlive reports whether a process with the given PID is running on
+// this host. Where os.FindProcess does not check, every process is taken to
+// be running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// flockFile does nothing where advisory locks are not available; the
+// exclusive creation of the LOCK file still keeps two processes from both
+// taking a free one.
+func flockFile(f *os.File) error {
+	return nil
+}
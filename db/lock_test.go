@@ -0,0 +1,146 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockRejectsSecondOpenAndBreaksStaleLocks(t *testing.T) {
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "LOCK")
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	writeLock := func(pid int) {
+		data := fmt.Sprintf("pid=%d\nhost=%s\nstarted=2026-01-02T03:04:05Z\n", pid, host)
+		require.NoError(t, os.WriteFile(lockPath, []byte(data), 0644))
+	}
+
+	store, err := db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+	_, err = db.Open(dir, db.DefaultOptions())
+	assert.ErrorIs(t, err, db.ErrLocked)
+	require.NoError(t, store.Close())
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err), "Close removes the LOCK")
+
+	// A running process holds the lock however old it is.
+	writeLock(os.Getppid())
+	_, err = db.Open(dir, db.DefaultOptions())
+	assert.ErrorIs(t, err, db.ErrLocked)
+
+	// A process that has exited left it stale.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, cmd.Run())
+	writeLock(cmd.Process.Pid)
+	_, err = db.Open(dir, db.DefaultOptions())
+	require.ErrorIs(t, err, db.ErrStaleLock)
+	assert.Contains(t, err.Error(), fmt.Sprintf("process %d", cmd.Process.Pid))
+
+	opts := db.DefaultOptions()
+	opts.BreakStaleLock = true
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	owner := store.StaleLockOwner()
+	require.NotNil(t, owner)
+	assert.Equal(t, cmd.Process.Pid, owner.PID)
+	assert.Equal(t, host, owner.Host)
+	require.NoError(t, store.Close())
+}
+
+// TestLockChild opens the database in MINILDB_LOCK_DIR at the time in
+// MINILDB_LOCK_AT and prints whether it got the lock, holding it long enough
+// for every other child to try. It is run as a subprocess by
+// TestConcurrentOpensLockOnce.
+func TestLockChild(t *testing.T) {
+	dir := os.Getenv("MINILDB_LOCK_DIR")
+	if dir == "" {
+		t.Skip("run by TestConcurrentOpensLockOnce")
+	}
+	at, err := strconv.ParseInt(os.Getenv("MINILDB_LOCK_AT"), 10, 64)
+	require.NoError(t, err)
+	time.Sleep(time.Until(time.Unix(0, at)))
+
+	opts := db.DefaultOptions()
+	opts.BreakStaleLock = true
+	store, err := db.Open(dir, opts)
+	switch {
+	case err == nil:
+		fmt.Println("RESULT won")
+		time.Sleep(500 * time.Millisecond)
+		require.NoError(t, store.Close())
+	case errors.Is(err, db.ErrLocked):
+		fmt.Println("RESULT locked")
+	default:
+		fmt.Println("RESULT error:", err)
+	}
+}
+
+func TestConcurrentOpensLockOnce(t *testing.T) {
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, exited.Run())
+
+	race := func(t *testing.T, dir string) {
+		const children = 4
+		at := time.Now().Add(300 * time.Millisecond).UnixNano()
+		results := make([]string, children)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cmd := exec.Command(os.Args[0], "-test.run=^TestLockChild$", "-test.v")
+				cmd.Env = append(os.Environ(), "MINILDB_LOCK_DIR="+dir, fmt.Sprintf("MINILDB_LOCK_AT=%d", at))
+				out, err := cmd.CombinedOutput()
+				assert.NoError(t, err, "%s", out)
+				for _, line := range strings.Split(string(out), "\n") {
+					if result, ok := strings.CutPrefix(line, "RESULT "); ok {
+						results[i] = result
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		var won, locked int
+		for _, r := range results {
+			switch r {
+			case "won":
+				won++
+			case "locked":
+				locked++
+			}
+		}
+		assert.Equal(t, 1, won, "results: %q", results)
+		assert.Equal(t, children-1, locked, "results: %q", results)
+	}
+
+	t.Run("free", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := db.Open(dir, db.DefaultOptions())
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		race(t, dir)
+	})
+	t.Run("stale", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := db.Open(dir, db.DefaultOptions())
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+		data := fmt.Sprintf("pid=%d\nhost=%s\nstarted=2026-01-02T03:04:05Z\n", exited.Process.Pid, host)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "LOCK"), []byte(data), 0644))
+		race(t, dir)
+	})
+}
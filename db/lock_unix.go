@@ -0,0 +1,26 @@
+//go:build unix
+
+package db
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// processAlive reports whether a process with the given PID is running on
+// this host.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// flockFile takes an exclusive advisory lock on f without waiting,
+// returning errLockHeld if another open file holds it.
+func flockFile(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package db
+
+func adviseWillNeed(b []byte) error {
+	return nil
+}
+
+func adviseDontNeed(b []byte) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package db
+
+import "golang.org/x/sys/unix"
+
+func adviseWillNeed(b []byte) error {
+	return unix.Madvise(b, unix.MADV_WILLNEED)
+}
+
+func adviseDontNeed(b []byte) error {
+	return unix.Madvise(b, unix.MADV_DONTNEED)
+}
@@ -0,0 +1,516 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The MANIFEST in use is the numbered file named by CURRENT. Databases
+// written before file numbering kept a single unnumbered MANIFEST and no
+// CURRENT; they are switched over the next time they are opened.
+const (
+	currentFileName        = "CURRENT"
+	legacyManifestFileName = "MANIFEST"
+)
+
+// Version edit field tags.
+const (
+	tagAddFile    byte = 1
+	tagDeleteFile byte = 2
+	tagNextFile   byte = 3
+	tagLogNumber  byte = 4
+	tagLastSeq    byte = 5
+	tagCompactPtr byte = 6
+	// tagAddFileSeqs is tagAddFile followed by the table's sequence range.
+	tagAddFileSeqs byte = 7
+	tagTime        byte = 8
+)
+
+// tableRef names an SSTable file (relative to the database directory) at a
+// level of the tree. Added tables carry the range of sequence numbers of
+// the writes they hold, which is zero when it is not known.
+type tableRef struct {
+	level       int
+	name        string
+	smallestSeq uint64
+	largestSeq  uint64
+}
+
+// compactPointer records the largest key of the table last compacted out
+// of level, where the next pick from the level starts looking.
+type compactPointer struct {
+	level int
+	key   string
+}
+
+// versionEdit is one change to the set of live SSTables. The MANIFEST is a
+// log of edits; replaying it from the start yields the current tree.
+type versionEdit struct {
+	added   []tableRef
+	deleted []tableRef
+	// nextFile, when non-zero, records the next unused file number.
+	nextFile uint64
+	// logNumber, when non-zero, records that every WAL numbered below it
+	// has been flushed, so recovery must not replay it.
+	logNumber uint64
+	// lastSeq, when non-zero, records a sequence number the database has
+	// reached, which a reopened database continues from.
+	lastSeq uint64
+	// pointers are the compaction pointers the edit moves.
+	pointers []compactPointer
+	// time, when non-zero, is when the edit was logged.
+	time time.Time
+}
+
+func (e *versionEdit) addFile(level int, sst *SSTable) {
+	e.added = append(e.added, tableRef{
+		level:       level,
+		name:        filepath.Base(sst.path),
+		smallestSeq: sst.smallestSeq,
+		largestSeq:  sst.largestSeq,
+	})
+}
+
+func (e *versionEdit) deleteFile(level int, path string) {
+	e.deleted = append(e.deleted, tableRef{level: level, name: filepath.Base(path)})
+}
+
+func (e *versionEdit) encode() []byte {
+	var buf bytes.Buffer
+	for _, ref := range e.added {
+		if ref.largestSeq == 0 {
+			buf.WriteByte(tagAddFile)
+		} else {
+			buf.WriteByte(tagAddFileSeqs)
+		}
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(ref.level))
+		_ = writeString(&buf, ref.name)
+		if ref.largestSeq != 0 {
+			_ = binary.Write(&buf, binary.LittleEndian, ref.smallestSeq)
+			_ = binary.Write(&buf, binary.LittleEndian, ref.largestSeq)
+		}
+	}
+	for _, ref := range e.deleted {
+		buf.WriteByte(tagDeleteFile)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(ref.level))
+		_ = writeString(&buf, ref.name)
+	}
+	if e.nextFile != 0 {
+		buf.WriteByte(tagNextFile)
+		_ = binary.Write(&buf, binary.LittleEndian, e.nextFile)
+	}
+	if e.logNumber != 0 {
+		buf.WriteByte(tagLogNumber)
+		_ = binary.Write(&buf, binary.LittleEndian, e.logNumber)
+	}
+	if e.lastSeq != 0 {
+		buf.WriteByte(tagLastSeq)
+		_ = binary.Write(&buf, binary.LittleEndian, e.lastSeq)
+	}
+	for _, p := range e.pointers {
+		buf.WriteByte(tagCompactPtr)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(p.level))
+		_ = writeString(&buf, p.key)
+	}
+	if !e.time.IsZero() {
+		buf.WriteByte(tagTime)
+		_ = binary.Write(&buf, binary.LittleEndian, e.time.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+func decodeVersionEdit(data []byte) (*versionEdit, error) {
+	r := bytes.NewReader(data)
+	e := &versionEdit{}
+	for r.Len() > 0 {
+		tag, _ := r.ReadByte()
+		switch tag {
+		case tagAddFile, tagAddFileSeqs, tagDeleteFile:
+			var level uint32
+			if err := binary.Read(r, binary.LittleEndian, &level); err != nil {
+				return nil, fmt.Errorf("failed to read level: %w", err)
+			}
+			name, err := readString(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file name: %w", err)
+			}
+			ref := tableRef{level: int(level), name: name}
+			if tag == tagAddFileSeqs {
+				if err := binary.Read(r, binary.LittleEndian, &ref.smallestSeq); err != nil {
+					return nil, fmt.Errorf("failed to read sequence range: %w", err)
+				}
+				if err := binary.Read(r, binary.LittleEndian, &ref.largestSeq); err != nil {
+					return nil, fmt.Errorf("failed to read sequence range: %w", err)
+				}
+			}
+			if tag != tagDeleteFile {
+				e.added = append(e.added, ref)
+			} else {
+				e.deleted = append(e.deleted, ref)
+			}
+		case tagNextFile:
+			if err := binary.Read(r, binary.LittleEndian, &e.nextFile); err != nil {
+				return nil, fmt.Errorf("failed to read next file number: %w", err)
+			}
+		case tagLogNumber:
+			if err := binary.Read(r, binary.LittleEndian, &e.logNumber); err != nil {
+				return nil, fmt.Errorf("failed to read log number: %w", err)
+			}
+		case tagLastSeq:
+			if err := binary.Read(r, binary.LittleEndian, &e.lastSeq); err != nil {
+				return nil, fmt.Errorf("failed to read last sequence number: %w", err)
+			}
+		case tagCompactPtr:
+			var level uint32
+			if err := binary.Read(r, binary.LittleEndian, &level); err != nil {
+				return nil, fmt.Errorf("failed to read level: %w", err)
+			}
+			key, err := readString(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read compaction pointer: %w", err)
+			}
+			e.pointers = append(e.pointers, compactPointer{level: int(level), key: key})
+		case tagTime:
+			var nanos int64
+			if err := binary.Read(r, binary.LittleEndian, &nanos); err != nil {
+				return nil, fmt.Errorf("failed to read edit time: %w", err)
+			}
+			e.time = time.Unix(0, nanos)
+		default:
+			return nil, fmt.Errorf("unknown version edit tag %d", tag)
+		}
+	}
+	return e, nil
+}
+
+// defaultMaxManifestFileSize is Options.MaxManifestFileSize when it is zero.
+const defaultMaxManifestFileSize = 4 * 1024 * 1024
+
+// manifest appends version edits to the MANIFEST file, syncing each one.
+type manifest struct {
+	path   string
+	file   File
+	writer *bufio.Writer
+	// size is the length of the file, and lastSeq the highest sequence
+	// number recorded in it, which a snapshot replacing it carries over.
+	size    int64
+	lastSeq uint64
+}
+
+// manifestName returns the file name of the MANIFEST with file number num.
+func manifestName(num uint64) string {
+	return fmt.Sprintf("MANIFEST-%06d", num)
+}
+
+// currentManifest returns the path of the MANIFEST in dir: the one CURRENT
+// names or, failing that, a legacy unnumbered MANIFEST. legacy reports the
+// latter; path is empty when there is neither.
+func currentManifest(fs FileSystem, dir string) (path string, legacy bool, err error) {
+	data, err := readFile(fs, filepath.Join(dir, currentFileName))
+	if err == nil {
+		name := strings.TrimSuffix(string(data), "\n")
+		if name == "" || strings.ContainsAny(name, "/\\\n") {
+			return "", false, fmt.Errorf("CURRENT names an invalid manifest %q", name)
+		}
+		return filepath.Join(dir, name), false, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("failed to read CURRENT: %w", err)
+	}
+	path = filepath.Join(dir, legacyManifestFileName)
+	if _, err := fs.Stat(path); err == nil {
+		return path, true, nil
+	} else if !os.IsNotExist(err) {
+		return "", false, fmt.Errorf("failed to stat manifest: %w", err)
+	}
+	return "", false, nil
+}
+
+// databaseExists reports whether dir holds a database: a MANIFEST or, for
+// databases written before there was one, SSTables or WALs.
+func databaseExists(fs FileSystem, dir string) (bool, error) {
+	path, _, err := currentManifest(fs, dir)
+	if err != nil || path != "" {
+		return path != "", err
+	}
+	for _, pattern := range []string{"*.sst", "*.walb"} {
+		matches, err := fs.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return false, fmt.Errorf("failed to scan %s: %w", dir, err)
+		}
+		if len(matches) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// openManifest opens the MANIFEST named by CURRENT for appending.
+func openManifest(fs FileSystem, dir string) (*manifest, error) {
+	path, legacy, err := currentManifest(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" || legacy {
+		return nil, fmt.Errorf("failed to open manifest: no CURRENT file in %s", dir)
+	}
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat manifest: %w", err)
+	}
+	file, err := fs.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	return &manifest{path: path, file: file, writer: bufio.NewWriter(file), size: info.Size()}, nil
+}
+
+func (m *manifest) append(e *versionEdit) error {
+	data := e.encode()
+	if err := writeFramedRecord(m.writer, data); err != nil {
+		return fmt.Errorf("failed to write version edit: %w", err)
+	}
+	m.size += int64(8 + len(data))
+	m.lastSeq = max(m.lastSeq, e.lastSeq)
+	if err := m.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush manifest: %w", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	return nil
+}
+
+func (m *manifest) close() error {
+	if err := m.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush manifest on close: %w", err)
+	}
+	return m.file.Close()
+}
+
+// readVersionEdits returns the edits of the MANIFEST at path, in the order
+// they were logged.
+func readVersionEdits(fs FileSystem, path string) ([]*versionEdit, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer file.Close()
+
+	var edits []*versionEdit
+	r := bufio.NewReader(file)
+	for {
+		data, err := readFramedRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// A torn final edit was never acknowledged; ignore it.
+			log.Printf("Ignoring truncated record at end of manifest %s", path)
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest record: %w", err)
+		}
+		edit, err := decodeVersionEdit(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode manifest record: %w", err)
+		}
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+// manifestState is the tree a MANIFEST describes.
+type manifestState struct {
+	// levels holds the live table names per level, in the order they were
+	// added.
+	levels [][]string
+	// nextFile is the last next file number recorded; zero for MANIFESTs
+	// written before file numbering.
+	nextFile uint64
+	// logNumber is the number of the oldest WAL that may hold writes no
+	// table has; zero when every WAL may.
+	logNumber uint64
+	// lastSeq is the highest sequence number recorded; zero when none was.
+	lastSeq uint64
+	// pointers holds the last compaction pointer recorded per level.
+	pointers []string
+	// seqs holds the sequence range recorded for each live table that has
+	// one.
+	seqs map[string]tableRef
+	// legacy is set when the state came from an unnumbered MANIFEST with no
+	// CURRENT.
+	legacy bool
+}
+
+// readManifest replays the MANIFEST in dir. It returns a nil state when no
+// MANIFEST exists.
+func readManifest(fs FileSystem, dir string, numLevels int) (*manifestState, error) {
+	path, legacy, err := currentManifest(fs, dir)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	edits, err := readVersionEdits(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &manifestState{levels: make([][]string, numLevels), pointers: make([]string, numLevels), seqs: make(map[string]tableRef), legacy: legacy}
+	levels := state.levels
+	for _, edit := range edits {
+		if edit.nextFile > state.nextFile {
+			state.nextFile = edit.nextFile
+		}
+		if edit.logNumber > state.logNumber {
+			state.logNumber = edit.logNumber
+		}
+		if edit.lastSeq > state.lastSeq {
+			state.lastSeq = edit.lastSeq
+		}
+		for _, p := range edit.pointers {
+			if p.level < numLevels {
+				state.pointers[p.level] = p.key
+			}
+		}
+		for _, ref := range edit.deleted {
+			if ref.level < numLevels {
+				levels[ref.level] = removeName(levels[ref.level], ref.name)
+			}
+			delete(state.seqs, ref.name)
+		}
+		for _, ref := range edit.added {
+			if ref.level >= numLevels {
+				return nil, fmt.Errorf("manifest references level %d beyond %d levels", ref.level, numLevels)
+			}
+			levels[ref.level] = append(levels[ref.level], ref.name)
+			if ref.largestSeq != 0 {
+				state.seqs[ref.name] = ref
+			}
+		}
+	}
+	return state, nil
+}
+
+// writeManifestSnapshot starts a new MANIFEST in dir with file number num,
+// holding a single edit that adds every table in levels and carries
+// logNumber, lastSeq and the compaction pointers, and points CURRENT at it.
+// num must be unused; the edit records num+1 as the next file number.
+func writeManifestSnapshot(fs FileSystem, dir string, levels [][]*SSTable, pointers []string, num, logNumber, lastSeq uint64) error {
+	edit := &versionEdit{nextFile: num + 1, logNumber: logNumber, lastSeq: lastSeq, time: time.Now()}
+	for levelNum, level := range levels {
+		for _, sst := range level {
+			edit.addFile(levelNum, sst)
+		}
+	}
+	for level, key := range pointers {
+		if key != "" {
+			edit.pointers = append(edit.pointers, compactPointer{level: level, key: key})
+		}
+	}
+
+	name := manifestName(num)
+	file, err := fs.Create(filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if err := writeFramedRecord(file, edit.encode()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write manifest snapshot: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync manifest snapshot: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest snapshot: %w", err)
+	}
+	if err := setCurrent(fs, dir, name); err != nil {
+		return fmt.Errorf("failed to install manifest snapshot: %w", err)
+	}
+	return nil
+}
+
+// setCurrent atomically points CURRENT at the MANIFEST called name.
+func setCurrent(fs FileSystem, dir, name string) error {
+	path := filepath.Join(dir, currentFileName)
+	tmpPath := path + ".tmp"
+	file, err := fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(name + "\n")); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDirOf(fs, path)
+}
+
+// manifestLogNumber returns the log number the MANIFEST in dir records, or
+// zero if it records none or cannot be read.
+func manifestLogNumber(fs FileSystem, dir string) uint64 {
+	state, err := readManifest(fs, dir, maxNumLevels)
+	if err != nil || state == nil {
+		return 0
+	}
+	return state.logNumber
+}
+
+func removeName(names []string, name string) []string {
+	for i, n := range names {
+		if n == name {
+			return append(names[:i], names[i+1:]...)
+		}
+	}
+	return names
+}
+
+// writeFramedRecord writes data as [length][crc32][data], the same framing
+// the WAL uses.
+func writeFramedRecord(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(data)); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFramedRecord(r io.Reader) ([]byte, error) {
+	var length, crc uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &crc); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, fmt.Errorf("CRC mismatch")
+	}
+	return data, nil
+}
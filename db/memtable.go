@@ -0,0 +1,174 @@
+package db
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	memTableMaxHeight = 12
+	memTableBranching = 4
+
+	// memNodeOverhead is the memory a skiplist node takes apart from the
+	// bytes of its key and value.
+	memNodeOverhead = int(unsafe.Sizeof(memNode{}))
+)
+
+// memTable is the in-memory write buffer: a skiplist kept sorted by key, so
+// that flushes, snapshots, and scans always see entries in ascending key
+// order without sorting or iterating a Go map. The tower heights come from a
+// fixed-seed generator, which makes the structure (and therefore any
+// iteration over it) fully deterministic for a given sequence of writes.
+//
+// Every write adds a node tagged with its sequence number, placed before
+// the older versions of its key, and nodes are never changed once linked
+// in. A snapshot can therefore read a memtable by reference, looking past
+// the versions newer than its sequence number, while writes go on.
+//
+// Writes must be serialized, which the DB does with db.mu. Reads need no
+// lock: a node is fully built before the atomic store that links it in.
+type memTable struct {
+	head   *memNode
+	height atomic.Int32
+	length int // distinct keys
+	size   int // bytes of memory held by nodes, keys and values
+	rnd    uint64
+}
+
+type memNode struct {
+	key   string
+	value string
+	seq   uint64
+	next  [memTableMaxHeight]atomic.Pointer[memNode]
+}
+
+func newMemTable() *memTable {
+	m := &memTable{head: &memNode{}, rnd: 0x9E3779B97F4A7C15}
+	m.height.Store(1)
+	return m
+}
+
+// randomHeight draws a tower height with P(h) = (1/branching)^(h-1) using a
+// xorshift generator.
+func (m *memTable) randomHeight() int {
+	h := 1
+	for h < memTableMaxHeight {
+		m.rnd ^= m.rnd << 13
+		m.rnd ^= m.rnd >> 7
+		m.rnd ^= m.rnd << 17
+		if m.rnd%memTableBranching != 0 {
+			break
+		}
+		h++
+	}
+	return h
+}
+
+// findGreaterOrEqual returns the first node with key >= key, which is the
+// newest version of key if it is present, filling prev with the rightmost
+// node before it at every level when prev is non-nil.
+func (m *memTable) findGreaterOrEqual(key string, prev *[memTableMaxHeight]*memNode) *memNode {
+	x := m.head
+	for level := int(m.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil && next.key < key; next = x.next[level].Load() {
+			x = next
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0].Load()
+}
+
+// get returns the newest value of key.
+func (m *memTable) get(key string) (string, bool) {
+	n := m.findGreaterOrEqual(key, nil)
+	if n != nil && n.key == key {
+		return n.value, true
+	}
+	return "", false
+}
+
+// getAt returns the newest value of key written at or before seq.
+func (m *memTable) getAt(key string, seq uint64) (string, bool) {
+	for n := m.findGreaterOrEqual(key, nil); n != nil && n.key == key; n = n.next[0].Load() {
+		if n.seq <= seq {
+			return n.value, true
+		}
+	}
+	return "", false
+}
+
+// put adds value as the newest version of key, written at seq.
+func (m *memTable) put(key, value string, seq uint64) {
+	var prev [memTableMaxHeight]*memNode
+	n := m.findGreaterOrEqual(key, &prev)
+	if n == nil || n.key != key {
+		m.length++
+	}
+
+	h := m.randomHeight()
+	if height := int(m.height.Load()); h > height {
+		for level := height; level < h; level++ {
+			prev[level] = m.head
+		}
+		// A reader that sees the new height before the node is linked
+		// in finds nil at the new levels and drops to the next one.
+		m.height.Store(int32(h))
+	}
+
+	n = &memNode{key: key, value: value, seq: seq}
+	for level := 0; level < h; level++ {
+		n.next[level].Store(prev[level].next[level].Load())
+		prev[level].next[level].Store(n)
+	}
+	m.size += memNodeOverhead + len(key) + len(value)
+}
+
+func (m *memTable) len() int {
+	return m.length
+}
+
+// bytes returns the memory the memtable holds: the keys and values and the
+// skiplist node of every version, overwritten ones included, as a
+// snapshot may still read them.
+func (m *memTable) bytes() int {
+	return m.size
+}
+
+// last returns the largest key, and false if the memtable is empty.
+func (m *memTable) last() (string, bool) {
+	x := m.head
+	for level := int(m.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	if x == m.head {
+		return "", false
+	}
+	return x.key, true
+}
+
+// forEach calls fn with the newest version of every key in ascending key
+// order until fn returns false.
+func (m *memTable) forEach(fn func(key, value string) bool) {
+	for n := m.head.next[0].Load(); n != nil; n = n.next[0].Load() {
+		if !fn(n.key, n.value) {
+			return
+		}
+		for next := n.next[0].Load(); next != nil && next.key == n.key; next = n.next[0].Load() {
+			n = next
+		}
+	}
+}
+
+// entries returns every entry in ascending key order.
+func (m *memTable) entries() [][2]string {
+	kvs := make([][2]string, 0, m.length)
+	m.forEach(func(key, value string) bool {
+		kvs = append(kvs, [2]string{key, value})
+		return true
+	})
+	return kvs
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemTableIteratesInKeyOrder(t *testing.T) {
+	mem := newMemTable()
+	want := make(map[string]string)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", rng.Intn(1000))
+		value := fmt.Sprintf("value%d", i)
+		mem.put(key, value, uint64(i+1))
+		want[key] = value
+	}
+
+	entries := mem.entries()
+	assert.Equal(t, len(want), mem.len())
+	assert.Len(t, entries, len(want))
+	assert.True(t, sort.SliceIsSorted(entries, func(i, j int) bool {
+		return entries[i][0] < entries[j][0]
+	}))
+	for _, kv := range entries {
+		assert.Equal(t, want[kv[0]], kv[1])
+	}
+
+	// Identical write sequences build identical structures.
+	again := newMemTable()
+	rng = rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		again.put(fmt.Sprintf("key%05d", rng.Intn(1000)), fmt.Sprintf("value%d", i), uint64(i+1))
+	}
+	assert.Equal(t, entries, again.entries())
+	assert.Equal(t, mem.height.Load(), again.height.Load())
+}
+
+func TestMemTableBytesCountsNodes(t *testing.T) {
+	mem := newMemTable()
+	mem.put("key1", "value", 1)
+	mem.put("key2", "value", 2)
+	assert.Equal(t, 2*(memNodeOverhead+len("key1value")), mem.bytes())
+
+	// Overwriting a key adds a version, which a snapshot may still read.
+	mem.put("key1", "longer value", 3)
+	assert.Equal(t, 3*memNodeOverhead+len("key1longer value")+2*len("key1value"), mem.bytes())
+	assert.Equal(t, 2, mem.len())
+}
+
+func TestMemTableReadsAsOfSequence(t *testing.T) {
+	mem := newMemTable()
+	mem.put("a", "a1", 1)
+	mem.put("b", "b2", 2)
+	mem.put("a", "a3", 3)
+	mem.put("c", "c4", 4)
+	mem.put("b", "b5", 5)
+
+	read := func(seq uint64) [][2]string {
+		var kvs [][2]string
+		for it := newMemIterator(mem, seq, false); it.valid(); it.next() {
+			kvs = append(kvs, [2]string{it.key(), it.value()})
+		}
+		return kvs
+	}
+	assert.Equal(t, [][2]string{{"a", "a1"}}, read(1))
+	assert.Equal(t, [][2]string{{"a", "a3"}, {"b", "b2"}}, read(3))
+	assert.Equal(t, [][2]string{{"a", "a3"}, {"b", "b5"}, {"c", "c4"}}, read(5))
+	assert.Equal(t, read(5), mem.entries())
+
+	value, ok := mem.getAt("b", 4)
+	assert.True(t, ok)
+	assert.Equal(t, "b2", value)
+	_, ok = mem.getAt("c", 3)
+	assert.False(t, ok)
+	value, _ = mem.get("b")
+	assert.Equal(t, "b5", value)
+
+	it := newMemIterator(mem, 2, false)
+	it.seek("b")
+	assert.Equal(t, "b", it.key())
+	assert.Equal(t, "b2", it.value())
+	it.next()
+	assert.False(t, it.valid())
+}
+
+func TestMergeRunsNewestWins(t *testing.T) {
+	newest := [][2]string{{"a", "new"}, {"c", "new"}}
+	middle := [][2]string{{"b", "mid"}, {"c", "mid"}, {"d", "mid"}}
+	oldest := [][2]string{{"a", "old"}, {"d", "old"}, {"e", "old"}}
+
+	got := mergeRuns([][][2]string{newest, middle, oldest})
+	assert.Equal(t, [][2]string{
+		{"a", "new"},
+		{"b", "mid"},
+		{"c", "new"},
+		{"d", "mid"},
+		{"e", "old"},
+	}, got)
+}
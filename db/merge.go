@@ -0,0 +1,317 @@
+package db
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// mergeRuns merges sorted runs of key-value pairs into a single run sorted by
+// key. runs must be ordered newest first; when several runs contain the same
+// key, the entry from the newest run wins. The output depends only on the
+// contents of runs, never on map iteration or scheduling order.
+func mergeRuns(runs [][][2]string) [][2]string {
+	if len(runs) == 0 {
+		return nil
+	}
+
+	merged := runs[len(runs)-1]
+	for i := len(runs) - 2; i >= 0; i-- {
+		merged = mergeTwoRuns(runs[i], merged)
+	}
+	return merged
+}
+
+// mergeTwoRuns merges two sorted runs, preferring newer on equal keys.
+func mergeTwoRuns(newer, older [][2]string) [][2]string {
+	out := make([][2]string, 0, len(newer)+len(older))
+	i, j := 0, 0
+	for i < len(newer) && j < len(older) {
+		switch {
+		case newer[i][0] < older[j][0]:
+			out = append(out, newer[i])
+			i++
+		case newer[i][0] > older[j][0]:
+			out = append(out, older[j])
+			j++
+		default:
+			out = append(out, newer[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, newer[i:]...)
+	out = append(out, older[j:]...)
+	return out
+}
+
+// storedForm reports whether merging levels needs values in stored form:
+// when value separation is enabled or any of the tables holds separated
+// values.
+func (db *DB) storedForm(levels ...[]*SSTable) bool {
+	if db.opts.ValueLogThreshold > 0 {
+		return true
+	}
+	for _, level := range levels {
+		for _, sst := range level {
+			if sst != nil && sst.separated {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// internalIterator is a sorted source of records for mergingIterator. It
+// starts at its first record; valid reports false once it is exhausted or
+// has failed, and err tells the two apart.
+type internalIterator interface {
+	valid() bool
+	key() string
+	value() string
+	next()
+	seek(target string)
+	err() error
+}
+
+// memIterator walks the versions of a memtable's keys written at or before
+// seq, newest version of each key only. With stored set, values are
+// returned in stored form.
+type memIterator struct {
+	mem    *memTable
+	seq    uint64
+	node   *memNode
+	stored bool
+}
+
+func newMemIterator(mem *memTable, seq uint64, stored bool) *memIterator {
+	it := &memIterator{mem: mem, seq: seq, stored: stored}
+	it.settle(mem.head.next[0].Load())
+	return it
+}
+
+// settle moves to the first version at or after n that is visible at
+// it.seq.
+func (it *memIterator) settle(n *memNode) {
+	for n != nil && n.seq > it.seq {
+		n = n.next[0].Load()
+	}
+	it.node = n
+}
+
+func (it *memIterator) valid() bool { return it.node != nil }
+func (it *memIterator) key() string { return it.node.key }
+func (it *memIterator) err() error  { return nil }
+
+// next skips the older versions of the current key.
+func (it *memIterator) next() {
+	n := it.node.next[0].Load()
+	for n != nil && n.key == it.node.key {
+		n = n.next[0].Load()
+	}
+	it.settle(n)
+}
+
+func (it *memIterator) value() string {
+	if it.stored {
+		return encodeInline(it.node.value)
+	}
+	return it.node.value
+}
+
+func (it *memIterator) seek(target string) {
+	it.settle(it.mem.findGreaterOrEqual(target, nil))
+}
+
+// runIterator streams the records of a sorted run of tables, one data block
+// at a time, reading ahead while it moves through a table in order. Tables
+// older than blockFormatVersion have no block handles and are read whole. With stored set, values are returned in stored form.
+type runIterator struct {
+	tables []*SSTable
+	stored bool
+
+	chunk   [][2]string
+	pos     int
+	table   int // next table to read from
+	block   int // next block of tables[table]
+	readErr error
+	ahead   readAhead
+}
+
+// levelIterators returns the tables of level as runs, newest first. Each L0
+// table is a run of its own; the tables of a deeper level do not overlap
+// and form a single run.
+func levelIterators(level int, tables []*SSTable, stored bool) []internalIterator {
+	var live []*SSTable
+	for _, sst := range tables {
+		if sst != nil {
+			live = append(live, sst)
+		}
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	if level > 0 {
+		return []internalIterator{&runIterator{tables: live, stored: stored}}
+	}
+	its := make([]internalIterator, 0, len(live))
+	for i := len(live) - 1; i >= 0; i-- {
+		its = append(its, &runIterator{tables: live[i : i+1], stored: stored})
+	}
+	return its
+}
+
+// valid loads the next chunk if needed and reports whether a record is
+// available.
+func (it *runIterator) valid() bool {
+	for it.pos >= len(it.chunk) {
+		if it.readErr != nil || it.table >= len(it.tables) {
+			return false
+		}
+		sst := it.tables[it.table]
+		var kvs [][2]string
+		var err error
+		if sst.format >= blockFormatVersion {
+			if it.block >= len(sst.blocks) {
+				it.table, it.block = it.table+1, 0
+				continue
+			}
+			kvs, err = it.ahead.blockEntries(sst, sst.blocks[it.block])
+			it.block++
+		} else {
+			kvs, err = sst.rawEntries()
+			it.table++
+		}
+		if err != nil {
+			it.readErr = err
+			return false
+		}
+		if it.stored && !sst.separated {
+			for i, kv := range kvs {
+				kvs[i][1] = encodeInline(kv[1])
+			}
+		}
+		it.chunk, it.pos = kvs, 0
+	}
+	return true
+}
+
+func (it *runIterator) key() string   { return it.chunk[it.pos][0] }
+func (it *runIterator) value() string { return it.chunk[it.pos][1] }
+func (it *runIterator) next()         { it.pos++ }
+func (it *runIterator) err() error    { return it.readErr }
+
+// seek positions the iterator at the first record with a key >= target,
+// skipping tables by key range and blocks by their first keys.
+func (it *runIterator) seek(target string) {
+	it.chunk, it.pos, it.readErr = nil, 0, nil
+	it.table = sort.Search(len(it.tables), func(i int) bool {
+		return it.tables[i].props.LargestKey >= target
+	})
+	it.block = 0
+	if it.table < len(it.tables) {
+		sst := it.tables[it.table]
+		if sst.format >= blockFormatVersion && target > sst.props.SmallestKey {
+			if it.block, it.readErr = sst.seekBlock(target); it.readErr != nil {
+				return
+			}
+		}
+	}
+	for it.valid() && it.key() < target {
+		it.pos++
+	}
+}
+
+// mergingIterator merges sources, ordered newest first, into one sorted
+// stream. A heap orders the sources by their current key; when several hold
+// the same key, the newest one's record is returned and the others are
+// moved past it.
+type mergingIterator struct {
+	sources []internalIterator
+	heap    mergeHeap
+
+	curKey, curValue string
+	ok               bool
+	mergeErr         error
+}
+
+func newMergingIterator(sources []internalIterator) *mergingIterator {
+	m := &mergingIterator{sources: sources}
+	m.heap.sources = sources
+	return m
+}
+
+// seek positions every source at target and moves to the first merged
+// record with a key >= target. seek("") starts from the beginning.
+func (m *mergingIterator) seek(target string) {
+	m.heap.order = m.heap.order[:0]
+	m.mergeErr = nil
+	for i, src := range m.sources {
+		src.seek(target)
+		if src.valid() {
+			m.heap.order = append(m.heap.order, i)
+		} else if err := src.err(); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+	heap.Init(&m.heap)
+	m.next()
+}
+
+// next moves to the following merged record.
+func (m *mergingIterator) next() {
+	if m.mergeErr != nil || len(m.heap.order) == 0 {
+		m.ok = false
+		return
+	}
+	top := m.sources[m.heap.order[0]]
+	m.curKey, m.curValue = top.key(), top.value()
+	for len(m.heap.order) > 0 {
+		src := m.sources[m.heap.order[0]]
+		if src.key() != m.curKey {
+			break
+		}
+		src.next()
+		if src.valid() {
+			heap.Fix(&m.heap, 0)
+		} else if err := src.err(); err != nil {
+			m.fail(err)
+			return
+		} else {
+			heap.Pop(&m.heap)
+		}
+	}
+	m.ok = true
+}
+
+func (m *mergingIterator) fail(err error) {
+	m.mergeErr = err
+	m.ok = false
+}
+
+// mergeHeap is a min-heap of source indexes ordered by the sources' current
+// keys, with the lower (newer) index first on equal keys.
+type mergeHeap struct {
+	sources []internalIterator
+	order   []int
+}
+
+func (h *mergeHeap) Len() int { return len(h.order) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	ki, kj := h.sources[h.order[i]].key(), h.sources[h.order[j]].key()
+	if ki != kj {
+		return ki < kj
+	}
+	return h.order[i] < h.order[j]
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.order[i], h.order[j] = h.order[j], h.order[i] }
+func (h *mergeHeap) Push(x any)    { h.order = append(h.order, x.(int)) }
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.order) - 1
+	x := h.order[n]
+	h.order = h.order[:n]
+	return x
+}
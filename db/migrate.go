@@ -0,0 +1,308 @@
+package db
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The layouts MigrateDir writes.
+//
+// LayoutV1 is the layout of databases written before the MANIFEST: flat
+// SSTables named sstable_NNNNNN.sst with no MANIFEST or CURRENT, every
+// one of them read as part of L0. Open still reads it and converts the
+// directory to LayoutV2 in place, so a v1 copy is only kept as v1 until it
+// is opened.
+//
+// LayoutV2 is the layout Open writes: SSTables placed in levels, a
+// numbered MANIFEST named by CURRENT, and a numbered WAL per memtable.
+const (
+	LayoutV1 = "v1"
+	LayoutV2 = "v2"
+)
+
+var supportedLayouts = []string{LayoutV1, LayoutV2}
+
+// migrateStagingDir is the subdirectory of the destination that a v2
+// migration builds its tables in before ingesting them.
+const migrateStagingDir = "migrate"
+
+// MigrationReport summarizes a completed MigrateDir run.
+type MigrationReport struct {
+	Keys     int
+	Checksum uint32
+	// Tables is how many SSTables the destination was written as.
+	Tables int
+}
+
+// MigrateDir copies every live key-value pair of the database in src into
+// dst in the given layout, then reads dst back and verifies that its key
+// count and content checksum match the source. dst must not exist or must
+// be empty. The source is read through a snapshot iterator and written out
+// as non-overlapping SSTables of about Options.TargetFileSizeBase bytes, so
+// neither database is held in memory. Writes made to src during the
+// migration are not copied. opts is used to open src and to build the new
+// tables; a nil opts means DefaultOptions().
+func MigrateDir(src, dst, layout string, opts *Options) (*MigrationReport, error) {
+	if !isSupportedLayout(layout) {
+		return nil, fmt.Errorf("unsupported layout %q (supported: %s)", layout, strings.Join(supportedLayouts, ", "))
+	}
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	fs := fsOrDefault(opts.FileSystem)
+	if entries, err := fs.ReadDir(dst); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("destination directory %s is not empty", dst)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to inspect destination directory: %w", err)
+	}
+
+	sourceOpts := *opts
+	sourceOpts.CreateIfMissing = false
+	source, err := Open(src, &sourceOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source database: %w", err)
+	}
+	defer source.Close()
+
+	tableDir := dst
+	if layout == LayoutV2 {
+		tableDir = filepath.Join(dst, migrateStagingDir)
+	}
+	if err := fs.MkdirAll(tableDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	w := &migrationWriter{fs: fs, dir: tableDir, opts: opts, size: opts.TargetFileSizeBase}
+	if w.size <= 0 {
+		w.size = defaultTargetFileSizeBase
+	}
+	digest := newMigrationDigest()
+	it := source.NewIterator()
+	for it.First(); it.Valid(); it.Next() {
+		digest.add(it.Key(), it.Value())
+		if err := w.add(it.Key(), it.Value()); err != nil {
+			it.Close()
+			w.abandon()
+			return nil, fmt.Errorf("failed to write destination table: %w", err)
+		}
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		w.abandon()
+		return nil, fmt.Errorf("failed to read source database: %w", err)
+	}
+	if err := w.finish(); err != nil {
+		w.abandon()
+		return nil, fmt.Errorf("failed to write destination table: %w", err)
+	}
+	if err := fs.SyncDir(tableDir); err != nil {
+		return nil, fmt.Errorf("failed to sync destination directory: %w", err)
+	}
+	report := &MigrationReport{Keys: digest.keys, Checksum: digest.sum(), Tables: len(w.paths)}
+
+	if layout == LayoutV2 {
+		if err := ingestMigrated(dst, w.paths, opts); err != nil {
+			return nil, err
+		}
+		for _, path := range w.paths {
+			fs.Remove(path)
+		}
+		if err := fs.Remove(tableDir); err != nil {
+			return nil, fmt.Errorf("failed to remove staging directory: %w", err)
+		}
+	}
+
+	if err := verifyMigration(dst, layout, opts, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ingestMigrated creates the v2 database in dst and ingests the tables
+// built for it.
+func ingestMigrated(dst string, paths []string, opts *Options) error {
+	targetOpts := *opts
+	targetOpts.CreateIfMissing = true
+	target, err := Open(dst, &targetOpts)
+	if err != nil {
+		return fmt.Errorf("failed to initialize destination database: %w", err)
+	}
+	if err := target.IngestSSTables(paths); err != nil {
+		target.Close()
+		return fmt.Errorf("failed to ingest destination tables: %w", err)
+	}
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("failed to close destination database: %w", err)
+	}
+	return nil
+}
+
+// migrationWriter writes a sorted stream of records as SSTables cut at
+// about size bytes, numbered from one in the names L0 tables take.
+type migrationWriter struct {
+	fs      FileSystem
+	dir     string
+	opts    *Options
+	size    int64
+	builder *SSTableBuilder
+	paths   []string
+}
+
+func (w *migrationWriter) add(key, value string) error {
+	if w.builder == nil {
+		path := filepath.Join(w.dir, tableFileName(0, uint64(len(w.paths)+1)))
+		builder, err := NewSSTableBuilder(path, w.opts)
+		if err != nil {
+			return err
+		}
+		w.builder = builder
+		w.paths = append(w.paths, path)
+	}
+	if err := w.builder.Add(key, value); err != nil {
+		return err
+	}
+	if w.builder.offset >= w.size {
+		return w.finish()
+	}
+	return nil
+}
+
+// finish finishes and syncs the table being written, if any.
+func (w *migrationWriter) finish() error {
+	if w.builder == nil {
+		return nil
+	}
+	builder := w.builder
+	w.builder = nil
+	if err := builder.Finish(); err != nil {
+		return err
+	}
+	return fileSync(w.fs, builder.sst.path)
+}
+
+// abandon removes every table written so far.
+func (w *migrationWriter) abandon() {
+	if w.builder != nil {
+		w.builder.Abandon()
+		w.builder = nil
+	}
+	for _, path := range w.paths {
+		w.fs.Remove(path)
+	}
+}
+
+// verifyMigration reads dst back and compares it with the report. A v2
+// destination is opened as a database; a v1 one has its tables read
+// directly, since opening it would convert it to v2.
+func verifyMigration(dst, layout string, opts *Options, want *MigrationReport) error {
+	fs := fsOrDefault(opts.FileSystem)
+	var digest *migrationDigest
+	var err error
+	if layout == LayoutV1 {
+		digest, err = digestTables(fs, dst)
+	} else {
+		if _, statErr := fs.Stat(filepath.Join(dst, currentFileName)); statErr != nil {
+			return fmt.Errorf("migration verification failed: %s has no CURRENT file: %w", dst, statErr)
+		}
+		digest, err = digestDatabase(dst, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read back destination database: %w", err)
+	}
+
+	if digest.keys != want.Keys {
+		return fmt.Errorf("migration verification failed: expected %d keys, found %d", want.Keys, digest.keys)
+	}
+	if sum := digest.sum(); sum != want.Checksum {
+		return fmt.Errorf("migration verification failed: checksum %08x does not match source %08x", sum, want.Checksum)
+	}
+	return nil
+}
+
+// digestDatabase opens the database in dir and digests its contents.
+func digestDatabase(dir string, opts *Options) (*migrationDigest, error) {
+	targetOpts := *opts
+	targetOpts.CreateIfMissing = false
+	target, err := Open(dir, &targetOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	digest := newMigrationDigest()
+	it := target.NewIterator()
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		digest.add(it.Key(), it.Value())
+	}
+	return digest, it.Err()
+}
+
+// digestTables digests the flat tables of a v1 directory in name order,
+// which is key order for the tables MigrateDir writes.
+func digestTables(fs FileSystem, dir string) (*migrationDigest, error) {
+	if _, err := fs.Stat(filepath.Join(dir, currentFileName)); err == nil {
+		return nil, fmt.Errorf("%s has a CURRENT file", dir)
+	}
+	paths, err := fs.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan SSTable files: %w", err)
+	}
+	sort.Strings(paths)
+	var tables []*SSTable
+	defer func() {
+		for _, sst := range tables {
+			sst.Close()
+		}
+	}()
+	for _, path := range paths {
+		sst := &SSTable{path: path, fs: fs, verifyChecksums: true}
+		if err := sst.Load(); err != nil {
+			sst.Close()
+			return nil, fmt.Errorf("failed to open SSTable %s: %w", path, err)
+		}
+		tables = append(tables, sst)
+	}
+
+	digest := newMigrationDigest()
+	it := &runIterator{tables: tables}
+	for ; it.valid(); it.next() {
+		digest.add(it.key(), it.value())
+	}
+	return digest, it.err()
+}
+
+// migrationDigest counts records and hashes them in order, length-prefixing
+// each field so that different splits of the same bytes produce different
+// sums.
+type migrationDigest struct {
+	keys int
+	h    hash.Hash32
+}
+
+func newMigrationDigest() *migrationDigest {
+	return &migrationDigest{h: crc32.NewIEEE()}
+}
+
+func (d *migrationDigest) add(key, value string) {
+	d.keys++
+	_ = writeString(d.h, key)
+	_ = writeString(d.h, value)
+}
+
+func (d *migrationDigest) sum() uint32 {
+	return d.h.Sum32()
+}
+
+func isSupportedLayout(layout string) bool {
+	for _, l := range supportedLayouts {
+		if l == layout {
+			return true
+		}
+	}
+	return false
+}
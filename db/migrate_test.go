@@ -0,0 +1,152 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// migrateSource writes a database in dir whose live keys, returned, come
+// from several flushed tables, the memtable, overwrites and deletes.
+func migrateSource(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	store, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	want := make(map[string]string)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		require.NoError(t, store.Put(key, value+key))
+		want[key] = value + key
+		if i%200 == 199 {
+			require.NoError(t, store.Flush())
+		}
+	}
+	for i := 0; i < 600; i += 7 {
+		key := fmt.Sprintf("key%04d", i)
+		require.NoError(t, store.Delete(key))
+		delete(want, key)
+	}
+	require.NoError(t, store.Put("key0003", "rewritten"))
+	want["key0003"] = "rewritten"
+	require.NoError(t, store.Close())
+	return want
+}
+
+func checkMigrated(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	store, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	defer store.Close()
+	got := make(map[string]string)
+	it := store.NewIterator()
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, want, got)
+}
+
+func TestMigrateDirLayouts(t *testing.T) {
+	root := filepath.Join("testdata", "migrate")
+	_ = os.RemoveAll(root)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+	want := migrateSource(t, filepath.Join(root, "source"))
+
+	opts := DefaultOptions()
+	opts.TargetFileSizeBase = 8 << 10
+
+	v1 := filepath.Join(root, "v1")
+	report, err := MigrateDir(filepath.Join(root, "source"), v1, LayoutV1, opts)
+	require.NoError(t, err)
+	assert.Equal(t, len(want), report.Keys)
+	assert.Greater(t, report.Tables, 1)
+	tables, err := filepath.Glob(filepath.Join(v1, "sstable_*.sst"))
+	require.NoError(t, err)
+	assert.Len(t, tables, report.Tables)
+	for _, name := range []string{currentFileName, legacyManifestFileName} {
+		_, err := os.Stat(filepath.Join(v1, name))
+		assert.True(t, os.IsNotExist(err), "v1 layout has %s", name)
+	}
+
+	// A v1 directory migrates to v2 with the same contents.
+	v2 := filepath.Join(root, "v2")
+	again, err := MigrateDir(v1, v2, LayoutV2, opts)
+	require.NoError(t, err)
+	assert.Equal(t, report.Keys, again.Keys)
+	assert.Equal(t, report.Checksum, again.Checksum)
+	_, err = os.Stat(filepath.Join(v2, currentFileName))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(v2, migrateStagingDir))
+	assert.True(t, os.IsNotExist(err), "staging directory left behind")
+	checkMigrated(t, v2, want)
+
+	// Opening the v1 copy converts it in place.
+	checkMigrated(t, v1, want)
+}
+
+func TestMigrateDirRejects(t *testing.T) {
+	root := filepath.Join("testdata", "migrate-reject")
+	_ = os.RemoveAll(root)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+	source := filepath.Join(root, "source")
+	migrateSource(t, source)
+
+	_, err := MigrateDir(source, filepath.Join(root, "v3"), "v3", nil)
+	assert.ErrorContains(t, err, "unsupported layout")
+
+	busy := filepath.Join(root, "busy")
+	require.NoError(t, os.MkdirAll(busy, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(busy, "x"), nil, 0644))
+	_, err = MigrateDir(source, busy, LayoutV2, nil)
+	assert.ErrorContains(t, err, "not empty")
+
+	_, err = MigrateDir(filepath.Join(root, "missing"), filepath.Join(root, "out"), LayoutV2, nil)
+	assert.ErrorIs(t, err, ErrDatabaseNotFound)
+}
+
+func TestVerifyMigrationCatchesMismatch(t *testing.T) {
+	root := filepath.Join("testdata", "migrate-verify")
+	_ = os.RemoveAll(root)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+	source := filepath.Join(root, "source")
+	migrateSource(t, source)
+	opts := DefaultOptions()
+	opts.TargetFileSizeBase = 8 << 10
+
+	for _, layout := range supportedLayouts {
+		t.Run(layout, func(t *testing.T) {
+			dst := filepath.Join(root, layout)
+			report, err := MigrateDir(source, dst, layout, opts)
+			require.NoError(t, err)
+			require.NoError(t, verifyMigration(dst, layout, opts, report))
+
+			short := *report
+			short.Keys++
+			assert.ErrorContains(t, verifyMigration(dst, layout, opts, &short), "expected")
+			changed := *report
+			changed.Checksum ^= 1
+			assert.ErrorContains(t, verifyMigration(dst, layout, opts, &changed), "checksum")
+		})
+	}
+
+	// A lost table changes the count.
+	v1 := filepath.Join(root, LayoutV1)
+	report, err := MigrateDir(source, filepath.Join(root, "lost"), LayoutV1, opts)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(root, "lost", tableFileName(0, 1))))
+	assert.ErrorContains(t, verifyMigration(filepath.Join(root, "lost"), LayoutV1, opts, report), "expected")
+	assert.NoError(t, verifyMigration(v1, LayoutV1, opts, report))
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MultiGet looks up keys together and returns one result per key, in the
+// order given; each result is what Get would have returned. The keys are
+// sorted and searched in a single version: every table is probed once with
+// all the keys its range covers, and each data block is read once for every
+// key it may hold, in file order, rather than once per key.
+func (db *DB) MultiGet(keys []string) []GetResult {
+	for _, key := range keys {
+		db.trace(TraceRecord{Op: TraceGet, Key: key})
+	}
+	results := db.multiGet(keys)
+	for i := range results {
+		if results[i].Error == nil && isDeleted(keys[i], results[i].Value) {
+			results[i] = GetResult{Error: fmt.Errorf("failed to get key %s: %w", keys[i], ErrNotFound)}
+			continue
+		}
+		if _, ok := decodeChunkedValue(results[i].Value); ok && results[i].Error == nil {
+			results[i].Value, results[i].Error = db.getJoined(keys[i])
+		}
+	}
+	return results
+}
+
+// multiGet is MultiGet leaving chunked values as their records and deleted
+// keys as their tombstones.
+func (db *DB) multiGet(keys []string) []GetResult {
+	results := make([]GetResult, len(keys))
+	if db.closed.Load() {
+		for i, key := range keys {
+			results[i].Error = fmt.Errorf("failed to get key %s: %w", key, ErrClosed)
+		}
+		return results
+	}
+
+	// pending holds the indices of keys still to be found in the tables.
+	var pending []int
+	db.mu.RLock()
+	for i, key := range keys {
+		if isInternalKey(key) {
+			results[i].Error = fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+			continue
+		}
+		if value, ok := db.memGet(key); ok {
+			results[i].Value = value
+			continue
+		}
+		pending = append(pending, i)
+	}
+	db.mu.RUnlock()
+	sort.SliceStable(pending, func(a, b int) bool {
+		return keys[pending[a]] < keys[pending[b]]
+	})
+
+	v := db.currentVersion()
+	defer v.unref()
+	sample := db.sampleRead(v.levels)
+	for levelNum, level := range v.levels {
+		for j := range level {
+			if len(pending) == 0 {
+				return results
+			}
+			// L0 tables overlap, so the newest is searched first. Tables
+			// below L0 do not, so each key meets at most one per level.
+			sst := level[j]
+			if levelNum == 0 {
+				sst = level[len(level)-1-j]
+			}
+			if sst != nil {
+				pending = multiGetTable(sst, keys, pending, results, sample)
+			}
+		}
+	}
+	for _, i := range pending {
+		results[i].Error = fmt.Errorf("failed to get key %s: %w", keys[i], ErrNotFound)
+	}
+	return results
+}
+
+// multiGetTable looks up the pending keys that sst's range covers, records
+// their results, and returns the keys that are still pending. pending must
+// be sorted by key and stays sorted.
+func multiGetTable(sst *SSTable, keys []string, pending []int, results []GetResult, sample bool) []int {
+	if sst.props.NumEntries == 0 {
+		return pending
+	}
+	lo := sort.Search(len(pending), func(a int) bool {
+		return keys[pending[a]] >= sst.props.SmallestKey
+	})
+	hi := sort.Search(len(pending), func(a int) bool {
+		return keys[pending[a]] > sst.props.LargestKey
+	})
+	if lo == hi {
+		return pending
+	}
+
+	batch := make([]string, hi-lo)
+	for a, i := range pending[lo:hi] {
+		batch[a] = keys[i]
+	}
+	found := sst.lookupBatch(batch)
+
+	remaining := append([]int(nil), pending[:lo]...)
+	for a, i := range pending[lo:hi] {
+		r := found[a]
+		if sample {
+			sst.stats.record(r.res)
+		}
+		switch {
+		case r.err != nil:
+			results[i].Error = fmt.Errorf("failed to get key %s: %w", keys[i], r.err)
+		case r.res == lookupFound:
+			results[i].Value = r.value
+		default:
+			remaining = append(remaining, i)
+		}
+	}
+	return append(remaining, pending[hi:]...)
+}
+
+// batchLookup is the outcome of looking up one key of a lookupBatch.
+type batchLookup struct {
+	value string
+	res   lookupResult
+	err   error
+}
+
+// lookupBatch looks up keys, which must be sorted, returning what lookup
+// would for each. For block-format tables each index partition is decoded
+// once and each data block read once for all the keys that fall in it.
+func (s *SSTable) lookupBatch(keys []string) []batchLookup {
+	out := make([]batchLookup, len(keys))
+	if s.format < blockFormatVersion {
+		for a, key := range keys {
+			out[a].value, out[a].res, out[a].err = s.lookup(key)
+		}
+		return out
+	}
+	if err := s.acquire(); err != nil {
+		for a := range out {
+			out[a] = batchLookup{res: lookupMissed, err: err}
+		}
+		return out
+	}
+	defer s.release()
+	if s.file == nil {
+		for a, key := range keys {
+			out[a].value, out[a].res, out[a].err = s.lookup(key)
+		}
+		return out
+	}
+
+	// Group the keys that pass the filter by the data block that may hold
+	// them. Sorted keys visit the blocks in file order.
+	type blockKeys struct {
+		handle blockHandle
+		keys   []int
+	}
+	var groups []blockKeys
+	var index *block
+	partNum := -1
+	var mayContain []bool
+	if s.filter != nil {
+		mayContain = s.filter.MayContainAll(keys)
+	}
+	for a, key := range keys {
+		out[a].res = lookupMissed
+		if mayContain != nil && !mayContain[a] {
+			out[a].res = lookupFiltered
+			continue
+		}
+		p := sort.Search(len(s.partitions), func(i int) bool {
+			return s.partitions[i].lastKey >= key
+		})
+		if p == len(s.partitions) {
+			continue
+		}
+		part := s.partitions[p]
+		if p != partNum {
+			var err error
+			if index, err = s.indexBlock(p); err != nil {
+				out[a].err = err
+				partNum = -1
+				continue
+			}
+			partNum = p
+		}
+		_, encoded, ok, err := index.seek(key)
+		if err != nil {
+			out[a].err = s.corruption(part.offset, err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		handle, err := decodeBlockHandle(encoded)
+		if err != nil {
+			out[a].err = s.corruption(part.offset, err.Error())
+			continue
+		}
+		if n := len(groups); n > 0 && groups[n-1].handle == handle {
+			groups[n-1].keys = append(groups[n-1].keys, a)
+		} else {
+			groups = append(groups, blockKeys{handle: handle, keys: []int{a}})
+		}
+	}
+
+	for _, g := range groups {
+		data, err := s.readBlock(g.handle)
+		for _, a := range g.keys {
+			if err != nil {
+				out[a].err = err
+				continue
+			}
+			out[a] = s.seekBatchKey(data, g.handle, keys[a])
+		}
+	}
+	return out
+}
+
+// seekBatchKey finds key in the data block at h, already read as data, and
+// resolves its value as lookup would.
+func (s *SSTable) seekBatchKey(data *block, h blockHandle, key string) batchLookup {
+	k, v, found, err := data.seek(key)
+	if err != nil {
+		return batchLookup{res: lookupMissed, err: s.corruption(h.offset, err.Error())}
+	}
+	if !found || k != key {
+		return batchLookup{res: lookupMissed}
+	}
+	value, err := s.decodeValue(key, string(v))
+	if err != nil {
+		return batchLookup{res: lookupMissed, err: s.corruption(h.offset, err.Error())}
+	}
+	if s.separated {
+		if value, err = s.vlog.resolve(value); err != nil {
+			return batchLookup{res: lookupMissed, err: s.corruption(0, fmt.Sprintf("value of %q: %v", key, err))}
+		}
+	}
+	return batchLookup{value: value, res: lookupFound}
+}
@@ -0,0 +1,47 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiGetMatchesGet(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("multiget", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Spread versions of the keys over L1, several L0 tables and the
+	// memtable, newest last.
+	for round := 0; round < 6; round++ {
+		for i := round; i < 200; i += 3 {
+			require.NoError(t, store.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf("v%d", round)))
+		}
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Put("key010", "memtable"))
+
+	keys := []string{"key010", "missing", "key150", "key000", "key199", "key150", "key200"}
+	for i := 0; i < 200; i += 7 {
+		keys = append(keys, fmt.Sprintf("key%03d", i))
+	}
+
+	results := store.MultiGet(keys)
+	require.Len(t, results, len(keys))
+	for i, key := range keys {
+		want, wantErr := store.Get(key)
+		if wantErr != nil {
+			assert.Error(t, results[i].Error, key)
+			continue
+		}
+		assert.NoError(t, results[i].Error, key)
+		assert.Equal(t, want, results[i].Value, key)
+	}
+	assert.Equal(t, "memtable", results[0].Value)
+	assert.Error(t, results[1].Error)
+}
@@ -0,0 +1,667 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultObjectCacheBytes     = 64 << 20
+	defaultObjectCacheBlockSize = 64 << 10
+)
+
+// ObjectStore is a flat namespace of immutable objects, such as an S3 or
+// GCS bucket, that ObjectFileSystem keeps SSTables in. Keys are
+// slash-separated. It must be safe for concurrent use.
+type ObjectStore interface {
+	// Put stores the size bytes read from r as key, replacing any object
+	// already there.
+	Put(key string, r io.Reader, size int64) error
+	// ReadAt reads len(p) bytes of key from off, as io.ReaderAt does.
+	ReadAt(key string, p []byte, off int64) (int, error)
+	// Size returns the length of key, or an error wrapping os.ErrNotExist
+	// if there is no such object.
+	Size(key string) (int64, error)
+	// Delete removes key. Deleting a missing object is not an error.
+	Delete(key string) error
+	// List returns the sorted keys starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// ObjectFileSystemOptions configures an ObjectFileSystem.
+type ObjectFileSystemOptions struct {
+	// Prefix is prepended to every object key, so several databases can
+	// share a bucket.
+	Prefix string
+
+	// CacheBytes bounds the local cache of SSTable blocks read from the
+	// store. Zero means 64 MiB.
+	CacheBytes int64
+
+	// CacheBlockSize is the unit the store is read and cached in. Zero
+	// means 64 KiB.
+	CacheBlockSize int64
+}
+
+// ObjectFileSystem is a FileSystem that keeps SSTables in an ObjectStore and
+// everything else, the WAL, MANIFEST and value log among them, on a local
+// FileSystem. A table is written locally as usual and uploaded once it is
+// complete: when it is synced under, renamed to or linked to a name ending
+// in .sst. The local copy is then removed and the table is read from the
+// store through a cache of its most recently used blocks.
+//
+// Tables are read in whole when memory mapped, so databases on an
+// ObjectFileSystem should use ReadModePread, which fetches only the blocks
+// a read needs.
+type ObjectFileSystem struct {
+	local  FileSystem
+	store  ObjectStore
+	prefix string
+	cache  *objectCache
+}
+
+// NewObjectFileSystem returns a FileSystem keeping SSTables in store and
+// other files in local. A nil local means the OS filesystem.
+func NewObjectFileSystem(local FileSystem, store ObjectStore, opts *ObjectFileSystemOptions) *ObjectFileSystem {
+	var o ObjectFileSystemOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.CacheBytes <= 0 {
+		o.CacheBytes = defaultObjectCacheBytes
+	}
+	if o.CacheBlockSize <= 0 {
+		o.CacheBlockSize = defaultObjectCacheBlockSize
+	}
+	return &ObjectFileSystem{
+		local:  fsOrDefault(local),
+		store:  store,
+		prefix: o.Prefix,
+		cache:  newObjectCache(o.CacheBytes, o.CacheBlockSize),
+	}
+}
+
+// isRemote reports whether name is kept in the store once complete.
+func isRemote(name string) bool {
+	return strings.HasSuffix(name, ".sst")
+}
+
+// key returns the object key of name.
+func (fs *ObjectFileSystem) key(name string) string {
+	return fs.prefix + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+}
+
+// dirKey returns the key prefix of the objects in dir.
+func (fs *ObjectFileSystem) dirKey(dir string) string {
+	k := fs.key(dir)
+	if k == fs.prefix+"." {
+		return fs.prefix
+	}
+	return k + "/"
+}
+
+func localExists(fs FileSystem, name string) (bool, error) {
+	_, err := fs.Stat(name)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// upload copies the local file name to the store as key and removes the
+// local copy.
+func (fs *ObjectFileSystem) upload(name, key string) error {
+	f, err := fs.local.Open(name)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fs.cache.drop(key)
+	err = fs.store.Put(key, f, info.Size())
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return fs.local.Remove(name)
+}
+
+// copyObject copies the object src to dst in the store.
+func (fs *ObjectFileSystem) copyObject(src, dst string) error {
+	size, err := fs.store.Size(src)
+	if err != nil {
+		return err
+	}
+	fs.cache.drop(dst)
+	return fs.store.Put(dst, io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+		return fs.store.ReadAt(src, p, off)
+	}), 0, size), size)
+}
+
+// download copies the object key to the local file name.
+func (fs *ObjectFileSystem) download(key, name string) error {
+	size, err := fs.store.Size(key)
+	if err != nil {
+		return err
+	}
+	out, err := fs.local.Create(name)
+	if err != nil {
+		return err
+	}
+	src := io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+		return fs.store.ReadAt(key, p, off)
+	}), 0, size)
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// storeErr returns os.ErrNotExist itself for an object store's error
+// wrapping it, so os.IsNotExist recognizes it inside an os.PathError.
+func storeErr(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) { return f(p, off) }
+
+func (fs *ObjectFileSystem) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *ObjectFileSystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens a table still being written, or not yet uploaded, from
+// the local filesystem, and an uploaded table from the store. A handle
+// that can write to a table uploads it when synced.
+func (fs *ObjectFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if !isRemote(name) {
+		return fs.local.OpenFile(name, flag, perm)
+	}
+	exists, err := localExists(fs.local, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists && flag&os.O_CREATE == 0 {
+		key := fs.key(name)
+		size, err := fs.store.Size(key)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: storeErr(err)}
+		}
+		return &objectFile{fs: fs, name: name, key: key, size: size}, nil
+	}
+	f, err := fs.local.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &uploadingFile{File: f, fs: fs, name: name}, nil
+}
+
+// Remove removes name from the local filesystem and, for a table, from the
+// store.
+func (fs *ObjectFileSystem) Remove(name string) error {
+	if !isRemote(name) {
+		return fs.local.Remove(name)
+	}
+	err := fs.local.Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	key := fs.key(name)
+	if os.IsNotExist(err) {
+		if _, serr := fs.store.Size(key); serr != nil {
+			return &os.PathError{Op: "remove", Path: name, Err: storeErr(serr)}
+		}
+	}
+	fs.cache.drop(key)
+	if err := fs.store.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// Rename moves a file, uploading it when it becomes a table and
+// downloading it when a table is renamed to a local name.
+func (fs *ObjectFileSystem) Rename(oldname, newname string) error {
+	local, err := localExists(fs.local, oldname)
+	if err != nil {
+		return err
+	}
+	switch {
+	case local && !isRemote(newname):
+		return fs.local.Rename(oldname, newname)
+	case local:
+		return fs.upload(oldname, fs.key(newname))
+	}
+	if !isRemote(oldname) {
+		return fs.local.Rename(oldname, newname)
+	}
+	if err := fs.Link(oldname, newname); err != nil {
+		return err
+	}
+	return fs.Remove(oldname)
+}
+
+// Link makes newname a copy of oldname. Objects cannot share storage as
+// hard links do, so linking to or from a table in the store copies it.
+func (fs *ObjectFileSystem) Link(oldname, newname string) error {
+	local, err := localExists(fs.local, oldname)
+	if err != nil {
+		return err
+	}
+	if local {
+		if !isRemote(newname) {
+			return fs.local.Link(oldname, newname)
+		}
+		if exists, err := fs.exists(newname); err != nil || exists {
+			return linkExistsErr(oldname, newname, err)
+		}
+		if err := fs.local.Link(oldname, newname); err != nil {
+			return err
+		}
+		return fs.upload(newname, fs.key(newname))
+	}
+	if !isRemote(oldname) {
+		return fs.local.Link(oldname, newname)
+	}
+	if exists, err := fs.exists(newname); err != nil || exists {
+		return linkExistsErr(oldname, newname, err)
+	}
+	if !isRemote(newname) {
+		if err := fs.download(fs.key(oldname), newname); err != nil {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+		}
+		return nil
+	}
+	if err := fs.copyObject(fs.key(oldname), fs.key(newname)); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func linkExistsErr(oldname, newname string, err error) error {
+	if err == nil {
+		err = os.ErrExist
+	}
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+}
+
+// exists reports whether name exists locally or, for a table, in the store.
+func (fs *ObjectFileSystem) exists(name string) (bool, error) {
+	local, err := localExists(fs.local, name)
+	if err != nil || local || !isRemote(name) {
+		return local, err
+	}
+	_, err = fs.store.Size(fs.key(name))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (fs *ObjectFileSystem) MkdirAll(dir string, perm os.FileMode) error {
+	return fs.local.MkdirAll(dir, perm)
+}
+
+func (fs *ObjectFileSystem) SyncDir(dir string) error {
+	return fs.local.SyncDir(dir)
+}
+
+func (fs *ObjectFileSystem) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.local.Stat(name)
+	if err == nil || !os.IsNotExist(err) || !isRemote(name) {
+		return info, err
+	}
+	size, err := fs.store.Size(fs.key(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: storeErr(err)}
+	}
+	return memFileInfo{name: filepath.Base(name), size: size}, nil
+}
+
+// ReadDir lists dir on the local filesystem together with the tables of dir
+// in the store.
+func (fs *ObjectFileSystem) ReadDir(dir string) ([]string, error) {
+	names, err := fs.local.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := fs.remoteNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	return mergeNames(names, remote), nil
+}
+
+// remoteNames returns the base names of the tables directly in dir in the
+// store.
+func (fs *ObjectFileSystem) remoteNames(dir string) ([]string, error) {
+	prefix := fs.dirKey(dir)
+	keys, err := fs.store.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	var names []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if name != "" && !strings.Contains(name, "/") && isRemote(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// mergeNames returns the sorted union of a and b.
+func mergeNames(a, b []string) []string {
+	seen := make(map[string]bool, len(a))
+	out := append([]string(nil), a...)
+	for _, name := range a {
+		seen[name] = true
+	}
+	for _, name := range b {
+		if !seen[name] {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Glob matches pattern on the local filesystem and against the tables in
+// the store. Only the last element of pattern may hold wildcards.
+func (fs *ObjectFileSystem) Glob(pattern string) ([]string, error) {
+	matches, err := fs.local.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(pattern)
+	remote, err := fs.remoteNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, name := range remote {
+		if ok, _ := path.Match(filepath.Base(pattern), name); ok {
+			found = append(found, filepath.Join(dir, name))
+		}
+	}
+	return mergeNames(matches, found), nil
+}
+
+// uploadingFile is a writable handle to a local table, which it uploads
+// when synced.
+type uploadingFile struct {
+	File
+	fs       *ObjectFileSystem
+	name     string
+	uploaded bool
+}
+
+// Sync syncs the table locally and uploads it, removing the local copy
+// once the handle is closed.
+func (f *uploadingFile) Sync() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	src, err := f.fs.local.Open(f.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	key := f.fs.key(f.name)
+	f.fs.cache.drop(key)
+	if err := f.fs.store.Put(key, src, info.Size()); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", f.name, err)
+	}
+	f.uploaded = true
+	return nil
+}
+
+func (f *uploadingFile) Write(p []byte) (int, error) {
+	f.uploaded = false
+	return f.File.Write(p)
+}
+
+func (f *uploadingFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.uploaded {
+		return f.fs.local.Remove(f.name)
+	}
+	return nil
+}
+
+// objectFile is a read-only handle to a table in the store.
+type objectFile struct {
+	fs   *ObjectFileSystem
+	name string
+	key  string
+	size int64
+	pos  int64
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < f.size {
+		block, err := f.fs.cache.block(f.fs.store, f.key, f.size, off)
+		if err != nil {
+			return n, fmt.Errorf("failed to read %s: %w", f.name, err)
+		}
+		c := copy(p[n:], block[off%f.fs.cache.blockSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+// Sync is a no-op: a table in the store is already durable.
+func (f *objectFile) Sync() error { return nil }
+
+func (f *objectFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{name: filepath.Base(f.name), size: f.size}, nil
+}
+
+func (f *objectFile) Close() error { return nil }
+
+// objectCache is an LRU cache of fixed-size, aligned blocks of objects.
+type objectCache struct {
+	capacity  int64
+	blockSize int64
+
+	mu     sync.Mutex
+	used   int64
+	lru    *list.List // of *objectBlock, most recently used first
+	blocks map[string]map[int64]*list.Element
+}
+
+type objectBlock struct {
+	key  string
+	off  int64
+	data []byte
+}
+
+func newObjectCache(capacity, blockSize int64) *objectCache {
+	return &objectCache{
+		capacity:  capacity,
+		blockSize: blockSize,
+		lru:       list.New(),
+		blocks:    make(map[string]map[int64]*list.Element),
+	}
+}
+
+// block returns the block of key, an object of size bytes, holding off,
+// fetching it from store on a miss.
+func (c *objectCache) block(store ObjectStore, key string, size, off int64) ([]byte, error) {
+	start := off - off%c.blockSize
+	c.mu.Lock()
+	if e, ok := c.blocks[key][start]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*objectBlock).data, nil
+	}
+	c.mu.Unlock()
+
+	data := make([]byte, min(c.blockSize, size-start))
+	if n, err := store.ReadAt(key, data, start); err != nil && !(err == io.EOF && n == len(data)) {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[key][start]; ok {
+		return e.Value.(*objectBlock).data, nil
+	}
+	if c.blocks[key] == nil {
+		c.blocks[key] = make(map[int64]*list.Element)
+	}
+	c.blocks[key][start] = c.lru.PushFront(&objectBlock{key: key, off: start, data: data})
+	c.used += int64(len(data))
+	for c.used > c.capacity && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+	return data, nil
+}
+
+// drop evicts every block of key, as when the object is replaced or
+// deleted.
+func (c *objectCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.blocks[key] {
+		c.remove(e)
+	}
+}
+
+// remove evicts the block at e. c.mu must be held.
+func (c *objectCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*objectBlock)
+	c.used -= int64(len(b.data))
+	delete(c.blocks[b.key], b.off)
+	if len(c.blocks[b.key]) == 0 {
+		delete(c.blocks, b.key)
+	}
+}
+
+// MemObjectStore is an ObjectStore held in memory, for tests. It is safe
+// for concurrent use.
+type MemObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemObjectStore returns an empty in-memory object store.
+func NewMemObjectStore() *MemObjectStore {
+	return &MemObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *MemObjectStore) Put(key string, r io.Reader, size int64) error {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, size); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.objects[key] = buf.Bytes()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemObjectStore) ReadAt(key string, p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	data, ok := s.objects[key]
+	s.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemObjectStore) Size(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return 0, fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *MemObjectStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemObjectStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
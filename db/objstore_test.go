@@ -0,0 +1,187 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mini-leveldb/db"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectFileSystemKeepsTablesInStore(t *testing.T) {
+	local := db.NewMemFileSystem()
+	store := db.NewMemObjectStore()
+	open := func() *db.DB {
+		opts := db.DefaultOptions()
+		opts.FileSystem = db.NewObjectFileSystem(local, store, &db.ObjectFileSystemOptions{
+			Prefix:         "tenant-a/",
+			CacheBytes:     8 << 10,
+			CacheBlockSize: 1 << 10,
+		})
+		opts.ReadMode = db.ReadModePread
+		store, err := db.Open("objdb", opts)
+		require.NoError(t, err)
+		return store
+	}
+
+	// The fourth flush compacts L0 into L1, which deletes the flushed
+	// tables from the store.
+	d := open()
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 100; j++ {
+			require.NoError(t, d.Put(fmt.Sprintf("key%d-%03d", i, j), strings.Repeat("v", 100)))
+		}
+		require.NoError(t, d.Flush())
+	}
+	require.NoError(t, d.Put("unflushed", "in the WAL"))
+
+	check := func(d *db.DB) {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 100; j++ {
+				got, err := d.Get(fmt.Sprintf("key%d-%03d", i, j))
+				require.NoError(t, err)
+				assert.Equal(t, strings.Repeat("v", 100), got)
+			}
+		}
+		got, err := d.Get("unflushed")
+		require.NoError(t, err)
+		assert.Equal(t, "in the WAL", got)
+	}
+	check(d)
+
+	localTables, err := local.Glob("objdb/*.sst")
+	require.NoError(t, err)
+	assert.Empty(t, localTables)
+	keys, err := store.List("tenant-a/objdb/")
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	var live int
+	for _, level := range d.Levels() {
+		live += len(level.Files)
+	}
+	assert.Len(t, keys, live)
+
+	require.NoError(t, d.Close())
+	d = open()
+	defer d.Close()
+	check(d)
+}
+
+// fakeS3 serves the subset of the S3 API S3ObjectStore uses, from memory.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	unsigned int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		s.unsigned++
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		if r.URL.Path != "/bucket" {
+			http.NotFound(w, r)
+			return
+		}
+		key = ""
+	}
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = data
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case key == "" && r.Method == http.MethodGet:
+		type content struct{ Key string }
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k := range s.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, content{k})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		xml.NewEncoder(w).Encode(result)
+	default:
+		data, ok := s.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			if start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			end = min(end+1, len(data))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start))
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[start:end]
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+
+	store, err := db.NewS3ObjectStore(db.S3Options{
+		Endpoint:        srv.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Client:          srv.Client(),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("db/a b.sst", bytes.NewReader([]byte("hello world")), 11))
+	require.NoError(t, store.Put("db/c.sst", bytes.NewReader(nil), 0))
+
+	size, err := store.Size("db/a b.sst")
+	require.NoError(t, err)
+	assert.EqualValues(t, 11, size)
+	_, err = store.Size("db/missing.sst")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	buf := make([]byte, 5)
+	n, err := store.ReadAt("db/a b.sst", buf, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	n, err = store.ReadAt("db/a b.sst", buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(buf[:n]))
+
+	keys, err := store.List("db/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db/a b.sst", "db/c.sst"}, keys)
+
+	require.NoError(t, store.Delete("db/a b.sst"))
+	require.NoError(t, store.Delete("db/a b.sst"))
+	keys, err = store.List("db/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db/c.sst"}, keys)
+	assert.Zero(t, fake.unsigned)
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// DeleteObsoleteFiles removes files in the database directory that no
+// longer belong to it: SSTables the MANIFEST does not list, temporary files
+// left by a flush or compaction that crashed part way, WALs of memtables
+// that have already been flushed, and MANIFESTs CURRENT no longer names.
+// Tables still pinned by a snapshot, tables a running flush or compaction is
+// writing, and tables that are listed but failed to load (kept for Repair)
+// are left alone. With Options.ArchiveWALs, flushed WALs are archived
+// rather than deleted. It returns the paths removed. Open runs it once; it
+// is safe to call at any time.
+func (db *DB) DeleteObsoleteFiles() ([]string, error) {
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to delete obsolete files: %w", ErrClosed)
+	}
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.deleteObsoleteFilesLocked()
+}
+
+// deleteObsoleteFilesLocked is DeleteObsoleteFiles for callers holding logMu
+// and db.mu, which keeps flushes and compactions from creating files while
+// the directory is inspected.
+func (db *DB) deleteObsoleteFilesLocked() ([]string, error) {
+	live := make(map[string]bool)
+	state, err := readManifest(db.fs, db.dir, len(db.levels))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live files: %w", err)
+	}
+	if state != nil {
+		for _, level := range state.levels {
+			for _, name := range level {
+				live[name] = true
+			}
+		}
+	}
+	for _, level := range db.levels {
+		for _, sst := range level {
+			live[filepath.Base(sst.path)] = true
+		}
+	}
+	for _, name := range db.unloaded {
+		live[name] = true
+	}
+	for name := range db.pending {
+		live[name] = true
+		live[name+".tmp"] = true
+	}
+	db.snapMu.Lock()
+	for snap := range db.snapshots {
+		for _, level := range snap.levels {
+			for _, sst := range level {
+				live[filepath.Base(sst.path)] = true
+			}
+		}
+	}
+	db.snapMu.Unlock()
+	for _, path := range db.wals {
+		live[filepath.Base(path)] = true
+	}
+	for _, imm := range db.imm {
+		for _, path := range imm.wals {
+			live[filepath.Base(path)] = true
+		}
+	}
+	for _, path := range db.pinnedWALs {
+		live[filepath.Base(path)] = true
+	}
+	current, _, err := currentManifest(db.fs, db.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live files: %w", err)
+	}
+	live[filepath.Base(current)] = true
+
+	var candidates []string
+	for _, pattern := range []string{"*.sst", "*.tmp", "*.walb", "MANIFEST*"} {
+		matches, err := db.fs.Glob(filepath.Join(db.dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan for obsolete files: %w", err)
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	var removed, retired []string
+	for _, path := range candidates {
+		if live[filepath.Base(path)] {
+			continue
+		}
+		if db.opts.ArchiveWALs && strings.HasSuffix(path, ".walb") {
+			retired = append(retired, path)
+			continue
+		}
+		if err := db.fs.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove obsolete file %s: %w", path, err)
+		}
+		removed = append(removed, path)
+	}
+	db.retireWALs(retired)
+	removed = append(removed, retired...)
+	if len(removed) > 0 {
+		log.Printf("Removed %d obsolete files", len(removed))
+	}
+	return removed, nil
+}
@@ -0,0 +1,64 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteObsoleteFiles(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+
+	store, err := db.Open("gc", opts)
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Close())
+
+	// Leftovers of a flush, a compaction and a WAL that crashed mid-way.
+	orphans := []string{"gc/sstable_1.sst", "gc/sstable_l1_2.sst.tmp", "gc/old.walb"}
+	for _, name := range orphans {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	store, err = db.Open("gc", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	for _, name := range orphans {
+		_, err := fs.Stat(name)
+		assert.Error(t, err, "%s should be removed on open", name)
+	}
+	value, err := store.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+
+	// Tables compacted away while a snapshot pins them stay on disk.
+	snap := store.GetSnapshot()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("k%d", i), "v"))
+		require.NoError(t, store.Flush())
+	}
+	before, err := fs.Glob("gc/*.sst")
+	require.NoError(t, err)
+	removed, err := store.DeleteObsoleteFiles()
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	after, err := fs.Glob("gc/*.sst")
+	require.NoError(t, err)
+	sort.Strings(before)
+	sort.Strings(after)
+	assert.Equal(t, before, after)
+
+	value, err = snap.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", value)
+	snap.Release()
+}
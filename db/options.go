@@ -0,0 +1,294 @@
+package db
+
+import "time"
+
+// Options configures a DB opened with Open.
+type Options struct {
+	// CreateIfMissing lets Open create a new database when dir holds none;
+	// otherwise Open fails with ErrDatabaseNotFound. DefaultOptions sets
+	// it.
+	CreateIfMissing bool
+
+	// ErrorIfExists makes Open fail with ErrDatabaseExists when dir already
+	// holds a database.
+	ErrorIfExists bool
+
+	// BreakStaleLock lets Open take over a LOCK file left by a process on
+	// this host that is no longer running, as after a crash, instead of
+	// failing with ErrStaleLock. DB.StaleLockOwner reports the process.
+	// Only databases on the operating system's filesystem are locked.
+	BreakStaleLock bool
+
+	// ReadSampleInterval samples one out of every ReadSampleInterval Get
+	// calls to collect per-SSTable filter and hit statistics. Zero disables
+	// sampling.
+	ReadSampleInterval int
+
+	// AutoTuneFilters makes compaction build each output table's bloom filter
+	// with the false-positive rate suggested by sampled reads of its inputs,
+	// instead of BloomFPRate or BloomBitsPerKey, once the inputs have
+	// enough samples.
+	AutoTuneFilters bool
+
+	// BloomFPRate is the false-positive rate each new table's bloom filter
+	// is sized for. Zero means 1%. It must be at least one in a million.
+	BloomFPRate float64
+
+	// BloomBitsPerKey, when positive, sizes each new table's bloom filter
+	// at this many bits per key instead of by BloomFPRate; ten bits give
+	// about a 1% false-positive rate. At most 64.
+	BloomBitsPerKey int
+
+	// MaxSnapshotAge force-releases snapshots older than this, so leaked
+	// snapshot handles cannot pin obsolete SSTables on disk forever. Zero
+	// disables the limit.
+	MaxSnapshotAge time.Duration
+
+	// OnSnapshotForceReleased, if set, is called after a snapshot is released
+	// for exceeding MaxSnapshotAge.
+	OnSnapshotForceReleased func(seq uint64, age time.Duration)
+
+	// TrackIterators records the stack that created each iterator, so that
+	// Close can say where every iterator left open was made. Close reports
+	// how many were left open either way. It costs a stack capture per
+	// iterator, so it is meant for debugging.
+	TrackIterators bool
+
+	// TraceFile, if set, is a file that every operation on the database,
+	// except reads through snapshots, is recorded to, with its keys, the
+	// size of its values and when it was called. DB.ReplayTrace runs a
+	// trace again. The file is replaced when the database is opened.
+	TraceFile string
+
+	// Compression is the codec applied to values in newly written SSTables.
+	// Existing tables keep the codec recorded in their footer.
+	Compression CompressionType
+
+	// CompressionDictSize, if positive and Compression is ZstdCompression,
+	// has each compaction output train a zstd dictionary of up to this
+	// many bytes from a sample of its values and compress its values
+	// against it, so tables of many small, similar values such as JSON
+	// documents compress well. The dictionary is stored in the table.
+	// Flushed tables are written without one. 16 KiB is a good start.
+	CompressionDictSize int
+
+	// RecordChecksums stores a CRC32C of each record's key and value in
+	// newly written SSTables, and every read of the record verifies it, so
+	// a flipped bit in a value is reported as ErrCorruption instead of
+	// returned. It costs four bytes per record. Unlike VerifyChecksums it
+	// does not read whole blocks, and it also covers the bytes between a
+	// block being verified and the value being decoded.
+	RecordChecksums bool
+
+	// VerifyChecksums checks the CRC32C of every SSTable data block a read
+	// or compaction touches, reporting mismatches as a *CorruptionError.
+	VerifyChecksums bool
+
+	// ValueLogThreshold moves values of at least this many bytes out of the
+	// SSTables into value log files when the memtable is flushed, so
+	// compaction only copies pointers to them. Zero keeps every value in
+	// the SSTables.
+	ValueLogThreshold int
+
+	// ValueLogFileSize is the size at which a value log file is sealed and a
+	// new one started. Zero means 64 MiB.
+	ValueLogFileSize int64
+
+	// ValueLogGCInterval runs ValueLogGC periodically in the background.
+	// Zero disables background collection.
+	ValueLogGCInterval time.Duration
+
+	// ValueChunkSize splits values longer than this many bytes into chunks
+	// of this size, each written as its own WAL record and memtable entry,
+	// with the key holding a small record of where they are. Reads join the
+	// chunks back; GetReader and PutReader stream them one at a time. With
+	// it set, every write also looks up the values it replaces, to reclaim
+	// the chunks of the ones that were chunked. Zero never chunks.
+	ValueChunkSize int
+
+	// FileSystem is where the database keeps its files. Nil means the
+	// operating system's filesystem.
+	FileSystem FileSystem
+
+	// L0SlowdownWritesTrigger delays every write by a millisecond while L0
+	// holds at least this many tables, giving compaction time to catch up.
+	// Zero disables the slowdown.
+	L0SlowdownWritesTrigger int
+
+	// L0StopWritesTrigger stalls writes while L0 holds at least this many
+	// tables; the stalled writer compacts L0 before its write proceeds.
+	// Zero disables the stop.
+	L0StopWritesTrigger int
+
+	// WriteBufferSize is the memory, in bytes, at which the memtable is made
+	// immutable and queued for a background flush. It counts every entry's
+	// key and value and the skiplist node holding them. Writes stall only
+	// while MaxImmutableMemTables memtables are already queued. Zero lets
+	// the memtable grow until Flush is called.
+	WriteBufferSize int
+
+	// MaxImmutableMemTables is how many full memtables may wait for the
+	// background flush before writes stall. Zero means one.
+	MaxImmutableMemTables int
+
+	// FlushInterval queues a memtable holding any writes for a background
+	// flush every interval, so a lightly written database still moves its
+	// writes into SSTables and bounds how much WAL a restart replays. Zero
+	// flushes only when the memtable fills or Flush is called.
+	FlushInterval time.Duration
+
+	// RateLimitBytesPerSec caps the combined rate at which flushes and
+	// compactions write SSTables, so bulk compaction leaves disk bandwidth
+	// for foreground reads. Zero leaves them unthrottled.
+	RateLimitBytesPerSec int64
+
+	// ReadMode selects whether SSTables are memory mapped or read with
+	// positioned reads. The zero value is ReadModeMmap.
+	ReadMode ReadMode
+
+	// MaxOpenFiles caps how many SSTables keep their file open and memory
+	// mapped. Past the cap, the least recently read tables are closed and
+	// opened again when a read needs them; their index and bloom filter
+	// stay in memory, so lookups the filter rules out never reopen them.
+	// The cap is exceeded only while more tables are being read at once.
+	// Zero leaves every table open.
+	MaxOpenFiles int
+
+	// PinL0IndexAndFilter keeps the index of every L0 table decoded in
+	// memory, so a Get, which may probe every L0 table, reads nothing but
+	// the data block it needs from each. The index stays resident while
+	// MaxOpenFiles closes the table's file. Bloom filters are always held
+	// in memory once a table is loaded.
+	PinL0IndexAndFilter bool
+
+	// PinL1IndexAndFilter does the same for the tables in L1.
+	PinL1IndexAndFilter bool
+
+	// MaxSubcompactions splits a large compaction by key range into up to
+	// this many sub-compactions that run on separate goroutines and write
+	// separate output tables. Zero or one runs every compaction whole.
+	MaxSubcompactions int
+
+	// WALSyncInterval, when positive, makes writes return once they reach
+	// the WAL file without waiting for an fsync, and syncs the WAL in the
+	// background this often instead. A crash can lose the writes made since
+	// the last sync; DB.DurableSequence reports the newest that cannot be
+	// lost. Zero syncs the WAL on every write.
+	WALSyncInterval time.Duration
+
+	// WALCheckpointInterval is how long the WAL goes between checkpoint
+	// records of the time and sequence number while it is written to,
+	// which bounds how precisely RestoreToTimestamp finds the writes
+	// logged by a point in time. Each record costs 33 bytes of WAL. Zero
+	// means one second.
+	WALCheckpointInterval time.Duration
+
+	// WALPerColumnFamily logs the writes to each column family in WALs of
+	// its own instead of the shared WAL, so DB.DropColumnFamily can dispose
+	// of a family's log at once. Writes spanning families, to the default
+	// keyspace, and range deletes stay in the shared WAL, and a commit group
+	// is still synced once per WAL it wrote. Each write then costs a 33-byte
+	// checkpoint record, which replay orders the WALs' records by; replay
+	// reads every WAL before applying any. Databases written either way
+	// open with either setting.
+	WALPerColumnFamily bool
+
+	// WALRecovery selects what Open does with a WAL record it cannot read
+	// or replay. The zero value is WALRecoveryFail.
+	WALRecovery WALRecoveryMode
+
+	// ArchiveWALs moves WALs into the archive subdirectory once their
+	// memtable is flushed, instead of deleting them, for point-in-time
+	// recovery and for consumers that read the log. DB.ArchivedWALs lists
+	// them.
+	ArchiveWALs bool
+
+	// WALArchiveTTL removes archived WALs last written longer ago than
+	// this. Zero keeps them regardless of age.
+	WALArchiveTTL time.Duration
+
+	// WALArchiveSizeLimit removes the oldest archived WALs while the
+	// archive holds more than this many bytes. Zero leaves it unbounded.
+	WALArchiveSizeLimit int64
+
+	// DisableAutoCompaction stops flushes and ingestion from compacting the
+	// levels they leave over their limits, and turns off the L0 write
+	// slowdown and stop, so a bulk load can write everything first and
+	// compact once at the end. DB.SetAutoCompaction changes it at runtime.
+	DisableAutoCompaction bool
+
+	// NumLevels is the depth of the LSM tree, L0 through L(NumLevels-1).
+	// Zero means 7; at most 16 levels are allowed. A database holding
+	// tables in a level deeper than NumLevels allows fails to open.
+	NumLevels int
+
+	// LevelMaxFiles[i] is how many tables level i may hold before it is
+	// compacted into the next level. Missing or zero entries mean 4 for L0
+	// and 10 for the levels below it.
+	LevelMaxFiles []int
+
+	// LevelTargetSizes[i] is the total size in bytes at which level i is
+	// compacted into the next level. Missing or zero entries leave L0
+	// unbounded by size, give L1 10 MiB, and give each deeper level
+	// LevelSizeMultiplier times the level above it.
+	LevelTargetSizes []int64
+
+	// LevelSizeMultiplier is how many times larger each level below L1 is
+	// than the one above it, for levels without a LevelTargetSizes entry.
+	// Zero means 10.
+	LevelSizeMultiplier int
+
+	// IntraL0CompactionRatio merges L0's tables into one L0 table, leaving
+	// L1 alone, when L0 reaches its file limit while the L1 tables it
+	// overlaps hold more than this many times its bytes: moving such small
+	// tables into L1 would rewrite far more of L1 than it moves, so it is
+	// put off until L0 has grown. L0 reaching its size limit always moves
+	// it into L1. Zero always compacts L0 into L1.
+	IntraL0CompactionRatio int
+
+	// TargetFileSizeBase is the size in bytes at which compactions into L1
+	// cut their output into a new table; each deeper level's tables are
+	// LevelSizeMultiplier times larger. L0 tables are never cut. Zero
+	// means 2 MiB.
+	TargetFileSizeBase int64
+
+	// MaxManifestFileSize is the size in bytes at which the MANIFEST, a log
+	// of every change to the set of tables, is replaced by a new one
+	// holding a single record of the current tree, so opening the database
+	// does not slow down as flushes and compactions accumulate. Zero means
+	// 4 MiB.
+	MaxManifestFileSize int64
+
+	// CompactionStyle selects how tables are compacted. The zero value is
+	// CompactionStyleLevel.
+	CompactionStyle CompactionStyle
+
+	// UniversalSizeRatio is how much larger, in percent, the next older
+	// sorted run may be than the newer runs already picked for it to join
+	// a universal compaction. Zero means 1.
+	UniversalSizeRatio int
+
+	// UniversalMaxSizeAmplificationPercent is how much space, as a percent
+	// of the oldest sorted run, the newer runs may take up before universal
+	// compaction merges every run into one. Zero means 200.
+	UniversalMaxSizeAmplificationPercent int
+
+	// StatsPersistInterval is how often the lifetime counters
+	// DB.LifetimeStats reports are saved in the background. They are also
+	// saved on Close. Zero saves them only on Close.
+	StatsPersistInterval time.Duration
+}
+
+// DefaultOptions returns the options used by NewDB.
+func DefaultOptions() *Options {
+	return &Options{
+		CreateIfMissing:         true,
+		ReadSampleInterval:      16,
+		VerifyChecksums:         true,
+		L0SlowdownWritesTrigger: 8,
+		L0StopWritesTrigger:     12,
+		WriteBufferSize:         64 << 20,
+		MaxImmutableMemTables:   2,
+		StatsPersistInterval:    time.Minute,
+	}
+}
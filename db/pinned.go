@@ -0,0 +1,58 @@
+package db
+
+import (
+	"bytes"
+	"log"
+)
+
+// pinIndexes keeps the index of every table in the levels that
+// Options.PinL0IndexAndFilter and PinL1IndexAndFilter name decoded in
+// memory. Tables already pinned are skipped, so it is cheap to call on
+// every version change. db.mu must be held.
+func (db *DB) pinIndexes() {
+	for level, pin := range []bool{db.opts.PinL0IndexAndFilter, db.opts.PinL1IndexAndFilter} {
+		if !pin || level >= len(db.levels) {
+			continue
+		}
+		for _, sst := range db.levels[level] {
+			if err := sst.pinIndex(); err != nil {
+				log.Printf("Warning: failed to pin index of %s: %v", sst.path, err)
+			}
+		}
+	}
+}
+
+// pinIndex reads every index partition of a block-format table into memory,
+// where lookups use them without reading the file. The copies outlive the
+// mapping, so they stay valid while the table cache closes the file.
+func (s *SSTable) pinIndex() error {
+	if s.format < blockFormatVersion || s.pinned.Load() != nil {
+		return nil
+	}
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	index := make([]*block, len(s.partitions))
+	for i, p := range s.partitions {
+		data, err := s.section(p.offset, int64(p.length))
+		if err != nil {
+			return err
+		}
+		if index[i], err = newBlock(bytes.Clone(data)); err != nil {
+			return s.corruption(p.offset, err.Error())
+		}
+	}
+	s.pinned.Store(&index)
+	return nil
+}
+
+// indexBlock returns index partition p of a block-format table, from
+// memory if the index is pinned.
+func (s *SSTable) indexBlock(p int) (*block, error) {
+	if pinned := s.pinned.Load(); pinned != nil {
+		return (*pinned)[p], nil
+	}
+	return s.readIndexBlock(s.partitions[p])
+}
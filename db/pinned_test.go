@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinL0IndexAndFilter(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FileSystem = NewMemFileSystem()
+	opts.PinL0IndexAndFilter = true
+	opts.MaxOpenFiles = 1
+	opts.DisableAutoCompaction = true
+	db, err := Open("pinned", opts)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 2000; j++ {
+			require.NoError(t, db.Put(fmt.Sprintf("key%d-%04d", i, j), fmt.Sprintf("value%d", i)))
+		}
+		require.NoError(t, db.Flush())
+	}
+	require.Len(t, db.levels[0], 3)
+	for _, sst := range db.levels[0] {
+		require.NotNil(t, sst.pinned.Load(), "L0 tables are pinned when installed")
+		assert.Len(t, *sst.pinned.Load(), len(sst.partitions))
+	}
+
+	// Lookups through the pinned index find every key even though at most
+	// one table's file is open at a time.
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 2000; j += 97 {
+			value, err := db.Get(fmt.Sprintf("key%d-%04d", i, j))
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("value%d", i), value)
+		}
+	}
+	results := db.MultiGet([]string{"key0-0000", "key2-1999", "key9-0000"})
+	assert.Equal(t, "value0", results[0].Value)
+	assert.Equal(t, "value2", results[1].Value)
+	assert.ErrorIs(t, results[2].Error, ErrNotFound)
+
+	// L1 is not pinned unless asked for.
+	db.compactMu.Lock()
+	require.NoError(t, db.compactLevel(0))
+	db.compactMu.Unlock()
+	require.NotEmpty(t, db.levels[1])
+	for _, sst := range db.levels[1] {
+		assert.Nil(t, sst.pinned.Load())
+	}
+	require.NoError(t, db.Close())
+
+	opts.PinL1IndexAndFilter = true
+	db, err = Open("pinned", opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, sst := range db.levels[1] {
+		assert.NotNil(t, sst.pinned.Load(), "tables loaded into L1 are pinned at open")
+	}
+	value, err := db.Get("key1-1234")
+	require.NoError(t, err)
+	assert.Equal(t, "value1", value)
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// defaultNumLevels is the depth of the LSM tree, L0 through L6, when
+	// Options.NumLevels is zero.
+	defaultNumLevels = 7
+
+	// maxNumLevels bounds Options.NumLevels. Repair reads MANIFESTs with
+	// this many levels so it can handle a database opened with any depth.
+	maxNumLevels = 16
+
+	defaultL0MaxFiles          = 4
+	defaultLevelMaxFiles       = 10
+	defaultL1TargetSize        = 10 * 1024 * 1024
+	defaultLevelSizeMultiplier = 10
+	defaultTargetFileSizeBase  = 2 * 1024 * 1024
+)
+
+// LevelPolicy bounds a level: it is compacted into the next level once it
+// holds maxFiles tables or, when maxSize is positive, maxSize bytes.
+// Compactions into the level cut their output into tables of about
+// targetFileSize bytes; zero, as for L0, writes one table.
+type LevelPolicy struct {
+	maxFiles       int
+	maxSize        int64
+	targetFileSize int64
+}
+
+// newLevelPolicies builds one LevelPolicy per level from opts, filling in
+// the defaults for the entries left zero, and rejects settings that cannot
+// describe a tree.
+func newLevelPolicies(opts *Options) ([]LevelPolicy, error) {
+	n := opts.NumLevels
+	if n == 0 {
+		n = defaultNumLevels
+	}
+	if n < 2 || n > maxNumLevels {
+		return nil, fmt.Errorf("invalid NumLevels %d: must be between 2 and %d", opts.NumLevels, maxNumLevels)
+	}
+	if len(opts.LevelMaxFiles) > n {
+		return nil, fmt.Errorf("invalid LevelMaxFiles: %d entries for %d levels", len(opts.LevelMaxFiles), n)
+	}
+	if len(opts.LevelTargetSizes) > n {
+		return nil, fmt.Errorf("invalid LevelTargetSizes: %d entries for %d levels", len(opts.LevelTargetSizes), n)
+	}
+	multiplier := int64(opts.LevelSizeMultiplier)
+	if multiplier < 0 {
+		return nil, fmt.Errorf("invalid LevelSizeMultiplier %d: must not be negative", multiplier)
+	}
+	if multiplier == 0 {
+		multiplier = defaultLevelSizeMultiplier
+	}
+	fileSize := opts.TargetFileSizeBase
+	if fileSize < 0 {
+		return nil, fmt.Errorf("invalid TargetFileSizeBase %d: must not be negative", fileSize)
+	}
+	if fileSize == 0 {
+		fileSize = defaultTargetFileSizeBase
+	}
+
+	policies := make([]LevelPolicy, n)
+	for level := range policies {
+		p := &policies[level]
+
+		p.maxFiles = defaultLevelMaxFiles
+		if level == 0 {
+			p.maxFiles = defaultL0MaxFiles
+		}
+		if level < len(opts.LevelMaxFiles) {
+			switch files := opts.LevelMaxFiles[level]; {
+			case files < 0:
+				return nil, fmt.Errorf("invalid LevelMaxFiles[%d] %d: must not be negative", level, files)
+			case files > 0:
+				p.maxFiles = files
+			}
+		}
+
+		switch {
+		case level == 1:
+			p.maxSize = defaultL1TargetSize
+		case level > 1:
+			p.maxSize = math.MaxInt64
+			if prev := policies[level-1].maxSize; prev <= math.MaxInt64/multiplier {
+				p.maxSize = prev * multiplier
+			}
+		}
+		if level < len(opts.LevelTargetSizes) {
+			switch size := opts.LevelTargetSizes[level]; {
+			case size < 0:
+				return nil, fmt.Errorf("invalid LevelTargetSizes[%d] %d: must not be negative", level, size)
+			case size > 0:
+				p.maxSize = size
+			}
+		}
+
+		switch {
+		case level == 1:
+			p.targetFileSize = fileSize
+		case level > 1:
+			p.targetFileSize = math.MaxInt64
+			if prev := policies[level-1].targetFileSize; prev <= math.MaxInt64/multiplier {
+				p.targetFileSize = prev * multiplier
+			}
+		}
+	}
+	return policies, nil
+}
@@ -0,0 +1,65 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelPolicyOptions(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.NumLevels = 3
+	opts.LevelMaxFiles = []int{2}
+	opts.LevelTargetSizes = []int64{0, 1}
+	store, err := db.Open("levels", opts)
+	require.NoError(t, err)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", round)))
+		}
+		require.NoError(t, store.Flush())
+	}
+
+	// Two L0 tables trigger an L0 compaction, and the one-byte L1 target
+	// sends its output straight on to L2, the last level.
+	levels := store.Levels()
+	require.Len(t, levels, 3)
+	assert.Empty(t, levels[0].Files)
+	assert.Empty(t, levels[1].Files)
+	assert.Len(t, levels[2].Files, 1)
+	value, err := store.Get("key05")
+	require.NoError(t, err)
+	assert.Equal(t, "value1", value)
+	require.NoError(t, store.Close())
+
+	shallow := *opts
+	shallow.NumLevels = 2
+	_, err = db.Open("levels", &shallow)
+	assert.Error(t, err, "tables in L2 do not fit in two levels")
+}
+
+func TestInvalidLevelPolicyOptions(t *testing.T) {
+	for name, set := range map[string]func(*db.Options){
+		"one level":           func(o *db.Options) { o.NumLevels = 1 },
+		"too many levels":     func(o *db.Options) { o.NumLevels = 17 },
+		"extra max files":     func(o *db.Options) { o.NumLevels = 2; o.LevelMaxFiles = []int{4, 10, 10} },
+		"negative max files":  func(o *db.Options) { o.LevelMaxFiles = []int{-1} },
+		"extra target sizes":  func(o *db.Options) { o.NumLevels = 2; o.LevelTargetSizes = []int64{0, 1, 2} },
+		"negative size":       func(o *db.Options) { o.LevelTargetSizes = []int64{0, -1} },
+		"negative multiplier": func(o *db.Options) { o.LevelSizeMultiplier = -10 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := db.DefaultOptions()
+			opts.FileSystem = db.NewMemFileSystem()
+			set(opts)
+			_, err := db.Open("invalid", opts)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+)
+
+// TableProperties describes the contents of one SSTable. It is written into
+// the table when it is created, so it is available without reading the index
+// or data blocks.
+type TableProperties struct {
+	SmallestKey  string
+	LargestKey   string
+	NumEntries   uint64
+	RawKeySize   uint64 // total bytes of all keys
+	RawValueSize uint64 // total bytes of all values before compression
+	DataSize     uint64 // bytes of the data section as stored on disk
+	Level        int    // level the table was written for; -1 if unknown
+	CreatedAt    time.Time
+
+	// SeparatedValues is set when values are stored with a kind byte and
+	// may point into the value log.
+	SeparatedValues bool
+
+	// RecordChecksums is set when each stored value is followed by the
+	// CRC32C of its key and value; see Options.RecordChecksums.
+	RecordChecksums bool
+
+	// FilterFPRate is the false-positive rate the bloom filter was built
+	// for, and FilterBitsPerKey the bits per key it was given, if it was
+	// sized that way rather than by rate. Both are zero for tables written
+	// before they were recorded.
+	FilterFPRate     float64
+	FilterBitsPerKey int
+
+	// CompressionDict is the zstd dictionary the table's values were
+	// compressed against, or nil; see Options.CompressionDictSize.
+	CompressionDict []byte
+}
+
+// The properties section is a CRC32C-protected list of named values, so
+// readers skip names they do not know and new properties can be added
+// without another format version.
+const (
+	propSmallestKey  = "smallest.key"
+	propLargestKey   = "largest.key"
+	propNumEntries   = "num.entries"
+	propRawKeySize   = "raw.key.size"
+	propRawValueSize = "raw.value.size"
+	propDataSize     = "data.size"
+	propLevel        = "level"
+	propCreatedAt    = "created.at"
+	propSeparated    = "value.separated"
+	propRecordCRC    = "record.checksums"
+	propFilterFPRate = "filter.fp.rate"
+	propFilterBits   = "filter.bits.per.key"
+	propDict         = "compression.dict"
+)
+
+func (p *TableProperties) encode() []byte {
+	pairs := [][2]string{
+		{propSmallestKey, p.SmallestKey},
+		{propLargestKey, p.LargestKey},
+		{propNumEntries, strconv.FormatUint(p.NumEntries, 10)},
+		{propRawKeySize, strconv.FormatUint(p.RawKeySize, 10)},
+		{propRawValueSize, strconv.FormatUint(p.RawValueSize, 10)},
+		{propDataSize, strconv.FormatUint(p.DataSize, 10)},
+		{propLevel, strconv.Itoa(p.Level)},
+		{propCreatedAt, strconv.FormatInt(p.CreatedAt.UnixNano(), 10)},
+		{propSeparated, strconv.FormatBool(p.SeparatedValues)},
+		{propRecordCRC, strconv.FormatBool(p.RecordChecksums)},
+		{propFilterFPRate, strconv.FormatFloat(p.FilterFPRate, 'g', -1, 64)},
+		{propFilterBits, strconv.Itoa(p.FilterBitsPerKey)},
+	}
+	if p.CompressionDict != nil {
+		pairs = append(pairs, [2]string{propDict, string(p.CompressionDict)})
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(pairs)))
+	for _, kv := range pairs {
+		_ = writeString(&buf, kv[0])
+		_ = writeString(&buf, kv[1])
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, crc32.Checksum(buf.Bytes(), castagnoli))
+	return buf.Bytes()
+}
+
+func decodeTableProperties(data []byte) (TableProperties, error) {
+	p := TableProperties{Level: -1}
+	if len(data) < 8 {
+		return p, fmt.Errorf("properties section too short")
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return p, fmt.Errorf("properties checksum mismatch")
+	}
+
+	count := int(binary.LittleEndian.Uint32(body))
+	offset := 4
+	for i := 0; i < count; i++ {
+		name, next, err := readStringFromMmap(body, offset)
+		if err != nil {
+			return p, fmt.Errorf("failed to read property name: %w", err)
+		}
+		value, next, err := readStringFromMmap(body, next)
+		if err != nil {
+			return p, fmt.Errorf("failed to read property %s: %w", name, err)
+		}
+		offset = next
+
+		switch name {
+		case propSmallestKey:
+			p.SmallestKey = value
+		case propLargestKey:
+			p.LargestKey = value
+		case propNumEntries:
+			p.NumEntries, err = strconv.ParseUint(value, 10, 64)
+		case propRawKeySize:
+			p.RawKeySize, err = strconv.ParseUint(value, 10, 64)
+		case propRawValueSize:
+			p.RawValueSize, err = strconv.ParseUint(value, 10, 64)
+		case propDataSize:
+			p.DataSize, err = strconv.ParseUint(value, 10, 64)
+		case propLevel:
+			p.Level, err = strconv.Atoi(value)
+		case propCreatedAt:
+			var nanos int64
+			nanos, err = strconv.ParseInt(value, 10, 64)
+			p.CreatedAt = time.Unix(0, nanos)
+		case propSeparated:
+			p.SeparatedValues, err = strconv.ParseBool(value)
+		case propRecordCRC:
+			p.RecordChecksums, err = strconv.ParseBool(value)
+		case propFilterFPRate:
+			p.FilterFPRate, err = strconv.ParseFloat(value, 64)
+		case propFilterBits:
+			p.FilterBitsPerKey, err = strconv.Atoi(value)
+		case propDict:
+			p.CompressionDict = []byte(value)
+		}
+		if err != nil {
+			return p, fmt.Errorf("invalid property %s: %w", name, err)
+		}
+	}
+	return p, nil
+}
+
+// Properties returns the table's properties. For tables written before
+// properties were recorded, they are derived from the index when the table
+// is loaded and the raw sizes and creation time are left zero.
+func (s *SSTable) Properties() TableProperties {
+	return s.props
+}
+
+// overlaps reports whether the table's key range intersects [smallest, largest].
+func (s *SSTable) overlaps(smallest, largest string) bool {
+	return s.props.NumEntries > 0 && s.props.SmallestKey <= largest && s.props.LargestKey >= smallest
+}
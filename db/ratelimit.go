@@ -0,0 +1,58 @@
+package db
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by the database's background writers
+// (flushes and compactions), so bulk table writes cannot monopolise the disk
+// and starve foreground reads. Tokens are bytes; they accrue at rate per
+// second up to a burst of a tenth of a second's worth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	rate := float64(bytesPerSec)
+	burst := rate / 10
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may be written. A request larger than the burst
+// is admitted by going into debt, which later callers pay off.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedWriter passes writes through a rateLimiter.
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	w.limiter.wait(len(p))
+	return w.w.Write(p)
+}
@@ -0,0 +1,36 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedFlush(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.RateLimitBytesPerSec = 200 << 10
+
+	store, err := db.Open("ratelimit", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%03d", i), value))
+	}
+
+	// ~100 KiB at 200 KiB/s with a 20 KiB burst takes about 400ms.
+	start := time.Now()
+	require.NoError(t, store.Flush())
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	got, err := store.Get("key050")
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"log"
+	"os"
+)
+
+const (
+	// readAheadAfterBlocks is how many data blocks an iterator must read in
+	// file order before read-ahead starts.
+	readAheadAfterBlocks = 2
+
+	// Read-ahead starts at initialReadAhead bytes and doubles with every
+	// window up to maxReadAhead, as a scan proves to be long.
+	initialReadAhead = 16 << 10
+	maxReadAhead     = 256 << 10
+)
+
+// readAhead tracks one iterator's reads of a table so a sequential scan
+// reads ahead of the block it needs rather than one block, or one page
+// fault, at a time. Mapped tables are read ahead by asking the kernel to
+// page in the window; tables read with pread are read a window at a time
+// into a buffer the following blocks are served from. A read that does not
+// follow the previous one, as after a seek, starts over.
+type readAhead struct {
+	sst        *SSTable
+	next       int64 // offset just past the last block read
+	sequential int   // blocks read in file order so far
+	window     int64
+
+	// buf holds the bytes from bufOff read ahead with pread; advised is
+	// the end of the range of a mapping already advised.
+	buf     []byte
+	bufOff  int64
+	advised int64
+}
+
+// blockEntries returns the records of the data block h of s, as
+// s.blockEntries would, reading ahead once the reads are sequential.
+func (ra *readAhead) blockEntries(s *SSTable, h blockHandle) ([][2]string, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	data, err := ra.read(s, h)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.decodeBlock(h, data)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeEntries(h, b)
+}
+
+// read returns the data block at h with its trailer. s must be pinned.
+func (ra *readAhead) read(s *SSTable, h blockHandle) ([]byte, error) {
+	n := int64(h.length) + blockTrailerSize
+	if ra.sst != s || h.offset != ra.next {
+		*ra = readAhead{sst: s}
+	} else {
+		ra.sequential++
+	}
+	ra.next = h.offset + n
+	if ra.sequential < readAheadAfterBlocks {
+		return s.section(h.offset, n)
+	}
+
+	dataEnd := int64(s.props.DataSize)
+	if s.pread {
+		if h.offset < ra.bufOff || h.offset+n > ra.bufOff+int64(len(ra.buf)) {
+			ra.grow()
+			size := max(n, min(ra.window, dataEnd-h.offset))
+			buf, err := s.section(h.offset, size)
+			if err != nil {
+				return nil, err
+			}
+			ra.buf, ra.bufOff = buf, h.offset
+		}
+		return ra.buf[h.offset-ra.bufOff : h.offset-ra.bufOff+n], nil
+	}
+
+	if s.unmap != nil && ra.next > ra.advised {
+		ra.grow()
+		start := h.offset - h.offset%int64(os.Getpagesize())
+		end := min(h.offset+ra.window, dataEnd)
+		if end > start {
+			if err := adviseWillNeed(s.mmap[start:end]); err != nil {
+				log.Printf("Warning: failed to read ahead in %s: %v", s.path, err)
+			}
+		}
+		ra.advised = end
+	}
+	return s.section(h.offset, n)
+}
+
+// grow sizes the next read-ahead window.
+func (ra *readAhead) grow() {
+	ra.window = min(max(ra.window*2, initialReadAhead), maxReadAhead)
+}
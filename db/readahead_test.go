@@ -0,0 +1,41 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadServesSequentialBlocks(t *testing.T) {
+	fs := NewMemFileSystem()
+	var kvs [][2]string
+	for i := 0; i < 60000; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)})
+	}
+	require.NoError(t, (&SSTable{path: "scan.sst", fs: fs}).Write(kvs))
+	sst := &SSTable{path: "scan.sst", fs: fs, pread: true, verifyChecksums: true}
+	require.NoError(t, sst.Load())
+	defer sst.Close()
+	require.Greater(t, len(sst.blocks), 100)
+
+	var ra readAhead
+	var got [][2]string
+	for i, h := range sst.blocks {
+		entries, err := ra.blockEntries(sst, h)
+		require.NoError(t, err)
+		got = append(got, entries...)
+		if i == readAheadAfterBlocks {
+			assert.Greater(t, len(ra.buf), int(h.length)+blockTrailerSize, "the window covers the blocks ahead")
+		}
+	}
+	assert.Equal(t, kvs, got)
+	assert.Equal(t, int64(maxReadAhead), ra.window, "a long scan grows the window to its limit")
+
+	// Going back to an earlier block starts over without reading ahead.
+	_, err := ra.blockEntries(sst, sst.blocks[10])
+	require.NoError(t, err)
+	assert.Zero(t, ra.sequential)
+	assert.Nil(t, ra.buf)
+}
@@ -0,0 +1,79 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadModes(t *testing.T) {
+	for name, mode := range map[string]db.ReadMode{"mmap": db.ReadModeMmap, "pread": db.ReadModePread} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := db.DefaultOptions()
+			opts.ReadMode = mode
+			store, err := db.Open(dir, opts)
+			require.NoError(t, err)
+
+			want := make(map[string]string)
+			for round := 0; round < 6; round++ {
+				for i := round * 100; i < round*100+300; i++ {
+					key := fmt.Sprintf("key%04d", i)
+					want[key] = fmt.Sprintf("value%d-%d", round, i)
+					require.NoError(t, store.Put(key, want[key]))
+				}
+				require.NoError(t, store.Flush())
+			}
+
+			check := func(store *db.DB) {
+				for key, value := range want {
+					got, err := store.Get(key)
+					require.NoError(t, err)
+					assert.Equal(t, value, got)
+				}
+				results := store.MultiGet([]string{"key0000", "key0450", "missing"})
+				assert.Equal(t, want["key0000"], results[0].Value)
+				assert.Equal(t, want["key0450"], results[1].Value)
+				assert.ErrorIs(t, results[2].Error, db.ErrNotFound)
+
+				it := store.NewIterator()
+				n := 0
+				for it.First(); it.Valid(); it.Next() {
+					assert.Equal(t, want[it.Key()], it.Value())
+					n++
+				}
+				assert.NoError(t, it.Err())
+				assert.NoError(t, it.Close())
+				assert.Len(t, want, n)
+			}
+			check(store)
+			require.NoError(t, store.Close())
+
+			store, err = db.Open(dir, opts)
+			require.NoError(t, err)
+			check(store)
+			require.NoError(t, store.Close())
+
+			// A damaged data block is reported the same way in both modes.
+			tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+			require.NoError(t, err)
+			require.NotEmpty(t, tables)
+			for _, path := range tables {
+				data, err := os.ReadFile(path)
+				require.NoError(t, err)
+				data[10] ^= 0xff
+				require.NoError(t, os.WriteFile(path, data, 0644))
+			}
+			store, err = db.Open(dir, opts)
+			require.NoError(t, err)
+			defer store.Close()
+			_, err = store.Get("key0000")
+			assert.ErrorIs(t, err, db.ErrCorruption)
+		})
+	}
+}
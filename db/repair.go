@@ -0,0 +1,448 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const lostDirName = "lost"
+
+// RepairReport summarizes what Repair found and salvaged.
+type RepairReport struct {
+	TablesScanned   int
+	TablesCorrupted int
+	TableRecords    int
+	WALRecords      int
+	KeysWritten     int
+	MovedAside      []string
+}
+
+var tableNamePattern = regexp.MustCompile(`^sstable_(?:l(\d+)_)?(\d+)\.sst$`)
+
+// Repair rebuilds the database in dir from whatever can still be read. Every
+// SSTable and the WAL are scanned; intact tables are read through their
+// index, and tables with a damaged footer, filter, or index are scanned
+// record by record from the start of the file until the data stops making
+// sense. The salvaged records are merged (newest wins) into a single fresh
+// SSTable with a rebuilt index and bloom filter, a new MANIFEST is written,
+// and files that could not be read cleanly are moved into dir/lost.
+//
+// The database must not be open while Repair runs.
+func Repair(dir string) (*RepairReport, error) {
+	return repair(osFS{}, dir)
+}
+
+func repair(fs FileSystem, dir string) (*RepairReport, error) {
+	report := &RepairReport{}
+
+	tables, err := orderedTableFiles(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Separated values are resolved while salvaging; the repaired table
+	// keeps every value inline.
+	vlog, err := openValueLog(fs, dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer vlog.close()
+
+	var runs [][][2]string
+	var corrupt, intact []string
+	for _, path := range tables {
+		report.TablesScanned++
+		kvs, ok := salvageTable(fs, path, vlog)
+		if !ok {
+			report.TablesCorrupted++
+			corrupt = append(corrupt, path)
+		} else {
+			intact = append(intact, path)
+		}
+		report.TableRecords += len(kvs)
+		runs = append(runs, kvs)
+	}
+
+	mem := newMemTable()
+	var seq uint64
+	put := func(key, value string) {
+		seq++
+		mem.put(key, value, seq)
+	}
+	walErr := replayWAL(fs, dir, manifestLogNumber(fs, dir), func(rec walRecord) {
+		switch rec.typ {
+		case walPut:
+			put(rec.key, rec.value)
+		case walDelete:
+			put(rec.key, tombstone)
+		case walRangeDelete:
+			// Tombstones in the runs are not looked at: deleting a
+			// deleted key again is harmless.
+			for _, key := range keysInRuns(append(runs, mem.entries()), rec.key, rec.value) {
+				put(key, tombstone)
+			}
+		default:
+			return
+		}
+		report.WALRecords++
+	})
+	if walErr != nil {
+		log.Printf("Repair: WAL had unreadable records: %v", walErr)
+	}
+	runs = append([][][2]string{mem.entries()}, runs...)
+
+	merged := mergeRuns(runs)
+	report.KeysWritten = len(merged)
+
+	num, err := maxFileNumber(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if state, err := readManifest(fs, dir, maxNumLevels); err == nil && state != nil && state.nextFile > num {
+		num = state.nextFile
+	}
+	num++
+
+	levels := make([][]*SSTable, defaultNumLevels)
+	if len(merged) > 0 {
+		path := filepath.Join(dir, tableFileName(0, num))
+		num++
+		tmpPath := path + ".tmp"
+		sst := &SSTable{path: tmpPath, fs: fs}
+		if err := sst.Write(merged); err != nil {
+			return nil, fmt.Errorf("failed to write repaired SSTable: %w", err)
+		}
+		if err := fileSync(fs, tmpPath); err != nil {
+			return nil, fmt.Errorf("failed to sync repaired SSTable: %w", err)
+		}
+		if err := fs.Rename(tmpPath, path); err != nil {
+			return nil, fmt.Errorf("failed to rename repaired SSTable: %w", err)
+		}
+		if err := syncDirOf(fs, path); err != nil {
+			return nil, err
+		}
+		sst.path = path
+		levels[0] = []*SSTable{sst}
+	}
+
+	// The repaired table holds every WAL's writes, so none is replayed
+	// again should the old WALs outlive a crash.
+	if err := writeManifestSnapshot(fs, dir, levels, nil, num, num, 0); err != nil {
+		return nil, fmt.Errorf("failed to write repaired manifest: %w", err)
+	}
+
+	// The new table and manifest are durable; retire the old files.
+	for _, path := range intact {
+		if err := fs.Remove(path); err != nil {
+			log.Printf("Warning: failed to remove repaired SSTable %s: %v", path, err)
+		}
+	}
+	toMove := corrupt
+	wals, err := walFiles(fs, dir)
+	if err != nil {
+		return report, err
+	}
+	if walErr != nil {
+		toMove = append(toMove, wals...)
+	} else {
+		for _, path := range wals {
+			if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove replayed WAL: %v", err)
+			}
+		}
+	}
+	leftovers, _ := fs.Glob(filepath.Join(dir, "*.tmp"))
+	toMove = append(toMove, leftovers...)
+
+	for _, path := range toMove {
+		moved, err := moveAside(fs, dir, path)
+		if err != nil {
+			return report, fmt.Errorf("failed to move %s aside: %w", path, err)
+		}
+		report.MovedAside = append(report.MovedAside, moved)
+	}
+	if len(report.MovedAside) > 0 {
+		if err := fs.SyncDir(filepath.Join(dir, lostDirName)); err != nil {
+			return report, fmt.Errorf("failed to sync %s: %w", lostDirName, err)
+		}
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return report, fmt.Errorf("failed to sync database directory: %w", err)
+	}
+
+	return report, nil
+}
+
+// orderedTableFiles lists the SSTables in dir newest first. Tables named by
+// a readable MANIFEST are ordered by level (L0 newest file first); any other
+// table is ordered after them by the level and file number in its name
+// (a timestamp for tables written before file numbering).
+func orderedTableFiles(fs FileSystem, dir string) ([]string, error) {
+	files, err := fs.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan SSTable files: %w", err)
+	}
+
+	var ordered []string
+	seen := make(map[string]bool)
+	if state, err := readManifest(fs, dir, maxNumLevels); state != nil && err == nil {
+		for _, level := range state.levels {
+			for i := len(level) - 1; i >= 0; i-- {
+				path := filepath.Join(dir, level[i])
+				if _, err := fs.Stat(path); err == nil && !seen[path] {
+					ordered = append(ordered, path)
+					seen[path] = true
+				}
+			}
+		}
+	} else if err != nil {
+		log.Printf("Repair: ignoring unreadable manifest: %v", err)
+	}
+
+	type candidate struct {
+		path  string
+		level int
+		num   uint64
+	}
+	var rest []candidate
+	for _, path := range files {
+		if seen[path] {
+			continue
+		}
+		c := candidate{path: path}
+		if m := tableNamePattern.FindStringSubmatch(filepath.Base(path)); m != nil {
+			if m[1] != "" {
+				c.level, _ = strconv.Atoi(m[1])
+			}
+			c.num, _ = strconv.ParseUint(m[2], 10, 64)
+		}
+		rest = append(rest, c)
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		if rest[i].level != rest[j].level {
+			return rest[i].level < rest[j].level
+		}
+		return rest[i].num > rest[j].num
+	})
+	for _, c := range rest {
+		ordered = append(ordered, c.path)
+	}
+	return ordered, nil
+}
+
+// salvageTable returns the records of the table at path. ok is false when
+// the table was damaged: either records in blocks that failed their checksum
+// were dropped, or the table could not be loaded normally and its records
+// were recovered by a raw scan instead.
+func salvageTable(fs FileSystem, path string, vlog *valueLog) ([][2]string, bool) {
+	sst := &SSTable{path: path, fs: fs, verifyChecksums: true, vlog: vlog}
+	if err := sst.Load(); err == nil {
+		defer sst.Close()
+		if sst.format >= blockFormatVersion {
+			return salvageBlocks(sst)
+		}
+
+		var kvs [][2]string
+		index, indexErr := sst.indexEntries()
+		intact := indexErr == nil
+		for _, entry := range index {
+			key, value, err := sst.readKVFromMmap(entry.offset)
+			if err != nil || key != entry.key {
+				intact = false
+				continue
+			}
+			kvs = append(kvs, [2]string{key, value})
+		}
+		if intact {
+			return kvs, true
+		}
+		// A checksummed table with a readable index can skip just the bad
+		// blocks; anything else falls back to the raw scan.
+		if indexErr == nil && len(sst.blocks) > 0 {
+			log.Printf("Repair: dropped records in corrupt blocks of SSTable %s", path)
+			return kvs, false
+		}
+	} else {
+		sst.Close()
+		log.Printf("Repair: scanning damaged SSTable %s: %v", path, err)
+	}
+
+	data, err := readFile(fs, path)
+	if err != nil {
+		return nil, false
+	}
+	// If the footer still points somewhere plausible, don't scan past the
+	// start of the filter section, and undo the table's value compression.
+	compression := NoCompression
+	separated, checksums := false, false
+	var dict *zstd.Decoder
+	if footer, err := parseFooter(data); err == nil {
+		if footer.propsOffset > 0 && footer.propsOffset < int64(len(data)-footer.size) {
+			if props, err := decodeTableProperties(data[footer.propsOffset : len(data)-footer.size]); err == nil {
+				separated = props.SeparatedValues
+				checksums = props.RecordChecksums
+				if props.CompressionDict != nil {
+					if dict, err = newDictDecoder(props.CompressionDict); err == nil {
+						defer dict.Close()
+					}
+				}
+			}
+		}
+		if footer.filterOffset > 0 && footer.filterOffset <= int64(len(data)-footer.size) {
+			data = data[:footer.filterOffset]
+		}
+		compression = footer.compression
+	}
+
+	records := scanBlocks(data)
+	if len(records) == 0 {
+		records = scanRecords(data)
+	}
+	var kvs [][2]string
+	for _, kv := range records {
+		stored := kv[1]
+		if checksums {
+			var err error
+			if stored, err = checkRecord(kv[0], stored); err != nil {
+				continue
+			}
+		}
+		value, err := decompressValue(compression, dict, stored)
+		if err != nil {
+			break
+		}
+		if separated {
+			if value, err = vlog.resolve(value); err != nil {
+				continue
+			}
+		}
+		kvs = append(kvs, [2]string{kv[0], value})
+	}
+	return kvs, false
+}
+
+// salvageBlocks reads every data block of a loaded table through its block
+// handles, skipping blocks that fail their checksum or do not decode.
+func salvageBlocks(sst *SSTable) ([][2]string, bool) {
+	var kvs [][2]string
+	intact := true
+	for _, h := range sst.blocks {
+		block, err := sst.blockEntries(h)
+		if err != nil {
+			intact = false
+			continue
+		}
+		for _, kv := range block {
+			if sst.separated {
+				if kv[1], err = sst.vlog.resolve(kv[1]); err != nil {
+					intact = false
+					continue
+				}
+			}
+			kvs = append(kvs, kv)
+		}
+	}
+	if !intact {
+		log.Printf("Repair: dropped records in corrupt blocks of SSTable %s", sst.path)
+	}
+	return kvs, intact
+}
+
+// scanBlocks recovers prefix-compressed data blocks from the start of data
+// without using any block handles. A block ends where the CRC32C of the bytes
+// since the previous boundary is followed by that same checksum; scanning
+// stops at the first block that does not decode or whose keys are out of
+// order.
+func scanBlocks(data []byte) [][2]string {
+	var kvs [][2]string
+	start := 0
+	for start < len(data) {
+		end := -1
+		crc := uint32(0)
+		for p := start; p+blockTrailerSize <= len(data); p++ {
+			if p > start {
+				crc = crc32.Update(crc, castagnoli, data[p-1:p])
+				if binary.LittleEndian.Uint32(data[p:]) == crc {
+					end = p
+					break
+				}
+			}
+		}
+		if end < 0 {
+			break
+		}
+
+		b, err := newBlock(data[start:end])
+		if err != nil {
+			break
+		}
+		ok := true
+		err = b.forEach(func(key string, value []byte) error {
+			if len(kvs) > 0 && key <= kvs[len(kvs)-1][0] {
+				ok = false
+				return fmt.Errorf("key out of order")
+			}
+			kvs = append(kvs, [2]string{key, string(value)})
+			return nil
+		})
+		if err != nil || !ok {
+			break
+		}
+		start = end + blockTrailerSize
+	}
+	return kvs
+}
+
+// scanRecords reads [len][key][len][value] records from the start of data,
+// stopping at the first record that does not parse or whose key does not
+// sort after the previous one. A block trailer is recognized by its CRC32C
+// matching the bytes since the previous block boundary, and skipped.
+func scanRecords(data []byte) [][2]string {
+	var kvs [][2]string
+	offset, blockStart := 0, 0
+	for offset+8 <= len(data) {
+		if offset > blockStart &&
+			binary.LittleEndian.Uint32(data[offset:]) == crc32.Checksum(data[blockStart:offset], castagnoli) {
+			offset += blockTrailerSize
+			blockStart = offset
+			continue
+		}
+		keyLen := int(binary.LittleEndian.Uint32(data[offset:]))
+		if keyLen <= 0 || offset+4+keyLen+4 > len(data) {
+			break
+		}
+		key := string(data[offset+4 : offset+4+keyLen])
+		valueStart := offset + 4 + keyLen
+		valueLen := int(binary.LittleEndian.Uint32(data[valueStart:]))
+		if valueLen < 0 || valueStart+4+valueLen > len(data) {
+			break
+		}
+		if len(kvs) > 0 && key <= kvs[len(kvs)-1][0] {
+			break
+		}
+		kvs = append(kvs, [2]string{key, string(data[valueStart+4 : valueStart+4+valueLen])})
+		offset = valueStart + 4 + valueLen
+	}
+	return kvs
+}
+
+func moveAside(fs FileSystem, dir, path string) (string, error) {
+	lost := filepath.Join(dir, lostDirName)
+	if err := fs.MkdirAll(lost, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(lost, filepath.Base(path))
+	if err := fs.Rename(path, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
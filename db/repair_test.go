@@ -0,0 +1,67 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairSalvagesDamagedTable(t *testing.T) {
+	dir := "testdata/repair"
+	_ = os.RemoveAll(dir)
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("table%d", i), "flushed"))
+		require.NoError(t, store.Put("shared", fmt.Sprintf("v%d", i)))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Put("unflushed", "wal"))
+	require.NoError(t, store.Close())
+
+	// Destroy the footer of the newest table: today this makes its keys vanish.
+	tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, tables, 3)
+	newest := tables[len(tables)-1]
+	info, err := os.Stat(newest)
+	require.NoError(t, err)
+	f, err := os.OpenFile(newest, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 16), info.Size()-16)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	report, err := db.Repair(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.TablesScanned)
+	assert.Equal(t, 1, report.TablesCorrupted)
+	assert.Equal(t, 1, report.WALRecords)
+	assert.Len(t, report.MovedAside, 1)
+
+	store, err = db.NewDB(dir)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for i := 0; i < 3; i++ {
+		got, err := store.Get(fmt.Sprintf("table%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "flushed", got)
+	}
+	got, err := store.Get("shared")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", got)
+	got, err = store.Get("unflushed")
+	assert.NoError(t, err)
+	assert.Equal(t, "wal", got)
+}
@@ -0,0 +1,601 @@
+package db
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Replication message types exchanged between a leader and its followers.
+const (
+	replMsgRecord        byte = 1
+	replMsgSnapshotBegin byte = 2
+	replMsgSnapshotEntry byte = 3
+	replMsgSnapshotEnd   byte = 4
+	replMsgTables        byte = 5
+)
+
+const (
+	defaultReplicationBacklog = 10000
+	followerSendBuffer        = 1024
+	followerRetryInterval     = 500 * time.Millisecond
+)
+
+// ReplicationOptions tunes a Leader.
+type ReplicationOptions struct {
+	// Backlog is the number of recent records kept in memory for followers
+	// that reconnect. Followers further behind than this are re-seeded from a
+	// full checkpoint of the leader's data.
+	Backlog int
+}
+
+// Leader streams committed writes to followers over TCP. Each follower
+// receives every record in sequence order; a follower that falls off the end
+// of the backlog (or was never connected) first receives a checkpoint and
+// then continues with the live stream. The checkpoint is the leader's
+// SSTables, which the follower ingests as they are, plus the memtable
+// entries not yet flushed; when the tables hold separated values it falls
+// back to all live key-value pairs.
+type Leader struct {
+	db       *DB
+	ln       net.Listener
+	runID    uint64
+	maxLog   int
+	unlisten func()
+
+	mu        sync.Mutex
+	backlog   []commitRecord
+	followers map[*leaderConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type leaderConn struct {
+	conn net.Conn
+	ch   chan commitRecord
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *leaderConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// StartLeader begins accepting follower connections on addr.
+func (db *DB) StartLeader(addr string, opts *ReplicationOptions) (*Leader, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for followers: %w", err)
+	}
+
+	runID, err := randomRunID()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to generate replication run id: %w", err)
+	}
+
+	l := &Leader{
+		db:        db,
+		ln:        ln,
+		runID:     runID,
+		maxLog:    defaultReplicationBacklog,
+		followers: make(map[*leaderConn]struct{}),
+	}
+	if opts != nil && opts.Backlog > 0 {
+		l.maxLog = opts.Backlog
+	}
+	l.unlisten = db.addListener(l.onCommit)
+
+	l.wg.Add(1)
+	go l.acceptLoop()
+
+	return l, nil
+}
+
+// Addr returns the address the leader is listening on.
+func (l *Leader) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops accepting followers and disconnects the connected ones.
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	for f := range l.followers {
+		f.close()
+	}
+	l.mu.Unlock()
+
+	l.unlisten()
+	err := l.ln.Close()
+	l.wg.Wait()
+	return err
+}
+
+// onCommit runs under the DB write lock, so records arrive in sequence order.
+func (l *Leader) onCommit(records []commitRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.backlog = append(l.backlog, records...)
+	if over := len(l.backlog) - l.maxLog; over > 0 {
+		l.backlog = append(l.backlog[:0:0], l.backlog[over:]...)
+	}
+
+	for f := range l.followers {
+		for _, rec := range records {
+			select {
+			case f.ch <- rec:
+			default:
+				// The follower is too slow; drop it so it reconnects and
+				// catches up from the backlog or a checkpoint.
+				log.Printf("Replication: disconnecting slow follower %s", f.conn.RemoteAddr())
+				delete(l.followers, f)
+				f.close()
+			}
+		}
+	}
+}
+
+func (l *Leader) acceptLoop() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if err := l.serveFollower(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Replication: follower %s disconnected: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (l *Leader) serveFollower(conn net.Conn) error {
+	defer conn.Close()
+
+	var hello [16]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return fmt.Errorf("failed to read follower handshake: %w", err)
+	}
+	followerRun := binary.LittleEndian.Uint64(hello[0:8])
+	appliedSeq := binary.LittleEndian.Uint64(hello[8:16])
+
+	f := &leaderConn{
+		conn: conn,
+		ch:   make(chan commitRecord, followerSendBuffer),
+		done: make(chan struct{}),
+	}
+	defer f.close()
+
+	// Hold the DB read lock while choosing the catch-up path and registering
+	// the follower, so no commit can fall between the catch-up data and the
+	// live stream.
+	l.db.mu.RLock()
+	plan, err := l.catchUp(followerRun, appliedSeq)
+	if err == nil && plan.tables != nil {
+		defer plan.tables.version.unref()
+	}
+	if err == nil {
+		l.mu.Lock()
+		if l.closed {
+			err = net.ErrClosed
+		} else {
+			l.followers[f] = struct{}{}
+		}
+		l.mu.Unlock()
+	}
+	l.db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.followers, f)
+		l.mu.Unlock()
+	}()
+
+	w := bufio.NewWriter(conn)
+	if err := binary.Write(w, binary.LittleEndian, l.runID); err != nil {
+		return fmt.Errorf("failed to write leader handshake: %w", err)
+	}
+	switch {
+	case plan.tables != nil:
+		if err := l.db.writeTableCheckpoint(w, plan.tables); err != nil {
+			return err
+		}
+	case plan.snapshot != nil:
+		if err := writeSnapshot(w, plan.seq, plan.snapshot); err != nil {
+			return err
+		}
+	}
+	for _, rec := range plan.pending {
+		if err := writeReplRecord(w, rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush catch-up data: %w", err)
+	}
+
+	for {
+		select {
+		case <-f.done:
+			return nil
+		case rec := <-f.ch:
+			if err := writeReplRecord(w, rec); err != nil {
+				return err
+			}
+			if len(f.ch) == 0 {
+				if err := w.Flush(); err != nil {
+					return fmt.Errorf("failed to flush replication stream: %w", err)
+				}
+			}
+		}
+	}
+}
+
+// catchUpPlan is what a follower is sent before the live stream: records
+// from the backlog, or a checkpoint at seq of either the pinned tables or
+// all live key-value pairs.
+type catchUpPlan struct {
+	pending  []commitRecord
+	seq      uint64
+	snapshot [][2]string
+	tables   *tableCheckpoint
+}
+
+// catchUp decides how a follower that has applied appliedSeq from run
+// followerRun gets back in sync: either from the in-memory backlog or from a
+// full checkpoint. It must be called with db.mu held.
+func (l *Leader) catchUp(followerRun, appliedSeq uint64) (catchUpPlan, error) {
+	l.mu.Lock()
+	current := l.db.seq
+	if followerRun == l.runID && appliedSeq <= current {
+		oldest := current + 1
+		if len(l.backlog) > 0 {
+			oldest = l.backlog[0].seq
+		}
+		if appliedSeq+1 >= oldest {
+			var pending []commitRecord
+			for _, rec := range l.backlog {
+				if rec.seq > appliedSeq {
+					pending = append(pending, rec)
+				}
+			}
+			l.mu.Unlock()
+			return catchUpPlan{pending: pending}, nil
+		}
+	}
+	l.mu.Unlock()
+
+	if tables := l.db.tableCheckpoint(); tables != nil {
+		return catchUpPlan{seq: current, tables: tables}, nil
+	}
+	snapshot, err := l.db.snapshotKVs()
+	if err != nil {
+		return catchUpPlan{}, fmt.Errorf("failed to build replication checkpoint: %w", err)
+	}
+	return catchUpPlan{seq: current, snapshot: snapshot}, nil
+}
+
+func writeReplRecord(w io.Writer, rec commitRecord) error {
+	if _, err := w.Write([]byte{replMsgRecord}); err != nil {
+		return fmt.Errorf("failed to write record type: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, rec.seq); err != nil {
+		return fmt.Errorf("failed to write record sequence: %w", err)
+	}
+	if err := writeString(w, rec.key); err != nil {
+		return fmt.Errorf("failed to write record key: %w", err)
+	}
+	if err := writeString(w, rec.value); err != nil {
+		return fmt.Errorf("failed to write record value: %w", err)
+	}
+	return nil
+}
+
+func writeSnapshot(w io.Writer, seq uint64, kvs [][2]string) error {
+	if _, err := w.Write([]byte{replMsgSnapshotBegin}); err != nil {
+		return fmt.Errorf("failed to write checkpoint header: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, seq); err != nil {
+		return fmt.Errorf("failed to write checkpoint sequence: %w", err)
+	}
+	for _, kv := range kvs {
+		if _, err := w.Write([]byte{replMsgSnapshotEntry}); err != nil {
+			return fmt.Errorf("failed to write checkpoint entry type: %w", err)
+		}
+		if err := writeString(w, kv[0]); err != nil {
+			return fmt.Errorf("failed to write checkpoint key: %w", err)
+		}
+		if err := writeString(w, kv[1]); err != nil {
+			return fmt.Errorf("failed to write checkpoint value: %w", err)
+		}
+	}
+	if _, err := w.Write([]byte{replMsgSnapshotEnd}); err != nil {
+		return fmt.Errorf("failed to write checkpoint trailer: %w", err)
+	}
+	return nil
+}
+
+// Follower applies a leader's write stream to a local DB, reconnecting with
+// backoff whenever the connection drops.
+type Follower struct {
+	db     *DB
+	addr   string
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	conn       net.Conn
+	leaderRun  uint64
+	appliedSeq uint64
+}
+
+// StartFollower connects db to the leader at addr and keeps applying its
+// writes until Close is called.
+func (db *DB) StartFollower(addr string) *Follower {
+	f := &Follower{
+		db:     db,
+		addr:   addr,
+		stopCh: make(chan struct{}),
+	}
+	f.wg.Add(1)
+	go f.run()
+	return f
+}
+
+// AppliedSequence returns the leader sequence number of the last record
+// applied locally.
+func (f *Follower) AppliedSequence() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.appliedSeq
+}
+
+// Close disconnects from the leader and stops the apply loop.
+func (f *Follower) Close() error {
+	select {
+	case <-f.stopCh:
+		return nil
+	default:
+	}
+	close(f.stopCh)
+
+	f.mu.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+	return nil
+}
+
+func (f *Follower) run() {
+	defer f.wg.Done()
+
+	for {
+		err := f.session()
+		select {
+		case <-f.stopCh:
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("Replication: lost leader %s: %v", f.addr, err)
+		}
+		select {
+		case <-f.stopCh:
+			return
+		case <-time.After(followerRetryInterval):
+		}
+	}
+}
+
+func (f *Follower) session() error {
+	conn, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial leader: %w", err)
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	select {
+	case <-f.stopCh:
+		f.mu.Unlock()
+		return nil
+	default:
+	}
+	f.conn = conn
+	var hello [16]byte
+	binary.LittleEndian.PutUint64(hello[0:8], f.leaderRun)
+	binary.LittleEndian.PutUint64(hello[8:16], f.appliedSeq)
+	f.mu.Unlock()
+
+	if _, err := conn.Write(hello[:]); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	var runID uint64
+	if err := binary.Read(r, binary.LittleEndian, &runID); err != nil {
+		return fmt.Errorf("failed to read leader handshake: %w", err)
+	}
+	f.mu.Lock()
+	f.leaderRun = runID
+	f.mu.Unlock()
+
+	for {
+		msgType, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch msgType {
+		case replMsgRecord:
+			var seq uint64
+			if err := binary.Read(r, binary.LittleEndian, &seq); err != nil {
+				return fmt.Errorf("failed to read record sequence: %w", err)
+			}
+			key, value, err := readReplKV(r)
+			if err != nil {
+				return err
+			}
+			if err := f.db.write([][2]string{{key, value}}, false); err != nil {
+				return fmt.Errorf("failed to apply replicated record %d: %w", seq, err)
+			}
+			f.setApplied(seq)
+
+		case replMsgSnapshotBegin:
+			seq, err := f.applySnapshot(r)
+			if err != nil {
+				return err
+			}
+			f.setApplied(seq)
+
+		case replMsgTables:
+			seq, err := f.applyTableCheckpoint(r)
+			if err != nil {
+				return err
+			}
+			f.setApplied(seq)
+
+		default:
+			return fmt.Errorf("unexpected replication message type %d", msgType)
+		}
+	}
+}
+
+// applySnapshot replaces the follower's keyspace with a checkpoint sent by
+// the leader, which it loads in batches.
+func (f *Follower) applySnapshot(r *bufio.Reader) (uint64, error) {
+	var seq uint64
+	if err := binary.Read(r, binary.LittleEndian, &seq); err != nil {
+		return 0, fmt.Errorf("failed to read checkpoint sequence: %w", err)
+	}
+	if err := f.clearKeyspace(); err != nil {
+		return 0, err
+	}
+
+	const batchSize = 1000
+	batch := make([][2]string, 0, batchSize)
+	for {
+		msgType, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read checkpoint entry: %w", err)
+		}
+		if msgType == replMsgSnapshotEnd {
+			break
+		}
+		if msgType != replMsgSnapshotEntry {
+			return 0, fmt.Errorf("unexpected message type %d inside checkpoint", msgType)
+		}
+		key, value, err := readReplKV(r)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, [2]string{key, value})
+		if len(batch) == batchSize {
+			if err := f.db.write(batch, false); err != nil {
+				return 0, fmt.Errorf("failed to apply checkpoint batch: %w", err)
+			}
+			batch = make([][2]string, 0, batchSize)
+		}
+	}
+	if len(batch) > 0 {
+		if err := f.db.write(batch, false); err != nil {
+			return 0, fmt.Errorf("failed to apply checkpoint batch: %w", err)
+		}
+	}
+	return seq, nil
+}
+
+// clearKeyspace deletes every key the follower holds before a checkpoint
+// is applied, so that keys the leader deleted while the follower was too
+// far behind to be sent the deletes do not survive on the follower. It is
+// logged as one range delete, from the smallest possible key to just past
+// the largest the follower holds. Until the checkpoint is applied, reads
+// on the follower find the keys missing.
+func (f *Follower) clearKeyspace() error {
+	f.db.mu.RLock()
+	last, ok := f.db.largestKey()
+	f.db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	if err := f.db.submit(&writeRequest{ranges: [][2]string{{"", last + "\x00"}}}); err != nil {
+		return fmt.Errorf("failed to clear follower before checkpoint: %w", err)
+	}
+	return nil
+}
+
+// largestKey returns the largest key the memtables and tables hold, deleted
+// or not, and false if they hold none. db.mu must be held.
+func (db *DB) largestKey() (string, bool) {
+	var largest string
+	var found bool
+	consider := func(key string, ok bool) {
+		if ok && (!found || key > largest) {
+			largest, found = key, true
+		}
+	}
+	consider(db.memTable.last())
+	for _, imm := range db.imm {
+		consider(imm.mem.last())
+	}
+	for _, level := range db.levels {
+		for _, sst := range level {
+			if sst != nil {
+				consider(sst.props.LargestKey, true)
+			}
+		}
+	}
+	return largest, found
+}
+
+func (f *Follower) setApplied(seq uint64) {
+	f.mu.Lock()
+	f.appliedSeq = seq
+	f.mu.Unlock()
+}
+
+func readReplKV(r io.Reader) (string, string, error) {
+	key, err := readString(r)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read replicated key: %w", err)
+	}
+	value, err := readString(r)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read replicated value: %w", err)
+	}
+	return key, value, nil
+}
+
+func randomRunID() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
@@ -0,0 +1,209 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationStreamsAndCatchesUp(t *testing.T) {
+	leaderDir := "testdata/repl_leader"
+	followerDir := "testdata/repl_follower"
+	_ = os.RemoveAll(leaderDir)
+	_ = os.RemoveAll(followerDir)
+
+	leaderDB, err := db.NewDB(leaderDir)
+	require.NoError(t, err)
+	followerDB, err := db.NewDB(followerDir)
+	require.NoError(t, err)
+
+	leader, err := leaderDB.StartLeader("127.0.0.1:0", &db.ReplicationOptions{Backlog: 4})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		leader.Close()
+		leaderDB.Close()
+		followerDB.Close()
+		os.RemoveAll("testdata")
+	})
+
+	// Written before the follower connects and beyond the backlog, so the
+	// follower must be seeded from a checkpoint.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leaderDB.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)))
+	}
+	require.NoError(t, leaderDB.Flush())
+
+	follower := followerDB.StartFollower(leader.Addr().String())
+	defer follower.Close()
+
+	require.NoError(t, leaderDB.Put("live", "stream"))
+
+	assert.Eventually(t, func() bool {
+		return follower.AppliedSequence() == leaderDB.LastSequence()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		got, err := followerDB.Get(fmt.Sprintf("key%02d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("value%d", i), got)
+	}
+	got, err := followerDB.Get("live")
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", got)
+}
+
+func TestReplicationBootstrapsFollowerFromSSTables(t *testing.T) {
+	leaderDir := "testdata/repl_ship_leader"
+	followerDir := "testdata/repl_ship_follower"
+	_ = os.RemoveAll(leaderDir)
+	_ = os.RemoveAll(followerDir)
+
+	leaderDB, err := db.NewDB(leaderDir)
+	require.NoError(t, err)
+	followerDB, err := db.NewDB(followerDir)
+	require.NoError(t, err)
+
+	leader, err := leaderDB.StartLeader("127.0.0.1:0", &db.ReplicationOptions{Backlog: 4})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		leader.Close()
+		leaderDB.Close()
+		followerDB.Close()
+		os.RemoveAll("testdata")
+	})
+
+	// Two flushed tables, the newer overwriting part of the older, and a
+	// memtable tail with a delete and an unflushed write.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, leaderDB.Put(fmt.Sprintf("key%02d", i), "old"))
+	}
+	require.NoError(t, leaderDB.Flush())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leaderDB.Put(fmt.Sprintf("key%02d", i), "new"))
+	}
+	require.NoError(t, leaderDB.Flush())
+	require.NoError(t, leaderDB.Delete("key15"))
+	require.NoError(t, leaderDB.Put("tail", "unflushed"))
+
+	follower := followerDB.StartFollower(leader.Addr().String())
+	defer follower.Close()
+
+	require.Eventually(t, func() bool {
+		return follower.AppliedSequence() == leaderDB.LastSequence()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		want := "old"
+		if i < 10 {
+			want = "new"
+		}
+		if i == 15 {
+			continue
+		}
+		got, err := followerDB.Get(fmt.Sprintf("key%02d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err = followerDB.Get("key15")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	got, err := followerDB.Get("tail")
+	assert.NoError(t, err)
+	assert.Equal(t, "unflushed", got)
+
+	// The leader's tables were ingested rather than rewritten.
+	files := 0
+	for _, level := range followerDB.Levels() {
+		files += len(level.Files)
+	}
+	assert.Equal(t, 2, files)
+	_, err = os.Stat(followerDir + "/replica-bootstrap")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReplicationCheckpointDropsKeysDeletedDuringLag(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		family bool // column family keys keep the leader from shipping tables
+	}{
+		{name: "tables"},
+		{name: "key-values", family: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			leaderDir := "testdata/repl_lag_leader_" + tc.name
+			followerDir := "testdata/repl_lag_follower_" + tc.name
+			_ = os.RemoveAll(leaderDir)
+			_ = os.RemoveAll(followerDir)
+
+			// L0 is compacted at every flush, so the leader's tables no
+			// longer hold the tombstone when the follower comes back.
+			leaderOpts := db.DefaultOptions()
+			leaderOpts.LevelMaxFiles = []int{1}
+			leaderDB, err := db.Open(leaderDir, leaderOpts)
+			require.NoError(t, err)
+			followerDB, err := db.NewDB(followerDir)
+			require.NoError(t, err)
+			leader, err := leaderDB.StartLeader("127.0.0.1:0", &db.ReplicationOptions{Backlog: 4})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				leader.Close()
+				leaderDB.Close()
+				followerDB.Close()
+				os.RemoveAll("testdata")
+			})
+
+			require.NoError(t, leaderDB.Put("gone", "1"))
+			require.NoError(t, leaderDB.Put("kept", "1"))
+			if tc.family {
+				cf, err := leaderDB.ColumnFamily("users")
+				require.NoError(t, err)
+				require.NoError(t, cf.Put("1", "alice"))
+			}
+			require.NoError(t, leaderDB.Flush())
+
+			follower := followerDB.StartFollower(leader.Addr().String())
+			require.Eventually(t, func() bool {
+				return follower.AppliedSequence() == leaderDB.LastSequence()
+			}, 5*time.Second, 10*time.Millisecond)
+			_, err = followerDB.Get("gone")
+			require.NoError(t, err)
+			require.NoError(t, follower.Close())
+
+			// The delete falls out of the backlog while the follower is
+			// away, so it comes back to a checkpoint.
+			require.NoError(t, leaderDB.Delete("gone"))
+			for i := 0; i < 10; i++ {
+				require.NoError(t, leaderDB.Put(fmt.Sprintf("key%02d", i), "v"))
+			}
+			require.NoError(t, leaderDB.Flush())
+
+			follower = followerDB.StartFollower(leader.Addr().String())
+			defer follower.Close()
+			require.Eventually(t, func() bool {
+				return follower.AppliedSequence() == leaderDB.LastSequence()
+			}, 5*time.Second, 10*time.Millisecond)
+
+			_, err = followerDB.Get("gone")
+			assert.ErrorIs(t, err, db.ErrNotFound)
+			got, err := followerDB.Get("kept")
+			require.NoError(t, err)
+			assert.Equal(t, "1", got)
+			got, err = followerDB.Get("key09")
+			require.NoError(t, err)
+			assert.Equal(t, "v", got)
+			if tc.family {
+				cf, err := followerDB.ColumnFamily("users")
+				require.NoError(t, err)
+				got, err := cf.Get("1")
+				require.NoError(t, err)
+				assert.Equal(t, "alice", got)
+			}
+		})
+	}
+}
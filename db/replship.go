@@ -0,0 +1,209 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+)
+
+// replicaBootstrapDirName is the subdirectory of a follower's directory
+// that the tables a leader ships are received into before being ingested.
+const replicaBootstrapDirName = "replica-bootstrap"
+
+// tableCheckpoint is what a leader ships to bring a follower up to seq: the
+// SSTables of a pinned version, oldest data first, and the memtable entries
+// not yet flushed into them.
+type tableCheckpoint struct {
+	seq     uint64
+	version *version
+	tables  []shippedTable
+	tail    [][2]string
+}
+
+type shippedTable struct {
+	level int
+	sst   *SSTable
+}
+
+// tableCheckpoint pins the current tables and copies the memtables for
+// shipping to a follower, or returns nil if the tables cannot be ingested
+// elsewhere: when they point into the value log, or hold reserved keys
+// such as those of chunked values. db.mu must be held.
+func (db *DB) tableCheckpoint() *tableCheckpoint {
+	v := db.currentVersion()
+	ckpt := &tableCheckpoint{seq: db.seq, version: v}
+	// Deeper levels hold older data, and L0's tables go from oldest to
+	// newest, so ingesting them in this order keeps newer data on top.
+	for level := len(v.levels) - 1; level >= 0; level-- {
+		for _, sst := range v.levels[level] {
+			if sst == nil {
+				continue
+			}
+			if sst.separated || isInternalKey(sst.props.SmallestKey) {
+				v.unref()
+				return nil
+			}
+			ckpt.tables = append(ckpt.tables, shippedTable{level: level, sst: sst})
+		}
+	}
+	ckpt.tail = db.memEntries()
+	return ckpt
+}
+
+// writeTableCheckpoint sends ckpt: its sequence number, each table's level,
+// size and bytes, and the tail entries.
+func (db *DB) writeTableCheckpoint(w io.Writer, ckpt *tableCheckpoint) error {
+	if _, err := w.Write([]byte{replMsgTables}); err != nil {
+		return fmt.Errorf("failed to write table checkpoint header: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, ckpt.seq); err != nil {
+		return fmt.Errorf("failed to write table checkpoint sequence: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(ckpt.tables))); err != nil {
+		return fmt.Errorf("failed to write table count: %w", err)
+	}
+	for _, t := range ckpt.tables {
+		if err := db.writeShippedTable(w, t); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(ckpt.tail))); err != nil {
+		return fmt.Errorf("failed to write tail length: %w", err)
+	}
+	for _, kv := range ckpt.tail {
+		if err := writeString(w, kv[0]); err != nil {
+			return fmt.Errorf("failed to write tail key: %w", err)
+		}
+		if err := writeString(w, kv[1]); err != nil {
+			return fmt.Errorf("failed to write tail value: %w", err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) writeShippedTable(w io.Writer, t shippedTable) error {
+	f, err := db.fs.Open(t.sst.path)
+	if err != nil {
+		return fmt.Errorf("failed to open SSTable %s for shipping: %w", t.sst.path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat SSTable %s for shipping: %w", t.sst.path, err)
+	}
+	if _, err := w.Write([]byte{byte(t.level)}); err != nil {
+		return fmt.Errorf("failed to write table level: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(info.Size())); err != nil {
+		return fmt.Errorf("failed to write table size: %w", err)
+	}
+	if _, err := io.CopyN(w, f, info.Size()); err != nil {
+		return fmt.Errorf("failed to ship SSTable %s: %w", t.sst.path, err)
+	}
+	return nil
+}
+
+// applyTableCheckpoint receives the tables a leader ships into a scratch
+// directory and ingests them, level by level from the deepest and one at a
+// time in L0, so newer data lands above older; then it applies the tail.
+// As with a key-value checkpoint, the follower's keyspace is cleared
+// first. It returns the leader sequence number the follower is then at.
+func (f *Follower) applyTableCheckpoint(r *bufio.Reader) (uint64, error) {
+	var seq uint64
+	if err := binary.Read(r, binary.LittleEndian, &seq); err != nil {
+		return 0, fmt.Errorf("failed to read table checkpoint sequence: %w", err)
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return 0, fmt.Errorf("failed to read table count: %w", err)
+	}
+
+	fs := f.db.fs
+	scratch := filepath.Join(f.db.dir, replicaBootstrapDirName)
+	if err := fs.MkdirAll(scratch, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", scratch, err)
+	}
+	var received []string
+	defer func() {
+		for _, path := range received {
+			fs.Remove(path)
+		}
+		fs.Remove(scratch)
+	}()
+
+	levels := make([]int, 0, count)
+	for i := 0; i < int(count); i++ {
+		level, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read table level: %w", err)
+		}
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return 0, fmt.Errorf("failed to read table size: %w", err)
+		}
+		path := filepath.Join(scratch, fmt.Sprintf("%06d.sst", i))
+		received = append(received, path)
+		if err := receiveFile(fs, path, r, int64(size)); err != nil {
+			return 0, fmt.Errorf("failed to receive SSTable: %w", err)
+		}
+		levels = append(levels, int(level))
+	}
+
+	if err := f.clearKeyspace(); err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(received); {
+		end := start + 1
+		if levels[start] > 0 {
+			for end < len(received) && levels[end] == levels[start] {
+				end++
+			}
+		}
+		if err := f.db.IngestSSTables(received[start:end]); err != nil {
+			return 0, fmt.Errorf("failed to ingest shipped SSTables: %w", err)
+		}
+		start = end
+	}
+
+	var tailLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &tailLen); err != nil {
+		return 0, fmt.Errorf("failed to read tail length: %w", err)
+	}
+	const batchSize = 1000
+	batch := make([][2]string, 0, batchSize)
+	for i := 0; i < int(tailLen); i++ {
+		key, value, err := readReplKV(r)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, [2]string{key, value})
+		if len(batch) == batchSize || i == int(tailLen)-1 {
+			if err := f.db.write(batch, false); err != nil {
+				return 0, fmt.Errorf("failed to apply checkpoint tail: %w", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	log.Printf("Replication: bootstrapped from %d shipped SSTables and %d tail entries at sequence %d", count, tailLen, seq)
+	return seq, nil
+}
+
+// receiveFile writes the next size bytes of r to path and syncs it.
+func receiveFile(fs FileSystem, path string, r io.Reader, size int64) error {
+	out, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, r, size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
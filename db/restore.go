@@ -0,0 +1,215 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RestoreReport summarizes a completed point-in-time restore.
+type RestoreReport struct {
+	// BackupSequence is the sequence number the backup was taken at.
+	BackupSequence uint64
+	// WALs is the number of WALs read from the source.
+	WALs int
+	// Writes is the number of writes replayed onto the backup, counting a
+	// range delete once.
+	Writes int
+	// LastSequence is the sequence number of the restored database.
+	LastSequence uint64
+}
+
+// restorePoint is where a restore stops: after the write with sequence
+// number seq, or, if byTime, at the first checkpoint record logged after ts.
+type restorePoint struct {
+	seq    uint64
+	ts     time.Time
+	byTime bool
+}
+
+// RestoreToSequence rebuilds in target the database in source as it was
+// after the write with sequence number seq. It starts from backup, a copy
+// written by Checkpoint, and replays the writes after it from the WALs in
+// source's archive and the WALs source has not flushed yet, so source must
+// have had Options.ArchiveWALs set, and kept every WAL since the backup,
+// from before the backup was taken. A batch is split if seq falls inside
+// it, and a range delete is restored whole if it starts at or before seq.
+//
+// target must not exist or must be empty, source must not be open, and
+// opts are the options target is opened with.
+func RestoreToSequence(backup, source, target string, seq uint64, opts *Options) (*RestoreReport, error) {
+	return restore(backup, source, target, restorePoint{seq: seq}, opts)
+}
+
+// RestoreToTimestamp is RestoreToSequence for the last write logged at or
+// before ts. WALs record the time only every walCheckpointInterval, so
+// writes logged up to that long after ts may be restored too.
+func RestoreToTimestamp(backup, source, target string, ts time.Time, opts *Options) (*RestoreReport, error) {
+	return restore(backup, source, target, restorePoint{ts: ts, byTime: true}, opts)
+}
+
+func restore(backup, source, target string, point restorePoint, opts *Options) (*RestoreReport, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	fs := fsOrDefault(opts.FileSystem)
+	if entries, err := fs.ReadDir(target); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("restore directory %s is not empty", target)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to inspect restore directory: %w", err)
+	}
+	if err := copyBackup(fs, backup, target); err != nil {
+		return nil, err
+	}
+	wals, err := restoreWALs(fs, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// The target holds the copied backup now, so it is opened as one.
+	restored := *opts
+	restored.ErrorIfExists = false
+	store, err := Open(target, &restored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open restored backup: %w", err)
+	}
+	report := &RestoreReport{BackupSequence: store.LastSequence(), WALs: len(wals)}
+	base := report.BackupSequence
+	if !point.byTime && point.seq < base {
+		store.Close()
+		return nil, fmt.Errorf("failed to restore to sequence %d: backup is at sequence %d", point.seq, base)
+	}
+
+	// Writes are applied as they were logged, in their stored form, and
+	// gathered into one commit until a range delete has to see them.
+	var pending [][2]string
+	var applyErr error
+	flush := func() {
+		if len(pending) > 0 && applyErr == nil {
+			applyErr = store.write(pending, false)
+		}
+		pending = nil
+	}
+	var seq uint64
+	done := false
+	apply := func(rec walRecord) {
+		if done {
+			return
+		}
+		switch rec.typ {
+		case walCheckpoint:
+			s, at, err := rec.checkpoint()
+			if err != nil {
+				applyErr, done = err, true
+				return
+			}
+			if point.byTime && at.After(point.ts) {
+				if s < base {
+					applyErr = fmt.Errorf("failed to restore to %s: backup was taken after it", point.ts.Format(time.RFC3339Nano))
+				}
+				done = true
+				return
+			}
+			seq = s
+		case walPut, walDelete:
+			seq++
+			if seq <= base {
+				return
+			}
+			if !point.byTime && seq > point.seq {
+				done = true
+				return
+			}
+			value := rec.value
+			if rec.typ == walDelete {
+				value = tombstone
+			}
+			pending = append(pending, [2]string{rec.key, value})
+			report.Writes++
+		case walRangeDelete:
+			// The checkpoint record after it sets the sequence number.
+			if seq < base {
+				return
+			}
+			if !point.byTime && seq >= point.seq {
+				done = true
+				return
+			}
+			flush()
+			if applyErr == nil {
+				applyErr = store.submit(&writeRequest{ranges: [][2]string{{rec.key, rec.value}}})
+			}
+			report.Writes++
+		}
+		if applyErr != nil {
+			done = true
+		}
+	}
+
+	errs := replayWALFiles(fs, wals, apply)
+	flush()
+	errs = append(errs, applyErr)
+	report.LastSequence = store.LastSequence()
+	errs = append(errs, store.Close())
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("failed to restore: %w", err)
+	}
+	if !point.byTime && report.LastSequence < point.seq {
+		return report, fmt.Errorf("failed to restore to sequence %d: WALs end at sequence %d", point.seq, report.LastSequence)
+	}
+	return report, nil
+}
+
+// copyBackup copies the files of the backup in dir into target. SSTables,
+// which are never modified, are hard-linked where possible.
+func copyBackup(fs FileSystem, dir, target string) error {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := fs.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	for _, name := range names {
+		src, dst := filepath.Join(dir, name), filepath.Join(target, name)
+		info, err := fs.Stat(src)
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".sst") {
+			err = linkOrCopy(fs, src, dst)
+		} else {
+			err = copyFile(fs, src, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy backup file %s: %w", name, err)
+		}
+	}
+	if err := fs.SyncDir(target); err != nil {
+		return fmt.Errorf("failed to sync restore directory: %w", err)
+	}
+	return nil
+}
+
+// restoreWALs returns the archived and live WALs of the database in dir, in
+// the order they were written.
+func restoreWALs(fs FileSystem, dir string) ([]string, error) {
+	archived, err := archivedWALs(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	live, err := walFiles(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	wals := append(archived, live...)
+	sort.SliceStable(wals, func(i, j int) bool { return walNumber(wals[i]) < walNumber(wals[j]) })
+	return wals, nil
+}
@@ -0,0 +1,127 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreToPointInTime(t *testing.T) {
+	root := filepath.Join("testdata", "restore")
+	_ = os.RemoveAll(root)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ArchiveWALs = true
+	// Every write more than a millisecond after the last one logs the
+	// time, so the restore to ts below stops right before d.
+	opts.WALCheckpointInterval = time.Millisecond
+	source := filepath.Join(root, "source")
+	backup := filepath.Join(root, "backup")
+	store, err := db.Open(source, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Put("b", "1"))
+	require.NoError(t, store.Checkpoint(backup))
+	base := store.LastSequence()
+
+	require.NoError(t, store.Put("c", "1"))
+	require.NoError(t, store.Delete("a"))
+	require.NoError(t, store.Flush())
+	afterDelete := store.LastSequence()
+	time.Sleep(10 * time.Millisecond)
+	ts := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.Put("d", "1"))
+	require.NoError(t, store.DeleteRange("b", "d"))
+	last := store.LastSequence()
+	require.NoError(t, store.Close())
+
+	check := func(target string, want map[string]string) {
+		t.Helper()
+		restored, err := db.Open(target, opts)
+		require.NoError(t, err)
+		defer restored.Close()
+		for _, key := range []string{"a", "b", "c", "d"} {
+			got, err := restored.Get(key)
+			if value, ok := want[key]; ok {
+				require.NoError(t, err, key)
+				assert.Equal(t, value, got, key)
+			} else {
+				assert.ErrorIs(t, err, db.ErrNotFound, key)
+			}
+		}
+	}
+
+	report, err := db.RestoreToSequence(backup, source, filepath.Join(root, "seq"), base+1, opts)
+	require.NoError(t, err)
+	assert.Equal(t, base, report.BackupSequence)
+	assert.Equal(t, base+1, report.LastSequence)
+	check(filepath.Join(root, "seq"), map[string]string{"a": "1", "b": "1", "c": "1"})
+
+	report, err = db.RestoreToTimestamp(backup, source, filepath.Join(root, "ts"), ts, opts)
+	require.NoError(t, err)
+	assert.Equal(t, afterDelete, report.LastSequence)
+	check(filepath.Join(root, "ts"), map[string]string{"b": "1", "c": "1"})
+
+	report, err = db.RestoreToSequence(backup, source, filepath.Join(root, "last"), last, opts)
+	require.NoError(t, err)
+	assert.Equal(t, last, report.LastSequence)
+	check(filepath.Join(root, "last"), map[string]string{"d": "1"})
+
+	_, err = db.RestoreToSequence(backup, source, filepath.Join(root, "early"), base-1, opts)
+	assert.Error(t, err)
+}
+
+func TestCheckpointWithArchivedWALsServesRestore(t *testing.T) {
+	root := filepath.Join("testdata", "restore-archive")
+	_ = os.RemoveAll(root)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ArchiveWALs = true
+	store, err := db.Open(filepath.Join(root, "source"), opts)
+	require.NoError(t, err)
+	backup := filepath.Join(root, "backup")
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Checkpoint(backup))
+	base := store.LastSequence()
+	require.NoError(t, store.Put("b", "1"))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Put("c", "1"))
+
+	plain := filepath.Join(root, "plain")
+	withArchive := filepath.Join(root, "with-archive")
+	require.NoError(t, store.Checkpoint(plain))
+	require.NoError(t, store.CheckpointWithOptions(withArchive, &db.CheckpointOptions{IncludeArchivedWALs: true}))
+	require.NoError(t, store.Close())
+
+	_, err = os.Stat(filepath.Join(plain, "archive"))
+	assert.True(t, os.IsNotExist(err), "archive copied without IncludeArchivedWALs")
+	archived, err := filepath.Glob(filepath.Join(withArchive, "archive", "*.walb"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, archived)
+
+	target := filepath.Join(root, "target")
+	_, err = db.RestoreToSequence(backup, withArchive, target, base+1, opts)
+	require.NoError(t, err)
+	restored, err := db.Open(target, opts)
+	require.NoError(t, err)
+	defer restored.Close()
+	got, err := restored.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, "1", got)
+	_, err = restored.Get("c")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+}
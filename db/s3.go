@@ -0,0 +1,313 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Options configures an S3ObjectStore.
+type S3Options struct {
+	// Endpoint is the base URL of the service, such as
+	// https://s3.us-east-1.amazonaws.com, or https://storage.googleapis.com
+	// for GCS through its S3-compatible XML API. It must be https: request
+	// bodies are streamed and left out of the signature, so only TLS keeps
+	// them from being altered in transit.
+	Endpoint string
+	// Region signs requests; GCS accepts "auto".
+	Region string
+	Bucket string
+
+	// AccessKeyID and SecretAccessKey are the credentials requests are
+	// signed with: an AWS access key, or a GCS HMAC key. SessionToken is
+	// set for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client sends the requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// S3ObjectStore is an ObjectStore backed by a bucket of Amazon S3 or a
+// service speaking its API, such as GCS or MinIO. Objects are addressed
+// path-style, as Endpoint/Bucket/key, and requests are signed with AWS
+// Signature Version 4.
+type S3ObjectStore struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3ObjectStore returns a store for the bucket opts names.
+func NewS3ObjectStore(opts S3Options) (*S3ObjectStore, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("failed to configure S3 store: no bucket")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("failed to configure S3 store: invalid endpoint %q", opts.Endpoint)
+	}
+	if endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("failed to configure S3 store: endpoint %q is not https", opts.Endpoint)
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3ObjectStore{opts: opts, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+// objectURL returns the URL of key, or of the bucket for an empty key.
+func (s *S3ObjectStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.opts.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do signs and sends a request, returning the response unless its status
+// is not 2xx.
+func (s *S3ObjectStore) do(method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	statusErr := fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %v", os.ErrNotExist, statusErr)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.EOF
+	}
+	return nil, statusErr
+}
+
+// sign adds the AWS Signature Version 4 headers to req. The payload is
+// left unsigned, as S3 allows over HTTPS, so bodies can be streamed.
+func (s *S3ObjectStore) sign(req *http.Request) {
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	signV4(req, s.opts.AccessKeyID, s.opts.SecretAccessKey, s.opts.Region, s.now(), "UNSIGNED-PAYLOAD")
+}
+
+// signV4 signs req for S3 in region at now, with payloadHash, the hex
+// SHA-256 of the body or UNSIGNED-PAYLOAD, as its content hash. The host
+// and every header req already has are signed.
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region string, now time.Time, payloadHash string) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); lower != "authorization" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes s as Signature Version 4 requires: everything
+// but unreserved characters, and '/' too unless it is a path.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// canonicalQuery returns query sorted and encoded for signing.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func (s *S3ObjectStore) Put(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, key, nil, io.LimitReader(r, size), size, nil)
+	if err != nil {
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ReadAt fetches the bytes of key at off with a ranged GET.
+func (s *S3ObjectStore) ReadAt(key string, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)}}
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0, header)
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read object: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && off > 0 {
+		// The range was ignored and the whole object sent.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return 0, io.EOF
+		}
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (s *S3ObjectStore) Size(key string) (int64, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat object: %w", err)
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (s *S3ObjectStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is the part of a ListObjectsV2 response List reads.
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through ListObjectsV2.
+func (s *S3ObjectStore) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
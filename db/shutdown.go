@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errShutdownAborted is what a flush or compaction cut short by Shutdown
+// fails with.
+var errShutdownAborted = errors.New("abandoned by shutdown")
+
+// ShutdownReport says what background work Shutdown gave up on. Abandoned
+// work leaves no trace: its partial output is removed and its inputs stay
+// as they were.
+type ShutdownReport struct {
+	// Abandoned describes each flush and compaction cut short, and each
+	// queued flush that had not started.
+	Abandoned []string
+	// UnflushedMemTables counts the full memtables left unflushed. Their
+	// writes are in their WALs and are replayed by the next Open.
+	UnflushedMemTables int
+}
+
+// Shutdown closes the database, first letting the flushes and compactions
+// in progress finish until ctx ends, and then stopping them where they are.
+// Flushes still queued are not started. A ctx that has already ended stops
+// the work in progress at once. Writes and other operations fail with
+// ErrClosed from the moment it is called. The memtable is not flushed, as
+// with Close.
+func (db *DB) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+	if db.closed.Load() {
+		return report, fmt.Errorf("failed to shut down database: %w", ErrClosed)
+	}
+	// Set before the database reports itself closed, so work that sees
+	// it closed also sees it aborting.
+	if ctx.Err() != nil {
+		db.aborting.Store(true)
+	}
+	if db.closed.Swap(true) {
+		return report, fmt.Errorf("failed to shut down database: %w", ErrClosed)
+	}
+
+	if db.bgStop != nil {
+		close(db.bgStop)
+		done := make(chan struct{})
+		go func() {
+			db.bgWG.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			db.aborting.Store(true)
+			<-done
+		}
+		db.bgStop = nil
+	}
+
+	db.abandonMu.Lock()
+	report.Abandoned = db.abandoned
+	db.abandonMu.Unlock()
+	db.mu.RLock()
+	report.UnflushedMemTables = len(db.imm)
+	for _, imm := range db.imm {
+		if !imm.abandoned {
+			report.Abandoned = append(report.Abandoned, fmt.Sprintf("queued flush of %d entries to L0, not started", imm.mem.len()))
+		}
+	}
+	db.mu.RUnlock()
+	return report, db.release(false)
+}
+
+// noteAbandoned records work given up on for Shutdown's report.
+func (db *DB) noteAbandoned(work string) {
+	db.abandonMu.Lock()
+	db.abandoned = append(db.abandoned, work)
+	db.abandonMu.Unlock()
+}
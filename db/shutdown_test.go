@@ -0,0 +1,88 @@
+package db_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mini-leveldb/db"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownAbandonsSlowFlush(t *testing.T) {
+	fs := db.NewFaultFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.WriteBufferSize = 64 << 10
+	opts.MaxImmutableMemTables = 2
+	store, err := db.Open("shutdown", opts)
+	require.NoError(t, err)
+
+	// The first flush blocks as it creates its table, so it is in
+	// progress when Shutdown is called and the second waits behind it.
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fs.OnMutation(func(op, name string) {
+		if op == "create" && strings.HasSuffix(name, ".sst.tmp") {
+			once.Do(func() { close(started) })
+			<-release
+		}
+	})
+
+	// 160 values of 1 KiB fill two memtables and part of a third.
+	rng := rand.New(rand.NewSource(1))
+	values := make([]string, 160)
+	for i := range values {
+		buf := make([]byte, 512)
+		rng.Read(buf)
+		values[i] = hex.EncodeToString(buf)
+		require.NoError(t, store.Put(fmt.Sprintf("key%03d", i), values[i]))
+	}
+	<-started
+
+	// With its context already ended, Shutdown aborts the flush in
+	// progress as soon as it is let go, which is once the database
+	// reports itself closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var report db.ShutdownReport
+	done := make(chan struct{})
+	go func() {
+		report, err = store.Shutdown(ctx)
+		close(done)
+	}()
+	for {
+		if _, err := store.Get("key000"); errors.Is(err, db.ErrClosed) {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	<-done
+	require.NoError(t, err)
+	require.Len(t, report.Abandoned, 2)
+	assert.Regexp(t, `^flush of \d+ entries to L0$`, report.Abandoned[0])
+	assert.Regexp(t, `^queued flush of \d+ entries to L0, not started$`, report.Abandoned[1])
+	assert.Equal(t, 2, report.UnflushedMemTables)
+	assert.ErrorIs(t, store.Put("late", "write"), db.ErrClosed)
+
+	// The abandoned memtables are replayed from their WALs.
+	fs.OnMutation(nil)
+	store, err = db.Open("shutdown", opts)
+	require.NoError(t, err)
+	for i := range values {
+		got, err := store.Get(fmt.Sprintf("key%03d", i))
+		require.NoError(t, err)
+		assert.Equal(t, values[i], got)
+	}
+	report, err = store.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, report.Abandoned)
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Snapshot is a consistent, read-only view of the database as of the moment
+// it was taken. It holds the memtables that were live, reading past the
+// writes made to them after its sequence number, and references to the
+// SSTables that were live, so compaction cannot delete them until the
+// snapshot is released.
+type Snapshot struct {
+	db        *DB
+	seq       uint64
+	createdAt time.Time
+	mems      []*memTable // newest first
+	levels    [][]*SSTable
+
+	mu       sync.RWMutex
+	released bool
+	forced   bool
+}
+
+// SnapshotStats reports snapshot bookkeeping.
+type SnapshotStats struct {
+	Live          int
+	ForceReleased uint64
+}
+
+// GetSnapshot captures the current state of the database. The snapshot must
+// be released with Release; snapshots older than Options.MaxSnapshotAge are
+// released automatically.
+func (db *DB) GetSnapshot() *Snapshot {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.snapshotLocked()
+}
+
+// snapshotLocked is GetSnapshot for callers holding db.mu.
+func (db *DB) snapshotLocked() *Snapshot {
+	snap := &Snapshot{
+		db:        db,
+		seq:       db.seq,
+		createdAt: time.Now(),
+		mems:      []*memTable{db.memTable},
+		levels:    make([][]*SSTable, len(db.levels)),
+	}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		snap.mems = append(snap.mems, db.imm[i].mem)
+	}
+	for levelNum, level := range db.levels {
+		snap.levels[levelNum] = append([]*SSTable(nil), level...)
+		for _, sst := range level {
+			sst.ref()
+		}
+	}
+
+	// Registered before db.mu is released, so value log GC, which checks
+	// for live snapshots under db.mu, cannot miss this one.
+	db.snapMu.Lock()
+	if db.snapshots == nil {
+		db.snapshots = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[snap] = struct{}{}
+	db.snapMu.Unlock()
+
+	return snap
+}
+
+// Sequence returns the sequence number of the last write visible to the
+// snapshot.
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// CreatedAt returns when the snapshot was taken.
+func (s *Snapshot) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+// Get reads key as of the snapshot.
+func (s *Snapshot) Get(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		if s.forced {
+			return "", fmt.Errorf("failed to get key %s: snapshot was force-released after exceeding its maximum age", key)
+		}
+		return "", fmt.Errorf("failed to get key %s: snapshot already released", key)
+	}
+	if isInternalKey(key) {
+		return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+
+	value, err := s.get(key)
+	if err != nil {
+		return "", err
+	}
+	if isDeleted(key, value) {
+		return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+	if c, ok := decodeChunkedValue(value); ok {
+		if value, err = joinChunks(c, s.get); err != nil {
+			return "", fmt.Errorf("failed to get key %s: %w", key, err)
+		}
+	}
+	return value, nil
+}
+
+// get looks key up in the snapshot's memtables and tables. s.mu must be
+// held, or the snapshot otherwise known not to be released.
+func (s *Snapshot) get(key string) (string, error) {
+	for _, mem := range s.mems {
+		if value, ok := mem.getAt(key, s.seq); ok {
+			return value, nil
+		}
+	}
+	value, ok, err := searchLevels(s.levels, key, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	if ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+}
+
+// Release drops the snapshot's table references. It is safe to call more
+// than once.
+func (s *Snapshot) Release() {
+	s.db.snapMu.Lock()
+	delete(s.db.snapshots, s)
+	s.db.snapMu.Unlock()
+
+	s.release(false)
+}
+
+func (s *Snapshot) release(forced bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return false
+	}
+	s.released = true
+	s.forced = forced
+	for _, level := range s.levels {
+		for _, sst := range level {
+			sst.unref()
+		}
+	}
+	s.levels = nil
+	s.mems = nil
+	return true
+}
+
+// SnapshotStats returns the number of live snapshots and how many have been
+// force-released for exceeding Options.MaxSnapshotAge.
+func (db *DB) SnapshotStats() SnapshotStats {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	return SnapshotStats{
+		Live:          len(db.snapshots),
+		ForceReleased: db.forceReleased.Load(),
+	}
+}
+
+// reapSnapshots force-releases every snapshot older than maxAge.
+func (db *DB) reapSnapshots(maxAge time.Duration) {
+	now := time.Now()
+
+	db.snapMu.Lock()
+	var stale []*Snapshot
+	for snap := range db.snapshots {
+		if now.Sub(snap.createdAt) > maxAge {
+			stale = append(stale, snap)
+			delete(db.snapshots, snap)
+		}
+	}
+	db.snapMu.Unlock()
+
+	for _, snap := range stale {
+		if !snap.release(true) {
+			continue
+		}
+		age := now.Sub(snap.createdAt)
+		db.forceReleased.Add(1)
+		log.Printf("Force-released snapshot at sequence %d after %v", snap.seq, age)
+		if db.opts.OnSnapshotForceReleased != nil {
+			db.opts.OnSnapshotForceReleased(snap.seq, age)
+		}
+	}
+}
+
+func (db *DB) snapshotReaper(maxAge time.Duration) {
+	defer db.bgWG.Done()
+
+	interval := maxAge / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.reapSnapshots(maxAge)
+		}
+	}
+}
+
+// releaseAllSnapshots is called by Close.
+func (db *DB) releaseAllSnapshots() {
+	db.snapMu.Lock()
+	snaps := db.snapshots
+	db.snapshots = nil
+	db.snapMu.Unlock()
+
+	for snap := range snaps {
+		snap.release(false)
+	}
+}
@@ -0,0 +1,158 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIsolationAndPinning(t *testing.T) {
+	dir := "testdata/snapshot"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	require.NoError(t, store.Put("k", "v1"))
+	require.NoError(t, store.Flush())
+	tablesBefore, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+
+	snap := store.GetSnapshot()
+	require.NoError(t, store.Put("k", "v2"))
+
+	// Enough flushes to compact the snapshot's table away.
+	for i := 0; i < 4; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("fill%d", i), "x"))
+		require.NoError(t, store.Flush())
+	}
+
+	got, err := snap.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", got)
+	got, err = store.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", got)
+
+	for _, path := range tablesBefore {
+		assert.FileExists(t, path, "pinned table must survive compaction")
+	}
+	snap.Release()
+	for _, path := range tablesBefore {
+		assert.NoFileExists(t, path, "released table must be deleted")
+	}
+	_, err = snap.Get("k")
+	assert.Error(t, err)
+}
+
+func TestSnapshotReadsMemTablesWhileWritesContinue(t *testing.T) {
+	dir := "testdata/snapshot_memtable"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		require.NoError(t, store.Put(key, "old"))
+		want[key] = "old"
+	}
+
+	snap := store.GetSnapshot()
+	defer snap.Release()
+	it := snap.NewIterator()
+	defer it.Close()
+
+	// Overwrites, deletes and new keys land in the memtable the snapshot
+	// reads, and a flush moves them on, while it iterates.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			var err error
+			switch i % 3 {
+			case 0:
+				err = store.Put(key, "new")
+			case 1:
+				err = store.Delete(key)
+			default:
+				err = store.Put(key+"-added", "new")
+			}
+			if err == nil && i == 100 {
+				err = store.Flush()
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	got := make(map[string]string)
+	for it.First(); it.Valid(); it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, <-done)
+	assert.Equal(t, want, got)
+
+	value, err := snap.Get("key001")
+	require.NoError(t, err)
+	assert.Equal(t, "old", value)
+	_, err = snap.Get("key002-added")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	value, err = store.Get("key000")
+	require.NoError(t, err)
+	assert.Equal(t, "new", value)
+}
+
+func TestSnapshotMaxAgeForcesRelease(t *testing.T) {
+	dir := "testdata/snapshot_ttl"
+	_ = os.RemoveAll(dir)
+
+	var callbacks atomic.Int32
+	store, err := db.Open(dir, &db.Options{
+		CreateIfMissing: true,
+		MaxSnapshotAge:  20 * time.Millisecond,
+		OnSnapshotForceReleased: func(seq uint64, age time.Duration) {
+			callbacks.Add(1)
+		},
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	require.NoError(t, store.Put("k", "v"))
+	snap := store.GetSnapshot()
+	assert.Equal(t, 1, store.SnapshotStats().Live)
+
+	assert.Eventually(t, func() bool {
+		return store.SnapshotStats().ForceReleased == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), callbacks.Load())
+	assert.Equal(t, 0, store.SnapshotStats().Live)
+
+	_, err = snap.Get("k")
+	assert.ErrorContains(t, err, "force-released")
+}
@@ -2,14 +2,32 @@ package db
 
 import (
 	"bufio"
+	"container/list"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
+	"log"
 	"sort"
 	"strings"
+	"sync/atomic"
 
-	"github.com/edsrzf/mmap-go"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ReadMode selects how SSTables are read.
+type ReadMode int
+
+const (
+	// ReadModeMmap maps each table into memory and reads it from the
+	// mapping, leaving caching to the page cache.
+	ReadModeMmap ReadMode = iota
+
+	// ReadModePread reads each block, index partition and record with a
+	// positioned read into a fresh buffer, for filesystems and containers
+	// where memory mapping is slow, unsupported or counted against a
+	// memory limit.
+	ReadModePread
 )
 
 type indexEntry struct {
@@ -17,12 +35,236 @@ type indexEntry struct {
 	offset int64
 }
 
+// Tables written before the footer was versioned end with a bare 16-byte
+// footer holding the index and filter offsets. Versioned tables end with the
+// offsets of their sections, the compression type, the format version, and a
+// magic number:
+//
+//	v1: [index u64][filter u64][compression u32][version u32][magic u64]
+//	v2: [index u64][filter u64][blocks u64][compression u32][version u32][magic u64]
+//	v3: [index u64][filter u64][blocks u64][properties u64][compression u32][version u32][magic u64]
+//	v4: [index u64][filter u64][blocks u64][properties u64][top index u64][compression u32][version u32][magic u64]
+//	v6: [index u64][filter u64][blocks u64][properties u64][top index u64][metadata crc u32][compression u32][version u32][magic u64]
+//	v7: same as v6
+//
+// From v2 on, data records are grouped into blocks of about tableBlockSize
+// bytes, each followed by a CRC32C trailer, and the handles of all blocks are
+// stored after the index. v3 adds a properties section after the handles. v4
+// partitions the index into pieces of about tableBlockSize bytes and adds a
+// top-level index of the partitions between them and the block handles; only
+// the top-level index is kept in memory. v5 keeps the v4 footer but stores
+// data blocks and index partitions in the prefix-compressed layout described
+// in block.go, with one index entry per data block. v6 adds the CRC32C of
+// everything from the filter up to the properties, which carry their own:
+// the filter, the index partitions, the top-level index and the block
+// handles. A damaged byte there would otherwise send reads to the wrong
+// offsets, so Load rejects the table instead. v7 follows the bloom filter's
+// m and k with its format version and hash scheme, both u32, so the filter
+// can change without making older tables unreadable.
+const (
+	legacyFooterSize   = 16
+	tableFooterSizeV1  = 32
+	tableMagic         = uint64(0x4d4c44425353544d) // "MTSSBDLM" read little-endian
+	tableFormatVersion = uint32(7)
+
+	// blockFormatVersion is the first version whose data blocks and index
+	// partitions are prefix-compressed blocks, indexed per block rather
+	// than per key.
+	blockFormatVersion = uint32(5)
+
+	// metaChecksumVersion is the first version whose footer holds the
+	// checksum of the filter and index sections.
+	metaChecksumVersion = uint32(6)
+
+	// filterVersionFormat is the first version recording the bloom
+	// filter's format version and hash scheme.
+	filterVersionFormat = uint32(7)
+
+	tableBlockSize   = 4096
+	blockTrailerSize = 4
+	blockHandleSize  = 12
+)
+
+// maxFooterOffsets is the most section offsets a footer holds.
+const maxFooterOffsets = 5
+
+// footerOffsetCount is the number of section offsets in each footer version.
+var footerOffsetCount = map[uint32]int{1: 2, 2: 3, 3: 4, 4: 5, 5: 5, 6: 5, 7: 5}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type tableFooter struct {
+	indexOffset  int64
+	filterOffset int64
+	blocksOffset int64 // zero for tables without data blocks
+	propsOffset  int64 // zero for tables without properties
+	topOffset    int64 // zero for tables with a single-level index
+	metaChecksum uint32
+	compression  CompressionType
+	version      uint32
+	size         int
+}
+
+// footerSize returns the size of a footer of the given version, which
+// holds the given number of offsets.
+func footerSize(version uint32, offsets int) int {
+	if version >= metaChecksumVersion {
+		return 8*offsets + 20
+	}
+	return 8*offsets + 16
+}
+
+func (f tableFooter) encode() []byte {
+	offsets := []int64{f.indexOffset, f.filterOffset, f.blocksOffset, f.propsOffset, f.topOffset}
+	buf := make([]byte, footerSize(tableFormatVersion, len(offsets)))
+	for i, off := range offsets {
+		binary.LittleEndian.PutUint64(buf[8*i:], uint64(off))
+	}
+	tail := buf[8*len(offsets):]
+	binary.LittleEndian.PutUint32(tail[0:4], f.metaChecksum)
+	binary.LittleEndian.PutUint32(tail[4:8], uint32(f.compression))
+	binary.LittleEndian.PutUint32(tail[8:12], tableFormatVersion)
+	binary.LittleEndian.PutUint64(tail[12:20], tableMagic)
+	return buf
+}
+
+// parseFooter decodes the footer at the end of data, accepting the legacy
+// layout and every versioned one.
+func parseFooter(data []byte) (tableFooter, error) {
+	if len(data) >= tableFooterSizeV1 && binary.LittleEndian.Uint64(data[len(data)-8:]) == tableMagic {
+		version := binary.LittleEndian.Uint32(data[len(data)-12:])
+		n, ok := footerOffsetCount[version]
+		if !ok {
+			return tableFooter{}, fmt.Errorf("unsupported SSTable format version %d", version)
+		}
+		size := footerSize(version, n)
+		if len(data) < size {
+			return tableFooter{}, fmt.Errorf("file too small for a v%d footer", version)
+		}
+
+		start := len(data) - size
+		var offsets [maxFooterOffsets]int64
+		for i := 0; i < n; i++ {
+			offsets[i] = int64(binary.LittleEndian.Uint64(data[start+8*i:]))
+		}
+		var checksum uint32
+		if version >= metaChecksumVersion {
+			checksum = binary.LittleEndian.Uint32(data[start+8*n:])
+			start += 4
+		}
+		return tableFooter{
+			indexOffset:  offsets[0],
+			filterOffset: offsets[1],
+			blocksOffset: offsets[2],
+			propsOffset:  offsets[3],
+			topOffset:    offsets[4],
+			metaChecksum: checksum,
+			compression:  CompressionType(binary.LittleEndian.Uint32(data[start+8*n:])),
+			version:      version,
+			size:         size,
+		}, nil
+	}
+
+	if len(data) < legacyFooterSize {
+		return tableFooter{}, fmt.Errorf("file too small for a footer")
+	}
+	start := len(data) - legacyFooterSize
+	return tableFooter{
+		indexOffset:  int64(binary.LittleEndian.Uint64(data[start : start+8])),
+		filterOffset: int64(binary.LittleEndian.Uint64(data[start+8 : start+16])),
+		compression:  NoCompression,
+		size:         legacyFooterSize,
+	}, nil
+}
+
+// blockHandle locates one data block; length excludes the CRC trailer.
+type blockHandle struct {
+	offset int64
+	length uint32
+}
+
+// indexPartition locates one piece of a partitioned index. lastKey is the
+// largest key the partition indexes.
+type indexPartition struct {
+	lastKey string
+	offset  int64
+	length  uint32
+}
+
 type SSTable struct {
-	path   string
-	index  []indexEntry
-	filter *BloomFilter
-	file   *os.File
-	mmap   mmap.MMap
+	path string
+	// fs holds the table's file; nil means the OS filesystem.
+	fs FileSystem
+	// index holds every key of tables with a single-level index. Tables
+	// with a partitioned index keep only the partitions' handles and read
+	// a partition from the mapped file when a lookup needs it.
+	index      []indexEntry
+	partitions []indexPartition
+	pinned     atomic.Pointer[[]*block] // decoded partitions; see pinIndex
+	filter     *BloomFilter
+	format     uint32 // footer version; zero for legacy tables
+	file       File
+	mmap       []byte       // nil when pread is set
+	unmap      func() error // nil unless mmap is an OS memory mapping
+	pread      bool         // read with ReadAt rather than a mapping
+
+	// cache, if set, may close file and mmap while the table is unpinned;
+	// see tableCache. elem, evicted and pins are guarded by cache.mu.
+	cache   *tableCache
+	elem    *list.Element
+	evicted bool
+	pins    int
+
+	// compression is the codec applied to values; Write uses it for new
+	// tables and Load reads it from the footer.
+	compression CompressionType
+	// dictSize, if positive, has Write train a compression dictionary of
+	// up to that many bytes; dict decodes values compressed against the
+	// dictionary a loaded table has.
+	dictSize int
+	dict     *zstd.Decoder
+
+	// recordChecksums tables follow each stored value with the CRC32C of
+	// the record; see checkRecord.
+	recordChecksums bool
+
+	// blocks lists the checksummed data blocks, in file order. Tables
+	// written before blocks existed have none and are read unverified.
+	blocks          []blockHandle
+	verifyChecksums bool
+
+	// separated tables store values in the form described in vlog.go;
+	// vlog resolves their pointers.
+	separated bool
+	vlog      *valueLog
+
+	// limiter, if set, throttles the writes of new tables.
+	limiter *rateLimiter
+
+	// level is the level Write records in the properties of a new table.
+	level int
+	props TableProperties
+	size  int64
+
+	// smallestSeq and largestSeq span the sequence numbers of the writes
+	// the table holds, as recorded in the MANIFEST; both are zero when
+	// that is not known, as for ingested tables.
+	smallestSeq uint64
+	largestSeq  uint64
+
+	// fpRate is the bloom filter false-positive rate used by Write; zero
+	// means defaultBloomFPRate. A positive bitsPerKey sizes the filter
+	// instead.
+	fpRate     float64
+	bitsPerKey int
+	stats      tableStats
+	priority   atomic.Int32
+
+	// refs counts the owners of the open table: the tree itself plus every
+	// snapshot and version that can still read it. obsolete tables are removed from disk
+	// when the last reference is dropped.
+	refs     atomic.Int32
+	obsolete atomic.Bool
 }
 
 func (s *SSTable) LinearSearch(key string) (string, bool) {
@@ -30,7 +272,7 @@ func (s *SSTable) LinearSearch(key string) (string, bool) {
 		return "", false
 	}
 
-	file, err := os.Open(s.path)
+	file, err := fsOrDefault(s.fs).Open(s.path)
 	if err != nil {
 		return "", false
 	}
@@ -51,187 +293,665 @@ func (s *SSTable) LinearSearch(key string) (string, bool) {
 }
 
 func (s *SSTable) BinarySearch(key string) (string, bool) {
-	if s.file == nil {
-		return "", false
+	v, res, err := s.lookup(key)
+	return v, err == nil && res == lookupFound
+}
+
+// lookup finds key in the table. A non-nil error is a *CorruptionError for
+// a record that failed its checksum or could not be decoded.
+func (s *SSTable) lookup(key string) (string, lookupResult, error) {
+	v, res, err := s.lookupRaw(key)
+	if err != nil || res != lookupFound || !s.separated {
+		return v, res, err
 	}
+	if v, err = s.vlog.resolve(v); err != nil {
+		return "", lookupMissed, s.corruption(0, fmt.Sprintf("value of %q: %v", key, err))
+	}
+	return v, lookupFound, nil
+}
+
+// lookupStored is lookup without resolving value log pointers; the value is
+// in stored form even for tables without separated values.
+func (s *SSTable) lookupStored(key string) (string, lookupResult, error) {
+	v, res, err := s.lookupRaw(key)
+	if err == nil && res == lookupFound && !s.separated {
+		v = encodeInline(v)
+	}
+	return v, res, err
+}
 
+// lookupRaw returns the value exactly as the table stores it.
+func (s *SSTable) lookupRaw(key string) (string, lookupResult, error) {
 	if s.filter != nil && !s.filter.MayContain(key) {
-		return "", false
+		return "", lookupFiltered, nil
+	}
+
+	if err := s.acquire(); err != nil {
+		return "", lookupMissed, err
+	}
+	defer s.release()
+	if s.file == nil {
+		return "", lookupMissed, nil
+	}
+
+	if s.format >= blockFormatVersion {
+		return s.lookupBlock(key)
+	}
+
+	index := s.index
+	if len(s.partitions) > 0 {
+		p := sort.Search(len(s.partitions), func(i int) bool {
+			return s.partitions[i].lastKey >= key
+		})
+		if p == len(s.partitions) {
+			return "", lookupMissed, nil
+		}
+		var err error
+		if index, err = s.readPartition(s.partitions[p]); err != nil {
+			return "", lookupMissed, err
+		}
 	}
 
-	i := sort.Search(len(s.index), func(i int) bool {
-		return s.index[i].key >= key
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].key >= key
 	})
-	if i == len(s.index) || s.index[i].key != key {
-		return "", false
+	if i == len(index) || index[i].key != key {
+		return "", lookupMissed, nil
 	}
-	off := s.index[i].offset
+	off := index[i].offset
 
-	k, v, ok := s.readKVFromMmap(off)
-	if !ok || k != key {
-		return "", false
+	k, v, err := s.readKVFromMmap(off)
+	if err != nil {
+		return "", lookupMissed, err
+	}
+	if k != key {
+		return "", lookupMissed, s.corruption(off, fmt.Sprintf("index entry for %q points at key %q", key, k))
 	}
-	return v, true
+	return v, lookupFound, nil
 }
 
+// Write writes kvs, which must be sorted by key, as a new table at s.path.
 func (s *SSTable) Write(kvs [][2]string) error {
-	file, err := os.Create(s.path)
+	b, err := newTableBuilder(s)
 	if err != nil {
-		return fmt.Errorf("failed to create SSTable: %w", err)
+		return err
 	}
-	defer file.Close()
+	for _, kv := range kvs {
+		if err := b.add(kv[0], kv[1]); err != nil {
+			b.Abandon()
+			return err
+		}
+	}
+	return b.Finish()
+}
 
-	s.filter = NewBloomFilter(uint(len(kvs)), 0.01)
+func (s *SSTable) Load() error {
+	if err := s.openFile(); err != nil {
+		return err
+	}
 
-	s.index = nil
+	stat, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file stats: %w", err)
+	}
+	size := stat.Size()
+	s.size = size
+	if size < legacyFooterSize {
+		return s.corruption(0, "file is too small")
+	}
 
-	for _, kv := range kvs {
-		offset, err := file.Seek(0, io.SeekCurrent)
+	// tail holds the file from base on: all of it when mapped, and with
+	// pread, everything from the filter on, read once the footer says
+	// where that starts.
+	tail, base := s.mmap, int64(0)
+	if s.pread {
+		n := min(size, int64(footerSize(tableFormatVersion, maxFooterOffsets)))
+		if tail, err = s.section(size-n, n); err != nil {
+			return err
+		}
+		base = size - n
+	}
+	footer, err := parseFooter(tail)
+	if err != nil {
+		return s.corruption(size, fmt.Sprintf("unreadable footer: %v", err))
+	}
+	indexOffset := footer.indexOffset
+	filterOffset := footer.filterOffset
+
+	footerPos := size - int64(footer.size)
+	if indexOffset < 0 || filterOffset < 0 {
+		return s.corruption(footerPos, "negative section offset in footer")
+	}
+	if indexOffset > footerPos || filterOffset > footerPos {
+		return s.corruption(footerPos, "section offset points beyond the footer")
+	}
+	if filterOffset >= indexOffset {
+		return s.corruption(footerPos, "filter section does not precede the index")
+	}
+	if s.pread {
+		if tail, err = s.section(filterOffset, size-filterOffset); err != nil {
+			return err
+		}
+		base = filterOffset
+	}
+	// at converts a file offset at or after base to an index into tail.
+	at := func(off int64) int { return int(off - base) }
+
+	// Sections after the index, when present, are the block handles and
+	// then the properties; each runs up to the next.
+	propsEnd := footerPos
+	blocksEnd := footerPos
+	if footer.propsOffset > 0 {
+		if footer.propsOffset < indexOffset || footer.propsOffset > footerPos {
+			return s.corruption(footer.propsOffset, "invalid properties section")
+		}
+		blocksEnd = footer.propsOffset
+	}
+	if footer.version >= metaChecksumVersion {
+		if got := crc32.Checksum(tail[at(filterOffset):at(blocksEnd)], castagnoli); got != footer.metaChecksum {
+			return s.corruption(filterOffset, fmt.Sprintf("filter and index checksum mismatch (got %08x, want %08x)", got, footer.metaChecksum))
+		}
+	}
+	indexEnd := blocksEnd
+	var blocks []blockHandle
+	if footer.blocksOffset > 0 {
+		if footer.blocksOffset < indexOffset || footer.blocksOffset > blocksEnd ||
+			(blocksEnd-footer.blocksOffset)%blockHandleSize != 0 {
+			return s.corruption(footer.blocksOffset, "invalid block handle section")
+		}
+		indexEnd = footer.blocksOffset
+		for off := indexEnd; off < blocksEnd; off += blockHandleSize {
+			b := blockHandle{
+				offset: int64(binary.LittleEndian.Uint64(tail[at(off) : at(off)+8])),
+				length: binary.LittleEndian.Uint32(tail[at(off)+8 : at(off)+12]),
+			}
+			if b.offset < 0 || b.offset+int64(b.length)+blockTrailerSize > filterOffset {
+				return s.corruption(off, "block handle beyond the data section")
+			}
+			blocks = append(blocks, b)
+		}
+	}
+
+	bits, offset, err := readBytesFromMmap(tail, at(filterOffset))
+	if err != nil {
+		return s.corruption(filterOffset, fmt.Sprintf("unreadable bloom filter: %v", err))
+	}
+
+	if offset+16 > len(tail) {
+		return s.corruption(filterOffset, "truncated bloom filter metadata")
+	}
+
+	m64 := binary.LittleEndian.Uint64(tail[offset : offset+8])
+	k64 := binary.LittleEndian.Uint64(tail[offset+8 : offset+16])
+	if k64 > maxBloomHashes || (k64 > 0 && (m64 == 0 || m64 > uint64(len(bits))*8)) {
+		return s.corruption(filterOffset, fmt.Sprintf("invalid bloom filter (m=%d, k=%d, %d bytes)", m64, k64, len(bits)))
+	}
+	filter := &BloomFilter{bitset: bits, m: uint(m64), k: uint(k64), scheme: bloomHashFNV1a}
+	if footer.version >= filterVersionFormat {
+		if offset+24 > len(tail) {
+			return s.corruption(filterOffset, "truncated bloom filter metadata")
+		}
+		version := binary.LittleEndian.Uint32(tail[offset+16 : offset+20])
+		filter.scheme = binary.LittleEndian.Uint32(tail[offset+20 : offset+24])
+		if version != bloomFilterVersion || !knownBloomHash(filter.scheme) {
+			// The keys are all still readable; only the filter's shortcut
+			// is lost.
+			log.Printf("Warning: ignoring bloom filter of %s with unknown format %d or hash scheme %d", s.path, version, filter.scheme)
+			filter = nil
+		}
+	}
+
+	var index []indexEntry
+	var partitions []indexPartition
+	if footer.topOffset > 0 {
+		if footer.topOffset < indexOffset || footer.topOffset > indexEnd {
+			return s.corruption(footer.topOffset, "invalid top-level index")
+		}
+		partitions, err = decodeTopIndex(tail[at(footer.topOffset):at(indexEnd)], indexOffset, footer.topOffset)
+		if err != nil {
+			return s.corruption(footer.topOffset, fmt.Sprintf("unreadable top-level index: %v", err))
+		}
+	} else {
+		index = decodeIndexEntries(tail[:at(indexEnd)], at(indexOffset))
+	}
+
+	var props TableProperties
+	if footer.propsOffset > 0 {
+		props, err = decodeTableProperties(tail[at(footer.propsOffset):at(propsEnd)])
 		if err != nil {
-			return fmt.Errorf("failed to seek in SSTable file: %w", err)
+			return s.corruption(footer.propsOffset, fmt.Sprintf("unreadable properties: %v", err))
+		}
+	} else {
+		// Tables without properties predate partitioned indexes, so the
+		// whole index is in memory.
+		props = TableProperties{
+			NumEntries: uint64(len(index)),
+			DataSize:   uint64(filterOffset),
+			Level:      -1,
 		}
-		if err := writeString(file, kv[0]); err != nil {
-			return fmt.Errorf("failed to write key: %w", err)
+		if len(index) > 0 {
+			props.SmallestKey = index[0].key
+			props.LargestKey = index[len(index)-1].key
 		}
-		if err := writeString(file, kv[1]); err != nil {
-			return fmt.Errorf("failed to write value: %w", err)
+	}
+
+	s.filter = filter
+	s.index = index
+	s.partitions = partitions
+	s.format = footer.version
+	s.props = props
+	s.separated = props.SeparatedValues
+	s.recordChecksums = props.RecordChecksums
+	s.compression = footer.compression
+	if props.CompressionDict != nil {
+		if s.dict, err = newDictDecoder(props.CompressionDict); err != nil {
+			return s.corruption(footer.propsOffset, err.Error())
 		}
+	}
+	s.blocks = blocks
+	s.refs.Store(1)
+	if s.cache != nil {
+		s.cache.add(s)
+	}
 
-		s.filter.Add(kv[0])
+	return nil
+}
 
-		s.index = append(s.index, indexEntry{
-			key:    kv[0],
-			offset: offset,
+// decodeIndexEntries reads [key][offset u64] index entries from data
+// starting at start, stopping at the end of data or the first entry that
+// does not parse.
+func decodeIndexEntries(data []byte, start int) []indexEntry {
+	var index []indexEntry
+	current := start
+	for current < len(data) {
+		key, next, err := readStringFromMmap(data, current)
+		if err != nil || next+8 > len(data) {
+			break
+		}
+		index = append(index, indexEntry{
+			key:    key,
+			offset: int64(binary.LittleEndian.Uint64(data[next : next+8])),
 		})
+		current = next + 8
 	}
+	return index
+}
 
-	filterOffset, err := file.Seek(0, io.SeekCurrent)
+// decodeTopIndex reads the partition handles of a partitioned index. Every
+// partition must lie within [indexStart, indexEnd).
+func decodeTopIndex(data []byte, indexStart, indexEnd int64) ([]indexPartition, error) {
+	var partitions []indexPartition
+	current := 0
+	for current < len(data) {
+		key, next, err := readStringFromMmap(data, current)
+		if err != nil || next+12 > len(data) {
+			return nil, fmt.Errorf("truncated partition handle")
+		}
+		p := indexPartition{
+			lastKey: key,
+			offset:  int64(binary.LittleEndian.Uint64(data[next : next+8])),
+			length:  binary.LittleEndian.Uint32(data[next+8 : next+12]),
+		}
+		if p.offset < indexStart || p.offset+int64(p.length) > indexEnd {
+			return nil, fmt.Errorf("partition for %q lies outside the index", key)
+		}
+		partitions = append(partitions, p)
+		current = next + 12
+	}
+	return partitions, nil
+}
+
+// readPartition decodes one partition of a per-key partitioned index, as
+// written by format v4.
+func (s *SSTable) readPartition(p indexPartition) ([]indexEntry, error) {
+	data, err := s.section(p.offset, int64(p.length))
 	if err != nil {
-		return fmt.Errorf("failed to seek to filter offset: %w", err)
+		return nil, err
 	}
-	if err := writeBytes(file, s.filter.bitset); err != nil {
-		return fmt.Errorf("failed to write bloom filter: %w", err)
+	entries := decodeIndexEntries(data, 0)
+	if len(entries) == 0 || entries[len(entries)-1].key != p.lastKey {
+		return nil, s.corruption(p.offset, fmt.Sprintf("index partition ending at %q is damaged", p.lastKey))
 	}
+	return entries, nil
+}
 
-	var m64, k64 uint64 = uint64(s.filter.m), uint64(s.filter.k)
-	if err := binary.Write(file, binary.LittleEndian, m64); err != nil {
-		return fmt.Errorf("failed to write bloom filter size: %w", err)
+// lookupBlock finds key in a table with prefix-compressed blocks.
+func (s *SSTable) lookupBlock(key string) (string, lookupResult, error) {
+	v, off, res, err := s.seekValue(key)
+	if err != nil || res != lookupFound {
+		return "", res, err
 	}
-	if err := binary.Write(file, binary.LittleEndian, k64); err != nil {
-		return fmt.Errorf("failed to write bloom filter hash count: %w", err)
+	value, err := s.decodeValue(key, string(v))
+	if err != nil {
+		return "", lookupMissed, s.corruption(off, err.Error())
 	}
+	return value, lookupFound, nil
+}
 
-	indexOffset, err := file.Seek(0, io.SeekCurrent)
+// seekValue finds key in a block-format table and returns its value as
+// stored, still compressed, along with the offset of the data block holding
+// it. The value may alias the table's mapping, so s must stay pinned while
+// it is used.
+func (s *SSTable) seekValue(key string) ([]byte, int64, lookupResult, error) {
+	p := sort.Search(len(s.partitions), func(i int) bool {
+		return s.partitions[i].lastKey >= key
+	})
+	if p == len(s.partitions) {
+		return nil, 0, lookupMissed, nil
+	}
+	part := s.partitions[p]
+	index, err := s.indexBlock(p)
 	if err != nil {
-		return fmt.Errorf("failed to seek to index offset: %w", err)
+		return nil, 0, lookupMissed, err
 	}
-	for _, entry := range s.index {
-		if err := writeString(file, entry.key); err != nil {
-			return fmt.Errorf("failed to write index key: %w", err)
-		}
-		if err := binary.Write(file, binary.LittleEndian, entry.offset); err != nil {
-			return fmt.Errorf("failed to write index offset: %w", err)
-		}
+	_, encoded, found, err := index.seek(key)
+	if err != nil {
+		return nil, 0, lookupMissed, s.corruption(part.offset, err.Error())
+	}
+	if !found {
+		return nil, 0, lookupMissed, nil
+	}
+	handle, err := decodeBlockHandle(encoded)
+	if err != nil {
+		return nil, 0, lookupMissed, s.corruption(part.offset, err.Error())
 	}
 
-	if err := binary.Write(file, binary.LittleEndian, indexOffset); err != nil {
-		return fmt.Errorf("failed to write footer: %w", err)
+	data, err := s.readBlock(handle)
+	if err != nil {
+		return nil, 0, lookupMissed, err
+	}
+	k, v, found, err := data.seek(key)
+	if err != nil {
+		return nil, 0, lookupMissed, s.corruption(handle.offset, err.Error())
 	}
-	if err := binary.Write(file, binary.LittleEndian, filterOffset); err != nil {
-		return fmt.Errorf("failed to write filter offset: %w", err)
+	if !found || k != key {
+		return nil, 0, lookupMissed, nil
 	}
+	return v, handle.offset, lookupFound, nil
+}
 
-	return nil
+// readBlock returns the data block at h, verifying its checksum when
+// verifyChecksums is set.
+func (s *SSTable) readBlock(h blockHandle) (*block, error) {
+	data, err := s.section(h.offset, int64(h.length)+blockTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeBlock(h, data)
 }
 
-func (s *SSTable) Load() error {
-	file, err := os.Open(s.path)
+// decodeBlock decodes the data block at h, already read with its trailer as
+// data, verifying its checksum when verifyChecksums is set.
+func (s *SSTable) decodeBlock(h blockHandle, data []byte) (*block, error) {
+	if s.verifyChecksums {
+		if err := s.checkBlock(h, data); err != nil {
+			return nil, err
+		}
+	}
+	b, err := newBlock(data[:h.length])
 	if err != nil {
-		return fmt.Errorf("failed to open SSTable: %w", err)
+		return nil, s.corruption(h.offset, err.Error())
 	}
-	s.file = file
+	return b, nil
+}
 
-	mmapData, err := mmap.Map(file, mmap.RDONLY, 0)
+// readIndexBlock returns the index partition p of a block-format table.
+func (s *SSTable) readIndexBlock(p indexPartition) (*block, error) {
+	data, err := s.section(p.offset, int64(p.length))
 	if err != nil {
-		return fmt.Errorf("failed to mmap SSTable: %w", err)
+		return nil, err
 	}
-	s.mmap = mmapData
+	b, err := newBlock(data)
+	if err != nil {
+		return nil, s.corruption(p.offset, err.Error())
+	}
+	return b, nil
+}
 
-	stat, err := file.Stat()
+// section returns the n bytes of the table at off: part of the mapping, or
+// with pread, read from the file into a new buffer.
+func (s *SSTable) section(off, n int64) ([]byte, error) {
+	if s.file == nil {
+		return nil, s.corruption(off, "table is not loaded")
+	}
+	if off < 0 || n < 0 || off+n > s.size {
+		return nil, s.corruption(off, fmt.Sprintf("%d bytes at offset %d lie beyond the file", n, off))
+	}
+	if !s.pread {
+		return s.mmap[off : off+n], nil
+	}
+	buf := make([]byte, n)
+	if _, err := s.file.ReadAt(buf, off); err != nil && !(err == io.EOF && len(buf) == 0) {
+		return nil, fmt.Errorf("failed to read SSTable %s at offset %d: %w", s.path, off, err)
+	}
+	return buf, nil
+}
+
+// readStringAt reads the length-prefixed string at off, returning it and
+// the offset after it.
+func (s *SSTable) readStringAt(off int64) (string, int64, error) {
+	prefix, err := s.section(off, 4)
 	if err != nil {
-		return fmt.Errorf("failed to get file stats: %w", err)
+		return "", 0, err
 	}
-	if stat.Size() < 16 {
-		return fmt.Errorf("SSTable file is too small: %s", s.path)
+	n := int64(binary.LittleEndian.Uint32(prefix))
+	data, err := s.section(off+4, n)
+	if err != nil {
+		return "", 0, err
 	}
+	return string(data), off + 4 + n, nil
+}
 
-	footerStart := len(s.mmap) - 16
-	indexOffset := int64(binary.LittleEndian.Uint64(s.mmap[footerStart : footerStart+8]))
-	filterOffset := int64(binary.LittleEndian.Uint64(s.mmap[footerStart+8 : footerStart+16]))
+// openFile opens the table's file and, unless it is read with pread, maps
+// it into memory.
+func (s *SSTable) openFile() error {
+	file, err := fsOrDefault(s.fs).Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open SSTable: %w", err)
+	}
+	s.file = file
+	if s.pread {
+		return nil
+	}
+	data, unmap, err := mapFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to mmap SSTable: %w", err)
+	}
+	s.mmap, s.unmap = data, unmap
+	return nil
+}
 
-	fileSize := stat.Size()
-	footerPos := fileSize - 16
-	if indexOffset < 0 || filterOffset < 0 {
-		return fmt.Errorf("invalid negative offset in SSTable: %s", s.path)
+// seekBlock returns the index in s.blocks of the block that would hold
+// target: the last block whose first key is <= target.
+func (s *SSTable) seekBlock(target string) (int, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
 	}
-	if indexOffset > footerPos || filterOffset > footerPos {
-		return fmt.Errorf("offset points beyond footer region in SSTable: %s", s.path)
+	defer s.release()
+	var readErr error
+	i := sort.Search(len(s.blocks), func(i int) bool {
+		b, err := s.readBlock(s.blocks[i])
+		if err == nil {
+			var first string
+			if first, _, _, err = b.entryAt(0, ""); err == nil {
+				return first > target
+			}
+			err = s.corruption(s.blocks[i].offset, err.Error())
+		}
+		readErr = err
+		return true
+	})
+	if i > 0 {
+		i--
 	}
-	if filterOffset >= indexOffset {
-		return fmt.Errorf("filterOffset must be < indexOffset in SSTable: %s", s.path)
+	return i, readErr
+}
+
+// blockEntries decodes every record of the data block at h.
+func (s *SSTable) blockEntries(h blockHandle) ([][2]string, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	b, err := s.readBlock(h)
+	if err != nil {
+		return nil, err
 	}
+	return s.decodeEntries(h, b)
+}
 
-	bits, offset, err := readBytesFromMmap(s.mmap, int(filterOffset))
+// decodeEntries decodes every record of b, the data block at h.
+func (s *SSTable) decodeEntries(h blockHandle, b *block) ([][2]string, error) {
+	var kvs [][2]string
+	err := b.forEach(func(key string, value []byte) error {
+		v, err := s.decodeValue(key, string(value))
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, [2]string{key, v})
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read bloom bits: %w", err)
+		return nil, s.corruption(h.offset, err.Error())
 	}
+	return kvs, nil
+}
 
-	if offset+16 > len(s.mmap) {
-		return fmt.Errorf("insufficient data for bloom filter metadata")
+// entries returns every record of the table in key order, with value log
+// pointers resolved.
+func (s *SSTable) entries() ([][2]string, error) {
+	kvs, err := s.rawEntries()
+	if err != nil || !s.separated {
+		return kvs, err
+	}
+	for i, kv := range kvs {
+		if kvs[i][1], err = s.vlog.resolve(kv[1]); err != nil {
+			return nil, s.corruption(0, fmt.Sprintf("value of %q: %v", kv[0], err))
+		}
 	}
+	return kvs, nil
+}
 
-	m64 := binary.LittleEndian.Uint64(s.mmap[offset : offset+8])
-	k64 := binary.LittleEndian.Uint64(s.mmap[offset+8 : offset+16])
-	filter := &BloomFilter{bitset: bits, m: uint(m64), k: uint(k64)}
+// rawEntries returns every record exactly as the table stores it.
+func (s *SSTable) rawEntries() ([][2]string, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	var kvs [][2]string
+	if s.format >= blockFormatVersion {
+		for _, h := range s.blocks {
+			block, err := s.blockEntries(h)
+			if err != nil {
+				return nil, err
+			}
+			kvs = append(kvs, block...)
+		}
+		return kvs, nil
+	}
 
-	var index []indexEntry
-	currentOffset := int(indexOffset)
+	index, err := s.indexEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range index {
+		key, value, err := s.readKVFromMmap(entry.offset)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, [2]string{key, value})
+	}
+	return kvs, nil
+}
 
-	for currentOffset < len(s.mmap)-16 {
-		key, newOffset, err := readStringFromMmap(s.mmap, currentOffset)
+// indexEntries returns the whole per-key index of a table older than
+// blockFormatVersion, reading every partition of a partitioned index.
+func (s *SSTable) indexEntries() ([]indexEntry, error) {
+	if len(s.partitions) == 0 {
+		return s.index, nil
+	}
+	entries := make([]indexEntry, 0, s.props.NumEntries)
+	for _, p := range s.partitions {
+		part, err := s.readPartition(p)
 		if err != nil {
-			break
+			return nil, err
 		}
+		entries = append(entries, part...)
+	}
+	return entries, nil
+}
 
-		if newOffset+8 > len(s.mmap)-16 {
-			break
+func (s *SSTable) ref() {
+	s.refs.Add(1)
+}
+
+// unref drops a reference, closing the table and, if it has been compacted
+// away, deleting its file once nothing references it.
+func (s *SSTable) unref() {
+	if s.refs.Add(-1) > 0 {
+		return
+	}
+	if err := s.Close(); err != nil {
+		log.Printf("Warning: failed to close SSTable %s: %v", s.path, err)
+	}
+	if s.obsolete.Load() {
+		if err := fsOrDefault(s.fs).Remove(s.path); err != nil {
+			log.Printf("Warning: failed to remove SSTable %s: %v", s.path, err)
 		}
+	}
+}
 
-		entryOffset := int64(binary.LittleEndian.Uint64(s.mmap[newOffset : newOffset+8]))
-		currentOffset = newOffset + 8
+func (s *SSTable) Close() error {
+	if s.cache != nil {
+		s.cache.forget(s)
+	}
+	if s.dict != nil {
+		s.dict.Close()
+	}
+	return s.closeFile()
+}
 
-		index = append(index, indexEntry{
-			key:    key,
-			offset: entryOffset,
-		})
+// decodeValue verifies the record of key and decodes its stored value.
+func (s *SSTable) decodeValue(key, stored string) (string, error) {
+	if s.recordChecksums {
+		var err error
+		if stored, err = checkRecord(key, stored); err != nil {
+			return "", err
+		}
 	}
+	return decompressValue(s.compression, s.dict, stored)
+}
 
-	s.file = file
-	s.filter = filter
-	s.index = index
+// checkRecord verifies the checksum following the stored value of key in
+// tables that have record checksums, and returns the value without it.
+func checkRecord(key, stored string) (string, error) {
+	if len(stored) < 4 {
+		return "", fmt.Errorf("value of %q is missing its checksum", key)
+	}
+	value, sum := stored[:len(stored)-4], stored[len(stored)-4:]
+	if recordChecksum(key, value) != binary.LittleEndian.Uint32([]byte(sum)) {
+		return "", fmt.Errorf("record checksum mismatch for %q", key)
+	}
+	return value, nil
+}
 
-	return nil
+// recordChecksum is the CRC32C of a record's key followed by its stored
+// value.
+func recordChecksum(key, stored string) uint32 {
+	return crc32.Update(crc32.Checksum([]byte(key), castagnoli), castagnoli, []byte(stored))
 }
 
-func (s *SSTable) Close() error {
+// closeFile unmaps and closes the table's file.
+func (s *SSTable) closeFile() error {
 	var firstErr error
 
-	if s.mmap != nil {
-		if err := s.mmap.Unmap(); err != nil && firstErr == nil {
+	if s.unmap != nil {
+		if err := s.unmap(); err != nil && firstErr == nil {
 			firstErr = err
 		}
-		s.mmap = nil
+		s.unmap = nil
 	}
+	s.mmap = nil
 
 	if s.file != nil {
 		if err := s.file.Close(); err != nil && firstErr == nil {
@@ -243,26 +963,72 @@ func (s *SSTable) Close() error {
 	return firstErr
 }
 
-func (s *SSTable) readKVFromMmap(off int64) (key, val string, ok bool) {
-	if s.mmap == nil || off < 0 || int(off) >= len(s.mmap) {
-		return "", "", false
+// readKVFromMmap decodes the record at off, first verifying the checksum of
+// the block that holds it when verifyChecksums is set.
+func (s *SSTable) readKVFromMmap(off int64) (key, val string, err error) {
+	if s.file == nil || off < 0 || off >= s.size {
+		return "", "", s.corruption(off, "record offset out of range")
+	}
+
+	if s.verifyChecksums {
+		if err := s.verifyBlock(off); err != nil {
+			return "", "", err
+		}
 	}
 
-	k, nextOffset, err := readStringFromMmap(s.mmap, int(off))
+	k, nextOffset, err := s.readStringAt(off)
 	if err != nil {
-		return "", "", false
+		return "", "", err
 	}
 
-	v, _, err := readStringFromMmap(s.mmap, nextOffset)
+	v, _, err := s.readStringAt(nextOffset)
 	if err != nil {
-		return "", "", false
+		return "", "", err
 	}
 
-	return k, v, true
+	v, err = s.decodeValue(k, v)
+	if err != nil {
+		return "", "", s.corruption(off, err.Error())
+	}
+
+	return k, v, nil
+}
+
+// verifyBlock checks the CRC32C of the data block containing off. Tables
+// without block handles have nothing to verify.
+func (s *SSTable) verifyBlock(off int64) error {
+	if len(s.blocks) == 0 {
+		return nil
+	}
+	i := sort.Search(len(s.blocks), func(i int) bool {
+		return s.blocks[i].offset > off
+	}) - 1
+	if i < 0 || off >= s.blocks[i].offset+int64(s.blocks[i].length) {
+		return s.corruption(off, "record is outside every data block")
+	}
+
+	data, err := s.section(s.blocks[i].offset, int64(s.blocks[i].length)+blockTrailerSize)
+	if err != nil {
+		return err
+	}
+	return s.checkBlock(s.blocks[i], data)
+}
+
+// checkBlock checks the CRC32C trailer of the block at h, read as data.
+func (s *SSTable) checkBlock(h blockHandle, data []byte) error {
+	want := binary.LittleEndian.Uint32(data[h.length:])
+	if got := crc32.Checksum(data[:h.length], castagnoli); got != want {
+		return s.corruption(h.offset, fmt.Sprintf("block checksum mismatch (got %08x, want %08x)", got, want))
+	}
+	return nil
+}
+
+func (s *SSTable) corruption(off int64, reason string) *CorruptionError {
+	return &CorruptionError{Path: s.path, Offset: off, Reason: reason}
 }
 
 func readBytesFromMmap(data []byte, offset int) ([]byte, int, error) {
-	if offset+4 > len(data) {
+	if offset < 0 || offset+4 > len(data) {
 		return nil, 0, fmt.Errorf("insufficient data for length prefix")
 	}
 
@@ -280,7 +1046,7 @@ func readBytesFromMmap(data []byte, offset int) ([]byte, int, error) {
 }
 
 func readStringFromMmap(data []byte, offset int) (string, int, error) {
-	if offset+4 > len(data) {
+	if offset < 0 || offset+4 > len(data) {
 		return "", 0, fmt.Errorf("insufficient data for length prefix")
 	}
 
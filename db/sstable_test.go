@@ -0,0 +1,280 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTablePropertiesRoundTrip(t *testing.T) {
+	dir := "testdata/properties"
+	_ = os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	kvs := [][2]string{{"apple", "red"}, {"banana", "yellow"}, {"cherry", "dark red"}}
+
+	sst := &SSTable{path: filepath.Join(dir, "props.sst"), level: 2, compression: SnappyCompression}
+	require.NoError(t, sst.Write(kvs))
+
+	loaded := &SSTable{path: sst.path}
+	require.NoError(t, loaded.Load())
+	defer loaded.Close()
+
+	props := loaded.Properties()
+	assert.Equal(t, "apple", props.SmallestKey)
+	assert.Equal(t, "cherry", props.LargestKey)
+	assert.Equal(t, uint64(3), props.NumEntries)
+	assert.Equal(t, uint64(len("applebananacherry")), props.RawKeySize)
+	assert.Equal(t, uint64(len("redyellowdark red")), props.RawValueSize)
+	assert.Equal(t, 2, props.Level)
+	assert.False(t, props.CreatedAt.IsZero())
+
+	info, err := os.Stat(sst.path)
+	require.NoError(t, err)
+	assert.Less(t, props.DataSize, uint64(info.Size()))
+
+	assert.True(t, loaded.overlaps("b", "c"))
+	assert.False(t, loaded.overlaps("d", "z"))
+}
+
+func TestPartitionedIndexLookups(t *testing.T) {
+	dir := "testdata/partitioned"
+	_ = os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	var kvs [][2]string
+	for i := 0; i < 100000; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("key%06d", i), fmt.Sprintf("v%d", i)})
+	}
+	sst := &SSTable{path: filepath.Join(dir, "partitioned.sst")}
+	require.NoError(t, sst.Write(kvs))
+
+	loaded := &SSTable{path: sst.path, verifyChecksums: true}
+	require.NoError(t, loaded.Load())
+	defer loaded.Close()
+
+	assert.Nil(t, loaded.index, "only the top-level index stays in memory")
+	assert.Greater(t, len(loaded.partitions), 1)
+
+	for i := 0; i < len(kvs); i += 7 {
+		kv := kvs[i]
+		got, ok := loaded.BinarySearch(kv[0])
+		require.True(t, ok, kv[0])
+		assert.Equal(t, kv[1], got)
+	}
+	_, ok := loaded.BinarySearch("key999999")
+	assert.False(t, ok)
+	_, ok = loaded.BinarySearch("key00000")
+	assert.False(t, ok)
+
+	entries, err := loaded.entries()
+	require.NoError(t, err)
+	assert.Equal(t, kvs, entries)
+}
+
+func TestBlocksElideSharedKeyPrefixes(t *testing.T) {
+	dir := "testdata/prefix"
+	_ = os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	var kvs [][2]string
+	for i := 0; i < 2000; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("metrics/cluster-a/host-042/cpu/%08d", i), "1"})
+	}
+	sst := &SSTable{path: filepath.Join(dir, "prefix.sst")}
+	require.NoError(t, sst.Write(kvs))
+
+	loaded := &SSTable{path: sst.path, verifyChecksums: true}
+	require.NoError(t, loaded.Load())
+	defer loaded.Close()
+
+	props := loaded.Properties()
+	assert.Less(t, props.DataSize, props.RawKeySize/2, "shared prefixes should not be stored per key")
+
+	for _, kv := range kvs {
+		got, ok := loaded.BinarySearch(kv[0])
+		require.True(t, ok, kv[0])
+		assert.Equal(t, kv[1], got)
+	}
+}
+
+func TestSSTableBuilderStreamsBlocks(t *testing.T) {
+	dir := "testdata/builder"
+	_ = os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	b, err := NewSSTableBuilder(filepath.Join(dir, "built.sst"), nil)
+	require.NoError(t, err)
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, b.Add(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%d", i)))
+	}
+	assert.NotEmpty(t, b.sst.blocks, "full blocks are written before Finish")
+	assert.Error(t, b.Add("key00000", "again"))
+	require.NoError(t, b.Finish())
+	assert.Error(t, b.Add("key99999", "late"))
+
+	loaded := &SSTable{path: b.sst.path, verifyChecksums: true}
+	require.NoError(t, loaded.Load())
+	defer loaded.Close()
+
+	assert.Equal(t, uint64(5000), loaded.Properties().NumEntries)
+	got, ok := loaded.BinarySearch("key04321")
+	assert.True(t, ok)
+	assert.Equal(t, "value4321", got)
+}
+
+func TestBloomFilterOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		bitsPerKey int
+		fpRate     float64
+		wantRate   float64
+	}{
+		{name: "default", wantRate: defaultBloomFPRate},
+		{name: "rate", fpRate: 0.001, wantRate: 0.001},
+		{name: "bits per key", bitsPerKey: 20, fpRate: 0.05},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.FileSystem = NewMemFileSystem()
+			opts.BloomFPRate = tc.fpRate
+			opts.BloomBitsPerKey = tc.bitsPerKey
+			db, err := Open("bloom", opts)
+			require.NoError(t, err)
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, db.Put(fmt.Sprintf("key%04d", i), "value"))
+			}
+			require.NoError(t, db.Flush())
+			require.NoError(t, db.Close())
+
+			// The setting is read back from the table's properties.
+			db, err = Open("bloom", opts)
+			require.NoError(t, err)
+			defer db.Close()
+			require.Len(t, db.levels[0], 1)
+			sst := db.levels[0][0]
+			props := sst.Properties()
+			assert.Equal(t, tc.bitsPerKey, props.FilterBitsPerKey)
+			if tc.bitsPerKey > 0 {
+				assert.Equal(t, uint(tc.bitsPerKey*1000), sst.filter.m)
+				assert.Less(t, props.FilterFPRate, 0.001, "twenty bits per key beat a 0.1% rate")
+			} else {
+				assert.Equal(t, tc.wantRate, props.FilterFPRate)
+				assert.Equal(t, optimalM(1000, tc.wantRate), sst.filter.m)
+			}
+		})
+	}
+}
+
+func TestInvalidBloomFilterOptions(t *testing.T) {
+	for _, set := range []func(*Options){
+		func(o *Options) { o.BloomBitsPerKey = -1 },
+		func(o *Options) { o.BloomBitsPerKey = maxBloomBitsPerKey + 1 },
+		func(o *Options) { o.BloomFPRate = 1 },
+		func(o *Options) { o.BloomFPRate = 1e-9 },
+	} {
+		opts := DefaultOptions()
+		opts.FileSystem = NewMemFileSystem()
+		set(opts)
+		_, err := Open("bloom", opts)
+		assert.Error(t, err)
+	}
+}
+
+func TestDamagedIndexOrFilterFailsLoad(t *testing.T) {
+	fs := NewMemFileSystem()
+	var kvs [][2]string
+	for i := 0; i < 500; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("key%04d", i), "value"})
+	}
+	sst := &SSTable{path: "meta.sst", fs: fs}
+	require.NoError(t, sst.Write(kvs))
+	data, err := readFile(fs, sst.path)
+	require.NoError(t, err)
+	footer, err := parseFooter(data)
+	require.NoError(t, err)
+
+	for name, off := range map[string]int64{
+		"filter":        footer.filterOffset + 8,
+		"index":         footer.indexOffset + 2,
+		"top index":     footer.topOffset + 1,
+		"block handles": footer.blocksOffset + 3,
+	} {
+		t.Run(name, func(t *testing.T) {
+			damaged := append([]byte(nil), data...)
+			damaged[off] ^= 0x01
+			f, err := fs.Create("damaged.sst")
+			require.NoError(t, err)
+			_, err = f.Write(damaged)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			loaded := &SSTable{path: "damaged.sst", fs: fs}
+			err = loaded.Load()
+			loaded.Close()
+			assert.ErrorIs(t, err, ErrCorruption)
+		})
+	}
+}
+
+func TestUnknownBloomHashSchemeIsIgnored(t *testing.T) {
+	fs := NewMemFileSystem()
+	var kvs [][2]string
+	for i := 0; i < 100; i++ {
+		kvs = append(kvs, [2]string{fmt.Sprintf("key%03d", i), "value"})
+	}
+	sst := &SSTable{path: "scheme.sst", fs: fs}
+	require.NoError(t, sst.Write(kvs))
+
+	loaded := &SSTable{path: sst.path, fs: fs}
+	require.NoError(t, loaded.Load())
+	require.NotNil(t, loaded.filter)
+	assert.Equal(t, bloomHashFNV1a, loaded.filter.scheme)
+	loaded.Close()
+
+	// Rewrite the scheme as one from a later version, keeping the
+	// metadata checksum valid.
+	data, err := readFile(fs, sst.path)
+	require.NoError(t, err)
+	footer, err := parseFooter(data)
+	require.NoError(t, err)
+	schemeAt := footer.filterOffset + 4 + int64(len(loaded.filter.bitset)) + 20
+	binary.LittleEndian.PutUint32(data[schemeAt:], 99)
+	crcAt := int64(len(data)) - int64(footer.size) + 8*maxFooterOffsets
+	binary.LittleEndian.PutUint32(data[crcAt:], crc32.Checksum(data[footer.filterOffset:footer.propsOffset], castagnoli))
+	f, err := fs.Create(sst.path)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	loaded = &SSTable{path: sst.path, fs: fs}
+	require.NoError(t, loaded.Load())
+	defer loaded.Close()
+	assert.Nil(t, loaded.filter, "a filter this version cannot probe is dropped")
+	value, ok := loaded.BinarySearch("key042")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+}
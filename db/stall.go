@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// l0SlowdownDelay is how long each write is held back while L0 is above
+// Options.L0SlowdownWritesTrigger.
+const l0SlowdownDelay = time.Millisecond
+
+// WriteStallStats reports how often writes have been held back.
+type WriteStallStats struct {
+	// Slowdowns counts writes delayed because L0 was above
+	// Options.L0SlowdownWritesTrigger.
+	Slowdowns uint64
+	// Stops counts writes that waited for a flush or an L0 compaction
+	// because a stop threshold was reached.
+	Stops uint64
+	// StallTime is the total time writes spent delayed or stopped.
+	StallTime time.Duration
+}
+
+// WriteStallStats returns the write stall counters accumulated since the
+// database was opened.
+func (db *DB) WriteStallStats() WriteStallStats {
+	return WriteStallStats{
+		Slowdowns: db.stalls.slowdowns.Load(),
+		Stops:     db.stalls.stops.Load(),
+		StallTime: time.Duration(db.stalls.nanos.Load()),
+	}
+}
+
+// throttleWrite applies backpressure before a write is queued. A full
+// memtable is swapped for an empty one and flushed in the background; the
+// write stalls only if too many memtables are already waiting to be flushed.
+// Once L0 reaches its stop threshold the writer itself compacts it, so the
+// memtables and L0 stay bounded however fast writes arrive. Below the stop
+// threshold, a large L0 only slows each write down. The L0 thresholds are
+// ignored while automatic compaction is disabled.
+func (db *DB) throttleWrite() error {
+	opts := db.opts
+
+	db.mu.RLock()
+	l0 := len(db.levels[0])
+	memBytes := db.memTable.bytes()
+	db.mu.RUnlock()
+	if db.noAutoCompaction.Load() {
+		// Nothing will shrink L0 until compaction is turned back on.
+		l0 = 0
+	}
+
+	if (opts.L0StopWritesTrigger > 0 && l0 >= opts.L0StopWritesTrigger) ||
+		(opts.WriteBufferSize > 0 && memBytes >= opts.WriteBufferSize) {
+		return db.makeRoomForWrite()
+	}
+
+	if opts.L0SlowdownWritesTrigger > 0 && l0 >= opts.L0SlowdownWritesTrigger {
+		time.Sleep(l0SlowdownDelay)
+		db.stalls.slowdowns.Add(1)
+		db.stalls.nanos.Add(int64(l0SlowdownDelay))
+	}
+	return nil
+}
+
+// makeRoomForWrite blocks other writers, then rotates a full memtable,
+// waiting for the flush goroutine if the immutable queue is full, and
+// compacts an overfull L0. Waiting and compacting count as a stop.
+func (db *DB) makeRoomForWrite() error {
+	start := time.Now()
+	stalled := false
+	defer func() {
+		if stalled {
+			db.stalls.stops.Add(1)
+			db.stalls.nanos.Add(int64(time.Since(start)))
+		}
+	}()
+
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	if err := db.makeRoomInMemTable(&stalled); err != nil {
+		return err
+	}
+
+	opts := db.opts
+	if opts.L0StopWritesTrigger <= 0 || db.noAutoCompaction.Load() {
+		return nil
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	db.mu.RLock()
+	l0 := len(db.levels[0])
+	db.mu.RUnlock()
+	if l0 >= opts.L0StopWritesTrigger {
+		log.Printf("Stalling writes: L0 holds %d tables", l0)
+		stalled = true
+		compact := func() error { return db.compactLevel(0) }
+		if db.universal() {
+			compact = db.compactUniversalWhileDue
+		}
+		if err := compact(); err != nil {
+			return fmt.Errorf("failed to compact stalled L0: %w", err)
+		}
+	}
+	return nil
+}
+
+// makeRoomInMemTable rotates a full memtable, first waiting for a flush if
+// the immutable queue is full. logMu must be held.
+func (db *DB) makeRoomInMemTable(stalled *bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	opts := db.opts
+	if opts.WriteBufferSize <= 0 || db.memTable.bytes() < opts.WriteBufferSize {
+		return nil
+	}
+	if len(db.imm) >= db.maxImmutable() {
+		log.Printf("Stalling writes: %d memtables waiting to be flushed", len(db.imm))
+		*stalled = true
+		db.flushErr = nil
+		db.scheduleFlush()
+		for len(db.imm) >= db.maxImmutable() && db.flushErr == nil {
+			db.flushCond.Wait()
+		}
+		if len(db.imm) >= db.maxImmutable() {
+			return fmt.Errorf("failed to flush stalled memtable: %w", db.flushErr)
+		}
+	}
+	return db.rotateMemTable()
+}
@@ -0,0 +1,113 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestL0WriteSlowdownAndStop(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.L0SlowdownWritesTrigger = 2
+	opts.L0StopWritesTrigger = 3
+
+	store, err := db.Open("stall", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	l0Tables := func() int {
+		matches, err := fs.Glob("stall/sstable_[0-9]*.sst")
+		require.NoError(t, err)
+		return len(matches)
+	}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+	assert.Equal(t, 2, l0Tables())
+	assert.Equal(t, db.WriteStallStats{}, store.WriteStallStats())
+
+	require.NoError(t, store.Put("key2", "value"))
+	stats := store.WriteStallStats()
+	assert.Equal(t, uint64(1), stats.Slowdowns, "writes are delayed at the slowdown trigger")
+	assert.Equal(t, uint64(0), stats.Stops)
+	assert.Positive(t, stats.StallTime)
+
+	require.NoError(t, store.Flush())
+	assert.Equal(t, 3, l0Tables())
+
+	require.NoError(t, store.Put("key3", "value"))
+	assert.Equal(t, uint64(1), store.WriteStallStats().Stops, "writes stop at the stop trigger")
+	assert.Equal(t, 0, l0Tables(), "the stalled write compacts L0")
+
+	for i := 0; i < 4; i++ {
+		value, err := store.Get(fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+}
+
+func TestMemTableWriteStop(t *testing.T) {
+	// Flushes block creating their table until release is closed.
+	fs := db.NewFaultFileSystem()
+	release := make(chan struct{})
+	fs.OnMutation(func(op, name string) {
+		if op == "create" && strings.HasSuffix(name, ".sst.tmp") {
+			<-release
+		}
+	})
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.WriteBufferSize = 590
+	opts.MaxImmutableMemTables = 1
+
+	store, err := db.Open("stall", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Each entry takes 21 bytes of key and value and a 128-byte skiplist
+	// node on 64-bit platforms, so every fourth write fills the memtable.
+	// The first full memtable is queued and writes carry on while it is
+	// flushed.
+	put := func(i int) error {
+		return store.Put(fmt.Sprintf("key%02d", i), "0123456789abcdef")
+	}
+	for i := 0; i < 8; i++ {
+		require.NoError(t, put(i))
+	}
+	assert.Equal(t, uint64(0), store.WriteStallStats().Stops)
+
+	// The second full memtable has nowhere to go until the flush finishes.
+	done := make(chan error)
+	go func() { done <- put(8) }()
+	select {
+	case err := <-done:
+		t.Fatalf("write completed while the immutable memtable queue was full: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	value, err := store.Get("key00")
+	assert.NoError(t, err, "reads are served from the queued memtable")
+	assert.Equal(t, "0123456789abcdef", value)
+
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, uint64(1), store.WriteStallStats().Stops)
+
+	require.NoError(t, store.Flush())
+	matches, err := fs.Glob("stall/sstable_*.sst")
+	require.NoError(t, err)
+	assert.NotEmpty(t, matches)
+	for i := 0; i < 9; i++ {
+		value, err := store.Get(fmt.Sprintf("key%02d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "0123456789abcdef", value)
+	}
+}
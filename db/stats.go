@@ -0,0 +1,120 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statsFileName is the file in the database directory that keeps the
+// lifetime counters between opens.
+const statsFileName = "STATS"
+
+// LifetimeStats are counters that accumulate over every open of the
+// database, not just the current one.
+type LifetimeStats struct {
+	Flushes        int64
+	BytesFlushed   int64
+	Compactions    int64
+	BytesCompacted int64 // table bytes written by compactions
+	Writes         int64 // sequence numbers assigned, one per key written
+}
+
+// LifetimeStats returns the counters saved when the database was opened
+// plus those of the current session. They are saved every
+// Options.StatsPersistInterval and on Close, so a crash loses at most an
+// interval's worth.
+func (db *DB) LifetimeStats() LifetimeStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.lifetimeStatsLocked()
+}
+
+func (db *DB) lifetimeStatsLocked() LifetimeStats {
+	s := db.lifetime
+	s.Flushes += int64(db.flushStats.Compactions)
+	s.BytesFlushed += db.flushStats.BytesWritten
+	for _, l := range db.compactionStats {
+		s.Compactions += int64(l.Compactions)
+		s.BytesCompacted += l.BytesWritten
+	}
+	s.Writes += int64(db.seq - db.openSeq)
+	return s
+}
+
+// readLifetimeStats reads the stats file in dir. A missing or damaged file
+// starts the counters from zero.
+func readLifetimeStats(fs FileSystem, dir string) LifetimeStats {
+	var s LifetimeStats
+	file, err := fs.Open(filepath.Join(dir, statsFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to open stats file: %v", err)
+		}
+		return s
+	}
+	defer file.Close()
+	data, err := readFramedRecord(file)
+	if err == nil {
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &s)
+	}
+	if err != nil {
+		log.Printf("Warning: ignoring unreadable stats file in %s: %v", dir, err)
+		return LifetimeStats{}
+	}
+	return s
+}
+
+// saveLifetimeStats replaces the stats file with the current counters.
+func (db *DB) saveLifetimeStats() error {
+	db.mu.RLock()
+	s := db.lifetimeStatsLocked()
+	db.mu.RUnlock()
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, s)
+	path := filepath.Join(db.dir, statsFileName)
+	tmpPath := path + ".tmp"
+	file, err := db.fs.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create stats file: %w", err)
+	}
+	if err := writeFramedRecord(file, buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write stats file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync stats file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close stats file: %w", err)
+	}
+	if err := db.fs.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install stats file: %w", err)
+	}
+	return nil
+}
+
+// statsLoop saves the lifetime counters every interval.
+func (db *DB) statsLoop(interval time.Duration) {
+	defer db.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			if err := db.saveLifetimeStats(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+)
+
+// GetReader returns a reader over the value of key, for values too large to
+// want as one string. A value in an SSTable is read from the table's mapping
+// and a value in the value log from the file, so neither is copied into
+// memory whole; the reader holds the table or file open until it is closed.
+// Values still in the memtable, and values the table compresses, are
+// already in memory and are served from there. A value stored as chunks,
+// with Options.ValueChunkSize, is read a chunk at a time; if it is replaced
+// while being read, the reader fails with an ErrCorruption error.
+//
+// A value log record's checksum covers the whole value, so a damaged record
+// is only reported, as an ErrCorruption error, when the reader reaches its
+// end. The caller must close the reader.
+func (db *DB) GetReader(key string) (io.ReadCloser, error) {
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to get key %s: %w", key, ErrClosed)
+	}
+	if isInternalKey(key) {
+		return nil, fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+	db.trace(TraceRecord{Op: TraceGet, Key: key})
+
+	db.mu.RLock()
+	value, ok := db.memGet(key)
+	db.mu.RUnlock()
+	if ok {
+		if isDeleted(key, value) {
+			return nil, fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+		}
+		return db.valueReader(value), nil
+	}
+
+	v := db.currentVersion()
+	defer v.unref()
+	sample := db.sampleRead(v.levels)
+	var rc io.ReadCloser
+	_, ok, err := walkLevels(v.levels, key, func(sst *SSTable) (string, lookupResult, error) {
+		r, res, err := sst.lookupReader(key)
+		if sample {
+			sst.stats.record(res)
+		}
+		rc = r
+		return "", res, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+	}
+
+	// A value the length of a chunked value record or a tombstone is read
+	// to find out whether it is one.
+	if sized, ok := rc.(interface{ Size() int64 }); ok && (sized.Size() == int64(chunkedValueLen) || sized.Size() == int64(len(tombstone))) {
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key %s: %w", key, err)
+		}
+		if isDeleted(key, string(data)) {
+			return nil, fmt.Errorf("failed to get key %s: %w", key, ErrNotFound)
+		}
+		return db.valueReader(string(data)), nil
+	}
+	return rc, nil
+}
+
+// GetPinned returns the value of key without copying it out of the SSTable
+// it is read from: val views the table's mapping, which a reference on the
+// table keeps mapped, even if it is compacted away, until release is
+// called. val must not be modified or used after release, and every
+// release must be called before the database is closed. Values not read
+// from a table, from the memtable, the value log or chunks, are returned
+// as copies with a release that does nothing; release may be called more
+// than once.
+func (db *DB) GetPinned(key string) (val []byte, release func(), err error) {
+	rc, err := db.GetReader(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r, ok := rc.(*tableValueReader); ok && r.sst != nil {
+		var once sync.Once
+		return r.value, func() { once.Do(func() { r.Close() }) }, nil
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	return data, func() {}, nil
+}
+
+// valueReader returns a reader over value, which is in memory unless it is
+// a chunked value record.
+func (db *DB) valueReader(value string) io.ReadCloser {
+	if c, ok := decodeChunkedValue(value); ok {
+		return io.NopCloser(&chunkReader{c: c, get: db.get})
+	}
+	return io.NopCloser(strings.NewReader(value))
+}
+
+// PutReader stores the value read from r under key. With
+// Options.ValueChunkSize set, a value longer than a chunk is written a chunk
+// at a time as it is read, and the key is updated once r is drained, so no
+// more than a chunk is held in memory. Otherwise the memtable and WAL hold
+// values whole, so r is read to its end before the write; what it saves
+// over Put is the caller building the value first.
+func (db *DB) PutReader(key string, r io.Reader) error {
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to put key %s: %w", key, err)
+	}
+	size := db.opts.ValueChunkSize
+	if size <= 0 {
+		var value strings.Builder
+		if _, err := io.Copy(&value, r); err != nil {
+			return fmt.Errorf("failed to read value of %s: %w", key, err)
+		}
+		db.trace(TraceRecord{Op: TracePut, Key: key, Size: int64(value.Len())})
+		return db.writeValues([][2]string{{key, value.String()}}, nil, false)
+	}
+
+	head := make([]byte, size+1)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		db.trace(TraceRecord{Op: TracePut, Key: key, Size: int64(n)})
+		return db.writeValues([][2]string{{key, string(head[:n])}}, nil, false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read value of %s: %w", key, err)
+	}
+	record, err := db.writeChunks(io.MultiReader(bytes.NewReader(head), r), size)
+	if err != nil {
+		return fmt.Errorf("failed to write chunks of %s: %w", key, err)
+	}
+	if c, ok := decodeChunkedValue(record); ok {
+		db.trace(TraceRecord{Op: TracePut, Key: key, Size: c.size})
+	}
+	return db.replaceValues([][2]string{{key, record}}, false)
+}
+
+// lookupReader is lookup returning a reader over the value. The reader of a
+// value read from the table's mapping keeps the table pinned until closed.
+func (s *SSTable) lookupReader(key string) (io.ReadCloser, lookupResult, error) {
+	if s.format < blockFormatVersion {
+		value, res, err := s.lookup(key)
+		if res != lookupFound {
+			return nil, res, err
+		}
+		return &tableValueReader{Reader: bytes.NewReader([]byte(value))}, res, err
+	}
+	if s.filter != nil && !s.filter.MayContain(key) {
+		return nil, lookupFiltered, nil
+	}
+
+	if err := s.acquire(); err != nil {
+		return nil, lookupMissed, err
+	}
+	pinned := true
+	defer func() {
+		if pinned {
+			s.release()
+		}
+	}()
+	if s.file == nil {
+		return nil, lookupMissed, nil
+	}
+
+	stored, off, res, err := s.seekValue(key)
+	if err != nil || res != lookupFound {
+		return nil, res, err
+	}
+	if s.recordChecksums {
+		checked, err := checkRecord(key, string(stored))
+		if err != nil {
+			return nil, lookupMissed, s.corruption(off, err.Error())
+		}
+		stored = stored[:len(checked)]
+	}
+	if s.compression != NoCompression {
+		if len(stored) > 0 && stored[0] == valueRaw {
+			stored = stored[1:]
+		} else {
+			value, err := decompressValue(s.compression, s.dict, string(stored))
+			if err != nil {
+				return nil, lookupMissed, s.corruption(off, err.Error())
+			}
+			stored = []byte(value)
+		}
+	}
+
+	if s.separated {
+		if len(stored) == 0 {
+			return nil, lookupMissed, s.corruption(off, fmt.Sprintf("value of %q is missing its kind byte", key))
+		}
+		switch stored[0] {
+		case valueKindInline:
+			stored = stored[1:]
+		case valueKindPointer:
+			p, err := decodeValuePointer(string(stored))
+			if err != nil {
+				return nil, lookupMissed, s.corruption(off, fmt.Sprintf("value of %q: %v", key, err))
+			}
+			r, err := s.vlog.reader(p)
+			if err != nil {
+				return nil, lookupMissed, s.corruption(0, fmt.Sprintf("value of %q: %v", key, err))
+			}
+			return r, lookupFound, nil
+		default:
+			return nil, lookupMissed, s.corruption(off, fmt.Sprintf("value of %q has unknown kind %d", key, stored[0]))
+		}
+	}
+
+	// The reference keeps the table open if it is compacted away, and the
+	// pin keeps the table cache from closing it, until the reader is closed.
+	pinned = false
+	s.ref()
+	return &tableValueReader{Reader: bytes.NewReader(stored), value: stored, sst: s}, lookupFound, nil
+}
+
+// tableValueReader reads a value in place in its table's mapping, keeping
+// sst referenced and pinned, or a copy of the value when sst is nil.
+type tableValueReader struct {
+	*bytes.Reader
+	value []byte
+	sst   *SSTable
+}
+
+func (r *tableValueReader) Close() error {
+	if r.sst != nil {
+		r.sst.release()
+		r.sst.unref()
+		r.sst = nil
+	}
+	return nil
+}
+
+// reader returns a reader over the value of the record at p. It opens the
+// file anew rather than sharing the log's handle, so garbage collection
+// removing the file does not cut the read short.
+func (v *valueLog) reader(p valuePointer) (io.ReadCloser, error) {
+	if v == nil {
+		return nil, fmt.Errorf("value pointer without a value log")
+	}
+	path := vlogFilePath(v.dir, p.file)
+	f, err := v.fs.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open value log %d: %w", p.file, err)
+	}
+
+	header := make([]byte, vlogRecordHeaderSize)
+	if _, err := f.ReadAt(header, p.offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read value log %d at %d: %w", p.file, p.offset, err)
+	}
+	keyLen := int64(binary.LittleEndian.Uint32(header[4:8]))
+	valueLen := int64(binary.LittleEndian.Uint32(header[8:12]))
+	if vlogRecordHeaderSize+keyLen+valueLen != int64(p.size) {
+		f.Close()
+		return nil, fmt.Errorf("value log %d at %d: record length mismatch", p.file, p.offset)
+	}
+	key := make([]byte, keyLen)
+	if _, err := f.ReadAt(key, p.offset+vlogRecordHeaderSize); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read value log %d at %d: %w", p.file, p.offset, err)
+	}
+
+	crc := crc32.New(castagnoli)
+	crc.Write(header[4:])
+	crc.Write(key)
+	return &vlogValueReader{
+		file: f,
+		path: path,
+		ptr:  p,
+		r:    io.NewSectionReader(f, p.offset+vlogRecordHeaderSize+keyLen, valueLen),
+		crc:  crc,
+		want: binary.LittleEndian.Uint32(header[0:4]),
+	}, nil
+}
+
+// vlogValueReader reads a value log record's value from the file, checking
+// the record's checksum once the value has been read through.
+type vlogValueReader struct {
+	file File
+	path string
+	ptr  valuePointer
+	r    *io.SectionReader
+	crc  hash.Hash32
+	want uint32
+}
+
+func (r *vlogValueReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && r.crc.Sum32() != r.want {
+		return n, &CorruptionError{Path: r.path, Offset: r.ptr.offset, Reason: "record checksum mismatch"}
+	}
+	return n, err
+}
+
+// Size returns the length of the value.
+func (r *vlogValueReader) Size() int64 {
+	return r.r.Size()
+}
+
+func (r *vlogValueReader) Close() error {
+	return r.file.Close()
+}
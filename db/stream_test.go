@@ -0,0 +1,154 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllAndClose(t *testing.T, r io.ReadCloser) string {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	return string(data)
+}
+
+func TestGetReaderStreamsValues(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts func(*db.Options)
+	}{
+		{"plain", func(*db.Options) {}},
+		{"compressed", func(o *db.Options) { o.Compression = db.SnappyCompression }},
+		{"value log", func(o *db.Options) { o.ValueLogThreshold = 100 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "stream", strings.ReplaceAll(tc.name, " ", "-"))
+			_ = os.RemoveAll(dir)
+			opts := db.DefaultOptions()
+			tc.opts(opts)
+			store, err := db.Open(dir, opts)
+			require.NoError(t, err)
+			defer store.Close()
+
+			large := strings.Repeat("streamed value;", 4096)
+			require.NoError(t, store.PutReader("large", strings.NewReader(large)))
+			require.NoError(t, store.Put("small", "inline"))
+
+			r, err := store.GetReader("large")
+			require.NoError(t, err)
+			assert.Equal(t, large, readAllAndClose(t, r), "memtable value")
+
+			require.NoError(t, store.Flush())
+			for _, key := range []string{"large", "small"} {
+				want, err := store.Get(key)
+				require.NoError(t, err)
+				r, err := store.GetReader(key)
+				require.NoError(t, err)
+				assert.Equal(t, want, readAllAndClose(t, r), key)
+			}
+
+			_, err = store.GetReader("missing")
+			assert.True(t, errors.Is(err, db.ErrNotFound))
+		})
+	}
+}
+
+func TestGetReaderReportsDamagedValueLogRecord(t *testing.T) {
+	dir := "testdata/stream-corrupt"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueLogThreshold = 100
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	value := strings.Repeat("x", 1000)
+	require.NoError(t, store.Put("key", value))
+	require.NoError(t, store.Flush())
+
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	require.Len(t, logs, 1)
+	f, err := os.OpenFile(logs[0], os.O_RDWR, 0)
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("y"), info.Size()-1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	r, err := store.GetReader("key")
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.True(t, errors.Is(err, db.ErrCorruption), fmt.Sprint(err))
+	assert.Len(t, data, len(value), "the damaged value is still read through")
+}
+
+func TestGetPinnedOutlivesCompaction(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.DisableAutoCompaction = true
+	opts.MaxOpenFiles = 1
+	store, err := db.Open("pinned-values", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	large := strings.Repeat("pinned value;", 1024)
+	require.NoError(t, store.Put("large", large))
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.Put("small", "inline"))
+	require.NoError(t, store.Flush())
+
+	value, release, err := store.GetPinned("large")
+	require.NoError(t, err)
+	small, releaseSmall, err := store.GetPinned("small")
+	require.NoError(t, err)
+
+	// Compacting the tables away, with only one file open at a time, leaves
+	// the pinned values readable until released.
+	require.NoError(t, store.Put("large", "replaced"))
+	require.NoError(t, store.Flush())
+	for i := 0; i < 2; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("filler%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.SetAutoCompaction(true))
+	assert.Empty(t, store.Levels()[0].Files)
+	assert.Equal(t, large, string(value))
+	assert.Equal(t, "inline", string(small))
+	release()
+	release()
+	releaseSmall()
+
+	value, release, err = store.GetPinned("large")
+	require.NoError(t, err)
+	assert.Equal(t, "replaced", string(value))
+	release()
+
+	require.NoError(t, store.Put("memtable", "copied"))
+	value, release, err = store.GetPinned("memtable")
+	require.NoError(t, err)
+	assert.Equal(t, "copied", string(value))
+	release()
+
+	_, _, err = store.GetPinned("missing")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+}
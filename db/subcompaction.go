@@ -0,0 +1,280 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minSubcompactionBytes is the least input a sub-compaction is given; smaller
+// compactions are not worth splitting.
+const minSubcompactionBytes = 1 << 20
+
+// compaction describes one compaction: every table in inputs, from level,
+// merged with the overlapping tables of output. Levelled compactions output
+// to level+1; universal compactions merge L0 runs back into L0 and have no
+// overlapping tables.
+type compaction struct {
+	level       int
+	output      int
+	inputs      []*SSTable
+	overlapping []*SSTable
+
+	// stored reads the inputs in their stored form; separated writes the
+	// outputs with value pointers rather than resolving them inline.
+	stored    bool
+	separated bool
+	fpRate    float64
+	// dropDeletes leaves tombstones out of the output, which is only safe
+	// when no older table outside the compaction holds the keys.
+	dropDeletes bool
+	// targetFileSize is the size at which an output table is cut and a new
+	// one started; zero writes one table per key range.
+	targetFileSize int64
+
+	// paths are the output paths allocated so far, marked pending until
+	// the compaction is installed or abandoned.
+	mu    sync.Mutex
+	paths []string
+}
+
+func (c *compaction) tables() []*SSTable {
+	return append(append([]*SSTable{}, c.inputs...), c.overlapping...)
+}
+
+// bottommost reports whether no table in levels[from:] overlaps the keys of
+// tables, so a compaction of tables has nothing below it for tombstones to
+// shadow. Snapshots and iterators hold references to the tables they read,
+// so dropping tombstones never changes what they see. db.mu must be held.
+func (db *DB) bottommost(from int, tables []*SSTable) bool {
+	var smallest, largest string
+	first := true
+	for _, sst := range tables {
+		if sst.props.NumEntries == 0 {
+			continue
+		}
+		if first || sst.props.SmallestKey < smallest {
+			smallest = sst.props.SmallestKey
+		}
+		if first || sst.props.LargestKey > largest {
+			largest = sst.props.LargestKey
+		}
+		first = false
+	}
+	for _, level := range db.levels[from:] {
+		for _, sst := range level {
+			if sst.overlaps(smallest, largest) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// subcompactionBounds splits c into key ranges of roughly equal size, one
+// per sub-compaction, using the first keys of the input data blocks as
+// candidate split points. It returns the key each range after the first
+// starts at; no bounds means the compaction runs as a single range.
+func (db *DB) subcompactionBounds(c *compaction) []string {
+	tables := c.tables()
+	var total int64
+	for _, sst := range tables {
+		total += sst.size
+	}
+	n := db.opts.MaxSubcompactions
+	if limit := int(total / minSubcompactionBytes); n > limit {
+		n = limit
+	}
+	if n <= 1 {
+		return nil
+	}
+
+	var keys []string
+	for _, sst := range tables {
+		if sst.format < blockFormatVersion {
+			keys = append(keys, sst.props.SmallestKey)
+			continue
+		}
+		if err := sst.acquire(); err != nil {
+			continue
+		}
+		for _, h := range sst.blocks {
+			// A damaged block is reported by the merge itself.
+			b, err := sst.readBlock(h)
+			if err != nil {
+				continue
+			}
+			if first, _, _, err := b.entryAt(0, ""); err == nil {
+				keys = append(keys, first)
+			}
+		}
+		sst.release()
+	}
+	sort.Strings(keys)
+	keys = slices.Compact(keys)
+
+	var bounds []string
+	for i := 1; i < n; i++ {
+		k := keys[i*len(keys)/n]
+		if k > keys[0] && (len(bounds) == 0 || k > bounds[len(bounds)-1]) {
+			bounds = append(bounds, k)
+		}
+	}
+	return bounds
+}
+
+// newOutputPath allocates the path of a new table in c.output and marks it
+// pending until the compaction's caller clears c.paths.
+func (db *DB) newOutputPath(c *compaction) string {
+	path := filepath.Join(db.dir, tableFileName(c.output, db.newFileNumber()))
+	c.mu.Lock()
+	c.paths = append(c.paths, path)
+	c.mu.Unlock()
+	db.addPending(path)
+	return path
+}
+
+// runSubcompaction merges the records of c with start <= key < end, where an
+// empty end means no upper bound, into new tables in c.output, starting a
+// new table each time one reaches c.targetFileSize. With c.dropDeletes,
+// tombstones are left out. It returns no tables if the range holds no
+// records; on failure, the tables it finished are removed.
+func (db *DB) runSubcompaction(c *compaction, start, end string) ([]*SSTable, error) {
+	nextLevel := c.output
+	m := newMergingIterator(append(levelIterators(c.level, c.inputs, c.stored), levelIterators(nextLevel, c.overlapping, c.stored)...))
+
+	resolve := c.stored && !c.separated
+	deleted := tombstone
+	if c.stored {
+		deleted = encodeInline(tombstone)
+	}
+
+	var outputs []*SSTable
+	var builder *SSTableBuilder
+	var sstablePath string
+	fail := func(err error) ([]*SSTable, error) {
+		if builder != nil {
+			builder.Abandon()
+		}
+		for _, sst := range outputs {
+			sst.Close()
+			db.fs.Remove(sst.path)
+		}
+		return nil, err
+	}
+
+	var err error
+	for m.seek(start); m.ok && (end == "" || m.curKey < end); m.next() {
+		value := m.curValue
+		if db.aborting.Load() {
+			err = errShutdownAborted
+			break
+		}
+		if c.dropDeletes && value == deleted && !strings.HasPrefix(m.curKey, chunkKeyPrefix) {
+			continue
+		}
+		if resolve {
+			if value, err = db.vlog.resolve(value); err != nil {
+				err = fmt.Errorf("failed to resolve value of %s: %w", m.curKey, err)
+				break
+			}
+		}
+		if builder == nil {
+			sstablePath = db.newOutputPath(c)
+			if builder, err = db.newOutputBuilder(c, sstablePath+".tmp"); err != nil {
+				return fail(fmt.Errorf("failed to write L%d SSTable: %w", nextLevel, err))
+			}
+		}
+		if err = builder.add(m.curKey, value); err != nil {
+			break
+		}
+		if c.targetFileSize > 0 && builder.offset >= c.targetFileSize {
+			sst, err := db.finishOutput(builder, sstablePath)
+			builder = nil
+			if err != nil {
+				return fail(err)
+			}
+			outputs = append(outputs, sst)
+		}
+	}
+	if err == nil {
+		err = m.mergeErr
+	}
+	if err != nil {
+		return fail(fmt.Errorf("failed to merge L%d→L%d compaction: %w", c.level, nextLevel, err))
+	}
+	if builder != nil {
+		sst, err := db.finishOutput(builder, sstablePath)
+		builder = nil
+		if err != nil {
+			return fail(err)
+		}
+		outputs = append(outputs, sst)
+	}
+	return outputs, nil
+}
+
+// seqSpan returns the sequence range covering those of tables, leaving out
+// tables whose range is not known.
+func seqSpan(tables []*SSTable) (smallest, largest uint64) {
+	for _, sst := range tables {
+		if sst.largestSeq == 0 {
+			continue
+		}
+		if smallest == 0 || sst.smallestSeq < smallest {
+			smallest = sst.smallestSeq
+		}
+		largest = max(largest, sst.largestSeq)
+	}
+	return smallest, largest
+}
+
+// newOutputBuilder starts a table of c's output at tmpPath.
+func (db *DB) newOutputBuilder(c *compaction, tmpPath string) (*SSTableBuilder, error) {
+	newSST := db.newTable(tmpPath)
+	newSST.level = c.output
+	newSST.smallestSeq, newSST.largestSeq = seqSpan(c.tables())
+	newSST.separated = c.separated
+	newSST.dictSize = db.opts.CompressionDictSize
+	if c.fpRate > 0 {
+		newSST.fpRate = c.fpRate
+		newSST.bitsPerKey = 0
+	}
+	return newTableBuilder(newSST)
+}
+
+// finishOutput finishes the table builder is writing, syncs it and renames
+// it into place at sstablePath. On failure the table is removed.
+func (db *DB) finishOutput(builder *SSTableBuilder, sstablePath string) (*SSTable, error) {
+	newSST := builder.sst
+	level := newSST.level
+	tmpPath := newSST.path
+	if err := builder.Finish(); err != nil {
+		builder.Abandon()
+		return nil, fmt.Errorf("failed to write L%d SSTable: %w", level, err)
+	}
+
+	if err := fileSync(db.fs, tmpPath); err != nil {
+		db.fs.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to sync L%d SSTable: %w", level, err)
+	}
+
+	if err := db.fs.Rename(tmpPath, sstablePath); err != nil {
+		db.fs.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to rename L%d SSTable: %w", level, err)
+	}
+	if err := syncDirOf(db.fs, sstablePath); err != nil {
+		db.fs.Remove(sstablePath)
+		return nil, err
+	}
+
+	newSST.path = sstablePath
+	if err := newSST.Load(); err != nil {
+		db.fs.Remove(sstablePath)
+		return nil, fmt.Errorf("failed to load L%d SSTable: %w", level, err)
+	}
+	return newSST, nil
+}
@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelSubcompactions(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.MaxSubcompactions = 4
+
+	store, err := db.Open("subcompact", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	// Four overlapping flushes of 1-2 MiB fill L0 and trigger a compaction
+	// large enough to split four ways.
+	value := func(round, i int) string {
+		return fmt.Sprintf("%d:%04d:%s", round, i, strings.Repeat("v", 2048))
+	}
+	for round := 0; round < 4; round++ {
+		for i := round; i < 1000; i += 1 + round%2 {
+			require.NoError(t, store.Put(fmt.Sprintf("key%04d", i), value(round, i)))
+		}
+		require.NoError(t, store.Flush())
+	}
+
+	outputs, err := fs.Glob("subcompact/sstable_l1_*.sst")
+	require.NoError(t, err)
+	assert.Len(t, outputs, 4)
+
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			round := 0
+			for r := 3; r > 0; r-- {
+				if i >= r && (i-r)%(1+r%2) == 0 {
+					round = r
+					break
+				}
+			}
+			got, err := store.Get(fmt.Sprintf("key%04d", i))
+			require.NoError(t, err)
+			require.Equal(t, value(round, i), got)
+		}
+	}
+	check()
+
+	require.NoError(t, store.Close())
+	store, err = db.Open("subcompact", opts)
+	require.NoError(t, err)
+	check()
+}
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// EventType identifies the kind of write an Event describes.
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a committed write delivered to subscribers. A delete has an empty
+// Value.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value string
+	Seq   uint64
+}
+
+// SlowConsumerPolicy selects what happens to the writes committed while a
+// subscriber's buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDrop discards the events that do not fit in the buffer.
+	// DroppedEvents counts them.
+	SlowConsumerDrop SlowConsumerPolicy = iota
+	// SlowConsumerBlock holds up every writer until the subscriber has
+	// made room, so no event is lost. A subscriber must then not write to
+	// the database while it has unread events.
+	SlowConsumerBlock
+)
+
+// SubscribeOptions selects the writes a subscription receives and how it
+// buffers them.
+type SubscribeOptions struct {
+	// Prefixes are the key prefixes to match; a key matching any of them is
+	// delivered. No prefixes, like an empty one, match all keys.
+	Prefixes []string
+	// Types are the kinds of write to deliver; none means all of them.
+	Types []EventType
+	// BufferSize is how many events may wait for the subscriber to receive
+	// them before SlowConsumer applies. Zero means no limit.
+	BufferSize int
+	// SlowConsumer is what happens once BufferSize events are waiting.
+	SlowConsumer SlowConsumerPolicy
+}
+
+// subscription queues events for one subscriber. Events are appended by the
+// commit path without blocking and delivered to the channel by a pump
+// goroutine. With a BufferSize, SlowConsumerDrop discards what does not
+// fit, and SlowConsumerBlock lets the queue overflow and has the writer wait
+// for it to drain once db.mu is released.
+type subscription struct {
+	opts   SubscribeOptions
+	ch     chan Event
+	done   chan struct{}
+	remove func()
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	dropped uint64
+	closed  bool
+}
+
+// Subscribe returns a channel that receives every write committed after the
+// call whose key starts with prefix, in sequence order. An empty prefix
+// matches all keys. The channel is closed by Unsubscribe or Close.
+func (db *DB) Subscribe(prefix string) <-chan Event {
+	return db.SubscribeWithOptions(SubscribeOptions{Prefixes: []string{prefix}})
+}
+
+// SubscribeWithOptions is Subscribe for the writes opts selects, buffered
+// as opts says.
+func (db *DB) SubscribeWithOptions(opts SubscribeOptions) <-chan Event {
+	sub := &subscription{
+		opts: opts,
+		ch:   make(chan Event),
+		done: make(chan struct{}),
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+	sub.remove = db.addListener(sub.onCommit)
+
+	db.subsMu.Lock()
+	if db.subs == nil {
+		db.subs = make(map[<-chan Event]*subscription)
+	}
+	db.subs[sub.ch] = sub
+	db.subsMu.Unlock()
+
+	go sub.pump()
+	return sub.ch
+}
+
+// Unsubscribe stops delivery to ch and closes it. Events still queued for ch
+// are discarded.
+func (db *DB) Unsubscribe(ch <-chan Event) {
+	db.subsMu.Lock()
+	sub, ok := db.subs[ch]
+	delete(db.subs, ch)
+	db.subsMu.Unlock()
+
+	if ok {
+		sub.remove()
+		sub.close()
+	}
+}
+
+// DroppedEvents returns how many events SlowConsumerDrop has discarded for
+// ch, or zero if ch is not a subscription.
+func (db *DB) DroppedEvents(ch <-chan Event) uint64 {
+	db.subsMu.Lock()
+	sub, ok := db.subs[ch]
+	db.subsMu.Unlock()
+	if !ok {
+		return 0
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.dropped
+}
+
+// waitForSubscribers waits until every SlowConsumerBlock subscription has
+// room in its buffer again. The commit path calls it after releasing db.mu,
+// holding logMu, so writers wait for slow subscribers while readers do not.
+func (db *DB) waitForSubscribers() {
+	db.subsMu.Lock()
+	var blocking []*subscription
+	for _, sub := range db.subs {
+		if sub.opts.SlowConsumer == SlowConsumerBlock && sub.opts.BufferSize > 0 {
+			blocking = append(blocking, sub)
+		}
+	}
+	db.subsMu.Unlock()
+
+	for _, sub := range blocking {
+		sub.mu.Lock()
+		for len(sub.queue) > sub.opts.BufferSize && !sub.closed {
+			sub.cond.Wait()
+		}
+		sub.mu.Unlock()
+	}
+}
+
+// closeSubscriptions closes every subscriber channel. Close calls it before
+// taking logMu, which a writer held up by a SlowConsumerBlock subscriber
+// keeps until the subscription drains or closes, and then drops the
+// listeners under db.mu.
+func (db *DB) closeSubscriptions() {
+	db.subsMu.Lock()
+	subs := db.subs
+	db.subs = nil
+	db.subsMu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+func (s *subscription) onCommit(records []commitRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	for _, rec := range records {
+		if !s.matches(rec.key) {
+			continue
+		}
+		event := Event{Type: EventPut, Key: rec.key, Value: rec.value, Seq: rec.seq}
+		if isDeleted(rec.key, rec.value) {
+			event.Type, event.Value = EventDelete, ""
+		}
+		if !s.wants(event.Type) {
+			continue
+		}
+		limit := s.opts.BufferSize
+		if limit > 0 && len(s.queue) >= limit && s.opts.SlowConsumer == SlowConsumerDrop {
+			s.dropped++
+			continue
+		}
+		s.queue = append(s.queue, event)
+	}
+	s.cond.Broadcast()
+}
+
+// matches reports whether key starts with one of the subscription's
+// prefixes. Internal keys only match prefixes that are internal too.
+func (s *subscription) matches(key string) bool {
+	if len(s.opts.Prefixes) == 0 {
+		return !isInternalKey(key)
+	}
+	for _, prefix := range s.opts.Prefixes {
+		if strings.HasPrefix(key, prefix) && (!isInternalKey(key) || isInternalKey(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// wants reports whether the subscription delivers events of type t.
+func (s *subscription) wants(t EventType) bool {
+	if len(s.opts.Types) == 0 {
+		return true
+	}
+	return slices.Contains(s.opts.Types, t)
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	close(s.done)
+	s.cond.Broadcast()
+}
+
+func (s *subscription) pump() {
+	defer close(s.ch)
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		ev := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeDeliversMatchingWrites(t *testing.T) {
+	dir := "testdata/subscribe"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	events := store.Subscribe("user:")
+
+	require.NoError(t, store.Put("user:1", "alice"))
+	require.NoError(t, store.Put("order:1", "ignored"))
+	require.NoError(t, store.PutBatch([][2]string{{"user:2", "bob"}, {"user:3", "carol"}}))
+
+	want := []db.Event{
+		{Type: db.EventPut, Key: "user:1", Value: "alice", Seq: 1},
+		{Type: db.EventPut, Key: "user:2", Value: "bob", Seq: 3},
+		{Type: db.EventPut, Key: "user:3", Value: "carol", Seq: 4},
+	}
+	for _, w := range want {
+		select {
+		case got := <-events:
+			assert.Equal(t, w, got)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", w.Key)
+		}
+	}
+
+	store.Unsubscribe(events)
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func TestSubscribeWithOptions(t *testing.T) {
+	dir := "testdata/subscribe-options"
+	_ = os.RemoveAll(dir)
+
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	receive := func(ch <-chan db.Event) db.Event {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event")
+			return db.Event{}
+		}
+	}
+
+	deletes := store.SubscribeWithOptions(db.SubscribeOptions{
+		Prefixes: []string{"user:", "order:"},
+		Types:    []db.EventType{db.EventDelete},
+	})
+	dropping := store.SubscribeWithOptions(db.SubscribeOptions{BufferSize: 2})
+	blocking := store.SubscribeWithOptions(db.SubscribeOptions{BufferSize: 1, SlowConsumer: db.SlowConsumerBlock})
+
+	// Two events fill the blocking subscription's buffer, one held by its
+	// pump and one queued; the third write waits for it to drain.
+	require.NoError(t, store.Put("user:1", "alice"))
+	require.NoError(t, store.Delete("user:1"))
+	written := make(chan error)
+	go func() {
+		written <- store.Delete("order:1")
+	}()
+	select {
+	case <-written:
+		t.Fatal("write was not held up by the blocking subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "user:1", receive(blocking).Key)
+	require.NoError(t, <-written)
+	assert.Equal(t, "user:1", receive(blocking).Key)
+	require.NoError(t, store.Delete("item:1"))
+
+	assert.Equal(t, db.Event{Type: db.EventDelete, Key: "user:1", Seq: 2}, receive(deletes))
+	assert.Equal(t, db.Event{Type: db.EventDelete, Key: "order:1", Seq: 3}, receive(deletes))
+
+	// Of the four events, those that did not fit in the buffer while
+	// nobody read were dropped.
+	var delivered []uint64
+	for done := false; !done; {
+		select {
+		case ev := <-dropping:
+			delivered = append(delivered, ev.Seq)
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	dropped := store.DroppedEvents(dropping)
+	assert.GreaterOrEqual(t, dropped, uint64(1))
+	assert.Equal(t, 4, len(delivered)+int(dropped))
+	assert.IsIncreasing(t, delivered)
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// tableCache bounds how many SSTables keep their file open and mapped, for
+// Options.MaxOpenFiles. A table keeps its index, filter and properties in
+// memory once loaded; the cache closes the file of the least recently used
+// table past the limit and a later read opens it again. Reads pin the table
+// while they use its mapping, and pinned tables are never closed, so the
+// limit is exceeded while more tables than it allows are being read at once.
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // open tables, most recently used first
+}
+
+func newTableCache(capacity int) *tableCache {
+	return &tableCache{capacity: capacity, lru: list.New()}
+}
+
+// add registers s, just loaded, as open.
+func (c *tableCache) add(s *SSTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.elem = c.lru.PushFront(s)
+	c.evict()
+}
+
+// forget drops s, which is being closed for good.
+func (c *tableCache) forget(s *SSTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.elem != nil {
+		c.lru.Remove(s.elem)
+		s.elem = nil
+	}
+	s.evicted = false
+}
+
+// acquire pins s, opening its file again if the cache closed it.
+func (c *tableCache) acquire(s *SSTable) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.evicted {
+		if err := s.openFile(); err != nil {
+			s.closeFile()
+			return fmt.Errorf("failed to reopen SSTable %s: %w", s.path, err)
+		}
+		s.evicted = false
+		s.elem = c.lru.PushFront(s)
+	} else if s.elem != nil {
+		c.lru.MoveToFront(s.elem)
+	}
+	s.pins++
+	c.evict()
+	return nil
+}
+
+// acquireIfOpen pins s only if its file is open, reporting whether it did.
+func (c *tableCache) acquireIfOpen(s *SSTable) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.elem == nil {
+		return false
+	}
+	s.pins++
+	return true
+}
+
+func (c *tableCache) release(s *SSTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.pins--
+	c.evict()
+}
+
+// evict closes the least recently used unpinned tables until no more than
+// capacity are open. c.mu must be held.
+func (c *tableCache) evict() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		s := e.Value.(*SSTable)
+		prev := e.Prev()
+		if s.pins == 0 {
+			c.lru.Remove(e)
+			s.elem = nil
+			s.evicted = true
+			if err := s.closeFile(); err != nil {
+				log.Printf("Warning: failed to close SSTable %s: %v", s.path, err)
+			}
+		}
+		e = prev
+	}
+}
+
+// openCount returns the number of tables with their file open.
+func (c *tableCache) openCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// acquire pins s's file mapping for a read, opening the file again if the
+// table cache closed it. Every successful acquire must be paired with a
+// release. Tables outside a cache stay open from Load to Close and need no
+// pin.
+func (s *SSTable) acquire() error {
+	if s.cache == nil {
+		return nil
+	}
+	return s.cache.acquire(s)
+}
+
+// acquireIfOpen pins s's file mapping if it is open, without reopening a
+// file the table cache closed. A true result must be paired with a release.
+func (s *SSTable) acquireIfOpen() bool {
+	if s.cache == nil {
+		return s.file != nil
+	}
+	return s.cache.acquireIfOpen(s)
+}
+
+func (s *SSTable) release() {
+	if s.cache != nil {
+		s.cache.release(s)
+	}
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxOpenFiles(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FileSystem = NewMemFileSystem()
+	opts.MaxOpenFiles = 2
+	opts.DisableAutoCompaction = true
+	db, err := Open("tablecache", opts)
+	require.NoError(t, err)
+
+	const tables, perTable = 6, 50
+	for i := 0; i < tables; i++ {
+		for j := 0; j < perTable; j++ {
+			require.NoError(t, db.Put(fmt.Sprintf("key%d-%02d", i, j), fmt.Sprintf("value%d", i)))
+		}
+		require.NoError(t, db.Flush())
+	}
+	require.Len(t, db.levels[0], tables)
+	assert.LessOrEqual(t, db.tables.openCount(), 2)
+
+	check := func(db *DB) {
+		var wg sync.WaitGroup
+		for i := 0; i < tables; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < perTable; j++ {
+					value, err := db.Get(fmt.Sprintf("key%d-%02d", i, j))
+					assert.NoError(t, err)
+					assert.Equal(t, fmt.Sprintf("value%d", i), value)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.LessOrEqual(t, db.tables.openCount(), 2, "unpinned tables are closed past the limit")
+
+		it := db.NewIterator()
+		n := 0
+		for it.First(); it.Valid(); it.Next() {
+			n++
+		}
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+		assert.Equal(t, tables*perTable, n)
+	}
+	check(db)
+
+	// Compacting reads every table and leaves the output readable.
+	require.NoError(t, db.SetAutoCompaction(true))
+	require.NoError(t, db.maybeCompact())
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open("tablecache", opts)
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
@@ -0,0 +1,369 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceOp is the kind of operation a trace record describes.
+type TraceOp byte
+
+const (
+	TraceGet TraceOp = iota + 1
+	TracePut
+	TraceDelete
+	TraceDeleteRange
+	// TraceScan is an iterator, recorded when it is closed with the key of
+	// its first Seek and the number of keys it stepped through.
+	TraceScan
+	TraceIncrement
+	TraceGetOrSet
+	TraceAppend
+	// TraceBatch is an atomic batch of the puts and deletes in Batch.
+	TraceBatch
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceGet:
+		return "get"
+	case TracePut:
+		return "put"
+	case TraceDelete:
+		return "delete"
+	case TraceDeleteRange:
+		return "delete-range"
+	case TraceScan:
+		return "scan"
+	case TraceIncrement:
+		return "increment"
+	case TraceGetOrSet:
+		return "get-or-set"
+	case TraceAppend:
+		return "append"
+	case TraceBatch:
+		return "batch"
+	}
+	return fmt.Sprintf("TraceOp(%d)", byte(op))
+}
+
+// TraceRecord is one operation of a trace written with Options.TraceFile.
+// Keys are recorded as stored, so a column family key carries its family's
+// prefix; values are recorded only by their size.
+type TraceRecord struct {
+	Op   TraceOp
+	Time time.Time
+	Key  string
+	// EndKey is the exclusive end of a TraceDeleteRange.
+	EndKey string
+	// Size is the size of the value a TracePut, TraceGetOrSet or
+	// TraceAppend writes, or the keys a TraceScan stepped through.
+	Size  int64
+	Batch []TraceRecord
+}
+
+// tracer appends the operations of a database to its trace file. Records
+// are buffered, so a crash loses the last of them.
+type tracer struct {
+	mu   sync.Mutex
+	file File
+	w    *bufio.Writer
+	err  error
+}
+
+func newTracer(fs FileSystem, path string) (*tracer, error) {
+	file, err := fs.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %w", err)
+	}
+	return &tracer{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// trace records rec if tracing is on. The first failure to write turns
+// tracing off, with a warning, rather than failing the operation.
+func (db *DB) trace(rec TraceRecord) {
+	t := db.tracer
+	if t == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	var buf bytes.Buffer
+	encodeTraceRecord(&buf, rec)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if t.err = writeFramedRecord(t.w, buf.Bytes()); t.err != nil {
+		log.Printf("Warning: tracing stopped: failed to write trace record: %v", t.err)
+	}
+}
+
+// traceBatch records the writes of kvs as one TraceBatch, with the keys in
+// deletes recorded as deletes.
+func (db *DB) traceBatch(kvs [][2]string, deletes map[int]bool) {
+	if db.tracer == nil {
+		return
+	}
+	batch := make([]TraceRecord, len(kvs))
+	for i, kv := range kvs {
+		if deletes[i] {
+			batch[i] = TraceRecord{Op: TraceDelete, Key: kv[0]}
+		} else {
+			batch[i] = TraceRecord{Op: TracePut, Key: kv[0], Size: int64(len(kv[1]))}
+		}
+	}
+	db.trace(TraceRecord{Op: TraceBatch, Batch: batch})
+}
+
+// close flushes the buffered records and closes the trace file.
+func (t *tracer) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = ErrClosed
+	err := t.w.Flush()
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close trace file: %w", err)
+	}
+	return nil
+}
+
+func encodeTraceRecord(buf *bytes.Buffer, rec TraceRecord) {
+	buf.WriteByte(byte(rec.Op))
+	_ = binary.Write(buf, binary.LittleEndian, rec.Time.UnixNano())
+	_ = writeString(buf, rec.Key)
+	_ = writeString(buf, rec.EndKey)
+	_ = binary.Write(buf, binary.LittleEndian, rec.Size)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(rec.Batch)))
+	for _, r := range rec.Batch {
+		encodeTraceRecord(buf, r)
+	}
+}
+
+func decodeTraceRecord(r *bytes.Reader) (TraceRecord, error) {
+	var rec TraceRecord
+	op, err := r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	rec.Op = TraceOp(op)
+	var nanos int64
+	if err := binary.Read(r, binary.LittleEndian, &nanos); err != nil {
+		return rec, err
+	}
+	rec.Time = time.Unix(0, nanos)
+	if rec.Key, err = readString(r); err != nil {
+		return rec, err
+	}
+	if rec.EndKey, err = readString(r); err != nil {
+		return rec, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rec.Size); err != nil {
+		return rec, err
+	}
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return rec, err
+	}
+	if int64(count) > int64(r.Len()) {
+		return rec, fmt.Errorf("batch count %d exceeds record size", count)
+	}
+	for i := uint32(0); i < count; i++ {
+		nested, err := decodeTraceRecord(r)
+		if err != nil {
+			return rec, err
+		}
+		rec.Batch = append(rec.Batch, nested)
+	}
+	return rec, nil
+}
+
+// TraceReader reads the records of a trace file in the order they were
+// written.
+type TraceReader struct {
+	file File
+	r    *bufio.Reader
+}
+
+// OpenTrace opens the trace file at path, on fs or, if fs is nil, the
+// operating system's filesystem.
+func OpenTrace(fs FileSystem, path string) (*TraceReader, error) {
+	file, err := fsOrDefault(fs).Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return &TraceReader{file: file, r: bufio.NewReader(file)}, nil
+}
+
+// Next returns the next record, or io.EOF after the last. A record cut off
+// by a crash ends the trace like io.EOF.
+func (t *TraceReader) Next() (TraceRecord, error) {
+	data, err := readFramedRecord(t.r)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return TraceRecord{}, io.EOF
+	}
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("failed to read trace record: %w", err)
+		}
+		return TraceRecord{}, err
+	}
+	rec, err := decodeTraceRecord(bytes.NewReader(data))
+	if err != nil {
+		return TraceRecord{}, fmt.Errorf("failed to decode trace record: %w", err)
+	}
+	return rec, nil
+}
+
+func (t *TraceReader) Close() error {
+	return t.file.Close()
+}
+
+// TraceReplayOptions configure ReplayTrace.
+type TraceReplayOptions struct {
+	// PreserveTiming waits between operations as long as passed between
+	// them when they were traced, divided by Speed, rather than running
+	// them back to back.
+	PreserveTiming bool
+	// Speed scales the waits of PreserveTiming. Zero means 1.
+	Speed float64
+}
+
+// TraceReplayReport summarizes a replay.
+type TraceReplayReport struct {
+	// Operations counts the records replayed, a batch counting once.
+	Operations int
+	// Errors counts operations that failed, other than reads of keys that
+	// do not exist, which may differ from the traced run.
+	Errors   int
+	Duration time.Duration
+}
+
+// ReplayTrace runs the operations of the trace t against the database, in
+// order and from one goroutine, writing values of the traced sizes. Replayed
+// against a copy of the traced database, or a fresh one for a trace taken
+// from its creation, it reproduces the traced load, so performance problems
+// can be studied away from where they happened.
+func (db *DB) ReplayTrace(t *TraceReader, opts *TraceReplayOptions) (*TraceReplayReport, error) {
+	if opts == nil {
+		opts = &TraceReplayOptions{}
+	}
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	values := newTraceValues()
+	report := &TraceReplayReport{}
+	start := time.Now()
+	var first time.Time
+	for {
+		rec, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if opts.PreserveTiming {
+			if first.IsZero() {
+				first = rec.Time
+			}
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		report.Operations++
+		if err := db.replayTraceRecord(rec, values); err != nil && !errors.Is(err, ErrNotFound) {
+			report.Errors++
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// replayTraceRecord runs one traced operation. Keys are used as recorded,
+// so column family keys go through the same internal paths as the calls
+// that traced them.
+func (db *DB) replayTraceRecord(rec TraceRecord, values *traceValues) error {
+	switch rec.Op {
+	case TraceGet:
+		_, err := db.getJoined(rec.Key)
+		return err
+	case TracePut:
+		return db.writeValues([][2]string{{rec.Key, values.value(rec.Size)}}, nil, false)
+	case TraceDelete:
+		return db.replaceValues([][2]string{{rec.Key, tombstone}}, false)
+	case TraceDeleteRange:
+		// Not DeleteRange, which rejects the internal keys
+		// DropColumnFamily deletes.
+		if rec.Key >= rec.EndKey {
+			return nil
+		}
+		return db.submit(&writeRequest{ranges: [][2]string{{rec.Key, rec.EndKey}}})
+	case TraceScan:
+		it := db.NewIterator()
+		defer it.Close()
+		n := rec.Size
+		for it.Seek(rec.Key); it.Valid() && n > 0; it.Next() {
+			n--
+		}
+		return it.Err()
+	case TraceIncrement:
+		_, err := db.Increment(rec.Key, 1)
+		return err
+	case TraceGetOrSet:
+		_, _, err := db.GetOrSet(rec.Key, values.value(rec.Size))
+		return err
+	case TraceAppend:
+		return db.Append(rec.Key, values.value(rec.Size))
+	case TraceBatch:
+		kvs := make([][2]string, len(rec.Batch))
+		deletes := make(map[int]bool)
+		for i, r := range rec.Batch {
+			if r.Op == TraceDelete {
+				kvs[i] = [2]string{r.Key, tombstone}
+				deletes[i] = true
+			} else {
+				kvs[i] = [2]string{r.Key, values.value(r.Size)}
+			}
+		}
+		return db.writeValues(kvs, deletes, true)
+	}
+	return fmt.Errorf("unknown trace operation %d", rec.Op)
+}
+
+// traceValues hands out replayed values cut from a block of random text,
+// so they neither cost much to make nor compress away.
+type traceValues struct {
+	block string
+}
+
+func newTraceValues() *traceValues {
+	rng := rand.New(rand.NewSource(1))
+	block := make([]byte, 64<<10)
+	for i := range block {
+		block[i] = byte('a' + rng.Intn(26))
+	}
+	return &traceValues{block: string(block)}
+}
+
+func (v *traceValues) value(size int64) string {
+	if size <= int64(len(v.block)) {
+		return v.block[:size]
+	}
+	return strings.Repeat(v.block, int(size)/len(v.block)+1)[:size]
+}
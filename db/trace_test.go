@@ -0,0 +1,92 @@
+package db_test
+
+import (
+	"io"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceRecordAndReplay(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.TraceFile = "ops.trace"
+	store, err := db.Open("traced", opts)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("a", "1"))
+	require.NoError(t, store.Put("b", strings.Repeat("x", 5000)))
+	_, err = store.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, store.Delete("a"))
+	var batch db.WriteBatch
+	batch.Put("c", "22")
+	batch.Delete("b")
+	require.NoError(t, store.Write(&batch))
+	it := store.NewIterator()
+	for it.Seek("c"); it.Valid(); it.Next() {
+	}
+	require.NoError(t, it.Close())
+	_, err = store.Increment("n", 5)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteRange("c", "d"))
+	require.NoError(t, store.Close())
+
+	trace, err := db.OpenTrace(fs, "ops.trace")
+	require.NoError(t, err)
+	var records []db.TraceRecord
+	for {
+		rec, err := trace.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records = append(records, rec)
+	}
+	require.NoError(t, trace.Close())
+
+	var ops []db.TraceOp
+	for _, rec := range records {
+		ops = append(ops, rec.Op)
+		assert.False(t, rec.Time.IsZero())
+	}
+	assert.Equal(t, []db.TraceOp{db.TracePut, db.TracePut, db.TraceGet, db.TraceDelete, db.TraceBatch,
+		db.TraceScan, db.TraceIncrement, db.TraceDeleteRange}, ops)
+	assert.Equal(t, int64(5000), records[1].Size)
+	require.Len(t, records[4].Batch, 2)
+	assert.Equal(t, db.TraceRecord{Op: db.TracePut, Key: "c", Size: 2}, withoutTime(records[4].Batch[0]))
+	assert.Equal(t, db.TraceRecord{Op: db.TraceDelete, Key: "b"}, withoutTime(records[4].Batch[1]))
+	assert.Equal(t, "c", records[5].Key)
+	assert.Equal(t, int64(1), records[5].Size, "the scan stepped past c")
+	assert.Equal(t, "d", records[7].EndKey)
+
+	// Replayed onto a fresh database, the trace leaves the same keys behind.
+	opts.TraceFile = ""
+	replayed, err := db.Open("replayed", opts)
+	require.NoError(t, err)
+	defer replayed.Close()
+	trace, err = db.OpenTrace(fs, "ops.trace")
+	require.NoError(t, err)
+	defer trace.Close()
+	report, err := replayed.ReplayTrace(trace, nil)
+	require.NoError(t, err)
+	assert.Equal(t, len(records), report.Operations)
+	assert.Zero(t, report.Errors)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := replayed.Get(key)
+		assert.ErrorIs(t, err, db.ErrNotFound, key)
+	}
+	n, err := replayed.Increment("n", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n, "increments are replayed as increments by one")
+}
+
+func withoutTime(rec db.TraceRecord) db.TraceRecord {
+	rec.Time = time.Time{}
+	return rec
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	defaultBloomFPRate = 0.01
+
+	// retuneEverySamples is how many sampled reads pass between two
+	// re-evaluations of table caching priorities.
+	retuneEverySamples = 1024
+
+	// minSamplesForAdvice is the number of sampled lookups a table needs
+	// before its statistics are trusted.
+	minSamplesForAdvice = 100
+)
+
+// CachePriority ranks SSTables by how much they benefit from staying in the
+// page cache.
+type CachePriority int32
+
+const (
+	CachePriorityLow CachePriority = iota
+	CachePriorityNormal
+	CachePriorityHigh
+)
+
+func (p CachePriority) String() string {
+	switch p {
+	case CachePriorityLow:
+		return "low"
+	case CachePriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// lookupResult describes how a single-table lookup ended.
+type lookupResult int
+
+const (
+	lookupFiltered lookupResult = iota // bloom filter ruled the key out
+	lookupMissed                       // filter passed, key absent (false positive)
+	lookupFound
+)
+
+// tableStats holds sampled read statistics for one SSTable.
+type tableStats struct {
+	lookups        atomic.Uint64
+	filtered       atomic.Uint64
+	falsePositives atomic.Uint64
+	hits           atomic.Uint64
+}
+
+func (ts *tableStats) record(res lookupResult) {
+	ts.lookups.Add(1)
+	switch res {
+	case lookupFiltered:
+		ts.filtered.Add(1)
+	case lookupMissed:
+		ts.falsePositives.Add(1)
+	case lookupFound:
+		ts.hits.Add(1)
+	}
+}
+
+// FilterAdvice reports the sampled read behavior of one SSTable and the bloom
+// filter false-positive rate that would suit it best.
+type FilterAdvice struct {
+	Path            string
+	Level           int
+	Lookups         uint64
+	Hits            uint64
+	Filtered        uint64
+	FalsePositives  uint64
+	ObservedFPRate  float64
+	ExpectedFPRate  float64
+	SuggestedFPRate float64
+	CachePriority   CachePriority
+}
+
+// FilterAdvice returns tuning advice for every SSTable that has received
+// enough sampled reads to judge.
+func (db *DB) FilterAdvice() []FilterAdvice {
+	v := db.currentVersion()
+	defer v.unref()
+
+	var advice []FilterAdvice
+	for levelNum, level := range v.levels {
+		for _, sst := range level {
+			if sst == nil {
+				continue
+			}
+			a, ok := sst.filterAdvice()
+			if !ok {
+				continue
+			}
+			a.Level = levelNum
+			advice = append(advice, a)
+		}
+	}
+	return advice
+}
+
+// sampleRead reports whether the current Get should record statistics, and
+// triggers a priority re-evaluation of the tables in levels every
+// retuneEverySamples samples.
+func (db *DB) sampleRead(levels [][]*SSTable) bool {
+	if db.opts.ReadSampleInterval <= 0 {
+		return false
+	}
+	if db.readCount.Add(1)%uint64(db.opts.ReadSampleInterval) != 0 {
+		return false
+	}
+	if db.sampleCount.Add(1)%retuneEverySamples == 0 {
+		retuneCachePriorities(levels)
+	}
+	return true
+}
+
+// retuneCachePriorities ranks tables by their share of sampled hits and asks
+// the kernel to prefetch hot tables and drop cold ones.
+func retuneCachePriorities(levels [][]*SSTable) {
+	var total uint64
+	var tables []*SSTable
+	for _, level := range levels {
+		for _, sst := range level {
+			if sst == nil {
+				continue
+			}
+			tables = append(tables, sst)
+			total += sst.stats.hits.Load()
+		}
+	}
+	if total == 0 || len(tables) == 0 {
+		return
+	}
+
+	fairShare := float64(total) / float64(len(tables))
+	for _, sst := range tables {
+		hits := float64(sst.stats.hits.Load())
+		priority := CachePriorityNormal
+		switch {
+		case hits >= 2*fairShare:
+			priority = CachePriorityHigh
+		case hits <= fairShare/4:
+			priority = CachePriorityLow
+		}
+		sst.setCachePriority(priority)
+	}
+}
+
+func (s *SSTable) setCachePriority(p CachePriority) {
+	if CachePriority(s.priority.Swap(int32(p))) == p || !s.acquireIfOpen() {
+		return
+	}
+	defer s.release()
+	if s.unmap == nil {
+		return
+	}
+
+	var err error
+	switch p {
+	case CachePriorityHigh:
+		err = adviseWillNeed(s.mmap)
+	case CachePriorityLow:
+		err = adviseDontNeed(s.mmap)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to apply %s cache priority to %s: %v", p, s.path, err)
+	}
+}
+
+func (s *SSTable) filterAdvice() (FilterAdvice, bool) {
+	lookups := s.stats.lookups.Load()
+	if lookups < minSamplesForAdvice {
+		return FilterAdvice{}, false
+	}
+
+	hits := s.stats.hits.Load()
+	filtered := s.stats.filtered.Load()
+	falsePositives := s.stats.falsePositives.Load()
+
+	a := FilterAdvice{
+		Path:           s.path,
+		Lookups:        lookups,
+		Hits:           hits,
+		Filtered:       filtered,
+		FalsePositives: falsePositives,
+		ExpectedFPRate: s.expectedFPRate(),
+		CachePriority:  CachePriority(s.priority.Load()),
+	}
+	if negatives := filtered + falsePositives; negatives > 0 {
+		a.ObservedFPRate = float64(falsePositives) / float64(negatives)
+	}
+	a.SuggestedFPRate = suggestFPRate(float64(filtered+falsePositives) / float64(lookups))
+	return a, true
+}
+
+// suggestFPRate maps the share of lookups that miss a table to a filter
+// false-positive rate: tables probed mostly for absent keys pay for every
+// false positive with a wasted read, while tables that usually contain the
+// key gain little from a large filter.
+func suggestFPRate(missRatio float64) float64 {
+	switch {
+	case missRatio >= 0.9:
+		return 0.001
+	case missRatio >= 0.5:
+		return 0.005
+	case missRatio >= 0.1:
+		return defaultBloomFPRate
+	default:
+		return 0.05
+	}
+}
+
+// expectedFPRate is the theoretical false-positive rate of the table's
+// filter given its size, hash count, and number of keys.
+func (s *SSTable) expectedFPRate() float64 {
+	if s.filter == nil || s.filter.m == 0 || s.props.NumEntries == 0 {
+		return 0
+	}
+	k := float64(s.filter.k)
+	n := float64(s.props.NumEntries)
+	m := float64(s.filter.m)
+	return math.Pow(1-math.Exp(-k*n/m), k)
+}
+
+// tunedFPRate picks the filter rate for a compaction output built from
+// inputs: the tightest rate suggested for any input with enough samples, or
+// zero, leaving the configured filter setting, when none has them.
+func tunedFPRate(inputs []*SSTable) float64 {
+	rate := 0.0
+	for _, sst := range inputs {
+		a, ok := sst.filterAdvice()
+		if !ok {
+			continue
+		}
+		if rate == 0 || a.SuggestedFPRate < rate {
+			rate = a.SuggestedFPRate
+		}
+	}
+	return rate
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// CompactionStyle selects how the tree is compacted.
+type CompactionStyle int
+
+const (
+	// CompactionStyleLevel moves data down through L1 to L6, each level
+	// bounded by its LevelPolicy. Space amplification stays low, but data
+	// is rewritten once for every level it passes through.
+	CompactionStyleLevel CompactionStyle = iota
+
+	// CompactionStyleUniversal keeps every table in L0 as a sorted run and
+	// merges runs of similar size, as RocksDB's universal compaction does.
+	// Data is rewritten far less often, at the cost of the tree taking up
+	// to Options.UniversalMaxSizeAmplificationPercent more space than it
+	// would fully compacted. Tables already below L0 are left in place.
+	CompactionStyleUniversal
+)
+
+const (
+	defaultUniversalSizeRatio     = 1
+	defaultUniversalMaxSizeAmpPct = 200
+	universalMinMergeWidth        = 2
+	universalReasonSizeAmp        = "size amplification"
+	universalReasonSizeRatio      = "size ratio"
+	universalReasonRunCount       = "sorted run count"
+)
+
+// universal reports whether the database uses universal compaction.
+func (db *DB) universal() bool {
+	return db.opts.CompactionStyle == CompactionStyleUniversal
+}
+
+// pickUniversal chooses the L0 runs a universal compaction should merge,
+// returning the index in db.levels[0] of the oldest run to merge (every
+// newer run is merged with it) and why, or -1 if nothing is due. Nothing is
+// due until L0 holds as many runs as its LevelPolicy allows files. Then, in
+// order of preference, it merges:
+//
+//   - every run, when the newer runs together exceed the oldest by
+//     UniversalMaxSizeAmplificationPercent;
+//   - the newest runs, taking each next older run while it is no more than
+//     UniversalSizeRatio percent larger than the runs taken so far;
+//   - otherwise just enough of the newest runs to bring the count back
+//     below the limit.
+//
+// db.mu must be held.
+func (db *DB) pickUniversal() (int, string) {
+	runs := db.levels[0]
+	n := len(runs)
+	trigger := db.levelPolicies[0].maxFiles
+	if n < trigger || n < universalMinMergeWidth {
+		return -1, ""
+	}
+
+	maxAmp := int64(db.opts.UniversalMaxSizeAmplificationPercent)
+	if maxAmp <= 0 {
+		maxAmp = defaultUniversalMaxSizeAmpPct
+	}
+	var newer int64
+	for _, sst := range runs[1:] {
+		newer += sst.size
+	}
+	if oldest := runs[0].size; oldest > 0 && newer*100 >= maxAmp*oldest {
+		return 0, universalReasonSizeAmp
+	}
+
+	ratio := int64(db.opts.UniversalSizeRatio)
+	if ratio <= 0 {
+		ratio = defaultUniversalSizeRatio
+	}
+	picked := runs[n-1].size
+	start := n - 1
+	for start > 0 && runs[start-1].size*100 <= picked*(100+ratio) {
+		start--
+		picked += runs[start].size
+	}
+	if n-start >= universalMinMergeWidth {
+		return start, universalReasonSizeRatio
+	}
+
+	return max(0, trigger-2), universalReasonRunCount
+}
+
+// compactL0Runs merges db.levels[0][start:] into one sorted run that takes
+// their place in L0, or, if nothing but tombstones is left, merges them
+// away. kind names the compaction, universal or intra-L0, in logs and
+// errors. compactMu must be held and db.mu must not be. Runs flushed while
+// the merge runs are newer than its output and stay after it.
+func (db *DB) compactL0Runs(start int, kind, reason string) error {
+	begin := time.Now()
+	db.mu.RLock()
+	inputs := append([]*SSTable(nil), db.levels[0][start:]...)
+	dropDeletes := start == 0 && db.bottommost(1, inputs)
+	db.mu.RUnlock()
+	log.Printf("Starting %s compaction of %d sorted runs (%s)", kind, len(inputs), reason)
+
+	c := &compaction{level: 0, output: 0, inputs: inputs, dropDeletes: dropDeletes}
+	c.stored = db.storedForm(inputs)
+	c.separated = c.stored && db.opts.ValueLogThreshold > 0
+	if db.opts.AutoTuneFilters {
+		c.fpRate = tunedFPRate(inputs)
+	}
+
+	defer func() { db.removePending(c.paths...) }()
+	outputs, err := db.runSubcompaction(c, "", "")
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Replaying the MANIFEST appends added tables to L0 in order, so runs
+	// flushed during the merge are deleted and added again after the
+	// output to keep them newer.
+	newer := db.levels[0][start+len(inputs):]
+	edit := &versionEdit{}
+	for _, sst := range inputs {
+		edit.deleteFile(0, sst.path)
+	}
+	for _, sst := range newer {
+		edit.deleteFile(0, sst.path)
+	}
+	for _, sst := range outputs {
+		edit.addFile(0, sst)
+	}
+	for _, sst := range newer {
+		edit.addFile(0, sst)
+	}
+	if err := db.logEdit(edit); err != nil {
+		for _, sst := range outputs {
+			sst.Close()
+			db.fs.Remove(sst.path)
+		}
+		return fmt.Errorf("failed to record %s compaction in manifest: %w", kind, err)
+	}
+
+	for _, sst := range inputs {
+		sst.obsolete.Store(true)
+		sst.unref()
+	}
+	level0 := append(append([]*SSTable(nil), db.levels[0][:start]...), outputs...)
+	db.levels[0] = append(level0, newer...)
+	db.installVersion()
+	db.recordCompaction(0, inputs, outputs, time.Since(begin))
+
+	var entries uint64
+	for _, sst := range outputs {
+		entries += sst.props.NumEntries
+	}
+	log.Printf("%s compaction completed: merged %d sorted runs into %d (%d keys), %d runs in L0",
+		strings.ToUpper(kind[:1])+kind[1:], len(inputs), len(outputs), entries, len(db.levels[0]))
+	return nil
+}
+
+// compactUniversalWhileDue runs universal compactions until none is due.
+// compactMu must be held and db.mu must not be.
+func (db *DB) compactUniversalWhileDue() error {
+	for {
+		db.mu.RLock()
+		start, reason := db.pickUniversal()
+		db.mu.RUnlock()
+		if start < 0 {
+			return nil
+		}
+		if err := db.compactL0Runs(start, "universal", reason); err != nil {
+			if errors.Is(err, errShutdownAborted) {
+				db.noteAbandoned(fmt.Sprintf("universal compaction of L0 runs %d and newer", start))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniversalCompaction(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	opts.CompactionStyle = db.CompactionStyleUniversal
+	store, err := db.Open("universal", opts)
+	require.NoError(t, err)
+
+	// Each round overwrites part of the previous one, so the runs must be
+	// merged newest first to keep the latest values.
+	for round := 0; round < 20; round++ {
+		for i := round * 10; i < round*10+20; i++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%04d", i), fmt.Sprintf("round%d", round)))
+		}
+		require.NoError(t, store.Flush())
+	}
+
+	check := func(store *db.DB) {
+		levels := store.Levels()
+		assert.Less(t, len(levels[0].Files), 4, "runs are merged once L0 reaches its file limit")
+		for _, level := range levels[1:] {
+			assert.Empty(t, level.Files, "universal compaction keeps every run in L0")
+		}
+		for i := 0; i < 210; i++ {
+			want := fmt.Sprintf("round%d", min(i/10, 19))
+			value, err := store.Get(fmt.Sprintf("key%04d", i))
+			assert.NoError(t, err)
+			assert.Equal(t, want, value, "key%04d", i)
+		}
+	}
+	check(store)
+
+	stats := store.CompactionStats()
+	assert.Positive(t, stats.Levels[0].Compactions)
+	assert.Zero(t, stats.Levels[1].Compactions)
+	require.NoError(t, store.Close())
+
+	// The MANIFEST keeps the runs in order across a reopen.
+	store, err = db.Open("universal", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	check(store)
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errAppendNeedsChunks stops an Append whose result has to be written as
+// chunks, which cannot happen while the key is held.
+var errAppendNeedsChunks = errors.New("appended value needs chunks")
+
+// update is a read-modify-write of one key, resolved by the commit group
+// leader so that no other write lands between the read and the write.
+type update struct {
+	key string
+	// apply is given the key's current value, with found false if it does
+	// not exist or is deleted, and returns the value to write in stored
+	// form, or write false to leave the key as it is.
+	apply func(value string, found bool) (stored string, write bool, err error)
+	// replaced is the chunked value the write replaced, if any, whose
+	// chunks are reclaimed once it commits.
+	replaced *chunkedValue
+}
+
+// readModifyWrite writes the value apply returns for the current value of
+// key, atomically with respect to every other write.
+func (db *DB) readModifyWrite(key string, apply func(value string, found bool) (string, bool, error)) error {
+	u := &update{key: key, apply: apply}
+	if err := db.submit(&writeRequest{update: u}); err != nil {
+		return err
+	}
+	if u.replaced != nil {
+		db.reclaimChunks(*u.replaced)
+	}
+	return nil
+}
+
+// resolveUpdate sets the writes of req to what its update writes, reading
+// the key from the requests queued before req in its group or from the
+// database. logMu must be held, so no other write can change the key, or
+// reclaim the chunks it names, before the group is applied.
+func (db *DB) resolveUpdate(earlier []*writeRequest, req *writeRequest) error {
+	u := req.update
+	value, found := "", false
+	for i := len(earlier) - 1; i >= 0 && !found; i-- {
+		for j := len(earlier[i].kvs) - 1; j >= 0; j-- {
+			if kv := earlier[i].kvs[j]; kv[0] == u.key {
+				value, found = kv[1], true
+				break
+			}
+		}
+	}
+	if !found {
+		v, err := db.get(u.key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to read key %s: %w", u.key, err)
+		}
+		value, found = v, err == nil
+	}
+	if found && isDeleted(u.key, value) {
+		value, found = "", false
+	}
+
+	var replaced *chunkedValue
+	if c, ok := decodeChunkedValue(value); found && ok {
+		joined, err := joinChunks(c, db.get)
+		if err != nil {
+			return fmt.Errorf("failed to read key %s: %w", u.key, err)
+		}
+		value, replaced = joined, &c
+	}
+
+	stored, write, err := u.apply(value, found)
+	if err != nil || !write {
+		return err
+	}
+	req.kvs = [][2]string{{u.key, stored}}
+	u.replaced = replaced
+	return nil
+}
+
+// GetOrSet returns the value of key if it exists, with loaded true, and
+// otherwise sets it to value and returns value, as sync.Map's LoadOrStore
+// does. The check and the write are atomic with respect to every other
+// write, so of several callers racing to set a key exactly one stores its
+// value and the rest load it.
+func (db *DB) GetOrSet(key, value string) (existing string, loaded bool, err error) {
+	if err := validateUserKey(key); err != nil {
+		return "", false, fmt.Errorf("failed to get or set key %s: %w", key, err)
+	}
+	db.trace(TraceRecord{Op: TraceGetOrSet, Key: key, Size: int64(len(value))})
+	stored := value
+	var chunks *chunkedValue
+	if db.needsChunks(value) {
+		// Chunks are written ahead, as no write can happen while the key is
+		// checked, and reclaimed if the key turns out to exist.
+		record, err := db.chunkValue(value)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to write chunks of %s: %w", key, err)
+		}
+		c, _ := decodeChunkedValue(record)
+		stored, chunks = record, &c
+	}
+
+	err = db.readModifyWrite(key, func(current string, found bool) (string, bool, error) {
+		if found {
+			existing, loaded = current, true
+			return "", false, nil
+		}
+		return stored, true, nil
+	})
+	if chunks != nil && (err != nil || loaded) {
+		db.reclaimChunks(*chunks)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if loaded {
+		return existing, true, nil
+	}
+	return value, false, nil
+}
+
+// Append appends suffix to the value of key, treating a key that does not
+// exist as empty. The read and the write are atomic with respect to every
+// other write, so concurrent appends to key are all kept, each whole.
+func (db *DB) Append(key, suffix string) error {
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to append to key %s: %w", key, err)
+	}
+	db.trace(TraceRecord{Op: TraceAppend, Key: key, Size: int64(len(suffix))})
+	err := db.readModifyWrite(key, func(value string, found bool) (string, bool, error) {
+		appended := value + suffix
+		if db.needsChunks(appended) {
+			return "", false, errAppendNeedsChunks
+		}
+		return appended, true, nil
+	})
+	if !errors.Is(err, errAppendNeedsChunks) {
+		return err
+	}
+
+	// A value that has to be chunked is written out whole as new chunks,
+	// which are swapped in only if the key still holds the value they were
+	// built from, and otherwise reclaimed and built again.
+	for {
+		base, err := db.getJoined(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to append to key %s: %w", key, err)
+		}
+		record, err := db.chunkValue(base + suffix)
+		if err != nil {
+			return fmt.Errorf("failed to write chunks of %s: %w", key, err)
+		}
+		chunks, _ := decodeChunkedValue(record)
+		swapped := false
+		err = db.readModifyWrite(key, func(value string, found bool) (string, bool, error) {
+			if value != base {
+				return "", false, nil
+			}
+			swapped = true
+			return record, true, nil
+		})
+		if err != nil || !swapped {
+			db.reclaimChunks(chunks)
+		}
+		if err != nil || swapped {
+			return err
+		}
+	}
+}
+
+// Update sets key to the value fn returns for its current value, which fn
+// gets as "" with found false if key does not exist. If fn returns write
+// false, or an error, key is left as it is and the error returned. The read
+// and the write are atomic with respect to every other write, so fn runs
+// while writes wait: it must be quick and must not use the database. A new
+// value that would have to be written as chunks is refused.
+func (db *DB) Update(key string, fn func(value string, found bool) (newValue string, write bool, err error)) error {
+	if err := validateUserKey(key); err != nil {
+		return fmt.Errorf("failed to update key %s: %w", key, err)
+	}
+	written := -1
+	err := db.readModifyWrite(key, func(value string, found bool) (string, bool, error) {
+		newValue, write, err := fn(value, found)
+		if err != nil || !write {
+			return "", false, err
+		}
+		if db.needsChunks(newValue) {
+			return "", false, fmt.Errorf("failed to update key %s: new value would need chunks", key)
+		}
+		written = len(newValue)
+		return newValue, true, nil
+	})
+	if err == nil && written >= 0 {
+		db.trace(TraceRecord{Op: TracePut, Key: key, Size: int64(written)})
+	}
+	return err
+}
+
+// DeleteIfExists deletes key and reports whether it existed. The check and
+// the delete are atomic with respect to every other write, so of several
+// callers deleting key exactly one is told it existed.
+func (db *DB) DeleteIfExists(key string) (deleted bool, err error) {
+	if err := validateUserKey(key); err != nil {
+		return false, fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+	db.trace(TraceRecord{Op: TraceDelete, Key: key})
+	err = db.readModifyWrite(key, func(value string, found bool) (string, bool, error) {
+		deleted = found
+		return tombstone, found, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
@@ -0,0 +1,163 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrSet(t *testing.T) {
+	dir := "testdata/get-or-set"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueChunkSize = 100
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Of the callers racing to set a key, exactly one stores its value.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	values := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value := fmt.Sprintf("id-%d", i)
+			got, loaded, err := store.GetOrSet("next-id", value)
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			if !loaded {
+				stored++
+				assert.Equal(t, value, got)
+			}
+			values[got] = true
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, stored)
+	assert.Len(t, values, 1)
+
+	large := strings.Repeat("x", 250)
+	got, loaded, err := store.GetOrSet("large", large)
+	require.NoError(t, err)
+	assert.False(t, loaded)
+	assert.Equal(t, large, got)
+	got, loaded, err = store.GetOrSet("large", "other")
+	require.NoError(t, err)
+	assert.True(t, loaded)
+	assert.Equal(t, large, got)
+
+	require.NoError(t, store.Delete("large"))
+	got, loaded, err = store.GetOrSet("large", "other")
+	require.NoError(t, err)
+	assert.False(t, loaded)
+	assert.Equal(t, "other", got)
+}
+
+func TestAppend(t *testing.T) {
+	dir := "testdata/append"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueChunkSize = 64
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Appends racing on one key are all kept, through the switch to
+	// chunks once the value outgrows ValueChunkSize.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, store.Append("log", fmt.Sprintf("[%d:%d]", i, j)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := store.Get("log")
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			assert.Equal(t, 1, strings.Count(got, fmt.Sprintf("[%d:%d]", i, j)))
+		}
+	}
+	assert.Len(t, got, 4*10*5)
+}
+
+func TestUpdateAndDeleteIfExists(t *testing.T) {
+	dir := "testdata/update"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueChunkSize = 64
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Updates racing on one key are applied one at a time.
+	double := func(value string, found bool) (string, bool, error) {
+		return value + value, found, nil
+	}
+	require.NoError(t, store.Put("k", "ab"))
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Update("k", double))
+		}()
+	}
+	wg.Wait()
+	got, err := store.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("ab", 32), got)
+
+	require.NoError(t, store.Update("missing", double))
+	_, err = store.Get("missing")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorContains(t, store.Update("k", double), "chunks")
+	failed := errors.New("refused")
+	assert.ErrorIs(t, store.Update("k", func(string, bool) (string, bool, error) {
+		return "x", true, failed
+	}), failed)
+	got, err = store.Get("k")
+	require.NoError(t, err)
+	assert.Len(t, got, 64)
+
+	// A chunked value is deleted like any other.
+	require.NoError(t, store.Put("large", strings.Repeat("x", 200)))
+	for _, key := range []string{"k", "large"} {
+		deleted, err := store.DeleteIfExists(key)
+		require.NoError(t, err)
+		assert.True(t, deleted)
+		deleted, err = store.DeleteIfExists(key)
+		require.NoError(t, err)
+		assert.False(t, deleted)
+		_, err = store.Get(key)
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	}
+}
@@ -0,0 +1,72 @@
+package db
+
+import "sync/atomic"
+
+// version is an immutable view of the tree: the tables of every level at one
+// moment. Flushes, compactions and ingestion edit db.levels under db.mu and
+// then publish a fresh version, so readers work from a version without
+// taking db.mu and never see a level half way through an update.
+//
+// A version holds a reference on each of its tables, which keeps a table
+// that has since been compacted away open until the last reader of an older
+// version is done with it. The DB holds one reference on its current
+// version and every reader holds one on the version it is using.
+type version struct {
+	levels [][]*SSTable
+	refs   atomic.Int32
+}
+
+// newVersion returns a version holding copies of levels, with one reference.
+func newVersion(levels [][]*SSTable) *version {
+	v := &version{levels: make([][]*SSTable, len(levels))}
+	for levelNum, level := range levels {
+		v.levels[levelNum] = append([]*SSTable(nil), level...)
+		for _, sst := range level {
+			sst.ref()
+		}
+	}
+	v.refs.Store(1)
+	return v
+}
+
+func (v *version) ref() {
+	v.refs.Add(1)
+}
+
+// unref drops a reference, releasing the version's tables when it was the
+// last.
+func (v *version) unref() {
+	if v.refs.Add(-1) > 0 {
+		return
+	}
+	for _, level := range v.levels {
+		for _, sst := range level {
+			sst.unref()
+		}
+	}
+	v.levels = nil
+}
+
+// installVersion publishes db.levels as the current version. db.mu must be
+// held for writing.
+func (db *DB) installVersion() {
+	db.pinIndexes()
+	v := newVersion(db.levels)
+	db.versionMu.Lock()
+	old := db.current
+	db.current = v
+	db.versionMu.Unlock()
+	if old != nil {
+		old.unref()
+	}
+}
+
+// currentVersion returns the current version with a reference the caller
+// must drop with unref. It does not wait for db.mu.
+func (db *DB) currentVersion() *version {
+	db.versionMu.Lock()
+	defer db.versionMu.Unlock()
+	v := db.current
+	v.ref()
+	return v
+}
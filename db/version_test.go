@@ -0,0 +1,75 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadsDuringCompaction(t *testing.T) {
+	// Compactions block creating their L1 output until release is closed.
+	fs := db.NewFaultFileSystem()
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 1)
+	fs.OnMutation(func(op, name string) {
+		if op == "create" && strings.Contains(name, "sstable_l1_") {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+	})
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+
+	store, err := db.Open("versions", opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+		require.NoError(t, store.Flush())
+	}
+
+	// The fourth L0 table makes a compaction due, which Flush runs.
+	require.NoError(t, store.Put("key3", "value"))
+	done := make(chan error)
+	go func() { done <- store.Flush() }()
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("compaction never started")
+	}
+
+	// Reads, writes and flushes carry on against the current version.
+	for i := 0; i < 4; i++ {
+		value, err := store.Get(fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+	require.NoError(t, store.Put("key4", "value"))
+	value, err := store.Get("key4")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	close(release)
+	require.NoError(t, <-done)
+
+	require.NoError(t, store.Put("key0", "newer"))
+	require.NoError(t, store.Flush())
+	for i := 0; i < 5; i++ {
+		want := "value"
+		if i == 0 {
+			want = "newer"
+		}
+		value, err := store.Get(fmt.Sprintf("key%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, want, value)
+	}
+}
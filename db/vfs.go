@@ -0,0 +1,438 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// FileSystem is the storage every database file is read and written
+// through: the WAL, MANIFEST, SSTables and value log. Paths are ordinary
+// slash- or OS-separated paths as built by filepath.Join.
+type FileSystem interface {
+	// Create creates or truncates name for reading and writing.
+	Create(name string) (File, error)
+	// Open opens name read-only.
+	Open(name string) (File, error)
+	// OpenFile opens name with os.OpenFile flags.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// Link makes newname refer to the same file as oldname.
+	Link(oldname, newname string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the sorted names of the entries in dir.
+	ReadDir(dir string) ([]string, error)
+	// Glob returns the paths matching pattern, as filepath.Glob does.
+	Glob(pattern string) ([]string, error)
+	// SyncDir makes the creations, renames and removals of entries in dir
+	// durable, as Sync does for a file's contents.
+	SyncDir(dir string) error
+}
+
+// File is an open file of a FileSystem.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// OSFileSystem returns the FileSystem backed by the operating system.
+func OSFileSystem() FileSystem {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (File, error) { return os.Create(name) }
+func (osFS) Open(name string) (File, error)   { return os.Open(name) }
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Remove(name string) error                    { return os.Remove(name) }
+func (osFS) Rename(oldname, newname string) error        { return os.Rename(oldname, newname) }
+func (osFS) Link(oldname, newname string) error          { return os.Link(oldname, newname) }
+func (osFS) MkdirAll(dir string, perm os.FileMode) error { return os.MkdirAll(dir, perm) }
+func (osFS) Stat(name string) (os.FileInfo, error)       { return os.Stat(name) }
+func (osFS) Glob(pattern string) ([]string, error)       { return filepath.Glob(pattern) }
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+// fsOrDefault returns fs, or the OS filesystem when fs is nil.
+func fsOrDefault(fs FileSystem) FileSystem {
+	if fs == nil {
+		return osFS{}
+	}
+	return fs
+}
+
+// syncDirOf makes the directory entry of path, as just created, renamed or
+// removed, durable.
+func syncDirOf(fs FileSystem, path string) error {
+	if err := fs.SyncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync directory of %s: %w", path, err)
+	}
+	return nil
+}
+
+// readFile returns the contents of name.
+func readFile(fs FileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// mapFile returns the contents of f. Operating system files are memory
+// mapped and must be released with unmap; files of other filesystems are
+// read into memory and unmap is nil.
+func mapFile(f File) (data []byte, unmap func() error, err error) {
+	if osFile, ok := f.(*os.File); ok {
+		m, err := mmap.Map(osFile, mmap.RDONLY, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, m.Unmap, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data = make([]byte, info.Size())
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
+
+// MemFileSystem is a FileSystem held entirely in memory, for tests and
+// ephemeral databases. Written data is visible to readers immediately;
+// Sync is a no-op. It is safe for concurrent use.
+type MemFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+// memData is the contents of a file, shared by every name linked to it.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFileSystem returns an empty in-memory filesystem.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, "/": true},
+	}
+}
+
+func (fs *MemFileSystem) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (fs *MemFileSystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, d: d, flag: flag}, nil
+}
+
+func (fs *MemFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		if len(fs.children(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFileSystem) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = d
+	return nil
+}
+
+// SyncDir is a no-op: directory changes are immediately visible and there
+// is nothing to lose.
+func (fs *MemFileSystem) SyncDir(dir string) error {
+	return nil
+}
+
+func (fs *MemFileSystem) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[oldname]
+	if !ok || !fs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, exists := fs.files[newname]; exists {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	fs.files[newname] = d
+	return nil
+}
+
+func (fs *MemFileSystem) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for d := dir; !fs.dirs[d]; d = filepath.Dir(d) {
+		if _, ok := fs.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: fmt.Errorf("not a directory")}
+		}
+		fs.dirs[d] = true
+	}
+	return nil
+}
+
+func (fs *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if d, ok := fs.files[name]; ok {
+		return d.info(name), nil
+	}
+	if fs.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFileSystem) ReadDir(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.children(dir), nil
+}
+
+// children returns the sorted names of the files and directories directly
+// inside dir. fs.mu must be held.
+func (fs *MemFileSystem) children(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *MemFileSystem) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var matches []string
+	for name := range fs.files {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (d *memData) info(name string) memFileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open handle to a memData.
+type memFile struct {
+	name   string
+	d      *memData
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.d.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.data = append(f.d.data, make([]byte, end-int64(len(f.d.data)))...)
+	}
+	copy(f.d.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return f.d.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,51 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabaseOnMemFileSystem(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	opts.ValueLogThreshold = 64
+
+	store, err := db.Open("mem/db", opts)
+	require.NoError(t, err)
+
+	big := string(make([]byte, 100))
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 50; i++ {
+			require.NoError(t, store.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf("r%d", round)))
+		}
+		require.NoError(t, store.Put("big", big))
+		require.NoError(t, store.Flush())
+	}
+	require.NoError(t, store.Put("unflushed", "yes"))
+	require.NoError(t, store.Checkpoint("mem/backup"))
+	require.NoError(t, store.Close())
+
+	_, err = os.Stat("mem")
+	assert.True(t, os.IsNotExist(err), "nothing is written to the real filesystem")
+
+	names, err := fs.ReadDir("mem/db")
+	require.NoError(t, err)
+	assert.Contains(t, names, "CURRENT")
+
+	for _, dir := range []string{"mem/db", "mem/backup"} {
+		store, err := db.Open(dir, opts)
+		require.NoError(t, err)
+		for _, kv := range [][2]string{{"key007", "r5"}, {"big", big}, {"unflushed", "yes"}} {
+			value, err := store.Get(kv[0])
+			assert.NoError(t, err, dir)
+			assert.Equal(t, kv[1], value, dir)
+		}
+		require.NoError(t, store.Close())
+	}
+}
@@ -0,0 +1,455 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Large values can be kept out of the LSM tree in append-only value log
+// files, so that compaction moves small pointers around instead of rewriting
+// the payloads. A table whose properties mark it as holding separated values
+// stores every value in one of two forms, distinguished by a leading kind
+// byte: the value itself, or a pointer into a value log file.
+const (
+	valueKindInline  byte = 0
+	valueKindPointer byte = 1
+
+	valuePointerSize = 16
+
+	defaultValueLogFileSize = 64 << 20
+
+	// valueLogGCDiscardRatio is the fraction of a value log file that must
+	// be dead before garbage collection rewrites its live values.
+	valueLogGCDiscardRatio = 0.5
+
+	// vlogRecordHeaderSize covers [crc u32][key len u32][value len u32].
+	vlogRecordHeaderSize = 12
+)
+
+// valuePointer locates one value log record.
+type valuePointer struct {
+	file   uint32
+	offset int64
+	size   uint32 // whole record, header included
+}
+
+func (p valuePointer) encode() string {
+	buf := make([]byte, 1+valuePointerSize)
+	buf[0] = valueKindPointer
+	binary.LittleEndian.PutUint32(buf[1:5], p.file)
+	binary.LittleEndian.PutUint64(buf[5:13], uint64(p.offset))
+	binary.LittleEndian.PutUint32(buf[13:17], p.size)
+	return string(buf)
+}
+
+func decodeValuePointer(stored string) (valuePointer, error) {
+	if len(stored) != 1+valuePointerSize || stored[0] != valueKindPointer {
+		return valuePointer{}, fmt.Errorf("malformed value pointer")
+	}
+	b := []byte(stored[1:])
+	return valuePointer{
+		file:   binary.LittleEndian.Uint32(b[0:4]),
+		offset: int64(binary.LittleEndian.Uint64(b[4:12])),
+		size:   binary.LittleEndian.Uint32(b[12:16]),
+	}, nil
+}
+
+func encodeInline(value string) string {
+	return string(valueKindInline) + value
+}
+
+// valueLog manages the vlog_<n>.vlog files of a database. Appends always go
+// to a file created by this process; files from earlier runs are read-only
+// until garbage collection removes them.
+type valueLog struct {
+	fs          FileSystem
+	dir         string
+	maxFileSize int64
+
+	mu         sync.Mutex
+	files      map[uint32]File
+	active     File
+	activeNum  uint32
+	activeSize int64
+	nextNum    uint32
+}
+
+func vlogFilePath(dir string, num uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("vlog_%06d.vlog", num))
+}
+
+func openValueLog(fs FileSystem, dir string, maxFileSize int64) (*valueLog, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = defaultValueLogFileSize
+	}
+	v := &valueLog{fs: fs, dir: dir, maxFileSize: maxFileSize, files: make(map[uint32]File), nextNum: 1}
+
+	paths, err := fs.Glob(filepath.Join(dir, "vlog_*.vlog"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan value log files: %w", err)
+	}
+	for _, path := range paths {
+		var num uint32
+		if _, err := fmt.Sscanf(filepath.Base(path), "vlog_%d.vlog", &num); err != nil {
+			continue
+		}
+		f, err := fs.Open(path)
+		if err != nil {
+			v.close()
+			return nil, fmt.Errorf("failed to open value log %s: %w", path, err)
+		}
+		v.files[num] = f
+		if num >= v.nextNum {
+			v.nextNum = num + 1
+		}
+	}
+	return v, nil
+}
+
+// append writes key and value as a new record and returns its location. The
+// record is durable only after sync.
+func (v *valueLog) append(key, value string) (valuePointer, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.active == nil || v.activeSize >= v.maxFileSize {
+		if err := v.rotate(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	rec := make([]byte, vlogRecordHeaderSize, vlogRecordHeaderSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(key)))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(value)))
+	rec = append(rec, key...)
+	rec = append(rec, value...)
+	binary.LittleEndian.PutUint32(rec[0:4], crc32.Checksum(rec[4:], castagnoli))
+
+	if _, err := v.active.Write(rec); err != nil {
+		return valuePointer{}, fmt.Errorf("failed to append to value log: %w", err)
+	}
+	p := valuePointer{file: v.activeNum, offset: v.activeSize, size: uint32(len(rec))}
+	v.activeSize += int64(len(rec))
+	return p, nil
+}
+
+// rotate seals the active file and starts a new one. The sealed file stays
+// open for reads. v.mu must be held.
+func (v *valueLog) rotate() error {
+	if v.active != nil {
+		if err := v.active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync value log: %w", err)
+		}
+	}
+
+	num := v.nextNum
+	f, err := v.fs.OpenFile(vlogFilePath(v.dir, num), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log: %w", err)
+	}
+	if err := syncDirOf(v.fs, vlogFilePath(v.dir, num)); err != nil {
+		f.Close()
+		return err
+	}
+	v.nextNum++
+	v.active, v.activeNum, v.activeSize = f, num, 0
+	v.files[num] = f
+	return nil
+}
+
+func (v *valueLog) sync() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.active == nil {
+		return nil
+	}
+	return v.active.Sync()
+}
+
+// read returns the value of the record at p.
+func (v *valueLog) read(p valuePointer) (string, error) {
+	v.mu.Lock()
+	f := v.files[p.file]
+	v.mu.Unlock()
+	if f == nil {
+		return "", fmt.Errorf("value log file %d does not exist", p.file)
+	}
+
+	rec := make([]byte, p.size)
+	if _, err := f.ReadAt(rec, p.offset); err != nil {
+		return "", fmt.Errorf("failed to read value log %d at %d: %w", p.file, p.offset, err)
+	}
+	_, value, err := decodeVlogRecord(rec)
+	if err != nil {
+		return "", fmt.Errorf("value log %d at %d: %w", p.file, p.offset, err)
+	}
+	return value, nil
+}
+
+func decodeVlogRecord(rec []byte) (key, value string, err error) {
+	if len(rec) < vlogRecordHeaderSize {
+		return "", "", fmt.Errorf("truncated record")
+	}
+	keyLen := int(binary.LittleEndian.Uint32(rec[4:8]))
+	valueLen := int(binary.LittleEndian.Uint32(rec[8:12]))
+	if vlogRecordHeaderSize+keyLen+valueLen != len(rec) {
+		return "", "", fmt.Errorf("record length mismatch")
+	}
+	if crc32.Checksum(rec[4:], castagnoli) != binary.LittleEndian.Uint32(rec[0:4]) {
+		return "", "", fmt.Errorf("record checksum mismatch")
+	}
+	body := rec[vlogRecordHeaderSize:]
+	return string(body[:keyLen]), string(body[keyLen:]), nil
+}
+
+// resolve turns a stored value into the user's value, reading pointers from
+// the value log.
+func (v *valueLog) resolve(stored string) (string, error) {
+	if stored == "" {
+		return "", fmt.Errorf("stored value is missing its kind byte")
+	}
+	switch stored[0] {
+	case valueKindInline:
+		return stored[1:], nil
+	case valueKindPointer:
+		if v == nil {
+			return "", fmt.Errorf("value pointer without a value log")
+		}
+		p, err := decodeValuePointer(stored)
+		if err != nil {
+			return "", err
+		}
+		return v.read(p)
+	default:
+		return "", fmt.Errorf("unknown stored value kind %d", stored[0])
+	}
+}
+
+// sealed returns the numbers of every file that is no longer appended to,
+// oldest first.
+func (v *valueLog) sealed() []uint32 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var nums []uint32
+	for num := range v.files {
+		if v.active == nil || num != v.activeNum {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+// scan calls fn for every intact record of file num, stopping at the first
+// record that does not decode (a torn tail).
+func (v *valueLog) scan(num uint32, fn func(key, value string, p valuePointer)) error {
+	data, err := readFile(v.fs, vlogFilePath(v.dir, num))
+	if err != nil {
+		return fmt.Errorf("failed to read value log %d: %w", num, err)
+	}
+	offset := 0
+	for offset+vlogRecordHeaderSize <= len(data) {
+		size := vlogRecordHeaderSize +
+			int(binary.LittleEndian.Uint32(data[offset+4:])) +
+			int(binary.LittleEndian.Uint32(data[offset+8:]))
+		if size < vlogRecordHeaderSize || offset+size > len(data) {
+			break
+		}
+		key, value, err := decodeVlogRecord(data[offset : offset+size])
+		if err != nil {
+			break
+		}
+		fn(key, value, valuePointer{file: num, offset: int64(offset), size: uint32(size)})
+		offset += size
+	}
+	return nil
+}
+
+func (v *valueLog) remove(num uint32) error {
+	v.mu.Lock()
+	f := v.files[num]
+	delete(v.files, num)
+	v.mu.Unlock()
+
+	if f != nil {
+		f.Close()
+	}
+	if err := v.fs.Remove(vlogFilePath(v.dir, num)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// paths returns the paths of every value log file.
+func (v *valueLog) paths() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var paths []string
+	for num := range v.files {
+		paths = append(paths, vlogFilePath(v.dir, num))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (v *valueLog) close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var firstErr error
+	if v.active != nil {
+		if err := v.active.Sync(); err != nil {
+			firstErr = err
+		}
+	}
+	for num, f := range v.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(v.files, num)
+	}
+	v.active = nil
+	return firstErr
+}
+
+// separateValue returns value in stored form, moving it into the value log
+// if it is at least ValueLogThreshold bytes. The value log must be synced
+// before the returned pointer is written to a table.
+func (db *DB) separateValue(key, value string) (string, error) {
+	if len(value) < db.opts.ValueLogThreshold {
+		return encodeInline(value), nil
+	}
+	p, err := db.vlog.append(key, value)
+	if err != nil {
+		return "", err
+	}
+	return p.encode(), nil
+}
+
+// resolveValues converts kvs from stored form back to user values.
+func (db *DB) resolveValues(kvs [][2]string) ([][2]string, error) {
+	for i, kv := range kvs {
+		value, err := db.vlog.resolve(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve value of %s: %w", kv[0], err)
+		}
+		kvs[i][1] = value
+	}
+	return kvs, nil
+}
+
+// ValueLogGC reclaims space in sealed value log files. A file is rewritten
+// when at least half of it is dead: its live values are written back
+// through the WAL into the memtable, to be separated again into the current
+// value log on the next flush, and the file is deleted. Collection is skipped
+// while snapshots are live, since they may still read the old files.
+func (db *DB) ValueLogGC() error {
+	if db.closed.Load() {
+		return fmt.Errorf("failed to collect value log: %w", ErrClosed)
+	}
+	for _, num := range db.vlog.sealed() {
+		if err := db.collectValueLog(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type vlogRecord struct {
+	key, value string
+	ptr        valuePointer
+}
+
+func (db *DB) collectValueLog(num uint32) error {
+	var records []vlogRecord
+	var total int64
+	if err := db.vlog.scan(num, func(key, value string, p valuePointer) {
+		records = append(records, vlogRecord{key: key, value: value, ptr: p})
+		total += int64(p.size)
+	}); err != nil {
+		return err
+	}
+
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.snapMu.Lock()
+	liveSnapshots := len(db.snapshots)
+	db.snapMu.Unlock()
+	if liveSnapshots > 0 {
+		return nil
+	}
+
+	var live [][2]string
+	var liveBytes int64
+	for _, rec := range records {
+		ok, err := db.pointsTo(rec.key, rec.ptr)
+		if err != nil {
+			return fmt.Errorf("failed to check value log record for %s: %w", rec.key, err)
+		}
+		if ok {
+			live = append(live, [2]string{rec.key, rec.value})
+			liveBytes += int64(rec.ptr.size)
+		}
+	}
+	if total > 0 && float64(liveBytes) > (1-valueLogGCDiscardRatio)*float64(total) {
+		return nil
+	}
+
+	if len(live) > 0 {
+		if err := db.wal.AppendBatch(live); err != nil {
+			return fmt.Errorf("failed to log relocated values: %w", err)
+		}
+		for _, kv := range live {
+			db.memTable.put(kv[0], kv[1], db.seq)
+		}
+	}
+	if err := db.vlog.remove(num); err != nil {
+		return fmt.Errorf("failed to remove value log %d: %w", num, err)
+	}
+	log.Printf("Value log GC: removed file %d, relocated %d of %d values", num, len(live), len(records))
+	return nil
+}
+
+// pointsTo reports whether the newest version of key is the value log record
+// at p. It must be called with db.mu held.
+func (db *DB) pointsTo(key string, p valuePointer) (bool, error) {
+	if _, ok := db.memGet(key); ok {
+		return false, nil
+	}
+	stored, ok, err := walkLevels(db.levels, key, func(sst *SSTable) (string, lookupResult, error) {
+		return sst.lookupStored(key)
+	})
+	if err != nil || !ok {
+		return false, err
+	}
+	return stored == p.encode(), nil
+}
+
+func (db *DB) valueLogGCLoop(interval time.Duration) {
+	defer db.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			if err := db.ValueLogGC(); err != nil && !errors.Is(err, ErrClosed) {
+				log.Printf("Value log GC failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package db_test
+
+import (
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueLogSeparatesAndCollectsLargeValues(t *testing.T) {
+	dir := "testdata/vlog"
+	_ = os.RemoveAll(dir)
+
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	opts := db.DefaultOptions()
+	opts.ValueLogThreshold = 100
+	opts.ValueLogFileSize = 8 << 10
+	store, err := db.Open(dir, opts)
+	require.NoError(t, err)
+
+	large := func(i, version int) string {
+		return strings.Repeat(fmt.Sprintf("%d-%d;", i, version), 200)
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("big%02d", i), large(i, 1)))
+	}
+	require.NoError(t, store.Put("small", "inline"))
+	require.NoError(t, store.Flush())
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.Len(t, tables, 1)
+	info, err := os.Stat(tables[0])
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(2*len(large(0, 1))), "large values should live in the value log")
+
+	firstLogs, _ := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	assert.Greater(t, len(firstLogs), 1)
+
+	// Overwrite every large value so the first files become garbage.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("big%02d", i), large(i, 2)))
+	}
+	require.NoError(t, store.Flush())
+	require.NoError(t, store.ValueLogGC())
+
+	for _, path := range firstLogs[:len(firstLogs)-1] {
+		assert.NoFileExists(t, path, "fully overwritten value log should be collected")
+	}
+	require.NoError(t, store.Close())
+
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		got, err := store.Get(fmt.Sprintf("big%02d", i))
+		require.NoError(t, err)
+		assert.Equal(t, large(i, 2), got)
+	}
+	got, err := store.Get("small")
+	require.NoError(t, err)
+	assert.Equal(t, "inline", got)
+}
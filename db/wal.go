@@ -2,55 +2,198 @@ package db
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type WAL struct {
-	file   *os.File
+	file   File
 	writer *bufio.Writer
+	// lastCheckpoint is when the last checkpoint record was written, and
+	// checkpointInterval how long the WAL goes before writing another.
+	lastCheckpoint     time.Time
+	checkpointInterval time.Duration
 }
 
+// defaultWALCheckpointInterval is the checkpoint interval of WALs whose
+// Options.WALCheckpointInterval is zero.
+const defaultWALCheckpointInterval = time.Second
+
+// A WAL record is [length u32][crc32 u32][data]. Typed records set
+// walTypedRecord in the length and start their data with a walRecordType
+// byte, followed by [keylen u32][key][vallen u32][value]; records from
+// before types existed have no type byte and are puts.
+const walTypedRecord = 1 << 31
+
+// walRecordType is the kind of a typed WAL record.
+type walRecordType uint8
+
+const (
+	walPut walRecordType = iota + 1
+	walDelete
+	walRangeDelete // key is the start of the range and value its end
+	walBatchBegin  // value is the number of records up to the BatchEnd; replayed, no longer written
+	walBatchEnd    // replayed, no longer written
+	walCheckpoint  // value is the sequence number of the last write before it and the time; see appendCheckpoint
+	walBatch       // value is a batch of Put and Delete records; see encodeWALBatch
+)
+
+// walRecord is a decoded WAL record.
+type walRecord struct {
+	typ   walRecordType
+	key   string
+	value string
+}
+
+// putRecord returns the record logging the write of value to key: a Delete
+// when value is a tombstone, a Put otherwise.
+func putRecord(key, value string) walRecord {
+	if isDeleted(key, value) {
+		return walRecord{typ: walDelete, key: key}
+	}
+	return walRecord{typ: walPut, key: key, value: value}
+}
+
+// checkpoint returns the sequence number and time a checkpoint record
+// carries. Records written before checkpoints had a time return the zero
+// time.
+func (rec walRecord) checkpoint() (uint64, time.Time, error) {
+	if len(rec.value) != 8 && len(rec.value) != 16 {
+		return 0, time.Time{}, fmt.Errorf("%w: checkpoint record of %d bytes", ErrCorruption, len(rec.value))
+	}
+	seq := binary.LittleEndian.Uint64([]byte(rec.value))
+	if len(rec.value) == 8 {
+		return seq, time.Time{}, nil
+	}
+	return seq, time.Unix(0, int64(binary.LittleEndian.Uint64([]byte(rec.value[8:])))), nil
+}
+
+// walFilePath returns the unnumbered WAL that databases used before each
+// memtable got a WAL of its own. NewWAL still writes there, and it is
+// replayed before any numbered WAL.
 func walFilePath(dir string) string {
 	return filepath.Join(dir, ".walb")
 }
 
+// walFiles returns the WALs in dir in the order they were written: the
+// unnumbered WAL first, then the numbered ones by file number.
+func walFiles(fs FileSystem, dir string) ([]string, error) {
+	paths, err := fs.Glob(filepath.Join(dir, "*.walb"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan WAL files: %w", err)
+	}
+	type numbered struct {
+		path string
+		num  uint64
+	}
+	var legacy []string
+	var wals []numbered
+	for _, path := range paths {
+		if path == walFilePath(dir) {
+			legacy = append(legacy, path)
+			continue
+		}
+		m := fileNumberPattern.FindStringSubmatch(filepath.Base(path))
+		if m == nil || m[2] == "" {
+			continue
+		}
+		num, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		wals = append(wals, numbered{path: path, num: num})
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i].num < wals[j].num })
+	for _, w := range wals {
+		legacy = append(legacy, w.path)
+	}
+	return legacy, nil
+}
+
+// liveWALs is walFiles without the WALs a flush has made obsolete: those
+// numbered below logNumber. The unnumbered WAL counts as number zero.
+func liveWALs(fs FileSystem, dir string, logNumber uint64) ([]string, error) {
+	paths, err := walFiles(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, path := range paths {
+		if walNumber(path) >= logNumber {
+			live = append(live, path)
+		}
+	}
+	return live, nil
+}
+
+// walNumber returns the file number of the WAL at path, or zero for the
+// unnumbered WAL.
+func walNumber(path string) uint64 {
+	m := fileNumberPattern.FindStringSubmatch(filepath.Base(path))
+	if m == nil || m[2] == "" {
+		return 0
+	}
+	num, _ := strconv.ParseUint(m[2], 10, 64)
+	return num
+}
+
 func NewWAL(dir string) (*WAL, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	return openWAL(osFS{}, walFilePath(dir))
+}
+
+// openWAL opens the WAL at path for appending, creating it and its
+// directory if needed.
+func openWAL(fs FileSystem, path string) (*WAL, error) {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
 	}
 
-	filePath := walFilePath(dir)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
 	}
+	// Synced records are only durable once the WAL's name is.
+	if err := syncDirOf(fs, path); err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	writer := bufio.NewWriter(file)
 
 	return &WAL{
-		file:   file,
-		writer: writer,
+		file:               file,
+		writer:             writer,
+		checkpointInterval: defaultWALCheckpointInterval,
 	}, nil
 }
 
 func (w *WAL) Append(key, value string) error {
-	return w.writeBinaryRecord(key, value)
+	if err := w.writeRecord(putRecord(key, value)); err != nil {
+		return err
+	}
+	return w.sync()
 }
 
+// AppendBatch writes kvs as a single batch record, so replay applies all of
+// them or none, and syncs once.
 func (w *WAL) AppendBatch(kvs [][2]string) error {
 	if w.writer == nil {
 		return os.ErrInvalid
 	}
 
-	for _, kv := range kvs {
-		if err := w.writeBinaryRecordNoSync(kv[0], kv[1]); err != nil {
-			return fmt.Errorf("failed to write batch record: %w", err)
-		}
+	if err := w.writeBatch(kvs); err != nil {
+		return err
 	}
 
 	if err := w.writer.Flush(); err != nil {
@@ -63,6 +206,138 @@ func (w *WAL) AppendBatch(kvs [][2]string) error {
 	return nil
 }
 
+// appendGroup logs every request of a commit group and, if sync is set,
+// syncs once. Atomic requests become a single batch record. seq is the
+// sequence number of the last write before the group: the group starts
+// with a checkpoint record if checkpointInterval has passed since the
+// last one, and every range delete is followed by one, since replaying it
+// may not write the same number of tombstones.
+func (w *WAL) appendGroup(group []*writeRequest, sync bool, seq uint64) error {
+	if w.writer == nil {
+		return os.ErrInvalid
+	}
+
+	if time.Since(w.lastCheckpoint) >= w.checkpointInterval {
+		if err := w.appendCheckpoint(seq); err != nil {
+			return err
+		}
+	}
+	for _, req := range group {
+		seq += uint64(len(req.kvs))
+		if req.atomic {
+			if err := w.writeBatch(req.kvs); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(req.ranges) > 0 {
+			// Replay expands the ranges again rather than logging their
+			// tombstones one by one.
+			for _, r := range req.ranges {
+				if err := w.writeRecord(walRecord{typ: walRangeDelete, key: r[0], value: r[1]}); err != nil {
+					return fmt.Errorf("failed to write range delete: %w", err)
+				}
+			}
+			if err := w.appendCheckpoint(seq); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, kv := range req.kvs {
+			if err := w.writeRecord(putRecord(kv[0], kv[1])); err != nil {
+				return fmt.Errorf("failed to write record: %w", err)
+			}
+		}
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush group: %w", err)
+	}
+	if !sync {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync group: %w", err)
+	}
+
+	return nil
+}
+
+// writeBatch writes kvs as one batch record. Its single checksum covers the
+// whole batch, so a torn write loses all of it.
+func (w *WAL) writeBatch(kvs [][2]string) error {
+	if err := w.writeRecord(walRecord{typ: walBatch, value: encodeWALBatch(kvs)}); err != nil {
+		return fmt.Errorf("failed to write batch record: %w", err)
+	}
+	return nil
+}
+
+// encodeWALBatch encodes kvs as a batch record's value: [count u32], then
+// for each write [type u8][keylen u32][key][vallen u32][value], where the
+// type is walPut or walDelete and a delete's value is empty.
+func encodeWALBatch(kvs [][2]string) string {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(kvs)))
+	for _, kv := range kvs {
+		rec := putRecord(kv[0], kv[1])
+		buf.WriteByte(byte(rec.typ))
+		_ = writeString(&buf, rec.key)
+		_ = writeString(&buf, rec.value)
+	}
+	return buf.String()
+}
+
+// decodeWALBatch decodes a batch record's value into its records.
+func decodeWALBatch(value string) ([]walRecord, error) {
+	r := strings.NewReader(value)
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("failed to read batch count: %w", err)
+	}
+	if int64(count) > int64(len(value)) {
+		return nil, fmt.Errorf("batch count %d exceeds record size", count)
+	}
+
+	recs := make([]walRecord, 0, count)
+	for i := uint32(0); i < count; i++ {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch record %d: %w", i, err)
+		}
+		rec := walRecord{typ: walRecordType(typ)}
+		if rec.typ != walPut && rec.typ != walDelete {
+			return nil, fmt.Errorf("batch record %d has type %d", i, typ)
+		}
+		if rec.key, err = readString(r); err != nil {
+			return nil, fmt.Errorf("failed to read batch key %d: %w", i, err)
+		}
+		if rec.value, err = readString(r); err != nil {
+			return nil, fmt.Errorf("failed to read batch value %d: %w", i, err)
+		}
+		recs = append(recs, rec)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("batch record has %d trailing bytes", r.Len())
+	}
+	return recs, nil
+}
+
+// appendCheckpoint writes a checkpoint record carrying seq, the sequence
+// number of the last write before it, and the current time: [seq u64]
+// [unix nanoseconds i64]. It is not synced; the next synced write makes it
+// durable.
+func (w *WAL) appendCheckpoint(seq uint64) error {
+	now := time.Now()
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, seq)
+	binary.LittleEndian.PutUint64(value[8:], uint64(now.UnixNano()))
+	if err := w.writeRecord(walRecord{typ: walCheckpoint, value: string(value)}); err != nil {
+		return fmt.Errorf("failed to write checkpoint record: %w", err)
+	}
+	w.lastCheckpoint = now
+	return nil
+}
+
 func (w *WAL) Close() error {
 	if err := w.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush WAL writer on close: %w", err)
@@ -71,93 +346,364 @@ func (w *WAL) Close() error {
 	return w.file.Close()
 }
 
+// Replay reads the WALs in dir that have not been flushed and returns the
+// resulting key-value state. Keys the WALs delete are left out.
 func Replay(dir string) (map[string]string, error) {
-	filePath := walFilePath(dir)
+	replayData := make(map[string]string)
+	err := replayWAL(osFS{}, dir, manifestLogNumber(osFS{}, dir), func(rec walRecord) {
+		switch rec.typ {
+		case walPut:
+			replayData[rec.key] = rec.value
+		case walDelete:
+			delete(replayData, rec.key)
+		case walRangeDelete:
+			for key := range replayData {
+				if key >= rec.key && key < rec.value {
+					delete(replayData, key)
+				}
+			}
+		}
+	})
+	return replayData, err
+}
 
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+// WALRecoveryMode selects what Open does with a WAL record it cannot read or
+// replay, such as one torn by a crash or damaged on disk.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryFail replays every record it can and then fails Open,
+	// reporting the others. Repair can salvage such a database.
+	WALRecoveryFail WALRecoveryMode = iota
+
+	// WALRecoveryTruncate stops replay at the first such record, truncates
+	// its WAL to just before it and empties every later WAL, and opens the
+	// database as of that point. Writes after the damage are lost, but none
+	// is applied over a write the damage hid. DB.WALRecovery reports what
+	// was cut off.
+	WALRecoveryTruncate
+)
+
+// WALRecoveryReport describes what WALRecoveryTruncate cut off when the
+// database was opened.
+type WALRecoveryReport struct {
+	// TruncatedWALs are the WALs cut short: the damaged one, then every
+	// later one, emptied.
+	TruncatedWALs []string
+	// DiscardedRecords counts the records that could still be read in what
+	// was cut off; DiscardedBytes counts every byte, the damaged record's
+	// included.
+	DiscardedRecords int
+	DiscardedBytes   int64
+}
+
+// replayWAL calls apply for every record in the WALs in dir numbered
+// logNumber or above, in log order, skipping the records it cannot read.
+func replayWAL(fs FileSystem, dir string, logNumber uint64, apply func(walRecord)) error {
+	paths, err := liveWALs(fs, dir, logNumber)
+	if err != nil {
+		return err
+	}
+	if errs := replayWALFiles(fs, paths, apply); len(errs) > 0 {
+		return fmt.Errorf("failed to replay WAL: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// replayWALFiles calls apply for every record of the WALs at paths, given
+// in file number order, skipping the records it cannot read. When column
+// family WALs are among them, the records of every WAL are read first and
+// then replayed in sequence order.
+func replayWALFiles(fs FileSystem, paths []string, apply func(walRecord)) []error {
+	var errs []error
+	if !hasFamilyWALs(paths) {
+		for _, path := range paths {
+			errs = append(errs, replayWALFile(fs, path, false, apply).errs...)
+		}
+		return errs
+	}
+	var segs walSegments
+	for _, path := range paths {
+		errs = append(errs, replayWALFile(fs, path, false, segs.collect()).errs...)
+	}
+	segs.replay(apply)
+	return errs
+}
+
+// replayWALTruncating is replayWAL for WALRecoveryTruncate: it stops at the
+// first record it cannot replay, truncates that WAL to just before it, and
+// empties every later WAL, so what remains is the log up to that point.
+// When column family WALs are among them, the WALs are independent logs:
+// each is cut at its own damage and the others are replayed whole.
+func replayWALTruncating(fs FileSystem, dir string, logNumber uint64, apply func(walRecord)) (WALRecoveryReport, error) {
+	var report WALRecoveryReport
+	paths, err := liveWALs(fs, dir, logNumber)
+	if err != nil {
+		return report, err
+	}
+	merged := hasFamilyWALs(paths)
+	var segs walSegments
+	replay := apply
+	damaged := false
+	for _, path := range paths {
+		if damaged {
+			if err := discardWAL(fs, path, &report); err != nil {
+				return report, err
+			}
+			continue
+		}
+
+		if merged {
+			replay = segs.collect()
+		}
+		res := replayWALFile(fs, path, true, replay)
+		if len(res.errs) > 0 {
+			return report, fmt.Errorf("failed to replay WAL: %w", errors.Join(res.errs...))
+		}
+		if res.damagedAt < 0 {
+			continue
+		}
+		damaged = !merged
+		log.Printf("Warning: WAL %s is damaged at offset %d: %v; truncating it there", path, res.damagedAt, res.damage)
+		report.DiscardedRecords += res.discarded
+		report.DiscardedBytes += res.size - res.damagedAt
+		if err := truncateFile(fs, path, res.damagedAt); err != nil {
+			return report, err
+		}
+		report.TruncatedWALs = append(report.TruncatedWALs, path)
+	}
+	segs.replay(apply)
+	return report, nil
+}
+
+// discardWAL empties the WAL at path, adding what it held to report.
+func discardWAL(fs FileSystem, path string, report *WALRecoveryReport) error {
+	file, err := fs.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open WAL file for replay: %w", err)
+	}
+	r := &offsetReader{r: bufio.NewReader(file)}
+	records := countWALRecords(r)
+	_, _ = io.Copy(io.Discard, r)
+	file.Close()
+	if r.n == 0 {
+		return nil
+	}
+	report.DiscardedRecords += records
+	report.DiscardedBytes += r.n
+	report.TruncatedWALs = append(report.TruncatedWALs, path)
+	return truncateFile(fs, path, 0)
+}
+
+// walFileReplay is the outcome of replaying one WAL file.
+type walFileReplay struct {
+	errs []error // the records skipped, or the failure to open the file
+
+	// When replay stops at damage, damagedAt is the offset of the record it
+	// could not replay, damage says why, and discarded counts the readable
+	// records after it. damagedAt is -1 if the file is intact.
+	damagedAt int64
+	damage    error
+	discarded int
+	size      int64 // bytes in the file
+}
+
+// replayWALFile calls apply for every Put, Delete, RangeDelete and
+// Checkpoint record in the WAL at path, including those in batch records.
+// A record it cannot read or make sense of is skipped, or, with
+// stopAtDamage, ends the replay. A damaged batch record is skipped whole.
+// WALs written before batches were single records frame them with
+// BatchBegin and BatchEnd: their records are held back until the BatchEnd
+// and then applied together, a batch left open by a damaged record or a
+// new BatchBegin is dropped whole, and one left open at the end of the
+// file, whose write was never acknowledged, is dropped silently.
+func replayWALFile(fs FileSystem, path string, stopAtDamage bool, apply func(walRecord)) walFileReplay {
+	res := walFileReplay{damagedAt: -1}
+	file, err := fs.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return map[string]string{}, nil
+			return res
 		}
-		return nil, fmt.Errorf("failed to open WAL file for replay: %w", err)
+		res.errs = []error{fmt.Errorf("failed to open WAL file for replay: %w", err)}
+		return res
 	}
 	defer file.Close()
 
-	replayData := make(map[string]string)
-	var errors []error
+	r := &offsetReader{r: bufio.NewReader(file)}
+	var batch []walRecord
+	inBatch := false
+	var batchCount uint32
+
+	replay := func(rec walRecord) error {
+		switch rec.typ {
+		case walBatchBegin:
+			if inBatch {
+				err := fmt.Errorf("%w: batch of %d records has no end", ErrCorruption, batchCount)
+				if stopAtDamage {
+					return err
+				}
+				res.errs = append(res.errs, err)
+			}
+			if len(rec.value) != 4 {
+				batch, inBatch = nil, false
+				return fmt.Errorf("%w: batch begin record of %d bytes", ErrCorruption, len(rec.value))
+			}
+			batch, inBatch = batch[:0], true
+			batchCount = binary.LittleEndian.Uint32([]byte(rec.value))
+		case walBatchEnd:
+			if !inBatch {
+				return fmt.Errorf("%w: batch end without a beginning", ErrCorruption)
+			}
+			inBatch = false
+			if uint32(len(batch)) != batchCount {
+				return fmt.Errorf("%w: batch holds %d records, want %d", ErrCorruption, len(batch), batchCount)
+			}
+			for _, r := range batch {
+				apply(r)
+			}
+		case walBatch:
+			recs, err := decodeWALBatch(rec.value)
+			if err != nil {
+				return fmt.Errorf("invalid WAL batch: %w", err)
+			}
+			for _, r := range recs {
+				apply(r)
+			}
+		case walPut, walDelete, walRangeDelete, walCheckpoint:
+			if rec.typ == walPut && rec.key == batchRecordKey {
+				kvs, err := decodeBatch([]byte(rec.value))
+				if err != nil {
+					return fmt.Errorf("invalid WAL batch: %w", err)
+				}
+				for _, kv := range kvs {
+					apply(putRecord(kv[0], kv[1]))
+				}
+				return nil
+			}
+			if inBatch {
+				batch = append(batch, rec)
+				return nil
+			}
+			apply(rec)
+		default:
+			return fmt.Errorf("%w: unknown WAL record type %d", ErrCorruption, rec.typ)
+		}
+		return nil
+	}
 
 	for {
-		key, value, err := readBinaryRecord(file)
+		start := r.n
+		rec, err := readWALRecord(r)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			errors = append(errors, fmt.Errorf("invalid WAL entry: %w", err))
+			err = fmt.Errorf("invalid WAL entry: %w", err)
+			batch, inBatch = nil, false
+		} else {
+			err = replay(rec)
+		}
+		if err == nil {
+			continue
+		}
+		if !stopAtDamage {
+			res.errs = append(res.errs, err)
 			continue
 		}
-		replayData[key] = value
-	}
 
-	if len(errors) > 0 {
-		return replayData, fmt.Errorf("failed to replay WAL: %v", errors)
+		res.damagedAt, res.damage = start, err
+		res.discarded = countWALRecords(r)
+		break
 	}
+	// Read whatever a torn record left, so size is the file's length.
+	_, _ = io.Copy(io.Discard, r)
+	res.size = r.n
 
-	return replayData, nil
+	return res
 }
 
-func (w *WAL) writeBinaryRecord(key, value string) error {
-	if w.writer == nil {
-		return os.ErrInvalid
+// countWALRecords reads r to its end and returns how many records it could
+// read.
+func countWALRecords(r io.Reader) int {
+	n := 0
+	for {
+		_, err := readWALRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n
+		}
+		if err == nil {
+			n++
+		}
 	}
+}
 
-	keyBytes := []byte(key)
-	valueBytes := []byte(value)
+// offsetReader counts the bytes read through it.
+type offsetReader struct {
+	r io.Reader
+	n int64
+}
 
-	data := make([]byte, 4+len(keyBytes)+4+len(valueBytes))
-	binary.LittleEndian.PutUint32(data[0:4], uint32(len(keyBytes)))
-	copy(data[4:4+len(keyBytes)], keyBytes)
-	binary.LittleEndian.PutUint32(data[4+len(keyBytes):8+len(keyBytes)], uint32(len(valueBytes)))
-	copy(data[8+len(keyBytes):], valueBytes)
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
 
-	crc := crc32.ChecksumIEEE(data)
+// truncateFile cuts the file at path down to its first size bytes. The
+// FileSystem has no truncate, so the kept bytes are written to a temporary
+// file that is synced and renamed over it.
+func truncateFile(fs FileSystem, path string, size int64) error {
+	in, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for truncation: %w", path, err)
+	}
+	defer in.Close()
 
-	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(data))); err != nil {
-		return fmt.Errorf("failed to write record length: %w", err)
+	tmpPath := path + ".tmp"
+	out, err := fs.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", path, err)
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, crc); err != nil {
-		return fmt.Errorf("failed to write CRC: %w", err)
+	if _, err := io.Copy(out, io.NewSectionReader(in, 0, size)); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return fmt.Errorf("failed to truncate %s: %w", path, err)
 	}
-	if _, err := w.writer.Write(data); err != nil {
-		return fmt.Errorf("failed to write data: %w", err)
+	if err := out.Sync(); err != nil {
+		out.Close()
+		fs.Remove(tmpPath)
+		return fmt.Errorf("failed to sync truncated %s: %w", path, err)
 	}
-
-	if err := w.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush WAL writer: %w", err)
+	if err := out.Close(); err != nil {
+		fs.Remove(tmpPath)
+		return fmt.Errorf("failed to truncate %s: %w", path, err)
 	}
-	if err := w.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync WAL file: %w", err)
+	if err := fs.Rename(tmpPath, path); err != nil {
+		fs.Remove(tmpPath)
+		return fmt.Errorf("failed to truncate %s: %w", path, err)
 	}
-
-	return nil
+	return syncDirOf(fs, path)
 }
 
-func (w *WAL) writeBinaryRecordNoSync(key, value string) error {
+// writeRecord appends rec to the writer's buffer without flushing it.
+func (w *WAL) writeRecord(rec walRecord) error {
 	if w.writer == nil {
 		return os.ErrInvalid
 	}
 
-	keyBytes := []byte(key)
-	valueBytes := []byte(value)
-
-	data := make([]byte, 4+len(keyBytes)+4+len(valueBytes))
-	binary.LittleEndian.PutUint32(data[0:4], uint32(len(keyBytes)))
-	copy(data[4:4+len(keyBytes)], keyBytes)
-	binary.LittleEndian.PutUint32(data[4+len(keyBytes):8+len(keyBytes)], uint32(len(valueBytes)))
-	copy(data[8+len(keyBytes):], valueBytes)
+	data := make([]byte, 1+4+len(rec.key)+4+len(rec.value))
+	data[0] = byte(rec.typ)
+	binary.LittleEndian.PutUint32(data[1:5], uint32(len(rec.key)))
+	copy(data[5:], rec.key)
+	binary.LittleEndian.PutUint32(data[5+len(rec.key):], uint32(len(rec.value)))
+	copy(data[9+len(rec.key):], rec.value)
 
 	crc := crc32.ChecksumIEEE(data)
 
-	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(data))); err != nil {
+	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(data))|walTypedRecord); err != nil {
 		return fmt.Errorf("failed to write record length: %w", err)
 	}
 	if err := binary.Write(w.writer, binary.LittleEndian, crc); err != nil {
@@ -170,29 +716,53 @@ func (w *WAL) writeBinaryRecordNoSync(key, value string) error {
 	return nil
 }
 
-func readBinaryRecord(file *os.File) (string, string, error) {
+// readWALRecord reads the next record from file. Records written before
+// records were typed are returned as puts.
+func readWALRecord(file io.Reader) (walRecord, error) {
 	var length, crc uint32
 
 	if err := binary.Read(file, binary.LittleEndian, &length); err != nil {
-		return "", "", err
+		return walRecord{}, err
 	}
 	if err := binary.Read(file, binary.LittleEndian, &crc); err != nil {
-		return "", "", err
+		return walRecord{}, err
 	}
+	typed := length&walTypedRecord != 0
+	length &^= walTypedRecord
 
-	data := make([]byte, length)
-	if _, err := io.ReadFull(file, data); err != nil {
-		return "", "", err
+	data, err := readFullBounded(file, int64(length))
+	if err != nil {
+		return walRecord{}, err
 	}
 
 	if crc32.ChecksumIEEE(data) != crc {
-		return "", "", fmt.Errorf("CRC mismatch")
+		return walRecord{}, fmt.Errorf("%w: CRC mismatch", ErrCorruption)
+	}
+
+	rec := walRecord{typ: walPut}
+	if typed {
+		if len(data) < 1 {
+			return walRecord{}, fmt.Errorf("%w: record too short: %d bytes", ErrCorruption, len(data))
+		}
+		rec.typ = walRecordType(data[0])
+		data = data[1:]
 	}
 
-	keyLen := binary.LittleEndian.Uint32(data[0:4])
-	key := string(data[4 : 4+keyLen])
-	valueLen := binary.LittleEndian.Uint32(data[4+keyLen : 8+keyLen])
-	value := string(data[8+keyLen : 8+keyLen+valueLen])
+	// The CRC only proves the record is what was written, so the lengths
+	// inside it are still checked against its size.
+	if len(data) < 8 {
+		return walRecord{}, fmt.Errorf("%w: record too short: %d bytes", ErrCorruption, len(data))
+	}
+	keyLen := uint64(binary.LittleEndian.Uint32(data[0:4]))
+	if 8+keyLen > uint64(len(data)) {
+		return walRecord{}, fmt.Errorf("%w: key length %d exceeds record size", ErrCorruption, keyLen)
+	}
+	rec.key = string(data[4 : 4+keyLen])
+	valueLen := uint64(binary.LittleEndian.Uint32(data[4+keyLen : 8+keyLen]))
+	if 8+keyLen+valueLen != uint64(len(data)) {
+		return walRecord{}, fmt.Errorf("%w: value length %d does not match record size", ErrCorruption, valueLen)
+	}
+	rec.value = string(data[8+keyLen:])
 
-	return key, value, nil
+	return rec, nil
 }
@@ -3,9 +3,12 @@ package db_test
 import (
 	"mini-leveldb/db"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWALAppendAndReplay(t *testing.T) {
@@ -51,3 +54,83 @@ func TestWALAppendAndReplay(t *testing.T) {
 		assert.Equalf(t, tt.value, got, "Replay should return the correct value for key %s", tt.key)
 	}
 }
+
+func TestReplayAppliesBatchAllOrNothing(t *testing.T) {
+	dir := "testdata/wal-batch"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	wal, err := db.NewWAL(dir)
+	require.NoError(t, err)
+	require.NoError(t, wal.Append("before", "kept"))
+	require.NoError(t, wal.AppendBatch([][2]string{{"a", "1"}, {"b", "2"}}))
+	require.NoError(t, wal.Close())
+
+	// Tear the batch record's last byte off, as a crash during the write
+	// would.
+	path := filepath.Join(dir, ".walb")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-1))
+
+	result, err := db.Replay(dir)
+	assert.Error(t, err, "the torn record is reported")
+	assert.Equal(t, map[string]string{"before": "kept"}, result)
+}
+
+func TestTruncatingRecoveryStopsAtDamagedRecord(t *testing.T) {
+	dir := "testdata/wal-truncate"
+	_ = os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll("testdata")
+	})
+
+	store, err := db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Put(key, "value-"+key))
+	}
+	require.NoError(t, store.Close())
+
+	// Damage the record of b; c, after it, is still readable.
+	wals, err := filepath.Glob(filepath.Join(dir, "*.walb"))
+	require.NoError(t, err)
+	var damaged string
+	for _, path := range wals {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		if i := strings.Index(string(data), "value-b"); i >= 0 {
+			data[i] ^= 0xff
+			require.NoError(t, os.WriteFile(path, data, 0644))
+			damaged = path
+		}
+	}
+	require.NotEmpty(t, damaged)
+
+	_, err = db.Open(dir, db.DefaultOptions())
+	require.Error(t, err, "the default recovery mode fails on damage")
+
+	opts := db.DefaultOptions()
+	opts.WALRecovery = db.WALRecoveryTruncate
+	store, err = db.Open(dir, opts)
+	require.NoError(t, err)
+	report := store.WALRecovery()
+	assert.Equal(t, []string{damaged}, report.TruncatedWALs)
+	assert.Equal(t, 1, report.DiscardedRecords)
+	assert.Positive(t, report.DiscardedBytes)
+
+	got, err := store.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "value-a", got)
+	for _, key := range []string{"b", "c"} {
+		_, err := store.Get(key)
+		assert.ErrorIs(t, err, db.ErrNotFound, key)
+	}
+	require.NoError(t, store.Close())
+
+	store, err = db.Open(dir, db.DefaultOptions())
+	require.NoError(t, err, "the truncated WAL replays cleanly")
+	require.NoError(t, store.Close())
+}
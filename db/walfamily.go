@@ -0,0 +1,295 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With Options.WALPerColumnFamily, a write to a single column family is
+// logged in a WAL of that family's own, named by familyWALFileName, while
+// writes to the default keyspace, range deletes and batches spanning
+// families stay in the shared WAL so that each is still one record. Every
+// family WAL belongs to the memtable that was active when it was opened,
+// takes a file number above that memtable's shared WAL, and is flushed,
+// archived and removed with it. The group committer still commits a
+// group with one fsync per WAL it touched.
+//
+// Replay has to put the records of the WALs back in commit order. Every
+// request logged while family WALs are in use is preceded by a checkpoint
+// record carrying the sequence number before it, and replay sorts the
+// records between checkpoints by it. DropColumnFamily deletes a family and
+// then disposes of its WALs without waiting for a flush.
+
+// walFor returns the WAL req is logged in, opening the WAL of its column
+// family if it has none yet. logMu must be held.
+func (db *DB) walFor(req *writeRequest) (*WAL, error) {
+	family, ok := requestFamily(req)
+	if !ok {
+		return db.wal, nil
+	}
+	if w, ok := db.familyWALs[family]; ok {
+		return w, nil
+	}
+	path := filepath.Join(db.dir, familyWALFileName(db.newFileNumber(), family))
+	w, err := openWAL(db.fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WAL for column family %s: %w", family, err)
+	}
+	db.configureWAL(w)
+	if db.familyWALs == nil {
+		db.familyWALs = make(map[string]*WAL)
+	}
+	db.familyWALs[family] = w
+	db.mu.Lock()
+	db.wals = append(db.wals, path)
+	db.mu.Unlock()
+	return w, nil
+}
+
+// requestFamily returns the column family every write of req is to, and
+// false if req writes the default keyspace, more than one family, or
+// deletes a range.
+func requestFamily(req *writeRequest) (string, bool) {
+	if len(req.ranges) > 0 || len(req.kvs) == 0 {
+		return "", false
+	}
+	var family string
+	for i, kv := range req.kvs {
+		name, ok := keyFamily(kv[0])
+		if !ok || (i > 0 && name != family) {
+			return "", false
+		}
+		family = name
+	}
+	return family, true
+}
+
+// keyFamily returns the column family key belongs to, if any.
+func keyFamily(key string) (string, bool) {
+	if !strings.HasPrefix(key, cfKeyPrefix) {
+		return "", false
+	}
+	rest := key[len(cfKeyPrefix):]
+	end := strings.IndexByte(rest, 0)
+	if end < 0 {
+		return "", false
+	}
+	return rest[:end], true
+}
+
+// appendFamilyGroup logs each request of group in its WAL and, if sync is
+// set, syncs every WAL it wrote to once. logMu must be held.
+func (db *DB) appendFamilyGroup(group []*writeRequest, sync bool) error {
+	seq := db.seq
+	var touched []*WAL
+	for _, req := range group {
+		w, err := db.walFor(req)
+		if err != nil {
+			return err
+		}
+		if err := w.appendGroup([]*writeRequest{req}, false, seq); err != nil {
+			return err
+		}
+		seq += uint64(len(req.kvs))
+		if !containsWAL(touched, w) {
+			touched = append(touched, w)
+		}
+	}
+	if !sync {
+		return nil
+	}
+	for _, w := range touched {
+		if err := w.sync(); err != nil {
+			return fmt.Errorf("failed to sync group: %w", err)
+		}
+	}
+	return nil
+}
+
+func containsWAL(wals []*WAL, w *WAL) bool {
+	for _, other := range wals {
+		if other == w {
+			return true
+		}
+	}
+	return false
+}
+
+// configureWAL sets the checkpoint interval of a WAL the database opened.
+// With family WALs every request is preceded by a checkpoint, for replay
+// to order it by.
+func (db *DB) configureWAL(w *WAL) {
+	switch {
+	case db.opts.WALPerColumnFamily:
+		w.checkpointInterval = 0
+	case db.opts.WALCheckpointInterval > 0:
+		w.checkpointInterval = db.opts.WALCheckpointInterval
+	}
+}
+
+// syncWALs fsyncs the shared WAL and every open family WAL. logMu must be
+// held.
+func (db *DB) syncWALs() error {
+	if err := db.wal.sync(); err != nil {
+		return err
+	}
+	for _, w := range db.familyWALs {
+		if err := w.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFamilyWALs closes the open family WALs, which the next writes to
+// their families replace with new ones. logMu must be held.
+func (db *DB) closeFamilyWALs() error {
+	var firstErr error
+	for family, w := range db.familyWALs {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close WAL for column family %s: %w", family, err)
+		}
+	}
+	db.familyWALs = nil
+	return firstErr
+}
+
+// retireFamilyWALs closes the WALs of a dropped column family and archives
+// or removes them, and forgets them in the memtables that listed them.
+// Flushed WALs still pinned by a LiveFiles caller are left to be retired
+// when it is done. The shared WAL is synced first, so the drop is durable
+// before the family's writes go.
+func (db *DB) retireFamilyWALs(family string) error {
+	db.committer.logMu.Lock()
+	defer db.committer.logMu.Unlock()
+	if err := db.syncWALs(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if w, ok := db.familyWALs[family]; ok {
+		if err := w.Close(); err != nil {
+			log.Printf("Warning: failed to close WAL for column family %s: %v", family, err)
+		}
+		delete(db.familyWALs, family)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.durableSeq.Store(db.seq)
+	suffix := familyWALSuffix(family)
+	notFamily := func(paths []string) []string {
+		var kept []string
+		for _, path := range paths {
+			if !strings.HasSuffix(path, suffix) {
+				kept = append(kept, path)
+			}
+		}
+		return kept
+	}
+	db.wals = notFamily(db.wals)
+	for _, imm := range db.imm {
+		imm.wals = notFamily(imm.wals)
+	}
+	pinned := make(map[string]bool)
+	for _, path := range db.pinnedWALs {
+		pinned[path] = true
+	}
+
+	paths, err := db.fs.Glob(filepath.Join(db.dir, "*"+suffix))
+	if err != nil {
+		return fmt.Errorf("failed to scan WAL files: %w", err)
+	}
+	var retired []string
+	for _, path := range paths {
+		if !pinned[path] {
+			retired = append(retired, path)
+		}
+	}
+	db.retireWALs(retired)
+	return nil
+}
+
+// isFamilyWAL reports whether path is a column family's WAL.
+func isFamilyWAL(path string) bool {
+	m := fileNumberPattern.FindStringSubmatch(filepath.Base(path))
+	return m != nil && m[2] != "" && strings.Contains(filepath.Base(path), ".cf-")
+}
+
+func hasFamilyWALs(paths []string) bool {
+	for _, path := range paths {
+		if isFamilyWAL(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// walSegment is the records a WAL holds from one checkpoint record, which
+// it starts with, up to the next. Records before a WAL's first checkpoint
+// form a segment at sequence number zero.
+type walSegment struct {
+	seq  uint64
+	recs []walRecord
+}
+
+// walSegments gathers the segments of several WALs to replay them in
+// sequence order.
+type walSegments []walSegment
+
+// collect returns an apply function for replayWALFile that adds the
+// records of one WAL to s.
+func (s *walSegments) collect() func(walRecord) {
+	cur := -1
+	return func(rec walRecord) {
+		if rec.typ == walCheckpoint {
+			// A checkpoint that cannot be decoded stays in the current
+			// segment, for replay to report.
+			if seq, _, err := rec.checkpoint(); err == nil {
+				*s = append(*s, walSegment{seq: seq})
+				cur = len(*s) - 1
+			}
+		}
+		if cur < 0 {
+			*s = append(*s, walSegment{})
+			cur = len(*s) - 1
+		}
+		(*s)[cur].recs = append((*s)[cur].recs, rec)
+	}
+}
+
+// replay calls apply for every record collected, ordering the segments by
+// sequence number and keeping segments at the same one in log order.
+func (s walSegments) replay(apply func(walRecord)) {
+	sort.SliceStable(s, func(i, j int) bool { return s[i].seq < s[j].seq })
+	for _, seg := range s {
+		for _, rec := range seg.recs {
+			apply(rec)
+		}
+	}
+}
+
+// DropColumnFamily deletes every key of the column family called name and
+// disposes of its WALs at once, archiving them with Options.ArchiveWALs,
+// instead of keeping them until the memtables holding the family's writes
+// are flushed. The deletion is logged as a range delete in the shared WAL.
+// The family can be written again afterwards, starting empty.
+func (db *DB) DropColumnFamily(name string) error {
+	cf, err := db.ColumnFamily(name)
+	if err != nil {
+		return fmt.Errorf("failed to drop column family: %w", err)
+	}
+	if db.closed.Load() {
+		return fmt.Errorf("failed to drop column family %s: %w", name, ErrClosed)
+	}
+	end := cf.prefix[:len(cf.prefix)-1] + "\x01"
+	db.trace(TraceRecord{Op: TraceDeleteRange, Key: cf.prefix, EndKey: end})
+	if err := db.submit(&writeRequest{ranges: [][2]string{{cf.prefix, end}}}); err != nil {
+		return fmt.Errorf("failed to drop column family %s: %w", name, err)
+	}
+	if err := db.retireFamilyWALs(name); err != nil {
+		return fmt.Errorf("failed to drop column family %s: %w", name, err)
+	}
+	return nil
+}
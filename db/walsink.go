@@ -0,0 +1,470 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShipBatchSize     = 1000
+	defaultShipMaxPending    = 100000
+	defaultShipRetryInterval = time.Second
+	defaultWALSegmentSize    = 64 << 20
+
+	shippedSegmentExt = ".wship"
+)
+
+// WALSink is a remote target that committed writes are shipped to, such as
+// a file share, an object store or a network endpoint, as a building block
+// for disaster recovery.
+type WALSink interface {
+	// Ship stores events, consecutive committed writes in sequence order,
+	// at the target and returns once they are durable there. A batch that
+	// fails is retried, so the target may receive writes it already holds.
+	Ship(events []Event) error
+	// AckedSequence returns the sequence number of the last write the
+	// target holds, from this or an earlier run, or zero if it holds none.
+	AckedSequence() (uint64, error)
+}
+
+// WALShippingOptions tunes a WALShipper.
+type WALShippingOptions struct {
+	// BatchSize is the most writes passed to one Ship. Zero means 1000.
+	BatchSize int
+	// MaxPending is how many writes may wait to be shipped before writers
+	// are held up until the sink catches up, so no write goes unshipped.
+	// Zero means 100000.
+	MaxPending int
+	// RetryInterval is how long to wait before retrying a failed Ship.
+	// Zero means one second.
+	RetryInterval time.Duration
+}
+
+// WALShipper ships every write committed after it starts to a WALSink in
+// the background, batching the writes that queue up while a Ship is in
+// flight. It tracks the last sequence number the sink acknowledged, so
+// the shipped writes, applied to a backup taken at or after StartSequence,
+// bring the database back up to AckedSequence.
+type WALShipper struct {
+	db     *DB
+	sink   WALSink
+	opts   WALShippingOptions
+	events <-chan Event
+	start  uint64
+	stopCh chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	acked   uint64
+	lastErr error
+	closed  bool
+}
+
+// StartWALShipping starts shipping committed writes to sink. Writes the
+// sink already acknowledged, in an earlier run, are not shipped again.
+func (db *DB) StartWALShipping(sink WALSink, opts *WALShippingOptions) (*WALShipper, error) {
+	if db.closed.Load() {
+		return nil, fmt.Errorf("failed to start WAL shipping: %w", ErrClosed)
+	}
+	s := &WALShipper{db: db, sink: sink, stopCh: make(chan struct{}), done: make(chan struct{})}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.BatchSize <= 0 {
+		s.opts.BatchSize = defaultShipBatchSize
+	}
+	if s.opts.MaxPending <= 0 {
+		s.opts.MaxPending = defaultShipMaxPending
+	}
+	if s.opts.RetryInterval <= 0 {
+		s.opts.RetryInterval = defaultShipRetryInterval
+	}
+	acked, err := sink.AckedSequence()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read acknowledged sequence: %w", err)
+	}
+	s.acked = acked
+
+	// Internal keys, such as the chunks of large values, are shipped too,
+	// so the writes can be replayed as they were committed.
+	s.events = db.SubscribeWithOptions(SubscribeOptions{
+		Prefixes:     []string{"", internalKeyPrefix},
+		BufferSize:   s.opts.MaxPending,
+		SlowConsumer: SlowConsumerBlock,
+	})
+	// Subscribing first means no write falls between the two: writes
+	// committed in between are both before StartSequence and shipped.
+	s.start = db.LastSequence()
+	if acked > 0 && acked < s.start {
+		log.Printf("Warning: WAL sink holds writes up to %d but the database is at %d; the writes in between were not shipped", acked, s.start)
+	}
+	go s.run()
+	return s, nil
+}
+
+// StartSequence returns the sequence number of the last write committed
+// before shipping started.
+func (s *WALShipper) StartSequence() uint64 {
+	return s.start
+}
+
+// AckedSequence returns the sequence number of the last write the sink
+// has acknowledged.
+func (s *WALShipper) AckedSequence() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// LastError returns the error of the last failed Ship, or nil once a Ship
+// succeeds again.
+func (s *WALShipper) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// Close stops shipping, waiting for a Ship in flight. Writes not shipped by
+// then are dropped, and AckedSequence tells how far the sink got. It
+// returns the error of the last Ship if that failed.
+func (s *WALShipper) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stopCh)
+	s.db.Unsubscribe(s.events)
+	<-s.done
+	return s.LastError()
+}
+
+func (s *WALShipper) run() {
+	defer close(s.done)
+	for {
+		var batch []Event
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				return
+			}
+			batch = append(batch, ev)
+		case <-s.stopCh:
+			return
+		}
+	fill:
+		for len(batch) < s.opts.BatchSize {
+			select {
+			case ev, ok := <-s.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, ev)
+			default:
+				break fill
+			}
+		}
+		if !s.ship(batch) {
+			return
+		}
+	}
+}
+
+// ship hands batch to the sink, skipping writes it already holds, and
+// retries until it succeeds or the shipper is closed. It reports whether
+// to carry on.
+func (s *WALShipper) ship(batch []Event) bool {
+	acked := s.AckedSequence()
+	for len(batch) > 0 && batch[0].Seq <= acked {
+		batch = batch[1:]
+	}
+	if len(batch) == 0 {
+		return true
+	}
+	for {
+		err := s.sink.Ship(batch)
+		s.mu.Lock()
+		s.lastErr = err
+		if err == nil {
+			s.acked = batch[len(batch)-1].Seq
+		}
+		s.mu.Unlock()
+		if err == nil {
+			return true
+		}
+		log.Printf("Warning: failed to ship %d writes from sequence %d: %v", len(batch), batch[0].Seq, err)
+		select {
+		case <-s.stopCh:
+			return false
+		case <-time.After(s.opts.RetryInterval):
+		}
+	}
+}
+
+// encodeShippedBatch encodes events as the sinks here store them: the
+// payload's length and CRC-32C, then each write's sequence number, type,
+// key and value.
+func encodeShippedBatch(events []Event) []byte {
+	var payload bytes.Buffer
+	for _, ev := range events {
+		binary.Write(&payload, binary.LittleEndian, ev.Seq)
+		payload.WriteByte(byte(ev.Type))
+		writeString(&payload, ev.Key)
+		writeString(&payload, ev.Value)
+	}
+	out := binary.LittleEndian.AppendUint32(nil, uint32(payload.Len()))
+	out = binary.LittleEndian.AppendUint32(out, crc32.Checksum(payload.Bytes(), castagnoli))
+	return append(out, payload.Bytes()...)
+}
+
+// ReadShippedWrites calls fn with each write in r, a segment written by
+// FileWALSink or an object written by ObjectStoreWALSink, in sequence
+// order. A batch cut short at the end of r, as by a crash while shipping,
+// is ignored; one that fails its checksum is reported as ErrCorruption.
+func ReadShippedWrites(r io.Reader, fn func(Event) error) error {
+	br := bufio.NewReader(r)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read shipped batch: %w", err)
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(br, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read shipped batch: %w", err)
+		}
+		if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(header[4:8]) {
+			return fmt.Errorf("shipped batch failed its checksum: %w", ErrCorruption)
+		}
+		pr := bytes.NewReader(payload)
+		for pr.Len() > 0 {
+			var ev Event
+			if err := binary.Read(pr, binary.LittleEndian, &ev.Seq); err != nil {
+				return fmt.Errorf("failed to decode shipped write: %w", ErrCorruption)
+			}
+			t, err := pr.ReadByte()
+			if err != nil {
+				return fmt.Errorf("failed to decode shipped write: %w", ErrCorruption)
+			}
+			ev.Type = EventType(t)
+			if ev.Key, err = readString(pr); err != nil {
+				return fmt.Errorf("failed to decode shipped write: %w", ErrCorruption)
+			}
+			if ev.Value, err = readString(pr); err != nil {
+				return fmt.Errorf("failed to decode shipped write: %w", ErrCorruption)
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// FileWALSink ships writes to segment files in a directory, such as one on
+// a file share. A segment is named after the sequence number of its first
+// write and a new one is started once the last reaches SegmentSize.
+type FileWALSink struct {
+	dir string
+	fs  FileSystem
+
+	// SegmentSize is the size at which a new segment is started. Zero
+	// means 64 MiB.
+	SegmentSize int64
+
+	mu   sync.Mutex
+	f    File
+	size int64
+}
+
+// NewFileWALSink returns a sink writing segments into dir, creating it if
+// needed. A nil fs means the OS filesystem.
+func NewFileWALSink(dir string, fs FileSystem) (*FileWALSink, error) {
+	fs = fsOrDefault(fs)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL sink directory: %w", err)
+	}
+	return &FileWALSink{dir: dir, fs: fs}, nil
+}
+
+// Segments returns the paths of the sink's segments, oldest first.
+func (s *FileWALSink) Segments() ([]string, error) {
+	return s.fs.Glob(filepath.Join(s.dir, "*"+shippedSegmentExt))
+}
+
+// Ship appends events to the current segment and syncs it. After a failed
+// write the batch goes into a new segment, which replaces the failed one if
+// that held nothing else.
+func (s *FileWALSink) Ship(events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segmentSize := s.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultWALSegmentSize
+	}
+	if s.f != nil && s.size >= segmentSize {
+		if err := s.f.Close(); err != nil {
+			log.Printf("Warning: failed to close WAL sink segment: %v", err)
+		}
+		s.f = nil
+	}
+	if s.f == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", events[0].Seq, shippedSegmentExt))
+		f, err := s.fs.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create WAL sink segment: %w", err)
+		}
+		if err := syncDirOf(s.fs, path); err != nil {
+			f.Close()
+			return err
+		}
+		s.f, s.size = f, 0
+	}
+	data := encodeShippedBatch(events)
+	if _, err := s.f.Write(data); err != nil {
+		s.abandon()
+		return fmt.Errorf("failed to write WAL sink segment: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		s.abandon()
+		return fmt.Errorf("failed to sync WAL sink segment: %w", err)
+	}
+	s.size += int64(len(data))
+	return nil
+}
+
+// abandon closes a segment whose last write failed, so the next batch
+// starts a new one. s.mu must be held.
+func (s *FileWALSink) abandon() {
+	s.f.Close()
+	s.f = nil
+}
+
+// AckedSequence reads the last write of the newest segment holding one.
+func (s *FileWALSink) AckedSequence() (uint64, error) {
+	segments, err := s.Segments()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list WAL sink segments: %w", err)
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		f, err := s.fs.Open(segments[i])
+		if err != nil {
+			return 0, fmt.Errorf("failed to open WAL sink segment: %w", err)
+		}
+		var last uint64
+		err = ReadShippedWrites(f, func(ev Event) error {
+			last = ev.Seq
+			return nil
+		})
+		f.Close()
+		if err != nil && !errors.Is(err, ErrCorruption) {
+			return 0, err
+		}
+		if last > 0 {
+			return last, nil
+		}
+	}
+	return 0, nil
+}
+
+// Close closes the current segment.
+func (s *FileWALSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// ObjectStoreWALSink ships each batch of writes to an ObjectStore as one
+// object, named after the sequence numbers of its first and last writes
+// so that listing the objects lists the writes in order.
+type ObjectStoreWALSink struct {
+	store  ObjectStore
+	prefix string
+}
+
+// NewObjectStoreWALSink returns a sink writing objects whose keys start
+// with prefix.
+func NewObjectStoreWALSink(store ObjectStore, prefix string) *ObjectStoreWALSink {
+	return &ObjectStoreWALSink{store: store, prefix: prefix}
+}
+
+// Ship uploads events as one object.
+func (s *ObjectStoreWALSink) Ship(events []Event) error {
+	data := encodeShippedBatch(events)
+	key := fmt.Sprintf("%s%020d-%020d%s", s.prefix, events[0].Seq, events[len(events)-1].Seq, shippedSegmentExt)
+	if err := s.store.Put(key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("failed to upload shipped writes: %w", err)
+	}
+	return nil
+}
+
+// Objects returns the keys of the shipped objects, oldest first.
+func (s *ObjectStoreWALSink) Objects() ([]string, error) {
+	keys, err := s.store.List(s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shipped writes: %w", err)
+	}
+	var objects []string
+	for _, key := range keys {
+		if _, _, ok := shippedObjectRange(strings.TrimPrefix(key, s.prefix)); ok {
+			objects = append(objects, key)
+		}
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// AckedSequence returns the last sequence number in the newest object's
+// name.
+func (s *ObjectStoreWALSink) AckedSequence() (uint64, error) {
+	objects, err := s.Objects()
+	if err != nil || len(objects) == 0 {
+		return 0, err
+	}
+	_, last, _ := shippedObjectRange(strings.TrimPrefix(objects[len(objects)-1], s.prefix))
+	return last, nil
+}
+
+// shippedObjectRange parses the sequence numbers out of the name of an
+// object written by ObjectStoreWALSink.
+func shippedObjectRange(name string) (first, last uint64, ok bool) {
+	name, found := strings.CutSuffix(name, shippedSegmentExt)
+	if !found {
+		return 0, 0, false
+	}
+	a, b, found := strings.Cut(name, "-")
+	if !found {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err = strconv.ParseUint(b, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, last, true
+}
@@ -0,0 +1,130 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"mini-leveldb/db"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shippedWrites reads back every write in the segments of sink.
+func shippedWrites(t *testing.T, fs db.FileSystem, sink *db.FileWALSink) []db.Event {
+	segments, err := sink.Segments()
+	require.NoError(t, err)
+	var events []db.Event
+	for _, path := range segments {
+		f, err := fs.Open(path)
+		require.NoError(t, err)
+		require.NoError(t, db.ReadShippedWrites(f, func(ev db.Event) error {
+			events = append(events, ev)
+			return nil
+		}))
+		f.Close()
+	}
+	return events
+}
+
+func TestFileWALSinkShipsAndResumes(t *testing.T) {
+	fs := db.NewMemFileSystem()
+	opts := db.DefaultOptions()
+	opts.FileSystem = fs
+	store, err := db.Open("shipping", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	sink, err := db.NewFileWALSink("dr/wal", fs)
+	require.NoError(t, err)
+	sink.SegmentSize = 64
+	shipper, err := store.StartWALShipping(sink, nil)
+	require.NoError(t, err)
+	assert.Zero(t, shipper.StartSequence())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.Put(fmt.Sprintf("key%d", i), "value"))
+	}
+	require.NoError(t, store.Delete("key3"))
+	require.Eventually(t, func() bool {
+		return shipper.AckedSequence() == store.LastSequence()
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, shipper.Close())
+	require.NoError(t, sink.Close())
+
+	events := shippedWrites(t, fs, sink)
+	require.Len(t, events, 11)
+	for i, ev := range events[:10] {
+		assert.Equal(t, db.Event{Type: db.EventPut, Key: fmt.Sprintf("key%d", i), Value: "value", Seq: uint64(i + 1)}, ev)
+	}
+	assert.Equal(t, db.Event{Type: db.EventDelete, Key: "key3", Seq: 11}, events[10])
+	segments, err := sink.Segments()
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 1)
+
+	// A new sink on the same directory picks up where the last one
+	// stopped.
+	sink, err = db.NewFileWALSink("dr/wal", fs)
+	require.NoError(t, err)
+	shipper, err = store.StartWALShipping(sink, nil)
+	require.NoError(t, err)
+	defer shipper.Close()
+	assert.Equal(t, uint64(11), shipper.AckedSequence())
+	require.NoError(t, store.Put("after", "restart"))
+	require.Eventually(t, func() bool {
+		return shipper.AckedSequence() == store.LastSequence()
+	}, 5*time.Second, 10*time.Millisecond)
+	events = shippedWrites(t, fs, sink)
+	require.Len(t, events, 12)
+	assert.Equal(t, "after", events[11].Key)
+}
+
+// flakySink fails its first failures Ships, then ships to an object store.
+type flakySink struct {
+	*db.ObjectStoreWALSink
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakySink) Ship(events []db.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("target unavailable")
+	}
+	return s.ObjectStoreWALSink.Ship(events)
+}
+
+func TestWALShipperRetriesFailedShips(t *testing.T) {
+	opts := db.DefaultOptions()
+	opts.FileSystem = db.NewMemFileSystem()
+	store, err := db.Open("retry", opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	objects := db.NewMemObjectStore()
+	sink := &flakySink{ObjectStoreWALSink: db.NewObjectStoreWALSink(objects, "dr/"), failures: 2}
+	shipper, err := store.StartWALShipping(sink, &db.WALShippingOptions{RetryInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer shipper.Close()
+
+	require.NoError(t, store.Put("a", "1"))
+	require.Eventually(t, func() bool {
+		return shipper.LastError() != nil
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, store.Put("b", "2"))
+	require.Eventually(t, func() bool {
+		return shipper.AckedSequence() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, shipper.LastError())
+
+	keys, err := sink.Objects()
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	acked, err := sink.AckedSequence()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), acked)
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DurableSequence returns the sequence number of the newest write known to
+// be synced to disk, which a crash cannot lose. With Options.WALSyncInterval
+// zero every write is synced before it returns, so this equals
+// LastSequence; otherwise it trails it by at most one sync interval.
+func (db *DB) DurableSequence() uint64 {
+	return db.durableSeq.Load()
+}
+
+// syncWALEveryWrite reports whether commits fsync the WAL themselves rather
+// than leaving it to walSyncLoop.
+func (db *DB) syncWALEveryWrite() bool {
+	return db.opts.WALSyncInterval <= 0
+}
+
+// walSyncLoop fsyncs the WAL every interval, bounding how many unsynced
+// writes a crash can lose.
+func (db *DB) walSyncLoop(interval time.Duration) {
+	defer db.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.bgStop:
+			return
+		case <-ticker.C:
+			db.committer.logMu.Lock()
+			db.mu.RLock()
+			seq := db.seq
+			db.mu.RUnlock()
+			if err := db.syncWALs(); err != nil {
+				log.Printf("Warning: background WAL sync failed: %v", err)
+			} else {
+				db.durableSeq.Store(seq)
+			}
+			db.committer.logMu.Unlock()
+		}
+	}
+}
+
+// sync fsyncs the records already written to the WAL file.
+func (w *WAL) sync() error {
+	if w.writer == nil {
+		return os.ErrInvalid
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush WAL writer: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package db_test
+
+import (
+	"mini-leveldb/db"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundWALSync(t *testing.T) {
+	open := func(fs *db.FaultFileSystem, interval time.Duration) *db.DB {
+		opts := db.DefaultOptions()
+		opts.FileSystem = fs
+		opts.WALSyncInterval = interval
+		store, err := db.Open("walsync", opts)
+		require.NoError(t, err)
+		return store
+	}
+
+	// Writes return before they are synced, so a crash before the next
+	// background sync loses them.
+	fs := db.NewFaultFileSystem()
+	store := open(fs, time.Hour)
+	require.NoError(t, store.Put("lost", "value"))
+	assert.Equal(t, uint64(1), store.LastSequence())
+	assert.Equal(t, uint64(0), store.DurableSequence())
+
+	crashed := open(fs.CrashImage(), time.Hour)
+	_, err := crashed.Get("lost")
+	assert.Error(t, err)
+	require.NoError(t, crashed.Close())
+	require.NoError(t, store.Close())
+
+	// Once the background sync has run the writes survive a crash.
+	fs = db.NewFaultFileSystem()
+	store = open(fs, 5*time.Millisecond)
+	t.Cleanup(func() { store.Close() })
+	require.NoError(t, store.Put("kept", "value"))
+	require.Eventually(t, func() bool {
+		return store.DurableSequence() == store.LastSequence()
+	}, 5*time.Second, time.Millisecond)
+
+	crashed = open(fs.CrashImage(), time.Hour)
+	t.Cleanup(func() { crashed.Close() })
+	value, err := crashed.Get("kept")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
@@ -0,0 +1,55 @@
+package server
+
+import "strings"
+
+// Authenticator decides what a network client may do from the credentials
+// it presents. Authenticate returns the client's ACL, or ok false to turn
+// the client away.
+type Authenticator interface {
+	Authenticate(user, token string) (acl ACL, ok bool)
+}
+
+// ACLRule grants access to the keys starting with Prefix.
+type ACLRule struct {
+	Prefix string
+	Read   bool
+	Write  bool
+}
+
+// ACL restricts a client to the keys its rules grant. The rule with the
+// longest prefix matching a key decides, so a rule granting nothing can
+// carve a subrange out of a broader one. A nil ACL grants every key; a
+// non-nil one denies keys no rule matches, so an empty one denies all.
+type ACL []ACLRule
+
+// Allows reports whether the ACL lets a client read key, or write it when
+// write is set.
+func (acl ACL) Allows(key string, write bool) bool {
+	if acl == nil {
+		return true
+	}
+	best := -1
+	for i, rule := range acl {
+		if strings.HasPrefix(key, rule.Prefix) && (best < 0 || len(rule.Prefix) > len(acl[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return false
+	}
+	if write {
+		return acl[best].Write
+	}
+	return acl[best].Read
+}
+
+// StaticTokens is an Authenticator accepting a fixed set of tokens, each
+// with its ACL; a nil ACL grants every key and an empty one none. The user
+// name is not checked.
+type StaticTokens map[string]ACL
+
+// Authenticate implements Authenticator.
+func (t StaticTokens) Authenticate(user, token string) (ACL, bool) {
+	acl, ok := t[token]
+	return acl, ok
+}
@@ -0,0 +1,549 @@
+// Package server serves databases over the network: the memcached text
+// protocol, with token authentication and per-prefix ACLs, per-command
+// stats and an access log, and a database per tenant with quotas. It uses
+// only the public API of package db.
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mini-leveldb/db"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMemcachedMaxValueSize = 1 << 20
+	memcachedMaxKeyLen           = 250
+	memcachedVersion             = "1.6.0-mini-leveldb"
+
+	// flaggedValueMagic starts the stored form of an item with nonzero
+	// client flags, which are kept as 4 big-endian bytes ahead of its
+	// data. An item whose data starts with flaggedValueMagic is stored
+	// the same way, so it is never mistaken for one with flags.
+	flaggedValueMagic = "\x00memcached-flags\x00"
+)
+
+// MemcachedOptions tunes a MemcachedServer.
+type MemcachedOptions struct {
+	// MaxValueSize is the largest value a set or add may store, in bytes.
+	// Zero means 1 MiB, memcached's default item size limit.
+	MaxValueSize int
+
+	// Authenticator, if set, requires clients to authenticate before any
+	// command but version and quit, the way memcached's ASCII
+	// authentication does: the first command is a set of any key whose
+	// data is "<user> <token>", answered with STORED once accepted. The ACL
+	// it returns then limits the keys the client may read and write.
+	Authenticator Authenticator
+
+	// AccessLog, if set, receives a JSON object per command, one per line,
+	// saying who ran it, on which key, with what outcome and how long it
+	// took; see AccessLogEntry.
+	AccessLog io.Writer
+
+	// TLSConfig, if set, makes clients connect over TLS. It must hold a
+	// certificate or a GetCertificate callback; setting ClientAuth and
+	// ClientCAs also authenticates clients by certificate.
+	TLSConfig *tls.Config
+}
+
+// MemcachedServer serves a database over the memcached text protocol, so
+// memcached clients can use it as a persistent cache. It speaks get, gets,
+// set, add, delete, incr, decr, version and quit. Items stored with client
+// flags of 0 are stored as their data alone, so the CLI and the Go API
+// read what memcached clients write; nonzero flags are stored ahead of the
+// data, which such readers then see too. The database keeps no expiration
+// times, so set and add reject nonzero ones rather than drop them. gets
+// reports a CAS unique of 0, as there is no cas command to use it with.
+type MemcachedServer struct {
+	database     *db.DB
+	tenants      *Tenants
+	ln           net.Listener
+	maxValueSize int
+	auth         Authenticator
+	stats        *serverStats
+	accessLog    *accessLog
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// StartMemcached begins accepting memcached clients of store on addr.
+func StartMemcached(store *db.DB, addr string, opts *MemcachedOptions) (*MemcachedServer, error) {
+	return startMemcached(store, nil, addr, opts)
+}
+
+// StartMemcached begins accepting memcached clients on addr, serving every
+// tenant. Keys name their tenant before a colon: "acme:user/1" is the key
+// user/1 of the tenant acme. ACLs apply to the whole key, so a token can be
+// limited to a tenant by an ACL rule for the prefix "acme:". Requests wait
+// for their tenant's request rate, and writes over its disk quota fail with
+// SERVER_ERROR.
+func (t *Tenants) StartMemcached(addr string, opts *MemcachedOptions) (*MemcachedServer, error) {
+	return startMemcached(nil, t, addr, opts)
+}
+
+func startMemcached(store *db.DB, tenants *Tenants, addr string, opts *MemcachedOptions) (*MemcachedServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for memcached clients: %w", err)
+	}
+	if opts != nil && opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+	s := &MemcachedServer{
+		database:     store,
+		tenants:      tenants,
+		ln:           ln,
+		maxValueSize: defaultMemcachedMaxValueSize,
+		conns:        make(map[net.Conn]struct{}),
+		stats:        newServerStats(),
+	}
+	if opts != nil && opts.MaxValueSize > 0 {
+		s.maxValueSize = opts.MaxValueSize
+	}
+	if opts != nil {
+		s.auth = opts.Authenticator
+		if opts.AccessLog != nil {
+			s.accessLog = &accessLog{w: opts.AccessLog}
+		}
+	}
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *MemcachedServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops accepting clients and disconnects the connected ones.
+func (s *MemcachedServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *MemcachedServer) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			err := s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+			if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Printf("Memcached: client %s disconnected: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// errMemcachedQuit ends a connection whose client sent quit.
+var errMemcachedQuit = errors.New("client quit")
+
+// memcachedSession is what a connection's client has authenticated as.
+type memcachedSession struct {
+	client        string
+	authenticated bool
+	user          string
+	acl           ACL
+	// dataIn counts the bytes of the current command's data block.
+	dataIn int
+}
+
+// checkKey returns why the client cannot read key, or write it when write
+// is set, or "" if it can.
+func (sess *memcachedSession) checkKey(key string, write bool) string {
+	if msg := checkMemcachedKey(key); msg != "" {
+		return msg
+	}
+	if !sess.acl.Allows(key, false) || (write && !sess.acl.Allows(key, true)) {
+		return "access denied"
+	}
+	return ""
+}
+
+// target returns the database holding key and its name there, or the line
+// to reply with if the client cannot read key, or write it when write is
+// set.
+func (s *MemcachedServer) target(sess *memcachedSession, key string, write bool) (store *db.DB, name string, reply string) {
+	if msg := sess.checkKey(key, write); msg != "" {
+		return nil, "", "CLIENT_ERROR " + msg
+	}
+	if s.tenants == nil {
+		return s.database, key, ""
+	}
+	tenant, name, ok := strings.Cut(key, ":")
+	if !ok {
+		return nil, "", "CLIENT_ERROR key needs a tenant, as in tenant:key"
+	}
+	if !validTenantName(tenant) {
+		return nil, "", "CLIENT_ERROR invalid tenant name"
+	}
+	if msg := checkMemcachedKey(name); msg != "" {
+		return nil, "", "CLIENT_ERROR " + msg
+	}
+	store, err := s.tenants.admit(tenant, write)
+	if err != nil {
+		return nil, "", "SERVER_ERROR " + replyText(err)
+	}
+	return store, name, ""
+}
+
+// serveConn runs one client's commands until it disconnects. Responses are
+// flushed once no further pipelined command is buffered.
+func (s *MemcachedServer) serveConn(conn net.Conn) error {
+	sess := &memcachedSession{client: conn.RemoteAddr().String(), authenticated: s.auth == nil}
+	r := bufio.NewReaderSize(conn, 4096)
+	w := &replyWriter{Writer: bufio.NewWriter(conn)}
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			fmt.Fprintf(w, "CLIENT_ERROR line too long\r\n")
+			return w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			fmt.Fprintf(w, "ERROR\r\n")
+		} else if err := s.run(sess, r, w, fields, len(line)); err != nil {
+			if errors.Is(err, errMemcachedQuit) {
+				return w.Flush()
+			}
+			return err
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// command runs one command and writes its reply. It returns an error only
+// when the connection cannot go on.
+func (s *MemcachedServer) command(sess *memcachedSession, r *bufio.Reader, w *replyWriter, fields []string) error {
+	name, args := fields[0], fields[1:]
+	if !sess.authenticated && name != "version" && name != "quit" {
+		if name == "set" {
+			return s.authenticate(sess, r, w, args)
+		}
+		fmt.Fprintf(w, "CLIENT_ERROR unauthenticated\r\n")
+		return nil
+	}
+	switch name {
+	case "get", "gets":
+		return s.get(sess, w, args, name == "gets")
+	case "set", "add":
+		return s.store(sess, r, w, name, args)
+	case "delete":
+		s.delete(sess, w, args)
+	case "incr", "decr":
+		s.incr(sess, w, args, name == "decr")
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", memcachedVersion)
+	case "quit":
+		return errMemcachedQuit
+	default:
+		fmt.Fprintf(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+// authenticate runs the set an unauthenticated client sends its
+// credentials in.
+func (s *MemcachedServer) authenticate(sess *memcachedSession, r *bufio.Reader, w *replyWriter, args []string) error {
+	if len(args) != 4 {
+		fmt.Fprintf(w, "CLIENT_ERROR unauthenticated\r\n")
+		return nil
+	}
+	data, ok, err := s.readData(sess, r, w, args[3])
+	if err != nil || !ok {
+		return err
+	}
+	user, token, _ := strings.Cut(data, " ")
+	acl, ok := s.auth.Authenticate(user, token)
+	if !ok {
+		fmt.Fprintf(w, "CLIENT_ERROR authentication failure\r\n")
+		return nil
+	}
+	sess.authenticated, sess.user, sess.acl = true, user, acl
+	fmt.Fprintf(w, "STORED\r\n")
+	return nil
+}
+
+func (s *MemcachedServer) get(sess *memcachedSession, w *replyWriter, keys []string, withCAS bool) error {
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return nil
+	}
+	stores, names := make([]*db.DB, len(keys)), make([]string, len(keys))
+	for i, key := range keys {
+		var reply string
+		if stores[i], names[i], reply = s.target(sess, key, false); reply != "" {
+			fmt.Fprintf(w, "%s\r\n", reply)
+			return nil
+		}
+	}
+	for i, key := range keys {
+		stored, err := stores[i].Get(names[i])
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", replyText(err))
+			return nil
+		}
+		flags, value := decodeItem(stored)
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d 0\r\n", key, flags, len(value))
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(value))
+		}
+		w.WriteString(value)
+		w.WriteString("\r\n")
+	}
+	fmt.Fprintf(w, "END\r\n")
+	return nil
+}
+
+// store runs set and add: <command> <key> <flags> <exptime> <bytes>
+// [noreply], followed by a data block of <bytes> bytes.
+func (s *MemcachedServer) store(sess *memcachedSession, r *bufio.Reader, w *replyWriter, name string, args []string) error {
+	noreply := len(args) == 5 && args[4] == "noreply"
+	if len(args) != 4 && !noreply {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return nil
+	}
+	value, ok, err := s.readData(sess, r, w, args[3])
+	if err != nil || !ok {
+		return err
+	}
+
+	store, key, reply := s.target(sess, args[0], true)
+	if reply != "" {
+		fmt.Fprintf(w, "%s\r\n", reply)
+		return nil
+	}
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		fmt.Fprintf(w, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	if args[2] != "0" {
+		fmt.Fprintf(w, "CLIENT_ERROR expiration is not supported\r\n")
+		return nil
+	}
+
+	item := encodeItem(uint32(flags), value)
+	reply = "STORED"
+	if name == "add" {
+		_, loaded, err := store.GetOrSet(key, item)
+		if err != nil {
+			reply = "SERVER_ERROR " + replyText(err)
+		} else if loaded {
+			reply = "NOT_STORED"
+		}
+	} else if err := store.Put(key, item); err != nil {
+		reply = "SERVER_ERROR " + replyText(err)
+	}
+	if !noreply {
+		fmt.Fprintf(w, "%s\r\n", reply)
+	}
+	return nil
+}
+
+// readData reads the data block of a storage command whose byte count is
+// sizeArg. If the block is invalid or too large, it replies to the client
+// and returns ok false.
+func (s *MemcachedServer) readData(sess *memcachedSession, r *bufio.Reader, w *replyWriter, sizeArg string) (data string, ok bool, err error) {
+	size, err := strconv.Atoi(sizeArg)
+	if err != nil || size < 0 {
+		fmt.Fprintf(w, "CLIENT_ERROR bad data chunk\r\n")
+		return "", false, nil
+	}
+	if size > s.maxValueSize {
+		// The data block cannot be told apart from commands without
+		// reading it, so skip it before replying.
+		n, err := r.Discard(size + 2)
+		sess.dataIn = n
+		if err != nil {
+			return "", false, err
+		}
+		fmt.Fprintf(w, "SERVER_ERROR object too large for cache\r\n")
+		return "", false, nil
+	}
+	buf := make([]byte, size+2)
+	n, err := io.ReadFull(r, buf)
+	sess.dataIn = n
+	if err != nil {
+		return "", false, err
+	}
+	if string(buf[size:]) != "\r\n" {
+		fmt.Fprintf(w, "CLIENT_ERROR bad data chunk\r\n")
+		return "", false, nil
+	}
+	return string(buf[:size]), true, nil
+}
+
+// delete runs delete <key> [noreply]. The key is checked and deleted
+// atomically, so that of several clients deleting it exactly one is told
+// DELETED.
+func (s *MemcachedServer) delete(sess *memcachedSession, w *replyWriter, args []string) {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return
+	}
+	store, key, reply := s.target(sess, args[0], true)
+	if reply != "" {
+		fmt.Fprintf(w, "%s\r\n", reply)
+		return
+	}
+
+	deleted, err := store.DeleteIfExists(key)
+	reply = "NOT_FOUND"
+	if err != nil {
+		reply = "SERVER_ERROR " + replyText(err)
+	} else if deleted {
+		reply = "DELETED"
+	}
+	if !noreply {
+		fmt.Fprintf(w, "%s\r\n", reply)
+	}
+}
+
+// incr runs incr and decr <key> <delta> [noreply] on values holding a
+// decimal 64-bit unsigned integer, as memcached does: incr wraps around
+// and decr stops at zero.
+func (s *MemcachedServer) incr(sess *memcachedSession, w *replyWriter, args []string, decr bool) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return
+	}
+	store, key, reply := s.target(sess, args[0], true)
+	if reply != "" {
+		fmt.Fprintf(w, "%s\r\n", reply)
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintf(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	var result string
+	found := false
+	err = store.Update(key, func(stored string, ok bool) (string, bool, error) {
+		if found = ok; !ok {
+			return "", false, nil
+		}
+		flags, value := decodeItem(stored)
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", false, errNotNumeric
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.FormatUint(n, 10)
+		return encodeItem(flags, result), true, nil
+	})
+	reply = result
+	switch {
+	case errors.Is(err, errNotNumeric):
+		reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	case err != nil:
+		reply = "SERVER_ERROR " + replyText(err)
+	case !found:
+		reply = "NOT_FOUND"
+	}
+	if !noreply {
+		fmt.Fprintf(w, "%s\r\n", reply)
+	}
+}
+
+var errNotNumeric = errors.New("value is not a decimal number")
+
+// encodeItem returns the stored form of an item's flags and data.
+func encodeItem(flags uint32, data string) string {
+	if flags == 0 && !strings.HasPrefix(data, flaggedValueMagic) {
+		return data
+	}
+	return flaggedValueMagic + string(binary.BigEndian.AppendUint32(nil, flags)) + data
+}
+
+// decodeItem returns the flags and data of an item stored by encodeItem. A
+// value written other than through the server is data with flags of 0.
+func decodeItem(stored string) (flags uint32, data string) {
+	rest, ok := strings.CutPrefix(stored, flaggedValueMagic)
+	if !ok || len(rest) < 4 {
+		return 0, stored
+	}
+	return binary.BigEndian.Uint32([]byte(rest[:4])), rest[4:]
+}
+
+// checkMemcachedKey returns why key cannot be used, or "" if it can.
+func checkMemcachedKey(key string) string {
+	if len(key) > memcachedMaxKeyLen {
+		return "key too long"
+	}
+	if strings.HasPrefix(key, "\x00") {
+		return "keys starting with 0x00 are reserved"
+	}
+	return ""
+}
+
+// replyText returns err's message on one line, to end a reply line with.
+func replyText(err error) string {
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
@@ -0,0 +1,273 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mini-leveldb/db"
+	"mini-leveldb/server"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemcachedProtocol(t *testing.T) {
+	dir := "testdata/memcached"
+	_ = os.RemoveAll(dir)
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+	srv, err := server.StartMemcached(store, "127.0.0.1:0", &server.MemcachedOptions{MaxValueSize: 16})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(request string, replyLines int) string {
+		t.Helper()
+		_, err := fmt.Fprint(conn, request)
+		require.NoError(t, err)
+		var reply string
+		for i := 0; i < replyLines; i++ {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			reply += line
+		}
+		return reply
+	}
+
+	assert.Equal(t, "STORED\r\n", send("set k 0 0 5\r\nhe\r\no\r\n", 1))
+	assert.Equal(t, "VALUE k 0 5\r\nhe\r\no\r\nEND\r\n", send("get k missing\r\n", 4))
+	assert.Equal(t, "NOT_STORED\r\n", send("add k 0 0 1\r\nx\r\n", 1))
+	assert.Equal(t, "STORED\r\n", send("add n 0 0 2\r\n10\r\n", 1))
+	assert.Equal(t, "15\r\n", send("incr n 5\r\n", 1))
+	assert.Equal(t, "0\r\n", send("decr n 100\r\n", 1))
+	assert.Equal(t, "NOT_FOUND\r\n", send("incr missing 1\r\n", 1))
+	assert.Equal(t, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n", send("incr k 1\r\n", 1))
+	assert.Equal(t, "STORED\r\n", send("set f 3 0 1\r\n7\r\n", 1))
+	assert.Equal(t, "VALUE f 3 1\r\n7\r\nEND\r\n", send("get f\r\n", 3))
+	assert.Equal(t, "8\r\n", send("incr f 1\r\n", 1))
+	assert.Equal(t, "VALUE f 3 1 0\r\n8\r\nEND\r\n", send("gets f\r\n", 3))
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", send("set f 4294967296 0 1\r\nx\r\n", 1))
+	assert.Equal(t, "SERVER_ERROR object too large for cache\r\n", send("set big 0 0 20\r\n01234567890123456789\r\n", 1))
+	assert.Equal(t, "DELETED\r\n", send("delete k\r\n", 1))
+	assert.Equal(t, "NOT_FOUND\r\n", send("delete k\r\n", 1))
+	assert.Equal(t, "END\r\n", send("get k\r\n", 1))
+	// A noreply command's reply is skipped, so the pipelined get answers next.
+	assert.Equal(t, "VALUE q 0 1\r\n1\r\nEND\r\n", send("set q 0 0 1 noreply\r\n1\r\nget q\r\n", 3))
+	assert.Equal(t, "ERROR\r\n", send("cas q 0 0 1 0\r\n", 1))
+
+	value, err := store.Get("n")
+	require.NoError(t, err)
+	assert.Equal(t, "0", value)
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 that signs itself.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mini-leveldb test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMemcachedOverMutualTLS(t *testing.T) {
+	dir := "testdata/memcached-tls"
+	_ = os.RemoveAll(dir)
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+
+	cert := selfSignedCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	srv, err := server.StartMemcached(store, "127.0.0.1:0", &server.MemcachedOptions{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "set k 0 0 1\r\nv\r\n")
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "STORED\r\n", reply)
+
+	// Without a client certificate the handshake is refused.
+	conn, err = tls.Dial("tcp", srv.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		defer conn.Close()
+		_, err = fmt.Fprint(conn, "get k\r\n")
+		if err == nil {
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+	}
+	assert.Error(t, err)
+}
+
+func TestMemcachedAuthenticationAndACL(t *testing.T) {
+	dir := "testdata/memcached-auth"
+	_ = os.RemoveAll(dir)
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+	srv, err := server.StartMemcached(store, "127.0.0.1:0", &server.MemcachedOptions{Authenticator: server.StaticTokens{
+		"admin":  nil,
+		"locked": server.ACL{},
+		"reader": server.ACL{
+			{Prefix: "public/", Read: true},
+			{Prefix: "public/inbox/", Read: true, Write: true},
+		},
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	dial := func() func(string) string {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		r := bufio.NewReader(conn)
+		return func(request string) string {
+			t.Helper()
+			_, err := fmt.Fprint(conn, request)
+			require.NoError(t, err)
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			return line
+		}
+	}
+
+	admin := dial()
+	assert.Equal(t, "CLIENT_ERROR unauthenticated\r\n", admin("get public/a\r\n"))
+	assert.Equal(t, "CLIENT_ERROR authentication failure\r\n", admin("set auth 0 0 10\r\nalice nope\r\n"))
+	assert.Equal(t, "STORED\r\n", admin("set auth 0 0 11\r\nalice admin\r\n"))
+	assert.Equal(t, "STORED\r\n", admin("set secret 0 0 1\r\nx\r\n"))
+	assert.Equal(t, "STORED\r\n", admin("set public/a 0 0 1\r\ny\r\n"))
+
+	reader := dial()
+	assert.Equal(t, "STORED\r\n", reader("set auth 0 0 10\r\nbob reader\r\n"))
+	assert.Equal(t, "VALUE public/a 0 1\r\n", reader("get public/a\r\n"))
+	assert.Equal(t, "y\r\n", reader(""))
+	assert.Equal(t, "END\r\n", reader(""))
+	assert.Equal(t, "CLIENT_ERROR access denied\r\n", reader("get secret\r\n"))
+	assert.Equal(t, "CLIENT_ERROR access denied\r\n", reader("set public/b 0 0 1\r\nz\r\n"))
+	assert.Equal(t, "STORED\r\n", reader("set public/inbox/b 0 0 1\r\nz\r\n"))
+	assert.Equal(t, "CLIENT_ERROR access denied\r\n", reader("delete public/a\r\n"))
+
+	// An empty ACL grants nothing, unlike a nil one.
+	locked := dial()
+	assert.Equal(t, "STORED\r\n", locked("set auth 0 0 12\r\ncarol locked\r\n"))
+	assert.Equal(t, "CLIENT_ERROR access denied\r\n", locked("get public/a\r\n"))
+	assert.Equal(t, "CLIENT_ERROR access denied\r\n", locked("set secret 0 0 1\r\nz\r\n"))
+}
+
+func TestMemcachedStatsAndAccessLog(t *testing.T) {
+	dir := "testdata/memcached-stats"
+	_ = os.RemoveAll(dir)
+	store, err := db.NewDB(dir)
+	require.NoError(t, err)
+	var accessLog syncBuffer
+	srv, err := server.StartMemcached(store, "127.0.0.1:0", &server.MemcachedOptions{AccessLog: &accessLog})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+		os.RemoveAll("testdata")
+	})
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "set k 0 0 3\r\nabc\r\nget k\r\nget k\r\nincr k 1\r\nbogus\r\nquit\r\n")
+	require.NoError(t, err)
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return srv.Stats()["quit"].Requests == 1 }, 5*time.Second, 10*time.Millisecond)
+	stats := srv.Stats()
+	assert.Equal(t, int64(1), stats["set"].Requests)
+	assert.Equal(t, int64(len("set k 0 0 3\r\nabc\r\n")), stats["set"].BytesIn)
+	assert.Equal(t, int64(len("STORED\r\n")), stats["set"].BytesOut)
+	assert.Equal(t, int64(2), stats["get"].Requests)
+	assert.Equal(t, int64(2*len("VALUE k 0 3\r\nabc\r\nEND\r\n")), stats["get"].BytesOut)
+	assert.Equal(t, int64(1), stats["incr"].Errors)
+	assert.Equal(t, int64(1), stats["unknown"].Errors)
+	var buckets int64
+	for _, n := range stats["get"].LatencyBuckets {
+		buckets += n
+	}
+	assert.Equal(t, int64(2), buckets)
+
+	lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	require.Len(t, lines, 6)
+	var entry server.AccessLogEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "get", entry.Command)
+	assert.Equal(t, "k", entry.Key)
+	assert.Equal(t, "VALUE", entry.Status)
+	assert.Equal(t, conn.LocalAddr().String(), entry.Client)
+}
+
+// syncBuffer is a bytes.Buffer safe for a server's goroutines to write to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
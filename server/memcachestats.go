@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram in CommandStats.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// CommandStats counts the requests a server has answered for one command.
+type CommandStats struct {
+	Requests int64
+	// Errors counts the requests answered with ERROR, CLIENT_ERROR or
+	// SERVER_ERROR.
+	Errors   int64
+	BytesIn  int64
+	BytesOut int64
+	// Latency is the total time spent answering.
+	Latency time.Duration
+	// LatencyBuckets[i] counts the requests answered within
+	// LatencyBuckets[i] and no faster bucket; the extra last entry
+	// counts the slower ones.
+	LatencyBuckets []int64
+}
+
+// memcachedCommands are the commands counted under their own name; any
+// other is counted as "unknown", so clients cannot add commands without
+// bound. "auth" is the set an unauthenticated client sends its
+// credentials in.
+var memcachedCommands = map[string]bool{
+	"get": true, "gets": true, "set": true, "add": true, "delete": true,
+	"incr": true, "decr": true, "version": true, "quit": true, "auth": true,
+}
+
+// serverStats holds a server's CommandStats by command.
+type serverStats struct {
+	mu       sync.Mutex
+	commands map[string]*CommandStats
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{commands: make(map[string]*CommandStats)}
+}
+
+func (st *serverStats) add(command string, failed bool, in, out int, elapsed time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	c, ok := st.commands[command]
+	if !ok {
+		c = &CommandStats{LatencyBuckets: make([]int64, len(LatencyBuckets)+1)}
+		st.commands[command] = c
+	}
+	c.Requests++
+	if failed {
+		c.Errors++
+	}
+	c.BytesIn += int64(in)
+	c.BytesOut += int64(out)
+	c.Latency += elapsed
+	i := 0
+	for i < len(LatencyBuckets) && elapsed > LatencyBuckets[i] {
+		i++
+	}
+	c.LatencyBuckets[i]++
+}
+
+func (st *serverStats) snapshot() map[string]CommandStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make(map[string]CommandStats, len(st.commands))
+	for name, c := range st.commands {
+		copied := *c
+		copied.LatencyBuckets = append([]int64(nil), c.LatencyBuckets...)
+		out[name] = copied
+	}
+	return out
+}
+
+// Stats returns the requests the server has answered, by command.
+func (s *MemcachedServer) Stats() map[string]CommandStats {
+	return s.stats.snapshot()
+}
+
+// replyWriter writes a command's reply, counting its bytes and keeping its
+// first word, which tells whether the command failed.
+type replyWriter struct {
+	*bufio.Writer
+	n      int
+	status string
+}
+
+func (w *replyWriter) reset() {
+	w.n, w.status = 0, ""
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	return w.WriteString(string(p))
+}
+
+func (w *replyWriter) WriteString(s string) (int, error) {
+	if w.n == 0 {
+		w.status, _, _ = strings.Cut(s, " ")
+		w.status = strings.TrimSuffix(w.status, "\r\n")
+	}
+	n, err := w.Writer.WriteString(s)
+	w.n += n
+	return n, err
+}
+
+func (w *replyWriter) failed() bool {
+	return w.status == "ERROR" || w.status == "CLIENT_ERROR" || w.status == "SERVER_ERROR"
+}
+
+// AccessLogEntry is a line of a MemcachedServer's access log.
+type AccessLogEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	User    string    `json:"user,omitempty"`
+	Command string    `json:"command"`
+	Key     string    `json:"key,omitempty"`
+	// Status is the first word of the reply, such as STORED, END or
+	// NOT_FOUND, or empty for a noreply command.
+	Status   string  `json:"status,omitempty"`
+	BytesIn  int     `json:"bytes_in"`
+	BytesOut int     `json:"bytes_out"`
+	Millis   float64 `json:"duration_ms"`
+}
+
+// accessLog writes entries to w one whole line at a time.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *accessLog) write(entry *AccessLogEntry) {
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// run runs one command, whose line was lineLen bytes long, and records it
+// in the stats and access log.
+func (s *MemcachedServer) run(sess *memcachedSession, r *bufio.Reader, w *replyWriter, fields []string, lineLen int) error {
+	name := fields[0]
+	if !sess.authenticated && name == "set" {
+		name = "auth"
+	} else if !memcachedCommands[name] || name == "auth" {
+		name = "unknown"
+	}
+	start := time.Now()
+	w.reset()
+	sess.dataIn = 0
+	err := s.command(sess, r, w, fields)
+	elapsed := time.Since(start)
+
+	in := lineLen + sess.dataIn
+	s.stats.add(name, w.failed(), in, w.n, elapsed)
+	if s.accessLog != nil {
+		entry := &AccessLogEntry{
+			Time:     start,
+			Client:   sess.client,
+			User:     sess.user,
+			Command:  name,
+			Status:   w.status,
+			BytesIn:  in,
+			BytesOut: w.n,
+			Millis:   float64(elapsed.Microseconds()) / 1000,
+		}
+		// The key of an auth command is meaningless, and of a get of several
+		// keys, the first stands for them all.
+		if len(fields) > 1 && name != "auth" && name != "unknown" {
+			entry.Key = fields[1]
+		}
+		s.accessLog.write(entry)
+	}
+	return err
+}
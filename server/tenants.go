@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mini-leveldb/db"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxTenantNameLen = 64
+	// tenantUsageInterval is how long a tenant's measured disk usage is
+	// trusted before its directory is measured again.
+	tenantUsageInterval = time.Second
+)
+
+// ErrQuotaExceeded is returned, wrapped, for writes to a tenant over
+// TenantOptions.MaxDiskBytes.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// TenantOptions configures Tenants.
+type TenantOptions struct {
+	// Options opens each tenant's database. Nil means db.DefaultOptions().
+	Options *db.Options
+
+	// MaxDiskBytes fails writes to a tenant, with ErrQuotaExceeded, while
+	// the files in its directory take up at least this many bytes. Usage is
+	// measured at most once a second, so a burst of writes can overshoot
+	// the quota by what it writes in that time. Zero leaves disk usage
+	// unbounded.
+	MaxDiskBytes int64
+
+	// MaxRequestsPerSec delays each tenant's requests beyond this many a
+	// second, so one tenant cannot starve the others. Zero leaves the rate
+	// unbounded.
+	MaxRequestsPerSec int64
+}
+
+// Tenants hosts independent databases, one per tenant, in subdirectories of
+// a root directory named after the tenants. Each is opened on its first
+// use and stays open until Close.
+type Tenants struct {
+	root string
+	opts TenantOptions
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+	closed  bool
+}
+
+type tenant struct {
+	db      *db.DB
+	dir     string
+	limiter *requestLimiter
+
+	usageMu  sync.Mutex
+	usage    int64
+	measured time.Time
+}
+
+// OpenTenants returns the tenants whose databases are kept under root,
+// creating root if needed.
+func OpenTenants(root string, opts *TenantOptions) (*Tenants, error) {
+	t := &Tenants{root: root, tenants: make(map[string]*tenant)}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.Options == nil {
+		t.opts.Options = db.DefaultOptions()
+	}
+	if err := t.fs().MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tenants directory: %w", err)
+	}
+	return t, nil
+}
+
+// fs returns the file system the tenants' databases are kept on.
+func (t *Tenants) fs() db.FileSystem {
+	if t.opts.Options.FileSystem != nil {
+		return t.opts.Options.FileSystem
+	}
+	return db.OSFileSystem()
+}
+
+// validTenantName reports whether name can name a tenant: 1 to 64 ASCII
+// letters, digits, '-' and '_', so it is always a plain directory name.
+func validTenantName(name string) bool {
+	if name == "" || len(name) > maxTenantNameLen {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// DB returns the database of the tenant name, opening it, and creating it
+// if db.Options.CreateIfMissing allows, on first use.
+func (t *Tenants) DB(name string) (*db.DB, error) {
+	tn, err := t.tenant(name)
+	if err != nil {
+		return nil, err
+	}
+	return tn.db, nil
+}
+
+func (t *Tenants) tenant(name string) (*tenant, error) {
+	if !validTenantName(name) {
+		return nil, fmt.Errorf("invalid tenant name %q: use 1 to %d letters, digits, '-' or '_'", name, maxTenantNameLen)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("failed to open tenant %s: %w", name, db.ErrClosed)
+	}
+	if tn, ok := t.tenants[name]; ok {
+		return tn, nil
+	}
+
+	dir := filepath.Join(t.root, name)
+	store, err := db.Open(dir, t.opts.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant %s: %w", name, err)
+	}
+	tn := &tenant{db: store, dir: dir}
+	if t.opts.MaxRequestsPerSec > 0 {
+		tn.limiter = newRequestLimiter(t.opts.MaxRequestsPerSec)
+	}
+	t.tenants[name] = tn
+	return tn, nil
+}
+
+// Names returns the tenants opened so far, sorted.
+func (t *Tenants) Names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.tenants))
+	for name := range t.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiskUsage returns the bytes the files in the tenant name's directory take
+// up, as last measured.
+func (t *Tenants) DiskUsage(name string) (int64, error) {
+	tn, err := t.tenant(name)
+	if err != nil {
+		return 0, err
+	}
+	return tn.diskUsage(t.fs())
+}
+
+// admit waits for the tenant name's request rate to allow one more
+// request, and, for a write, checks it is within its disk quota. It
+// returns the tenant's database.
+func (t *Tenants) admit(name string, write bool) (*db.DB, error) {
+	tn, err := t.tenant(name)
+	if err != nil {
+		return nil, err
+	}
+	if tn.limiter != nil {
+		tn.limiter.wait()
+	}
+	if write && t.opts.MaxDiskBytes > 0 {
+		usage, err := tn.diskUsage(t.fs())
+		if err != nil {
+			return nil, err
+		}
+		if usage >= t.opts.MaxDiskBytes {
+			return nil, fmt.Errorf("tenant %s uses %d of its %d bytes: %w", name, usage, t.opts.MaxDiskBytes, ErrQuotaExceeded)
+		}
+	}
+	return tn.db, nil
+}
+
+func (tn *tenant) diskUsage(fs db.FileSystem) (int64, error) {
+	tn.usageMu.Lock()
+	defer tn.usageMu.Unlock()
+	if !tn.measured.IsZero() && time.Since(tn.measured) < tenantUsageInterval {
+		return tn.usage, nil
+	}
+	usage, err := dirSize(fs, tn.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure disk usage: %w", err)
+	}
+	tn.usage, tn.measured = usage, time.Now()
+	return usage, nil
+}
+
+// dirSize returns the total size of the files in dir and its
+// subdirectories, such as the WAL archive.
+func dirSize(fs db.FileSystem, dir string) (int64, error) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, name := range names {
+		info, err := fs.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			// Removed since it was listed, as obsolete files are.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if info.IsDir() {
+			size, err := dirSize(fs, filepath.Join(dir, name))
+			if err != nil {
+				return 0, err
+			}
+			total += size
+			continue
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// requestLimiter is a token bucket of requests: they accrue at rate per
+// second up to a burst of a tenth of a second's worth.
+type requestLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRequestLimiter(perSec int64) *requestLimiter {
+	rate := float64(perSec)
+	burst := rate / 10
+	return &requestLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until one more request may be served. Waiting requests go
+// into debt, which later callers pay off.
+func (l *requestLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Close closes every tenant's database.
+func (t *Tenants) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	var firstErr error
+	for name, tn := range t.tenants {
+		if err := tn.db.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close tenant %s: %w", name, err)
+		}
+	}
+	return firstErr
+}
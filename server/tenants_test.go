@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"mini-leveldb/server"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantsServeSeparateDatabasesWithQuotas(t *testing.T) {
+	root := "testdata/tenants"
+	_ = os.RemoveAll(root)
+	tenants, err := server.OpenTenants(root, &server.TenantOptions{MaxDiskBytes: 64 << 10})
+	require.NoError(t, err)
+	srv, err := tenants.StartMemcached("127.0.0.1:0", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.Close()
+		tenants.Close()
+		os.RemoveAll("testdata")
+	})
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(request string) string {
+		t.Helper()
+		_, err := fmt.Fprint(conn, request)
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		return line
+	}
+
+	assert.Equal(t, "STORED\r\n", send("set acme:k 0 0 1\r\na\r\n"))
+	assert.Equal(t, "STORED\r\n", send("set globex:k 0 0 1\r\ng\r\n"))
+	assert.Equal(t, "CLIENT_ERROR key needs a tenant, as in tenant:key\r\n", send("set k 0 0 1\r\nx\r\n"))
+	assert.Equal(t, "CLIENT_ERROR invalid tenant name\r\n", send("get ../x:k\r\n"))
+	assert.DirExists(t, filepath.Join(root, "acme"))
+	assert.Equal(t, []string{"acme", "globex"}, tenants.Names())
+
+	acme, err := tenants.DB("acme")
+	require.NoError(t, err)
+	value, err := acme.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "a", value)
+	globex, err := tenants.DB("globex")
+	require.NoError(t, err)
+	value, err = globex.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, "g", value)
+
+	// Filling acme past its quota stops its writes, but not globex's.
+	big := strings.Repeat("x", 32<<10)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, acme.Put(fmt.Sprintf("big%d", i), big))
+	}
+	require.NoError(t, acme.Flush())
+	// Usage is measured at most once a second, so the quota takes hold
+	// within one.
+	assert.Eventually(t, func() bool {
+		return strings.HasPrefix(send("set acme:more 0 0 1\r\nx\r\n"), "SERVER_ERROR tenant acme uses")
+	}, 5*time.Second, 100*time.Millisecond)
+	usage, err := tenants.DiskUsage("acme")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, usage, int64(64<<10))
+	assert.Equal(t, "STORED\r\n", send("set globex:more 0 0 1\r\nx\r\n"))
+	assert.Equal(t, "VALUE acme:k 0 1\r\n", send("get acme:k\r\n"), "reads are allowed over the quota")
+}